@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"x.realy.lol/bech32encoding"
+	"x.realy.lol/chk"
+	"x.realy.lol/config"
+	"x.realy.lol/database"
+	"x.realy.lol/errorf"
+	"x.realy.lol/filter"
+	"x.realy.lol/hex"
+	"x.realy.lol/log"
+	"x.realy.lol/p256k"
+	"x.realy.lol/relay"
+)
+
+// command runs the command of the configuration, and returns the exit code.
+func command(cfg *config.C) (code int) {
+	var err error
+	switch cfg.Command {
+	case "export":
+		err = withDatabase(cfg, func(d *database.D) error { return export(d, cfg.Args) })
+	case "import":
+		err = withDatabase(cfg, func(d *database.D) error { return importEvents(d, cfg.Args) })
+	case "reindex":
+		err = withDatabase(cfg, reindex)
+	case "fsck":
+		err = withDatabase(cfg, func(d *database.D) error { return fsck(d, cfg.Args) })
+	case "stats":
+		err = withDatabase(cfg, stats)
+	case "backup":
+		err = backup(cfg, cfg.Args)
+	case "restore":
+		err = restore(cfg, cfg.Args)
+	default:
+		err = errorf.E("unknown command %s", cfg.Command)
+	}
+	if err != nil {
+		log.F.F("%s: %s", cfg.Command, err)
+		return 1
+	}
+	return
+}
+
+// withDatabase opens the event store for a command, which fails if the relay is running.
+func withDatabase(cfg *config.C, fn func(d *database.D) error) (err error) {
+	d := database.New()
+	if err = d.Init(cfg.DataDir); chk.E(err) {
+		return
+	}
+	defer d.Close()
+	return fn(d)
+}
+
+// secretKey returns a signer for an nsec or hex secret key.
+func secretKey(key string) (sign *p256k.Signer, err error) {
+	var sec []byte
+	if sec, err = bech32encoding.NsecToBytes([]byte(key)); err != nil {
+		if sec, err = hex.Dec(key); err != nil {
+			return nil, errorf.E("invalid secret key")
+		}
+	}
+	sign = &p256k.Signer{}
+	if err = sign.InitSec(sec); chk.E(err) {
+		return
+	}
+	return
+}
+
+// export writes the events that match a filter to stdout.
+//
+//	export [-order created_at|serial] [filter JSON]
+func export(d *database.D, args []string) (err error) {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	order := fs.String("order", "created_at", "order of the events, created_at or serial")
+	if err = fs.Parse(args); err != nil {
+		return
+	}
+	var o database.ExportOrder
+	switch *order {
+	case "created_at":
+		o = database.ByCreatedAt
+	case "serial":
+		o = database.BySerial
+	default:
+		return errorf.E("invalid order %s", *order)
+	}
+	var f filter.F
+	if fs.NArg() > 0 {
+		if err = json.Unmarshal([]byte(fs.Arg(0)), &f); err != nil {
+			return errorf.E("invalid filter: %s", err)
+		}
+	}
+	var n int
+	if n, err = d.Export(os.Stdout, f, o); err != nil {
+		return
+	}
+	log.I.F("exported %d events", n)
+	return
+}
+
+// importEvents stores the events of JSON lines files, or stdin if there are none or the file
+// is "-".
+//
+//	import [-workers n] [file|-]...
+func importEvents(d *database.D, args []string) (err error) {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	workers := fs.Int("workers", 0, "number of workers verifying events, 0 is the number of CPUs")
+	if err = fs.Parse(args); err != nil {
+		return
+	}
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	for _, name := range files {
+		var r io.Reader = os.Stdin
+		if name != "-" {
+			var f *os.File
+			if f, err = os.Open(name); err != nil {
+				return
+			}
+			r = f
+			defer f.Close()
+		}
+		progress := func(s database.ImportStats) {
+			fmt.Fprintf(os.Stderr, "%s: read %d stored %d duplicate %d invalid %d refused %d\n",
+				name, s.Read, s.Stored, s.Duplicate, s.Invalid, s.Refused)
+		}
+		if _, err = d.Import(r, *workers, progress); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// reindex generates the index keys of the stored events again.
+func reindex(d *database.D) (err error) {
+	var n int
+	if n, err = d.Reindex(); err != nil {
+		return
+	}
+	log.I.F("reindexed %d events", n)
+	return
+}
+
+// fsck checks the integrity of the event store, and repairs it with -repair. It fails if
+// there are problems that were not repaired.
+//
+//	fsck [-repair]
+func fsck(d *database.D, args []string) (err error) {
+	fs := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	repair := fs.Bool("repair", false,
+		"delete the records that are wrong and write the missing ones")
+	if err = fs.Parse(args); err != nil {
+		return
+	}
+	var r database.FsckReport
+	if r, err = d.Fsck(*repair); err != nil {
+		return
+	}
+	fmt.Println(r)
+	if r.Problems() > 0 && !*repair {
+		return errorf.E("found %d problems, run fsck -repair to repair them", r.Problems())
+	}
+	return
+}
+
+// stats prints the stats of the event store as JSON.
+func stats(d *database.D) (err error) {
+	var s *database.StoreStats
+	if s, err = d.StoreStats(true); err != nil {
+		return
+	}
+	var b []byte
+	if b, err = json.MarshalIndent(s, "", "  "); chk.E(err) {
+		return
+	}
+	fmt.Println(string(b))
+	return
+}
+
+// backup writes a backup of the event store to a file, or stdout, from the relay at a URL
+// while it is running, or from the data directory while it isn't.
+//
+//	backup [-since version] [-relay url -key nsec] [file|-]
+func backup(cfg *config.C, args []string) (err error) {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	since := fs.Uint64("since", 0, "version printed by the last backup, for an incremental backup")
+	url := fs.String("relay", "", "url of the running relay to back up")
+	key := fs.String("key", "", "nsec/hex secret key of the superuser or an admin of the relay")
+	if err = fs.Parse(args); err != nil {
+		return
+	}
+	var w io.Writer = os.Stdout
+	var f *os.File
+	if fs.NArg() > 0 && fs.Arg(0) != "-" {
+		if f, err = os.Create(fs.Arg(0)); err != nil {
+			return
+		}
+		defer func() {
+			if err != nil {
+				f.Close()
+				os.Remove(f.Name())
+			}
+		}()
+		w = f
+	}
+	bw := bufio.NewWriter(w)
+	var next uint64
+	if *url != "" {
+		var sign *p256k.Signer
+		if sign, err = secretKey(*key); err != nil {
+			return
+		}
+		next, err = relay.Backup(context.Background(), *url, sign, *since, bw)
+	} else {
+		err = withDatabase(cfg, func(d *database.D) (err error) {
+			next, err = d.Backup(bw, *since)
+			return
+		})
+	}
+	if err != nil {
+		return
+	}
+	if err = bw.Flush(); err != nil {
+		return
+	}
+	if f != nil {
+		if err = f.Close(); err != nil {
+			return
+		}
+	}
+	log.I.F("backup complete, use -since %d for the next incremental backup", next)
+	return
+}
+
+// restore creates the event store in the data directory, which must be empty, from a full
+// backup and then its incremental backups, in order.
+//
+//	restore file|-...
+func restore(cfg *config.C, args []string) (err error) {
+	if len(args) == 0 {
+		return errorf.E("no backups to restore")
+	}
+	var backups []io.Reader
+	for _, name := range args {
+		if name == "-" {
+			backups = append(backups, bufio.NewReader(os.Stdin))
+			continue
+		}
+		var f *os.File
+		if f, err = os.Open(name); err != nil {
+			return
+		}
+		defer f.Close()
+		backups = append(backups, bufio.NewReader(f))
+	}
+	if err = database.Restore(cfg.DataDir, backups...); err != nil {
+		return
+	}
+	log.I.F("restored %d backups to %s", len(backups), cfg.DataDir)
+	return
+}
@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"path/filepath"
+	"slices"
+	"time"
 
 	"github.com/pkg/profile"
 	"go-simpler.org/env"
@@ -17,13 +20,29 @@ import (
 // configurations should generally be stored in the database, where APIs make them easy to
 // modify.
 type C struct {
-	AppName   string `env:"APP_NAME" default:"realy"`
-	Listen    string `env:"LISTEN" default:"0.0.0.0" usage:"network listen address"`
-	Port      int    `env:"PORT" default:"3334" usage:"network listen port"`
-	Pprof     bool   `env:"PPROF" default:"false" usage:"enable pprof on 127.0.0.1:6060"`
-	Superuser string `env:"SUPERUSER" usage:"superuser npub/hex public key"`
+	AppName          string        `env:"APP_NAME" default:"realy"`
+	Listen           string        `env:"LISTEN" default:"0.0.0.0" usage:"network listen address"`
+	Port             int           `env:"PORT" default:"3334" usage:"network listen port"`
+	TrustedProxies   []string      `env:"TRUSTED_PROXIES" usage:"comma separated addresses or CIDR ranges of the reverse proxies in front of the relay, the X-Forwarded-For header of their requests is the address of the client, it is ignored if they are not set"`
+	Pprof            bool          `env:"PPROF" default:"false" usage:"enable pprof on 127.0.0.1:6060"`
+	MetricsListen    string        `env:"METRICS_LISTEN" usage:"address to serve prometheus/openmetrics metrics on at /metrics, such as 127.0.0.1:9100, they are not served if it is empty"`
+	Superuser        string        `env:"SUPERUSER" usage:"superuser npub/hex public key"`
+	DataDir          string        `env:"DATA_DIR" usage:"storage location for the event store (default ~/.local/share/<APP_NAME>)"`
+	WritePolicy      string        `env:"WRITE_POLICY" usage:"program that decides which events are accepted, reading and writing JSON lines like strfry write policy plugins"`
+	GCSize           int           `env:"GC_SIZE" default:"0" usage:"size of the event store in megabytes above which the least accessed events are deleted, 0 is unlimited"`
+	Primary          string        `env:"PRIMARY" usage:"url of a relay to follow the change feed of, as a read-only replica"`
+	PrimaryKey       string        `env:"PRIMARY_KEY" usage:"nsec/hex secret key of a superuser or admin of the PRIMARY relay, to authorize following it"`
+	SnapshotDir      string        `env:"SNAPSHOT_DIR" usage:"directory to write scheduled snapshots of the event store to, none are taken if it is empty"`
+	SnapshotInterval time.Duration `env:"SNAPSHOT_INTERVAL" default:"24h" usage:"how often a snapshot is taken"`
+	SnapshotKeep     int           `env:"SNAPSHOT_KEEP" default:"7" usage:"number of snapshots that are kept, older ones are deleted"`
+	// Command is a command that runs on the event store instead of the relay, with its Args.
+	Command string
+	Args    []string
 }
 
+// commands are the commands that run on the event store instead of the relay.
+var commands = []string{"export", "import", "reindex", "fsck", "stats", "backup", "restore"}
+
 func New() (c *C) {
 	if len(os.Args) == 2 && os.Args[1] == "version" {
 		fmt.Println(version.Version)
@@ -33,6 +52,14 @@ func New() (c *C) {
 	if err := env.Load(c, &env.Options{SliceSep: ","}); chk.T(err) {
 		return
 	}
+	if c.DataDir == "" {
+		var home string
+		var err error
+		if home, err = os.UserHomeDir(); chk.E(err) {
+			home = "."
+		}
+		c.DataDir = filepath.Join(home, ".local", "share", c.AppName)
+	}
 	if len(os.Args) == 2 && os.Args[1] == "help" {
 		fmt.Printf("\nenvironment variables that configure %s\n\n", c.AppName)
 		env.Usage(c, os.Stdout, nil)
@@ -41,23 +68,63 @@ commands:
 
   - print this help message
 
-      %s help    
+      %[1]s help    
 
   - print version info
 
-      %s version 
+      %[1]s version 
 
   - print environment variables as a standard key=value set
 
-      %s env 
+      %[1]s env 
+
+  - write the stored events that match a filter to stdout as JSON lines, oldest first or in
+    the order they were stored
+
+      %[1]s export [-order created_at|serial] [filter JSON]
+
+  - store the events of JSON lines files, or stdin, verifying them with a number of workers
+
+      %[1]s import [-workers n] [file|-]...
+
+  - delete the indexes of the stored events and generate them again
+
+      %[1]s reindex
+
+  - check the integrity of the event store, and delete the records that are wrong and write
+    the missing ones with -repair
 
-`, os.Args[0], os.Args[0], os.Args[0])
+      %[1]s fsck [-repair]
+
+  - print the counts of the events by kind and author, and the number and size of the keys
+    of each prefix, as JSON
+
+      %[1]s stats
+
+  - write a backup of the event store to a file, or stdout, which is incremental with the
+    -since that the previous backup printed. while the relay is running it is backed up
+    through its /backup endpoint by a superuser or admin key
+
+      %[1]s backup [-since version] [-relay url -key nsec] [file|-]
+
+  - create the event store in an empty DATA_DIR from a full backup and its incremental
+    backups, in order
+
+      %[1]s restore file|-...
+
+  export, import, reindex, fsck, stats and backup without -relay open the event store, so the
+  relay must not be running.
+
+`, os.Args[0])
 		os.Exit(0)
 	}
 	if len(os.Args) == 2 && os.Args[1] == "env" {
 		keyvalue.PrintEnv(*c, os.Stdout)
 		os.Exit(0)
 	}
+	if len(os.Args) >= 2 && slices.Contains(commands, os.Args[1]) {
+		c.Command, c.Args = os.Args[1], os.Args[2:]
+	}
 	// now we have the config, set up all the things here rather than somewhere unrelated.
 	if c.Pprof {
 		defer profile.Start(profile.MemProfile).Stop()
@@ -0,0 +1,140 @@
+package database
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/dgraph-io/badger/v4"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/database/indexes/prefixes"
+	"x.realy.lol/database/indexes/types/timestamp"
+	"x.realy.lol/database/indexes/types/varint"
+	timeStamp "x.realy.lol/timestamp"
+)
+
+// AccessFlushSize is the number of accessed events that are accumulated before they are
+// written without waiting for the next flush.
+const AccessFlushSize = 10000
+
+// access accumulates the number of times events have been returned by queries, so the
+// LastAccessed and AccessCounter records are updated in batches without writing on reads.
+type access struct {
+	sync.Mutex
+	counts   map[uint64]uint64
+	flushing atomic.Bool
+}
+
+func newAccess() (a *access) { return &access{counts: make(map[uint64]uint64)} }
+
+// recordAccess counts an access of each of the serials. If enough are waiting, they are
+// flushed in the background.
+func (d *D) recordAccess(sers []*varint.V) {
+	d.access.Lock()
+	for _, ser := range sers {
+		d.access.counts[ser.ToUint64()]++
+	}
+	full := len(d.access.counts) >= AccessFlushSize
+	d.access.Unlock()
+	if full && d.access.flushing.CompareAndSwap(false, true) {
+		go func() {
+			defer d.access.flushing.Store(false)
+			chk.E(d.FlushAccess())
+		}()
+	}
+}
+
+// FlushAccess writes the accesses recorded since the last flush, setting the LastAccessed
+// record of each event to the current time, adding to its AccessCounter, and moving it in the
+// AccessOrder accordingly.
+func (d *D) FlushAccess() (err error) {
+	d.access.Lock()
+	counts := d.access.counts
+	d.access.counts = make(map[uint64]uint64)
+	d.access.Unlock()
+	if len(counts) == 0 {
+		return
+	}
+	now := &timestamp.T{}
+	now.FromInt64(timeStamp.Now().ToInt64())
+	var nb []byte
+	if nb, err = now.Bytes(); chk.E(err) {
+		return
+	}
+	sers := make([]uint64, 0, len(counts))
+	for s := range counts {
+		sers = append(sers, s)
+	}
+	for len(sers) > 0 {
+		batch := sers[:min(1000, len(sers))]
+		sers = sers[len(batch):]
+		if err = d.Update(func(txn *badger.Txn) (err error) {
+			for _, s := range batch {
+				ser := varint.New()
+				ser.FromUint64(s)
+				laKey := searchPrefix(prefixes.LastAccessed, ser.Bytes())
+				var item *badger.Item
+				if item, err = txn.Get(laKey); err != nil {
+					if errors.Is(err, badger.ErrKeyNotFound) {
+						// the event was deleted since it was accessed.
+						err = nil
+						continue
+					}
+					return
+				}
+				var la []byte
+				if la, err = item.ValueCopy(nil); chk.E(err) {
+					return
+				}
+				acKey := searchPrefix(prefixes.AccessCounter, ser.Bytes())
+				var count uint64
+				if count, err = accessCount(txn, acKey); chk.E(err) {
+					return
+				}
+				// the event moves toward the end of the AccessOrder.
+				if ao := accessOrderKey(ser, la, count); ao != nil {
+					if err = txn.Delete(ao); chk.E(err) {
+						return
+					}
+				}
+				if err = txn.Set(laKey, nb); chk.E(err) {
+					return
+				}
+				if err = txn.Set(accessOrderKey(ser, nb, count+counts[s]), nil); chk.E(err) {
+					return
+				}
+				ac := varint.New()
+				ac.FromUint64(count + counts[s])
+				if err = txn.Set(acKey, ac.Bytes()); chk.E(err) {
+					return
+				}
+			}
+			return
+		}); chk.E(err) {
+			return
+		}
+	}
+	return
+}
+
+// accessCount reads the value of an AccessCounter record, which is zero if it is missing or
+// empty.
+func accessCount(txn *badger.Txn, key []byte) (count uint64, err error) {
+	var item *badger.Item
+	if item, err = txn.Get(key); err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			err = nil
+		}
+		return
+	}
+	var val []byte
+	if val, err = item.ValueCopy(nil); err != nil || len(val) == 0 {
+		return
+	}
+	var ac *varint.V
+	if ac, err = varint.FromBytes(val); err != nil {
+		return
+	}
+	return ac.ToUint64(), nil
+}
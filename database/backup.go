@@ -0,0 +1,156 @@
+package database
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/errorf"
+	"x.realy.lol/log"
+)
+
+// SnapshotPrefix and SnapshotSuffix are the start and end of the names of the snapshot files
+// written by Snapshot, which have the UTC time of the snapshot between them, so they sort in
+// the order they were taken.
+const (
+	SnapshotPrefix = "snapshot-"
+	SnapshotSuffix = ".bak"
+)
+
+// LoadPendingWrites is the number of pending writes while a backup is loaded by Restore.
+const LoadPendingWrites = 256
+
+// Backup writes a consistent snapshot of the database to w, while it is in use, in the
+// format of badger backups. If since is greater than zero it is incremental, and only has the
+// keys written or deleted after that version. next is the since of the next incremental
+// backup, the version of the newest key in this one, so a full backup followed by each of its
+// incremental backups restores the database as it was at the last of them.
+func (d *D) Backup(w io.Writer, since uint64) (next uint64, err error) {
+	var upto uint64
+	if upto, err = d.DB.Backup(w, since); chk.E(err) {
+		return
+	}
+	// the badger iterator skips versions up to since, so it is not incremented as the badger
+	// documentation says it should be.
+	if next = upto; upto < since {
+		// nothing was written since the last backup.
+		next = since
+	}
+	return
+}
+
+// Restore creates a database in a data directory from a full backup and then the
+// incremental backups that follow it, in order. The directory must not have a database in it,
+// and the database must not be open while it is restored.
+func Restore(path string, backups ...io.Reader) (err error) {
+	var entries []os.DirEntry
+	if entries, err = os.ReadDir(path); err != nil && !os.IsNotExist(err) {
+		return
+	}
+	if len(entries) > 0 {
+		return errorf.E("%s is not empty, restore into a new data directory", path)
+	}
+	opts := badger.DefaultOptions(path)
+	opts.Logger = NewLogger(0, path)
+	var db *badger.DB
+	if db, err = badger.Open(opts); chk.E(err) {
+		return
+	}
+	defer func() { chk.E(db.Close()) }()
+	for i, r := range backups {
+		if err = db.Load(r, LoadPendingWrites); err != nil {
+			return errorf.E("failed to load backup %d: %s", i+1, err)
+		}
+	}
+	return
+}
+
+// Snapshot writes a full backup of the database to a new file in a directory, and returns its
+// path. The backup is written to a temporary file which is renamed when it is complete, so
+// the snapshot files in the directory are always complete.
+func (d *D) Snapshot(dir string) (path string, err error) {
+	if err = os.MkdirAll(dir, 0700); chk.E(err) {
+		return
+	}
+	var f *os.File
+	if f, err = os.CreateTemp(dir, SnapshotPrefix+"*.tmp"); chk.E(err) {
+		return
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	w := bufio.NewWriter(f)
+	if _, err = d.Backup(w, 0); err != nil {
+		return
+	}
+	if err = w.Flush(); chk.E(err) {
+		return
+	}
+	if err = f.Sync(); chk.E(err) {
+		return
+	}
+	if err = f.Close(); chk.E(err) {
+		return
+	}
+	path = filepath.Join(dir,
+		SnapshotPrefix+time.Now().UTC().Format("20060102T150405Z")+SnapshotSuffix)
+	if err = os.Rename(f.Name(), path); chk.E(err) {
+		return
+	}
+	return
+}
+
+// RotateSnapshots deletes the oldest snapshot files in a directory so there are at most keep,
+// and returns the paths that were deleted.
+func RotateSnapshots(dir string, keep int) (deleted []string, err error) {
+	var entries []os.DirEntry
+	if entries, err = os.ReadDir(dir); chk.E(err) {
+		return
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), SnapshotPrefix) &&
+			strings.HasSuffix(e.Name(), SnapshotSuffix) {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	for len(names) > keep {
+		path := filepath.Join(dir, names[0])
+		if err = os.Remove(path); chk.E(err) {
+			return
+		}
+		deleted, names = append(deleted, path), names[1:]
+	}
+	return
+}
+
+// StartSnapshots writes a snapshot to a directory every interval in the background, and keeps
+// the newest keep of them. It is stopped by an interrupt handler in the same way as
+// StartReaper.
+func (d *D) StartSnapshots(dir string, interval time.Duration, keep int) {
+	d.every(interval, func() {
+		path, err := d.Snapshot(dir)
+		if chk.E(err) {
+			return
+		}
+		log.I.F("wrote snapshot %s", path)
+		var deleted []string
+		if deleted, err = RotateSnapshots(dir, keep); chk.E(err) {
+			return
+		}
+		for _, p := range deleted {
+			log.I.F("deleted snapshot %s", p)
+		}
+	})
+}
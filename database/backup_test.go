@@ -0,0 +1,93 @@
+package database
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/filter"
+)
+
+func TestD_Backup(t *testing.T) {
+	d, evs := loadExampleEvents(t, "testrealy-backup", 100)
+	var err error
+	full := new(bytes.Buffer)
+	var next uint64
+	if next, err = d.Backup(full, 0); chk.E(err) {
+		t.Fatal(err)
+	}
+	// an incremental backup has the changes since the full one.
+	ser, err := d.FindEventSerialById(evs[0].GetIdBytes())
+	if chk.E(err) {
+		t.Fatal(err)
+	}
+	if err = d.DeleteEvent(ser); chk.E(err) {
+		t.Fatal(err)
+	}
+	incremental := new(bytes.Buffer)
+	if _, err = d.Backup(incremental, next); chk.E(err) {
+		t.Fatal(err)
+	}
+	if incremental.Len() >= full.Len() {
+		t.Fatalf("incremental backup of %d bytes, the full backup is %d", incremental.Len(),
+			full.Len())
+	}
+	for _, c := range []struct {
+		backups  []*bytes.Buffer
+		expected int
+	}{
+		{[]*bytes.Buffer{bytes.NewBuffer(full.Bytes())}, len(evs)},
+		{[]*bytes.Buffer{bytes.NewBuffer(full.Bytes()), incremental}, len(evs) - 1},
+	} {
+		dir := t.TempDir()
+		var backups []io.Reader
+		for _, b := range c.backups {
+			backups = append(backups, b)
+		}
+		if err = Restore(dir, backups...); chk.E(err) {
+			t.Fatal(err)
+		}
+		r := New()
+		if err = r.Init(dir); chk.E(err) {
+			t.Fatal(err)
+		}
+		n, _, err := r.Count(filter.F{})
+		r.Close()
+		if chk.E(err) || n != int64(c.expected) {
+			t.Fatalf("restored %d events, expected %d", n, c.expected)
+		}
+	}
+	// a restore doesn't overwrite a database.
+	if err = Restore(d.Path(), bytes.NewBuffer(full.Bytes())); err == nil {
+		t.Fatal("restored over a database")
+	}
+	// only the newest snapshots are kept.
+	dir := t.TempDir()
+	if err = os.WriteFile(filepath.Join(dir, "other"), nil, 0600); chk.E(err) {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"20250101T000000Z", "20250102T000000Z"} {
+		path := filepath.Join(dir, SnapshotPrefix+name+SnapshotSuffix)
+		if err = os.WriteFile(path, nil, 0600); chk.E(err) {
+			t.Fatal(err)
+		}
+	}
+	var path string
+	if path, err = d.Snapshot(dir); chk.E(err) {
+		t.Fatal(err)
+	}
+	var deleted []string
+	if deleted, err = RotateSnapshots(dir, 2); chk.E(err) || len(deleted) != 1 ||
+		filepath.Base(deleted[0]) != SnapshotPrefix+"20250101T000000Z"+SnapshotSuffix {
+		t.Fatalf("deleted %v", deleted)
+	}
+	if fi, err := os.Stat(path); chk.E(err) || fi.Size() == 0 {
+		t.Fatalf("the snapshot %s is empty", path)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "other")); chk.E(err) {
+		t.Fatal("rotation deleted a file that isn't a snapshot")
+	}
+}
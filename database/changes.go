@@ -0,0 +1,371 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/dgraph-io/badger/v4"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/database/indexes"
+	"x.realy.lol/database/indexes/prefixes"
+	"x.realy.lol/database/indexes/types/varint"
+	"x.realy.lol/errorf"
+	"x.realy.lol/event"
+	"x.realy.lol/filter"
+	"x.realy.lol/hex"
+	"x.realy.lol/kind"
+	"x.realy.lol/log"
+)
+
+// ChangeBatch is the most changes that are read from the change log at once.
+const ChangeBatch = 1000
+
+// Op is the kind of a change to the stored events.
+type Op byte
+
+const (
+	// Insert is an event that was stored.
+	Insert Op = iota + 1
+	// Replace is a replaceable or addressable event that was stored, and is newer than the
+	// versions in Replaces, which are not deleted.
+	Replace
+	// Delete is an event that was deleted, by a client, expiry, retention or garbage
+	// collection.
+	Delete
+)
+
+func (o Op) String() string {
+	switch o {
+	case Insert:
+		return "insert"
+	case Replace:
+		return "replace"
+	case Delete:
+		return "delete"
+	}
+	return fmt.Sprintf("op(%d)", byte(o))
+}
+
+func (o Op) MarshalJSON() ([]byte, error) { return json.Marshal(o.String()) }
+
+func (o *Op) UnmarshalJSON(b []byte) (err error) {
+	var s string
+	if err = json.Unmarshal(b, &s); err != nil {
+		return
+	}
+	for _, op := range []Op{Insert, Replace, Delete} {
+		if s == op.String() {
+			*o = op
+			return
+		}
+	}
+	return errorf.E("unknown change op %s", s)
+}
+
+// Change is an entry of the change log, which records every insert, replacement and deletion
+// of an event in the order they were committed. Sequence numbers increase, but may have gaps.
+type Change struct {
+	Seq uint64 `json:"seq"`
+	Op  Op     `json:"op"`
+	// Id is the hex id of the event.
+	Id string `json:"id"`
+	// Replaces are the hex ids of the older versions of a replaced event.
+	Replaces []string `json:"replaces,omitempty"`
+	// Event is the event that was inserted or replaced, if it is still stored when the change
+	// is read. If it isn't, a later change deletes it.
+	Event *event.E `json:"event,omitempty"`
+	// ser is the serial of the event, which is only meaningful to this database.
+	ser uint64
+}
+
+// changeLog numbers the changes. The mutex is held from taking a sequence number until the
+// change is committed, so the log is written in order, and wake is closed and replaced after
+// each commit to wake the iterators that are waiting for changes.
+type changeLog struct {
+	mx   sync.Mutex
+	seq  *badger.Sequence
+	wake chan struct{}
+}
+
+// logged runs an update that records changes with logChange, so they are committed in the
+// order of their sequence numbers.
+func (d *D) logged(fn func(txn *badger.Txn) (err error)) (err error) {
+	d.changes.mx.Lock()
+	defer d.changes.mx.Unlock()
+	if err = d.Update(fn); err != nil {
+		return
+	}
+	close(d.changes.wake)
+	d.changes.wake = make(chan struct{})
+	return
+}
+
+// logChange records a change in a transaction run by logged.
+//
+//	[ prefix ][ 8 bytes sequence ] [ op ][ 8 serial ][ 32 bytes id ][ 32 bytes replaced ids... ]
+func (d *D) logChange(txn *badger.Txn, op Op, ser *varint.V, id []byte,
+	replaces [][]byte) (err error) {
+
+	var seq uint64
+	if seq, err = d.changes.seq.Next(); chk.E(err) {
+		return
+	}
+	// sequence zero is before every change.
+	seq++
+	v := make([]byte, 9, 9+len(id)+len(replaces)*32)
+	v[0] = byte(op)
+	binary.BigEndian.PutUint64(v[1:], ser.ToUint64())
+	v = append(v, id...)
+	for _, r := range replaces {
+		v = append(v, r...)
+	}
+	return txn.Set(changeKey(seq), v)
+}
+
+func changeKey(seq uint64) []byte {
+	return binary.BigEndian.AppendUint64(searchPrefix(prefixes.ChangeLog), seq)
+}
+
+// replaced returns the ids of the stored versions of a replaceable or addressable event that
+// are older than it, which it replaces.
+func (d *D) replaced(ev *event.E) (ids [][]byte, err error) {
+	f := filter.F{Kinds: []int{ev.Kind}, Authors: []string{ev.Pubkey}}
+	if kind.IsAddressableKind(ev.Kind) {
+		f.Tags = filter.TagMap{"d": {ev.Tags.GetD()}}
+	}
+	var p *Plan
+	if p, err = d.Plan(f); chk.E(err) {
+		return
+	}
+	var index []indexes.FullIndex
+	if index, err = d.Execute(p); chk.E(err) {
+		return
+	}
+	for _, fi := range index {
+		if fi.CreatedAt.ToTimestamp() < ev.CreatedAt {
+			ids = append(ids, fi.Id.Bytes())
+		}
+	}
+	return
+}
+
+// Changes returns up to limit changes after a sequence number, in order.
+func (d *D) Changes(after uint64, limit int) (changes []*Change, err error) {
+	if err = d.View(func(txn *badger.Txn) (err error) {
+		prf := searchPrefix(prefixes.ChangeLog)
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: prf})
+		defer it.Close()
+		start := changeKey(after + 1)
+		for it.Seek(start); it.ValidForPrefix(prf) && len(changes) < limit; it.Next() {
+			item := it.Item()
+			var v []byte
+			if v, err = item.ValueCopy(nil); chk.E(err) {
+				return
+			}
+			if len(v) < 9+32 || (len(v)-9)%32 != 0 {
+				return errorf.E("invalid change log entry %x", item.Key())
+			}
+			c := &Change{
+				Seq: binary.BigEndian.Uint64(item.Key()[len(prf):]),
+				Op:  Op(v[0]),
+				Id:  hex.Enc(v[9:41]),
+				ser: binary.BigEndian.Uint64(v[1:9]),
+			}
+			for r := v[41:]; len(r) > 0; r = r[32:] {
+				c.Replaces = append(c.Replaces, hex.Enc(r[:32]))
+			}
+			changes = append(changes, c)
+		}
+		return
+	}); chk.E(err) {
+		return
+	}
+	for _, c := range changes {
+		if c.Op == Delete {
+			continue
+		}
+		ser := varint.New()
+		ser.FromUint64(c.ser)
+		if c.Event, err = d.GetEventFromSerial(ser); err != nil {
+			// deleted after the change, the change that deleted it follows.
+			err = nil
+		}
+	}
+	return
+}
+
+// LastChange returns the sequence number of the newest change, or zero if there is none.
+func (d *D) LastChange() (seq uint64, err error) {
+	err = d.View(func(txn *badger.Txn) (err error) {
+		prf := searchPrefix(prefixes.ChangeLog)
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: prf, Reverse: true})
+		defer it.Close()
+		it.Seek(append(append([]byte{}, prf...), bytes.Repeat([]byte{0xff}, 8)...))
+		if it.ValidForPrefix(prf) {
+			seq = binary.BigEndian.Uint64(it.Item().Key()[len(prf):])
+		}
+		return
+	})
+	return
+}
+
+// TrimChanges deletes the changes up to and including a sequence number.
+func (d *D) TrimChanges(upTo uint64) (n int, err error) {
+	for {
+		var batch int
+		if err = d.Update(func(txn *badger.Txn) (err error) {
+			prf := searchPrefix(prefixes.ChangeLog)
+			it := txn.NewIterator(badger.IteratorOptions{Prefix: prf, PrefetchValues: false})
+			var keys [][]byte
+			for it.Seek(prf); it.ValidForPrefix(prf) && len(keys) < ReapBatch; it.Next() {
+				k := it.Item().KeyCopy(nil)
+				if binary.BigEndian.Uint64(k[len(prf):]) > upTo {
+					break
+				}
+				keys = append(keys, k)
+			}
+			it.Close()
+			for _, k := range keys {
+				if err = txn.Delete(k); chk.E(err) {
+					return
+				}
+			}
+			batch = len(keys)
+			return
+		}); chk.E(err) {
+			return
+		}
+		n += batch
+		if batch < ReapBatch {
+			return
+		}
+	}
+}
+
+// ChangeIterator tails the change log, returning each change after a sequence number and
+// then waiting for new ones.
+type ChangeIterator struct {
+	d     *D
+	after uint64
+	buf   []*Change
+	curr  *Change
+	err   error
+}
+
+// TailChanges returns an iterator of the changes after a sequence number.
+func (d *D) TailChanges(after uint64) (it *ChangeIterator) {
+	return &ChangeIterator{d: d, after: after}
+}
+
+// Next advances to the next change, waiting for it if there is none. It returns false if the
+// context is done, in which case it can be called again, or if reading the log fails, which
+// Err returns.
+func (it *ChangeIterator) Next(ctx context.Context) bool {
+	for len(it.buf) == 0 {
+		if it.err != nil {
+			return false
+		}
+		it.d.changes.mx.Lock()
+		wake := it.d.changes.wake
+		it.d.changes.mx.Unlock()
+		if it.buf, it.err = it.d.Changes(it.after, ChangeBatch); it.err != nil {
+			return false
+		}
+		if len(it.buf) > 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-wake:
+		}
+	}
+	it.curr, it.buf = it.buf[0], it.buf[1:]
+	it.after = it.curr.Seq
+	return true
+}
+
+// Change returns the change Next advanced to.
+func (it *ChangeIterator) Change() *Change { return it.curr }
+
+// Err returns the error that stopped the iterator, if any.
+func (it *ChangeIterator) Err() error { return it.err }
+
+// FollowPosition returns the sequence number of the last change of a primary that a follower
+// has applied, or zero if it hasn't applied any.
+func (d *D) FollowPosition(primary string) (seq uint64, err error) {
+	err = d.View(func(txn *badger.Txn) (err error) {
+		var item *badger.Item
+		if item, err = txn.Get(searchPrefix(prefixes.FollowPosition, []byte(primary))); err != nil {
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				err = nil
+			}
+			return
+		}
+		return item.Value(func(v []byte) error {
+			if len(v) == 8 {
+				seq = binary.BigEndian.Uint64(v)
+			}
+			return nil
+		})
+	})
+	return
+}
+
+// SetFollowPosition stores the sequence number of the last change of a primary that a
+// follower has applied.
+func (d *D) SetFollowPosition(primary string, seq uint64) (err error) {
+	return d.Set(searchPrefix(prefixes.FollowPosition, []byte(primary)),
+		binary.BigEndian.AppendUint64(nil, seq))
+}
+
+// Apply makes a change of a primary to this database, as a follower, and returns true if it
+// changed it. Inserted events that are already stored or that this database refuses, such as
+// events that have expired since they were logged, and deletions of events that aren't stored,
+// are skipped, so the follower moves past them.
+func (d *D) Apply(c *Change) (applied bool, err error) {
+	switch c.Op {
+	case Insert, Replace:
+		if c.Event == nil {
+			return
+		}
+		if err = d.StoreEvent(c.Event); err != nil {
+			switch msg := err.Error(); {
+			case strings.HasPrefix(msg, "duplicate"):
+				err = nil
+			case strings.HasPrefix(msg, "blocked:"), strings.HasPrefix(msg, "invalid:"):
+				log.D.F("change %d not applied: %s", c.Seq, msg)
+				err = nil
+			}
+			return
+		}
+	case Delete:
+		var id []byte
+		if id, err = hex.Dec(c.Id); err != nil {
+			err = errorf.E("invalid change id %s", c.Id)
+			return
+		}
+		var ser *varint.V
+		if ser, err = d.FindEventSerialById(id); err != nil {
+			err = nil
+			return
+		}
+		if err = d.DeleteEvent(ser); err != nil {
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				err = nil
+			}
+			return
+		}
+	default:
+		err = errorf.E("unknown change op %d", c.Op)
+		return
+	}
+	return true, nil
+}
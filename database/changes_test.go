@@ -0,0 +1,132 @@
+package database
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/event"
+	"x.realy.lol/filter"
+	"x.realy.lol/kind"
+	"x.realy.lol/p256k"
+	"x.realy.lol/timestamp"
+)
+
+func TestD_Changes(t *testing.T) {
+	d, examples := loadExampleEvents(t, "testrealy-changes", 1)
+	var err error
+	sign := &p256k.Signer{}
+	if err = sign.Generate(); chk.E(err) {
+		t.Fatal(err)
+	}
+	now := timestamp.Now()
+	store := func(k int, createdAt timestamp.Timestamp, content string) (ev *event.E) {
+		ev = event.New()
+		ev.Kind = k
+		ev.CreatedAt = createdAt
+		ev.Content = content
+		if err = ev.Sign(sign); chk.E(err) {
+			t.Fatal(err)
+		}
+		if err = d.StoreEvent(ev); chk.E(err) {
+			t.Fatal(err)
+		}
+		return
+	}
+	note := store(kind.TextNote, now, "note")
+	profile := store(kind.ProfileMetadata, now-10, "old profile")
+	newer := store(kind.ProfileMetadata, now, "new profile")
+	ser, err := d.FindEventSerialById(note.GetIdBytes())
+	if chk.E(err) {
+		t.Fatal(err)
+	}
+	if err = d.DeleteEvent(ser); chk.E(err) {
+		t.Fatal(err)
+	}
+	var changes []*Change
+	if changes, err = d.Changes(0, 100); chk.E(err) {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		op Op
+		id string
+	}{
+		{Insert, examples[0].Id}, {Insert, note.Id}, {Insert, profile.Id},
+		{Replace, newer.Id}, {Delete, note.Id},
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("%d changes, expected %d", len(changes), len(expected))
+	}
+	for i, c := range changes {
+		if c.Op != expected[i].op || c.Id != expected[i].id ||
+			(i > 0 && c.Seq <= changes[i-1].Seq) {
+			t.Fatalf("change %d is %d %s %s, expected %s %s", i, c.Seq, c.Op, c.Id,
+				expected[i].op, expected[i].id)
+		}
+	}
+	// the deleted note is no longer stored, so its insert has no event.
+	if changes[1].Event != nil || changes[2].Event == nil ||
+		!slices.Equal(changes[3].Replaces, []string{profile.Id}) {
+		t.Fatalf("unexpected changes %+v %+v", changes[1], changes[3])
+	}
+	// the iterator returns the stored changes, and then waits for new ones.
+	it := d.TailChanges(changes[2].Seq)
+	for range 2 {
+		if !it.Next(context.Background()) {
+			t.Fatal(it.Err())
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	if it.Next(ctx) || it.Err() != nil {
+		t.Fatal("the iterator returned a change that wasn't made")
+	}
+	cancel()
+	tailed := event.New()
+	tailed.Kind = kind.TextNote
+	tailed.CreatedAt = now
+	tailed.Content = "tailed"
+	if err = tailed.Sign(sign); chk.E(err) {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		chk.E(d.StoreEvent(tailed))
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !it.Next(ctx) || it.Change().Event == nil || it.Change().Event.Content != "tailed" {
+		t.Fatalf("the new change was not returned: %v", it.Err())
+	}
+	// a follower that applies the log has the same events.
+	f := New()
+	if err = f.Init(t.TempDir()); chk.E(err) {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if changes, err = d.Changes(0, 100); chk.E(err) {
+		t.Fatal(err)
+	}
+	for _, c := range changes {
+		if _, err = f.Apply(c); chk.E(err) {
+			t.Fatal(err)
+		}
+	}
+	for _, db := range []*D{d, f} {
+		if n, _, err := db.Count(filter.F{Authors: []string{note.Pubkey}}); chk.E(err) ||
+			n != 3 {
+			t.Fatalf("%d events after the changes, expected 3", n)
+		}
+	}
+	var last uint64
+	if last, err = d.LastChange(); chk.E(err) || last != changes[len(changes)-1].Seq {
+		t.Fatalf("last change %d, expected %d", last, changes[len(changes)-1].Seq)
+	}
+	if _, err = d.TrimChanges(changes[3].Seq); chk.E(err) {
+		t.Fatal(err)
+	}
+	if changes, err = d.Changes(0, 100); chk.E(err) || len(changes) != 2 {
+		t.Fatalf("%d changes after trimming, expected 2", len(changes))
+	}
+}
@@ -0,0 +1,194 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/dgraph-io/badger/v4"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/database/indexes/prefixes"
+	"x.realy.lol/errorf"
+	"x.realy.lol/hex"
+)
+
+// ConfigVersion is the version of the Config document written by this version of the relay.
+// Version 0 is the untyped record that only had the retention and quotas members, which
+// decodes into the same fields.
+const ConfigVersion = 1
+
+// Config is the runtime configuration of the relay, which is stored in the configuration
+// record and can be changed while the relay is running.
+type Config struct {
+	Version int  `json:"version"`
+	Info    Info `json:"info"`
+	// Admins are the pubkeys, besides the superuser, that can use the management API.
+	Admins    []string        `json:"admins,omitempty"`
+	Limits    Limits          `json:"limits"`
+	Access    Access          `json:"access"`
+	Retention RetentionPolicy `json:"retention"`
+	Quotas    QuotaPolicy     `json:"quotas"`
+	// Mirrors are the upstream relays whose events are copied to this relay.
+	Mirrors []Mirror `json:"mirrors,omitempty"`
+}
+
+// Info is the description of the relay that is published in its nip-11 information document.
+type Info struct {
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+	Pubkey      string `json:"pubkey,omitempty"`
+	Contact     string `json:"contact,omitempty"`
+	Icon        string `json:"icon,omitempty"`
+	Banner      string `json:"banner,omitempty"`
+}
+
+// Limits are the limits on what clients can send to the relay.
+type Limits struct {
+	// EphemeralRate is the number of ephemeral events per second that a connection can send,
+	// after a burst of up to EphemeralBurst. A rate of zero is unlimited.
+	EphemeralRate  float64 `json:"ephemeral_rate"`
+	EphemeralBurst int     `json:"ephemeral_burst"`
+}
+
+// Access is the allow and deny lists of who can publish to the relay. If AllowPubkeys is not
+// empty, only those pubkeys can publish. The lists are of hex encoded pubkeys and event ids.
+type Access struct {
+	AllowPubkeys []string `json:"allow_pubkeys,omitempty"`
+	DenyPubkeys  []string `json:"deny_pubkeys,omitempty"`
+	DenyEvents   []string `json:"deny_events,omitempty"`
+	DenyKinds    []int    `json:"deny_kinds,omitempty"`
+	// Reasons are the reasons given for adding pubkeys and event ids to the lists.
+	Reasons map[string]string `json:"reasons,omitempty"`
+}
+
+// DefaultConfig returns the configuration of a relay that hasn't been configured.
+func DefaultConfig() (c *Config) {
+	return &Config{
+		Version: ConfigVersion,
+		Limits:  Limits{EphemeralRate: 20, EphemeralBurst: 100},
+	}
+}
+
+// Validate checks the values that can't be used.
+func (c *Config) Validate() (err error) {
+	if err = c.Retention.Validate(); err != nil {
+		return
+	}
+	for _, list := range [][]string{c.Admins, c.Access.AllowPubkeys, c.Access.DenyPubkeys,
+		c.Access.DenyEvents, c.Quotas.Allowlist} {
+		for _, v := range list {
+			if _, err = hex.Dec(v); err != nil || len(v) != 64 {
+				return errorf.E("invalid pubkey or event id: %s", v)
+			}
+		}
+	}
+	for _, m := range c.Mirrors {
+		if err = m.Validate(); err != nil {
+			return
+		}
+	}
+	if c.Info.Pubkey != "" {
+		if _, err = hex.Dec(c.Info.Pubkey); err != nil || len(c.Info.Pubkey) != 64 {
+			return errorf.E("invalid info pubkey: %s", c.Info.Pubkey)
+		}
+	}
+	return
+}
+
+// clone returns a deep copy of the configuration, by encoding it.
+func (c *Config) clone() (c2 *Config) {
+	b, _ := json.Marshal(c)
+	c2 = &Config{}
+	_ = json.Unmarshal(b, c2)
+	return
+}
+
+// config is the configuration in effect, and the functions that are called when it changes.
+type config struct {
+	atomic.Pointer[Config]
+	mx       sync.Mutex
+	watchers []func(c *Config)
+}
+
+// Config returns the configuration in effect. It must not be modified, use UpdateConfig.
+func (d *D) Config() (c *Config) { return d.config.Load() }
+
+// SetConfig validates, stores and applies a configuration. The functions added with
+// OnConfig are called with it before this returns.
+func (d *D) SetConfig(c *Config) (err error) {
+	d.config.mx.Lock()
+	defer d.config.mx.Unlock()
+	return d.setConfig(c)
+}
+
+// UpdateConfig changes the configuration with a function that modifies a copy of the one in
+// effect, and then stores and applies it as SetConfig does.
+func (d *D) UpdateConfig(fn func(c *Config)) (err error) {
+	d.config.mx.Lock()
+	defer d.config.mx.Unlock()
+	c := d.Config().clone()
+	fn(c)
+	return d.setConfig(c)
+}
+
+func (d *D) setConfig(c *Config) (err error) {
+	c.Version = ConfigVersion
+	if err = c.Validate(); err != nil {
+		return
+	}
+	var b []byte
+	if b, err = json.Marshal(c); chk.E(err) {
+		return
+	}
+	if err = d.Set(searchPrefix(prefixes.Config), b); chk.E(err) {
+		return
+	}
+	d.config.Store(c)
+	for _, fn := range d.config.watchers {
+		fn(c)
+	}
+	return
+}
+
+// OnConfig adds a function that is called with the configuration in effect, and again every
+// time it changes, so running components pick up changes without a restart. The function
+// must not change the configuration.
+func (d *D) OnConfig(fn func(c *Config)) {
+	d.config.mx.Lock()
+	defer d.config.mx.Unlock()
+	d.config.watchers = append(d.config.watchers, fn)
+	fn(d.Config())
+}
+
+// loadConfig reads the configuration record, upgrading it from older versions. If it has not
+// been written, the DefaultConfig is used.
+func (d *D) loadConfig() (err error) {
+	c := DefaultConfig()
+	var b []byte
+	if err = d.View(func(txn *badger.Txn) (err error) {
+		var item *badger.Item
+		if item, err = txn.Get(searchPrefix(prefixes.Config)); err != nil {
+			return
+		}
+		b, err = item.ValueCopy(nil)
+		return
+	}); err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			err = nil
+			d.config.Store(c)
+		}
+		return
+	}
+	if err = json.Unmarshal(b, c); chk.E(err) {
+		return
+	}
+	if c.Version > ConfigVersion {
+		return errorf.E("configuration version %d is newer than this relay supports (%d)",
+			c.Version, ConfigVersion)
+	}
+	c.Version = ConfigVersion
+	d.config.Store(c)
+	return
+}
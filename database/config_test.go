@@ -0,0 +1,76 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/database/indexes/prefixes"
+	"x.realy.lol/kind"
+)
+
+func TestD_Config(t *testing.T) {
+	var err error
+	d := New()
+	tmpDir := filepath.Join(os.TempDir(), "testrealy-config")
+	os.RemoveAll(tmpDir)
+	defer os.RemoveAll(tmpDir)
+	if err = d.Init(tmpDir); chk.E(err) {
+		t.Fatal(err)
+	}
+	if d.Config().Limits != DefaultConfig().Limits {
+		t.Fatalf("expected the default configuration, got %+v", d.Config())
+	}
+	var seen []*Config
+	d.OnConfig(func(c *Config) { seen = append(seen, c) })
+	if err = d.UpdateConfig(func(c *Config) {
+		c.Info.Name = "test relay"
+		c.Access.DenyKinds = []int{kind.Reaction}
+	}); chk.E(err) {
+		t.Fatal(err)
+	}
+	if len(seen) != 2 || seen[1].Info.Name != "test relay" {
+		t.Fatalf("the configuration change was not applied")
+	}
+	if err = d.UpdateConfig(func(c *Config) {
+		c.Access.DenyPubkeys = []string{"not a pubkey"}
+	}); err == nil {
+		t.Fatal("an invalid configuration was accepted")
+	}
+	if d.Config().Access.DenyPubkeys != nil {
+		t.Fatal("an invalid configuration was applied")
+	}
+	// the configuration is loaded when the database is opened again.
+	if err = d.Close(); chk.E(err) {
+		t.Fatal(err)
+	}
+	d = New()
+	if err = d.Init(tmpDir); chk.E(err) {
+		t.Fatal(err)
+	}
+	c := d.Config()
+	if c.Info.Name != "test relay" || len(c.Access.DenyKinds) != 1 || c.Version != ConfigVersion {
+		t.Fatalf("the configuration was not stored: %+v", c)
+	}
+	// a version 0 record only has some sections, the rest are defaults.
+	if err = d.Set(searchPrefix(prefixes.Config),
+		[]byte(`{"retention":{"rules":[{"kinds":[7],"max_age_days":30}]}}`)); chk.E(err) {
+		t.Fatal(err)
+	}
+	if err = d.loadConfig(); chk.E(err) {
+		t.Fatal(err)
+	}
+	if c = d.Config(); len(c.Retention.Rules) != 1 || c.Limits != DefaultConfig().Limits {
+		t.Fatalf("the version 0 configuration was not upgraded: %+v", c)
+	}
+	if err = d.Set(searchPrefix(prefixes.Config), []byte(`{"version":99}`)); chk.E(err) {
+		t.Fatal(err)
+	}
+	if err = d.loadConfig(); err == nil {
+		t.Fatal("a newer configuration version was accepted")
+	}
+	if err = d.Close(); chk.E(err) {
+		t.Fatal(err)
+	}
+}
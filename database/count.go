@@ -0,0 +1,207 @@
+package database
+
+import (
+	"encoding/binary"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/dgraph-io/badger/v4"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/database/indexes"
+	"x.realy.lol/database/indexes/prefixes"
+	"x.realy.lol/database/indexes/types/idhash"
+	"x.realy.lol/filter"
+	"x.realy.lol/hll"
+)
+
+// CountExactMax is the most keys of the driving paths of a count that are scanned to count
+// it exactly. A count that needs more is estimated from a sample of the events.
+const CountExactMax = StatsScanCap / 2
+
+// CountSampleMax is the most events that are checked to estimate a count.
+const CountSampleMax = StatsScanCap / 2
+
+// CountResult is the number of events that match a set of filters.
+type CountResult struct {
+	Count int64
+	// Approximate is true if Count is estimated from a sample of the events.
+	Approximate bool
+	// HLL are the nip-45 registers of the authors of the events, for a single filter with a
+	// single e, p, a or q tag value, which nip-45 defines them for, and nil otherwise.
+	HLL *hll.T
+}
+
+// Count returns the number of events that match a filter, ignoring its limit. It is
+// CountEvents for a single filter.
+func (d *D) Count(f filter.F) (count int64, approximate bool, err error) {
+	var r CountResult
+	if r, err = d.CountEvents([]filter.F{f}, nil); err != nil {
+		return
+	}
+	return r.Count, r.Approximate, nil
+}
+
+// CountEvents returns the number of events that match any of a set of filters, ignoring
+// their limits, so an event that matches more than one is counted once. The rules, if there
+// are any, are the IndexRules of each filter, and only the events they keep are counted. It
+// scans the index keys of the query plans and the FullIndex, and does not decode any events.
+//
+// If the driving paths of the plans have more than CountExactMax keys to scan, the count is
+// approximate, estimated from the events in a range of the Id index, which are a uniform
+// sample as the keys start with a hash of the id. The nip-45 registers, which read the author
+// of each event from its record without decoding the rest of it, are only set when the
+// driving paths are scanned.
+func (d *D) CountEvents(ff []filter.F, rules [][]IndexRule) (r CountResult, err error) {
+	return d.countEvents(ff, rules, CountExactMax, CountSampleMax)
+}
+
+func (d *D) countEvents(ff []filter.F, rules [][]IndexRule, exactMax, sampleMax int) (
+	r CountResult, err error) {
+
+	plans := make([]*Plan, len(ff))
+	for i, f := range ff {
+		f.Limit = nil
+		f.Cursor = nil
+		if plans[i], err = d.Plan(f); chk.E(err) {
+			return
+		}
+		if i < len(rules) {
+			plans[i].Rules = rules[i]
+		}
+	}
+	var offset int
+	if len(ff) == 1 {
+		var ok bool
+		if offset, ok = nip45Offset(ff[0]); ok {
+			r.HLL = hll.New()
+		}
+	}
+	if err = d.View(func(txn *badger.Txn) (err error) {
+		// the serials counted by each filter, so the union is counted.
+		seen := make(map[string]struct{})
+		budget := exactMax
+		fn := func(fi *indexes.FullIndex) {
+			r.Count++
+			if r.HLL != nil {
+				if pk := eventAuthor(txn, fi); pk != nil {
+					r.HLL.Add(pk[offset:])
+				}
+			}
+		}
+		for _, p := range plans {
+			for _, prf := range p.Driving.Prefixes {
+				if err = p.scan(txn, prf, seen, 0, &budget, fn); chk.E(err) {
+					return
+				}
+				if budget < 0 {
+					r = CountResult{Approximate: true}
+					return sample(txn, plans, sampleMax, &r)
+				}
+			}
+		}
+		return
+	}); chk.E(err) {
+		return
+	}
+	return
+}
+
+// sample estimates the number of events that match any of a set of plans from the first
+// events of the Id index, up to limit. The index is in order of a hash of the event ids, so
+// these are a uniform sample, and the count is the matches divided by the fraction of the
+// hashes that were read. If every event is read, the count is exact.
+func sample(txn *badger.Txn, plans []*Plan, limit int, r *CountResult) (err error) {
+	prf := searchPrefix(prefixes.Id)
+	it := txn.NewIterator(badger.IteratorOptions{Prefix: prf, PrefetchValues: false})
+	defer it.Close()
+	var n, matched int
+	var last uint64
+	for it.Seek(prf); it.ValidForPrefix(prf); it.Next() {
+		if n >= limit {
+			r.Count = int64(float64(matched) / (float64(last) + 1) * math.Exp2(64))
+			return
+		}
+		key := it.Item().Key()
+		if len(key) <= len(prf)+idhash.Len {
+			continue
+		}
+		n++
+		last = binary.BigEndian.Uint64(key[len(prf):])
+		ser := key[len(prf)+idhash.Len:]
+		var fi *indexes.FullIndex
+		if fi, err = getFullIndex(txn, ser); err != nil {
+			err = nil
+			continue
+		}
+		for _, p := range plans {
+			var ok bool
+			if ok, err = p.sampled(txn, fi, ser); chk.E(err) {
+				return
+			}
+			if ok {
+				matched++
+				break
+			}
+		}
+	}
+	r.Count, r.Approximate = int64(matched), false
+	return
+}
+
+// sampled returns true if an event matches the plan, including the fields of the filter that
+// are covered by its driving path.
+func (p *Plan) sampled(txn *badger.Txn, fi *indexes.FullIndex, ser []byte) (ok bool,
+	err error) {
+
+	for _, t := range p.tags {
+		if t == p.Driving {
+			if ok, err = inPath(txn, t, ser); err != nil || !ok {
+				return
+			}
+		}
+	}
+	return p.matches(txn, fi, ser)
+}
+
+// nip45Offset returns the offset into the pubkeys of the authors of the nip-45 registers for
+// a filter, which is the hex digit at position 32 of its tag value plus 8. ok is false if the
+// filter doesn't have a single e, p, a or q tag value.
+func nip45Offset(f filter.F) (offset int, ok bool) {
+	if len(f.Tags) != 1 {
+		return
+	}
+	for k, values := range f.Tags {
+		switch strings.TrimPrefix(k, "#") {
+		case "e", "p", "a", "q":
+		default:
+			return
+		}
+		if len(values) != 1 || len(values[0]) <= 32 {
+			return
+		}
+		n, err := strconv.ParseUint(values[0][32:33], 16, 8)
+		if err != nil {
+			return
+		}
+		offset, ok = int(n)+8, true
+	}
+	return
+}
+
+// eventAuthor returns the pubkey of an event, which is after the id at the start of its record,
+// or nil if the event is gone.
+func eventAuthor(txn *badger.Txn, fi *indexes.FullIndex) (pubkey []byte) {
+	item, err := txn.Get(searchPrefix(prefixes.Event, fi.Ser.Bytes()))
+	if err != nil {
+		return
+	}
+	_ = item.Value(func(val []byte) (err error) {
+		if len(val) >= 64 {
+			pubkey = append([]byte(nil), val[32:64]...)
+		}
+		return
+	})
+	return
+}
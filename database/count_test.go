@@ -0,0 +1,135 @@
+package database
+
+import (
+	"strconv"
+	"testing"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/database/indexes/types/pubhash"
+	"x.realy.lol/filter"
+	"x.realy.lol/hex"
+	"x.realy.lol/hll"
+)
+
+func TestD_Count(t *testing.T) {
+	d, evs := loadExampleEvents(t, "testrealy-count", 1000)
+	var err error
+	var pTag string
+	for _, ev := range evs {
+		if tg := ev.Tags.GetFirst([]string{"p"}); tg != nil {
+			pTag = tg.Value()
+			break
+		}
+	}
+	filters := []filter.F{
+		{Kinds: []int{1}, Limit: filter.IntToPointer(5)},
+		{Kinds: []int{3}, Tags: filter.TagMap{"p": {pTag}}},
+		{Tags: filter.TagMap{"p": {pTag}}},
+		{},
+	}
+	for _, f := range filters {
+		var expected int64
+		for _, ev := range evs {
+			if f.Matches(ev) {
+				expected++
+			}
+		}
+		var count int64
+		var approximate bool
+		if count, approximate, err = d.Count(f); chk.E(err) {
+			t.Fatal(err)
+		}
+		if approximate {
+			t.Fatalf("count of %d events should be exact", expected)
+		}
+		if count != expected {
+			t.Fatalf("expected count %d, got %d for %s", expected, count, f)
+		}
+	}
+}
+
+func TestD_CountApproximate(t *testing.T) {
+	d, evs := loadExampleEvents(t, "testrealy-count-sample", 1000)
+	var err error
+	f := filter.F{Kinds: []int{1}}
+	var expected int64
+	for _, ev := range evs {
+		if f.Matches(ev) {
+			expected++
+		}
+	}
+	// a count that scans more keys than the exact limit is estimated from a sample.
+	var r CountResult
+	if r, err = d.countEvents([]filter.F{f}, nil, 10, len(evs)/2); chk.E(err) {
+		t.Fatal(err)
+	}
+	if !r.Approximate {
+		t.Fatal("count should be approximate")
+	}
+	if r.Count < expected*7/10 || r.Count > expected*13/10 {
+		t.Fatalf("expected about %d events, got %d", expected, r.Count)
+	}
+	// a sample of every event is exact.
+	if r, err = d.countEvents([]filter.F{f}, nil, 10, len(evs)*2); chk.E(err) {
+		t.Fatal(err)
+	}
+	if r.Approximate || r.Count != expected {
+		t.Fatalf("expected count %d, got %d approximate %v", expected, r.Count, r.Approximate)
+	}
+}
+
+func TestD_CountEvents(t *testing.T) {
+	d, evs := loadExampleEvents(t, "testrealy-count-union", 1000)
+	var err error
+	var pTag, excluded string
+	for _, ev := range evs {
+		if tg := ev.Tags.GetFirst([]string{"p"}); tg != nil {
+			// the author of an event that matches is excluded by the rule.
+			pTag, excluded = tg.Value(), ev.Pubkey
+			break
+		}
+	}
+	// the filters overlap, the events that match both are counted once.
+	ff := []filter.F{{Kinds: []int{1}}, {Tags: filter.TagMap{"p": {pTag}}}}
+	exclude := pubhash.New()
+	if err = exclude.FromPubkeyHex(excluded); chk.E(err) {
+		t.Fatal(err)
+	}
+	var expected int64
+	for _, ev := range evs {
+		if (ff[0].Matches(ev) || ff[1].Matches(ev)) && ev.Pubkey != excluded {
+			expected++
+		}
+	}
+	rule := []IndexRule{ExcludeAuthors([]*pubhash.T{exclude})}
+	var r CountResult
+	if r, err = d.CountEvents(ff, [][]IndexRule{rule, rule}); chk.E(err) {
+		t.Fatal(err)
+	}
+	if r.Approximate || r.Count != expected || r.HLL != nil {
+		t.Fatalf("expected count %d, got %d approximate %v", expected, r.Count, r.Approximate)
+	}
+	// a single p tag has the nip-45 registers of the authors, from the offset of the tag.
+	f := filter.F{Tags: filter.TagMap{"p": {pTag}}}
+	sketch := hll.New()
+	for _, ev := range evs {
+		if f.Matches(ev) {
+			pk, _ := hex.Dec(ev.Pubkey)
+			sketch.Add(pk[nibble(t, pTag[32])+8:])
+		}
+	}
+	if r, err = d.CountEvents([]filter.F{f}, nil); chk.E(err) {
+		t.Fatal(err)
+	}
+	if r.HLL == nil || r.HLL.String() != sketch.String() {
+		t.Fatalf("expected registers %s, got %v", sketch, r.HLL)
+	}
+}
+
+func nibble(t *testing.T, c byte) int {
+	n, err := strconv.ParseUint(string(c), 16, 8)
+	if chk.E(err) {
+		t.Fatal(err)
+	}
+	return int(n)
+}
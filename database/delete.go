@@ -0,0 +1,94 @@
+package database
+
+import (
+	"bytes"
+
+	"github.com/dgraph-io/badger/v4"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/database/indexes"
+	"x.realy.lol/database/indexes/prefixes"
+	"x.realy.lol/database/indexes/types/varint"
+	"x.realy.lol/event"
+)
+
+// DeleteEvent removes an event and all of its index keys. It returns badger.ErrKeyNotFound if
+// there is no event with the serial.
+func (d *D) DeleteEvent(ser *varint.V) (err error) {
+	var keys [][]byte
+	var size int64
+	if err = d.logged(func(txn *badger.Txn) (err error) {
+		keys, size, err = d.deleteEvent(txn, ser)
+		return
+	}); err != nil {
+		return
+	}
+	d.updateStats(keys, -1)
+	d.addSize(-size)
+	return
+}
+
+// deleteEvent deletes an event and its index keys in a transaction, and returns the keys that
+// were deleted and the size of the keys, the event record and the metadata values. The
+// deletion is recorded in the change log, so the transaction must be run by logged.
+func (d *D) deleteEvent(txn *badger.Txn, ser *varint.V) (keys [][]byte, size int64, err error) {
+	evk := new(bytes.Buffer)
+	if err = indexes.EventEnc(ser).MarshalWrite(evk); chk.E(err) {
+		return
+	}
+	var item *badger.Item
+	if item, err = txn.Get(evk.Bytes()); err != nil {
+		return
+	}
+	var val []byte
+	if val, err = item.ValueCopy(nil); chk.E(err) {
+		return
+	}
+	ev := event.New()
+	if err = ev.UnmarshalRead(bytes.NewBuffer(val)); chk.E(err) {
+		return
+	}
+	if keys, err = d.EventIndexes(ev, ser); chk.E(err) {
+		return
+	}
+	size = int64(len(val))
+	// the metadata keys start with the serial, and have a timestamp after it or a value. The
+	// AccessOrder key is found from the values of the LastAccessed and AccessCounter records.
+	var la []byte
+	for _, prf := range []int{prefixes.FirstSeen, prefixes.LastAccessed, prefixes.AccessCounter} {
+		sp := searchPrefix(prf, ser.Bytes())
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: sp})
+		for it.Seek(sp); it.ValidForPrefix(sp); it.Next() {
+			item := it.Item()
+			keys = append(keys, item.KeyCopy(nil))
+			size += item.ValueSize()
+			if prf != prefixes.LastAccessed {
+				continue
+			}
+			if la, err = item.ValueCopy(nil); chk.E(err) {
+				it.Close()
+				return
+			}
+		}
+		it.Close()
+	}
+	var count uint64
+	if count, err = accessCount(txn, searchPrefix(prefixes.AccessCounter,
+		ser.Bytes())); chk.E(err) {
+		return
+	}
+	if ao := accessOrderKey(ser, la, count); ao != nil {
+		keys = append(keys, ao)
+	}
+	keys = append(keys, evk.Bytes())
+	for _, k := range keys {
+		if err = txn.Delete(k); chk.E(err) {
+			return
+		}
+		size += int64(len(k))
+	}
+	if err = d.logChange(txn, Delete, ser, ev.GetIdBytes(), nil); chk.E(err) {
+		return
+	}
+	return
+}
@@ -0,0 +1,98 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/database/indexes"
+	"x.realy.lol/database/indexes/types/varint"
+	"x.realy.lol/errorf"
+	"x.realy.lol/event"
+	"x.realy.lol/filter"
+	"x.realy.lol/hex"
+	"x.realy.lol/kind"
+)
+
+// applyDeletion deletes the events that a nip-09 deletion request refers to, the events of its
+// e tags, and the versions of the replaceable and addressable events of its a tags up to its
+// created_at. Only the events of the author of the request are deleted, and deletion requests
+// are not. The request is stored, so the events it deletes are refused if they are sent again,
+// see deletedBy. It returns the number of events that were deleted.
+func (d *D) applyDeletion(ev *event.E) (n int, err error) {
+	var ff []filter.F
+	var ids []string
+	for _, t := range ev.Tags.GetAll([]string{"e"}) {
+		if len(t) > 1 {
+			ids = append(ids, t.Value())
+		}
+	}
+	if len(ids) > 0 {
+		ff = append(ff, filter.F{Ids: ids, Authors: []string{ev.Pubkey}})
+	}
+	pubkey := ev.GetPubkeyBytes()
+	for _, a := range ev.Tags.Get_a_Tags() {
+		if !bytes.Equal(a.Pubkey, pubkey) ||
+			!(kind.IsReplaceableKind(a.Kind) || kind.IsAddressableKind(a.Kind)) {
+			continue
+		}
+		until := ev.CreatedAt
+		f := filter.F{Kinds: []int{a.Kind}, Authors: []string{ev.Pubkey}, Until: &until}
+		if kind.IsAddressableKind(a.Kind) {
+			f.Tags = filter.TagMap{"d": {a.Ident}}
+		}
+		ff = append(ff, f)
+	}
+	var sers []*varint.V
+	for _, f := range ff {
+		var p *Plan
+		if p, err = d.Plan(f); chk.E(err) {
+			return
+		}
+		var index []indexes.FullIndex
+		if index, err = d.Execute(p); chk.E(err) {
+			return
+		}
+		for _, fi := range index {
+			if fi.Kind.ToKind() != kind.Deletion {
+				sers = append(sers, fi.Ser)
+			}
+		}
+	}
+	if len(sers) == 0 {
+		return
+	}
+	return d.deleteEvents(sers)
+}
+
+// deletedBy returns an error if a stored nip-09 deletion request of the author of an event
+// refers to it, by its id, or by its address with a created_at at or after it.
+func (d *D) deletedBy(ev *event.E) (err error) {
+	ff := []filter.F{{Kinds: []int{kind.Deletion}, Authors: []string{ev.Pubkey},
+		Tags: filter.TagMap{"e": {ev.Id}}, Limit: filter.IntToPointer(1)}}
+	if kind.IsReplaceableKind(ev.Kind) || kind.IsAddressableKind(ev.Kind) {
+		var ident string
+		if kind.IsAddressableKind(ev.Kind) {
+			ident = ev.Tags.GetD()
+		}
+		since := ev.CreatedAt
+		ff = append(ff, filter.F{Kinds: []int{kind.Deletion}, Authors: []string{ev.Pubkey},
+			Tags:  filter.TagMap{"a": {fmt.Sprintf("%d:%s:%s", ev.Kind, ev.Pubkey, ident)}},
+			Since: &since, Limit: filter.IntToPointer(1)})
+	}
+	for _, f := range ff {
+		var p *Plan
+		if p, err = d.Plan(f); chk.E(err) {
+			return
+		}
+		var index []indexes.FullIndex
+		if index, err = d.Execute(p); chk.E(err) {
+			return
+		}
+		if len(index) > 0 {
+			return errorf.E("blocked: event was deleted by its author with %s",
+				hex.Enc(index[0].Id.Bytes()))
+		}
+	}
+	return
+}
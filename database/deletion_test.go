@@ -0,0 +1,71 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/event"
+	"x.realy.lol/filter"
+	"x.realy.lol/hex"
+	"x.realy.lol/kind"
+	"x.realy.lol/p256k"
+	"x.realy.lol/tags"
+	"x.realy.lol/timestamp"
+)
+
+func TestD_Deletion(t *testing.T) {
+	d, _ := loadExampleEvents(t, "testrealy-deletion", 1)
+	var err error
+	author, other := &p256k.Signer{}, &p256k.Signer{}
+	for _, sign := range []*p256k.Signer{author, other} {
+		if err = sign.Generate(); chk.E(err) {
+			t.Fatal(err)
+		}
+	}
+	now := timestamp.Now()
+	sign := func(s *p256k.Signer, k int, created timestamp.Timestamp, tt tags.Tags) (
+		ev *event.E) {
+
+		ev = event.New()
+		ev.Kind, ev.CreatedAt, ev.Tags, ev.Content = k, created, tt, fmt.Sprint(created)
+		if err = ev.Sign(s); chk.E(err) {
+			t.Fatal(err)
+		}
+		return
+	}
+	store := func(ev *event.E) {
+		if err = d.StoreEvent(ev); chk.E(err) {
+			t.Fatal(err)
+		}
+	}
+	note := sign(author, kind.TextNote, now-10, nil)
+	othersNote := sign(other, kind.TextNote, now-10, nil)
+	article := sign(author, kind.Article, now-10, tags.Tags{{"d", "post"}})
+	store(note)
+	store(othersNote)
+	store(article)
+	addr := fmt.Sprintf("%d:%s:post", kind.Article, hex.Enc(author.Pub()))
+	deletion := sign(author, kind.Deletion, now-5, tags.Tags{{"e", note.Id},
+		{"e", othersNote.Id}, {"a", addr}})
+	store(deletion)
+	var evs []*event.E
+	if evs, _, err = d.Query(filter.F{Kinds: []int{kind.TextNote, kind.Article},
+		Authors: []string{hex.Enc(author.Pub()), hex.Enc(other.Pub())}}); chk.E(err) {
+		t.Fatal(err)
+	}
+	// only the events of the author of the request are deleted.
+	if len(evs) != 1 || evs[0].Id != othersNote.Id {
+		t.Fatalf("expected only the note of another author to remain, got %d", len(evs))
+	}
+	// the deleted events are refused if they are sent again.
+	for _, ev := range []*event.E{note, article,
+		sign(author, kind.Article, now-6, tags.Tags{{"d", "post"}})} {
+		if err = d.StoreEvent(ev); err == nil || !strings.HasPrefix(err.Error(), "blocked") {
+			t.Fatalf("a deleted event was stored again: %v", err)
+		}
+	}
+	// a version of the address after the request is not deleted.
+	store(sign(author, kind.Article, now, tags.Tags{{"d", "post"}}))
+}
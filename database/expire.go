@@ -0,0 +1,139 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/database/indexes"
+	"x.realy.lol/database/indexes/prefixes"
+	"x.realy.lol/database/indexes/types/varint"
+	"x.realy.lol/interrupt"
+	"x.realy.lol/log"
+	"x.realy.lol/timestamp"
+)
+
+// ReapBatch is the number of expired events that are deleted in each transaction.
+const ReapBatch = 256
+
+// ReapInterval is how often the reaper deletes the events that have expired.
+const ReapInterval = time.Minute
+
+// ReapExpired deletes the events with a nip-40 expiration time before now, and all of their
+// index keys, and returns how many were deleted.
+func (d *D) ReapExpired(now timestamp.Timestamp) (n int, err error) {
+	for {
+		var keys [][]byte
+		var size int64
+		var batch int
+		if err = d.logged(func(txn *badger.Txn) (err error) {
+			var exKeys [][]byte
+			var sers []*varint.V
+			prf := searchPrefix(prefixes.Expiration)
+			it := txn.NewIterator(badger.IteratorOptions{Prefix: prf})
+			for it.Seek(prf); it.ValidForPrefix(prf) && len(sers) < ReapBatch; it.Next() {
+				k := it.Item().KeyCopy(nil)
+				exp, ser := indexes.ExpirationVars()
+				if err = indexes.ExpirationDec(exp, ser).UnmarshalRead(bytes.NewBuffer(k)); chk.E(err) {
+					it.Close()
+					return
+				}
+				if exp.ToTimestamp() >= now {
+					break
+				}
+				exKeys, sers = append(exKeys, k), append(sers, ser)
+			}
+			it.Close()
+			for i, ser := range sers {
+				var deleted [][]byte
+				var sz int64
+				if deleted, sz, err = d.deleteEvent(txn, ser); err != nil {
+					if !errors.Is(err, badger.ErrKeyNotFound) {
+						return
+					}
+					// the event is already gone, so only the expiration key is left.
+					if err = txn.Delete(exKeys[i]); chk.E(err) {
+						return
+					}
+					deleted = [][]byte{exKeys[i]}
+				}
+				keys = append(keys, deleted...)
+				size += sz
+			}
+			batch = len(sers)
+			return
+		}); chk.E(err) {
+			return
+		}
+		d.updateStats(keys, -1)
+		d.addSize(-size)
+		d.metrics.reaped.Add(float64(batch))
+		n += batch
+		if batch < ReapBatch {
+			return
+		}
+	}
+}
+
+// expiredSerials returns the encoded serials of the events with a nip-40 expiration time before
+// now, which the reaper is yet to delete, so the query plans can skip them.
+func (d *D) expiredSerials(now timestamp.Timestamp) (sers map[string]struct{}, err error) {
+	err = d.View(func(txn *badger.Txn) (err error) {
+		prf := searchPrefix(prefixes.Expiration)
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: prf, PrefetchValues: false})
+		defer it.Close()
+		for it.Seek(prf); it.ValidForPrefix(prf); it.Next() {
+			exp, ser := indexes.ExpirationVars()
+			if err = indexes.ExpirationDec(exp, ser).UnmarshalRead(
+				bytes.NewBuffer(it.Item().KeyCopy(nil))); chk.E(err) {
+				return
+			}
+			if exp.ToTimestamp() >= now {
+				break
+			}
+			if sers == nil {
+				sers = make(map[string]struct{})
+			}
+			sers[string(ser.Bytes())] = struct{}{}
+		}
+		return
+	})
+	return
+}
+
+// StartReaper deletes expired events every interval in the background. It is stopped by an
+// interrupt handler, which waits for a batch in progress to finish, so it must be started after
+// the handler that closes the database is added.
+func (d *D) StartReaper(interval time.Duration) {
+	d.every(interval, func() {
+		if n, err := d.ReapExpired(timestamp.Now()); !chk.E(err) && n > 0 {
+			log.I.F("deleted %d expired events", n)
+		}
+	})
+}
+
+// every runs fn every interval in a goroutine until an interrupt, and the interrupt handler
+// waits for a run in progress to finish.
+func (d *D) every(interval time.Duration, fn func()) {
+	quit, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-tick.C:
+				fn()
+			}
+		}
+	}()
+	interrupt.AddHandler(func() {
+		close(quit)
+		<-done
+	})
+}
@@ -0,0 +1,168 @@
+package database
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/database/indexes/prefixes"
+	"x.realy.lol/database/indexes/types/varint"
+	"x.realy.lol/event"
+	"x.realy.lol/filter"
+	"x.realy.lol/kind"
+	"x.realy.lol/p256k"
+	"x.realy.lol/tags"
+	"x.realy.lol/timestamp"
+)
+
+// countKeys returns the number of keys in the database, except for the change log, which
+// records deletions.
+func countKeys(t *testing.T, d *D) (n int) {
+	cl := searchPrefix(prefixes.ChangeLog)
+	if err := d.View(func(txn *badger.Txn) (err error) {
+		it := txn.NewIterator(badger.IteratorOptions{})
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			if !bytes.HasPrefix(it.Item().Key(), cl) {
+				n++
+			}
+		}
+		return
+	}); chk.E(err) {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestD_ReapExpired(t *testing.T) {
+	d, evs := loadExampleEvents(t, "testrealy-expire", 100)
+	var err error
+	now := timestamp.Now()
+	var alreadyExpiring int
+	for _, ev := range evs {
+		if ev.Expired(now + 200) {
+			alreadyExpiring++
+		}
+	}
+	if alreadyExpiring > 0 {
+		t.Skip("example events expire during the test")
+	}
+	before := countKeys(t, d)
+	sign := &p256k.Signer{}
+	if err = sign.Generate(); chk.E(err) {
+		t.Fatal(err)
+	}
+	exp := strconv.FormatInt((now + 100).ToInt64(), 10)
+	for i := range 5 {
+		ev := event.New()
+		ev.Kind = kind.TextNote
+		ev.CreatedAt = now
+		ev.Content = "expiring " + strconv.Itoa(i)
+		ev.Tags = tags.Tags{{"expiration", exp}, {"t", "expiring"}}
+		if err = ev.Sign(sign); chk.E(err) {
+			t.Fatal(err)
+		}
+		if err = d.StoreEvent(ev); chk.E(err) {
+			t.Fatal(err)
+		}
+	}
+	f := filter.F{Tags: filter.TagMap{"t": {"expiring"}}}
+	var found []*event.E
+	if found, _, err = d.Query(f); chk.E(err) {
+		t.Fatal(err)
+	}
+	if len(found) != 5 {
+		t.Fatalf("expected 5 events before they expire, got %d", len(found))
+	}
+	var n int
+	if n, err = d.ReapExpired(now); chk.E(err) {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("deleted %d events before they expired", n)
+	}
+	if n, err = d.ReapExpired(now + 200); chk.E(err) {
+		t.Fatal(err)
+	}
+	if n != 5 {
+		t.Fatalf("expected 5 expired events to be deleted, got %d", n)
+	}
+	if after := countKeys(t, d); after != before {
+		t.Fatalf("expected %d keys after deleting the expired events, got %d", before, after)
+	}
+	if found, _, err = d.Query(f); chk.E(err) {
+		t.Fatal(err)
+	}
+	if len(found) != 0 {
+		t.Fatalf("expected no events after they were deleted, got %d", len(found))
+	}
+}
+
+func TestD_StoreExpired(t *testing.T) {
+	d, _ := loadExampleEvents(t, "testrealy-store-expired", 1)
+	sign := &p256k.Signer{}
+	if err := sign.Generate(); chk.E(err) {
+		t.Fatal(err)
+	}
+	ev := event.New()
+	ev.Kind = kind.TextNote
+	ev.CreatedAt = timestamp.Now() - 10
+	ev.Tags = tags.Tags{{"expiration", strconv.FormatInt(ev.CreatedAt.ToInt64(), 10)}}
+	if err := ev.Sign(sign); chk.E(err) {
+		t.Fatal(err)
+	}
+	if err := d.StoreEvent(ev); err == nil {
+		t.Fatal("an expired event was stored")
+	}
+}
+
+func TestD_QueryExpired(t *testing.T) {
+	d, _ := loadExampleEvents(t, "testrealy-query-expired", 1)
+	sign := &p256k.Signer{}
+	var err error
+	if err = sign.Generate(); chk.E(err) {
+		t.Fatal(err)
+	}
+	now := timestamp.Now()
+	var expiring *event.E
+	for i := range 6 {
+		ev := event.New()
+		ev.Kind, ev.CreatedAt = kind.TextNote, now-timestamp.Timestamp(10-i)
+		ev.Content = strconv.Itoa(i)
+		ev.Tags = tags.Tags{{"t", "expiring"}}
+		// the newest events expire, and they don't count toward the limit of a query.
+		if i >= 3 {
+			ev.Tags = append(ev.Tags, tags.Tag{"expiration", strconv.FormatInt(now.ToInt64(), 10)})
+			expiring = ev
+		}
+		if err = ev.Sign(sign); chk.E(err) {
+			t.Fatal(err)
+		}
+		if err = d.StoreEvent(ev); chk.E(err) {
+			t.Fatal(err)
+		}
+	}
+	for !expiring.Expired(timestamp.Now()) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	f := filter.F{Tags: filter.TagMap{"t": {"expiring"}}, Limit: filter.IntToPointer(3)}
+	var found []*event.E
+	if found, _, err = d.Query(f); chk.E(err) {
+		t.Fatal(err)
+	}
+	if len(found) != 3 {
+		t.Fatalf("expected a full page of 3 events that have not expired, got %d", len(found))
+	}
+	var sers varint.S
+	if sers, err = d.Filter(f); chk.E(err) || len(sers) != 3 {
+		t.Fatalf("expected 3 serials of events that have not expired, got %d", len(sers))
+	}
+	var n int64
+	if n, _, err = d.Count(f); chk.E(err) || n != 3 {
+		t.Fatalf("expected a count of 3 events that have not expired, got %d", n)
+	}
+}
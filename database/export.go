@@ -0,0 +1,198 @@
+package database
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/database/indexes"
+	"x.realy.lol/errorf"
+	"x.realy.lol/event"
+	"x.realy.lol/filter"
+	"x.realy.lol/log"
+	"x.realy.lol/timestamp"
+)
+
+// ExportOrder is the order of the events written by Export.
+type ExportOrder int
+
+const (
+	// ByCreatedAt writes the oldest events first, and events with the same created_at in the
+	// order they were stored.
+	ByCreatedAt ExportOrder = iota
+	// BySerial writes the events in the order they were stored.
+	BySerial
+)
+
+// MaxImportLine is the longest line of an import, longer lines stop it.
+const MaxImportLine = 1 << 24
+
+// ImportProgress is how often Import reports its progress.
+const ImportProgress = 5 * time.Second
+
+// Export writes the events that match a filter to w as JSON lines, one event per line, which
+// is the format of strfry export and nak. The limit of the filter, if it has one, selects the
+// newest events, but there is no default limit. Events that have expired are not written.
+func (d *D) Export(w io.Writer, f filter.F, order ExportOrder) (n int, err error) {
+	var p *Plan
+	if p, err = d.Plan(f); chk.E(err) {
+		return
+	}
+	p.Limit = math.MaxInt
+	if f.Limit != nil {
+		p.Limit = *f.Limit
+	}
+	var index []indexes.FullIndex
+	if index, err = d.Execute(p); chk.E(err) {
+		return
+	}
+	sort.Slice(index, func(i, j int) bool {
+		si, sj := index[i].Ser.ToUint64(), index[j].Ser.ToUint64()
+		if order == BySerial {
+			return si < sj
+		}
+		ci, cj := index[i].CreatedAt.ToTimestamp(), index[j].CreatedAt.ToTimestamp()
+		if ci == cj {
+			return si < sj
+		}
+		return ci < cj
+	})
+	bw := bufio.NewWriter(w)
+	now := timestamp.Now()
+	for _, fi := range index {
+		var ev *event.E
+		if ev, err = d.GetEventFromSerial(fi.Ser); err != nil {
+			// the event was deleted after the index was read.
+			err = nil
+			continue
+		}
+		if ev.Expired(now) {
+			continue
+		}
+		var b []byte
+		if b, err = ev.Marshal(); chk.E(err) {
+			return
+		}
+		if _, err = bw.Write(append(b, '\n')); err != nil {
+			return
+		}
+		n++
+	}
+	err = bw.Flush()
+	return
+}
+
+// ImportStats are the counts of the lines read by Import.
+type ImportStats struct {
+	// Read is the number of lines that are not empty.
+	Read int
+	// Stored is the number of events that were stored.
+	Stored int
+	// Duplicate is the number of events that were already stored, or repeated in the input.
+	Duplicate int
+	// Invalid is the number of lines that are not events, or have an invalid signature.
+	Invalid int
+	// Refused is the number of valid events that were not stored, such as expired and
+	// ephemeral events, and events over the quota of their author.
+	Refused int
+}
+
+// Import reads JSON lines of events from r, the format of strfry export and nak, and stores
+// them. The lines are decoded and verified by a number of workers, the number of CPUs if it
+// is not greater than zero, and stored in the order they are verified, so the order of the
+// input is not kept. Lines that are not valid events are counted and skipped, and only the
+// failure to read r or to store an event stops the import. progress, if it isn't nil, is
+// called with the counts every ImportProgress, and when the import ends.
+func (d *D) Import(r io.Reader, workers int, progress func(s ImportStats)) (stats ImportStats,
+	err error) {
+
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	lines := make(chan []byte, workers*4)
+	// a nil event is a line that is not a valid event.
+	verified := make(chan *event.E, workers*4)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for line := range lines {
+				ev := event.New()
+				if e := ev.Unmarshal(line); e != nil {
+					log.D.F("invalid event: %s", e)
+					verified <- nil
+					continue
+				}
+				if valid, e := ev.Verify(); e != nil || !valid {
+					log.D.F("event %s has an invalid signature", ev.Id)
+					verified <- nil
+					continue
+				}
+				verified <- ev
+			}
+		}()
+	}
+	var readErr error
+	go func() {
+		defer func() {
+			close(lines)
+			wg.Wait()
+			close(verified)
+		}()
+		sc := bufio.NewScanner(r)
+		sc.Buffer(make([]byte, 0, 1<<16), MaxImportLine)
+		for sc.Scan() {
+			line := sc.Bytes()
+			if len(strings.TrimSpace(string(line))) == 0 {
+				continue
+			}
+			lines <- append([]byte(nil), line...)
+		}
+		readErr = sc.Err()
+	}()
+	last := time.Now()
+	for ev := range verified {
+		stats.Read++
+		if err != nil {
+			// drain the workers after a failure to store.
+			continue
+		}
+		switch {
+		case ev == nil:
+			stats.Invalid++
+		default:
+			if e := d.StoreEvent(ev); e != nil {
+				switch {
+				case strings.HasPrefix(e.Error(), "duplicate"):
+					stats.Duplicate++
+				case strings.HasPrefix(e.Error(), "blocked:"),
+					strings.HasPrefix(e.Error(), "invalid:"):
+					log.D.F("event %s not stored: %s", ev.Id, e)
+					stats.Refused++
+				default:
+					err = errorf.E("failed to store event %s: %s", ev.Id, e)
+				}
+				break
+			}
+			stats.Stored++
+		}
+		if progress != nil && time.Since(last) >= ImportProgress {
+			progress(stats)
+			last = time.Now()
+		}
+	}
+	if err == nil && readErr != nil {
+		err = errorf.E("failed to read the import: %s", readErr)
+	}
+	if progress != nil {
+		progress(stats)
+	}
+	return
+}
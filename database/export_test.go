@@ -0,0 +1,85 @@
+package database
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/event"
+	"x.realy.lol/filter"
+)
+
+func TestD_ExportImport(t *testing.T) {
+	d, evs := loadExampleEvents(t, "testrealy-export", 200)
+	var err error
+	for _, order := range []ExportOrder{ByCreatedAt, BySerial} {
+		buf := new(bytes.Buffer)
+		var n int
+		if n, err = d.Export(buf, filter.F{}, order); chk.E(err) || n != len(evs) {
+			t.Fatalf("exported %d events, expected %d", n, len(evs))
+		}
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		for i, line := range lines {
+			ev := event.New()
+			if err = ev.Unmarshal([]byte(line)); chk.E(err) {
+				t.Fatal(err)
+			}
+			// the example events are stored in order, so serial order is their order.
+			if order == BySerial && ev.Id != evs[i].Id {
+				t.Fatalf("event %d is %s, expected %s", i, ev.Id, evs[i].Id)
+			}
+			if order == ByCreatedAt && i > 0 {
+				prev := event.New()
+				_ = prev.Unmarshal([]byte(lines[i-1]))
+				if prev.CreatedAt > ev.CreatedAt {
+					t.Fatalf("event %d is older than the one before it", i)
+				}
+			}
+		}
+	}
+	// an export with a filter only has the events that match it.
+	f := filter.F{Kinds: []int{evs[0].Kind}}
+	var matching int
+	for _, ev := range evs {
+		if f.Matches(ev) {
+			matching++
+		}
+	}
+	buf := new(bytes.Buffer)
+	if n, err := d.Export(buf, f, ByCreatedAt); chk.E(err) || n != matching {
+		t.Fatalf("exported %d events of kind %d, expected %d", n, evs[0].Kind, matching)
+	}
+	// the export imports into another database, with invalid lines skipped.
+	all := new(bytes.Buffer)
+	if _, err = d.Export(all, filter.F{}, BySerial); chk.E(err) {
+		t.Fatal(err)
+	}
+	tampered := event.New()
+	b, _ := evs[0].Marshal()
+	_ = tampered.Unmarshal(b)
+	tampered.Sig = strings.Repeat("0", len(tampered.Sig))
+	b, _ = tampered.Marshal()
+	all.WriteString("not an event\n\n")
+	all.Write(append(b, '\n'))
+	// repeated events are duplicates.
+	b, _ = evs[1].Marshal()
+	all.Write(append(b, '\n'))
+	i := New()
+	if err = i.Init(t.TempDir()); chk.E(err) {
+		t.Fatal(err)
+	}
+	defer i.Close()
+	var reported bool
+	var stats ImportStats
+	if stats, err = i.Import(all, 4, func(ImportStats) { reported = true }); chk.E(err) {
+		t.Fatal(err)
+	}
+	expected := ImportStats{Read: len(evs) + 3, Stored: len(evs), Duplicate: 1, Invalid: 2}
+	if stats != expected || !reported {
+		t.Fatalf("import %+v, expected %+v", stats, expected)
+	}
+	if n, _, err := i.Count(filter.F{}); chk.E(err) || n != int64(len(evs)) {
+		t.Fatalf("%d events imported, expected %d", n, len(evs))
+	}
+}
@@ -62,7 +62,7 @@ func TestD_Filter(t *testing.T) {
 	if sers, err = d.Filter(filter.F{
 		Kinds: []int{0},
 		Limit: filter.IntToPointer(50),
-	}, nil); chk.E(err) {
+	}); chk.E(err) {
 		t.Fatal(err)
 	}
 	// log.I.S(sers)
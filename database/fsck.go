@@ -0,0 +1,448 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v4"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/database/indexes"
+	"x.realy.lol/database/indexes/prefixes"
+	"x.realy.lol/database/indexes/types/fullid"
+	"x.realy.lol/database/indexes/types/fulltext"
+	identhash "x.realy.lol/database/indexes/types/identHash"
+	"x.realy.lol/database/indexes/types/idhash"
+	"x.realy.lol/database/indexes/types/kindidx"
+	"x.realy.lol/database/indexes/types/letter"
+	"x.realy.lol/database/indexes/types/prefix"
+	"x.realy.lol/database/indexes/types/pubhash"
+	ts "x.realy.lol/database/indexes/types/timestamp"
+	"x.realy.lol/database/indexes/types/varint"
+	"x.realy.lol/errorf"
+	"x.realy.lol/event"
+	"x.realy.lol/log"
+)
+
+// FsckReport is the number of records checked by Fsck, and of the problems it found.
+type FsckReport struct {
+	// Events is the number of event records.
+	Events int
+	// Undecodable is the number of event records that are not valid binary events.
+	Undecodable int
+	// Incomplete is the number of events that are missing some of their index keys.
+	Incomplete int
+	// Missing is the number of index keys that are missing.
+	Missing int
+	// IndexKeys is the number of index keys.
+	IndexKeys int
+	// Invalid is the number of index keys that can't be decoded.
+	Invalid int
+	// Dangling is the number of index keys of a serial that has no event.
+	Dangling int
+	// Mismatched is the number of index keys with a kind, pubkey or created_at that is not the
+	// one in the FullIndex of their event.
+	Mismatched int
+	// Orphans is the number of FirstSeen, LastAccessed and AccessCounter records of a serial
+	// that has no event, and of AccessOrder keys that are not the ones of its access history.
+	Orphans int
+	// Repaired is the number of keys that were written or deleted to repair the problems.
+	Repaired int
+}
+
+// Problems returns the number of problems that were found.
+func (r FsckReport) Problems() int {
+	return r.Undecodable + r.Missing + r.Invalid + r.Dangling + r.Mismatched + r.Orphans
+}
+
+func (r FsckReport) String() string {
+	return fmt.Sprintf("events: %d undecodable: %d incomplete: %d missing index keys: %d\n"+
+		"index keys: %d invalid: %d dangling: %d mismatched: %d\n"+
+		"orphaned metadata: %d\nproblems: %d repaired keys: %d",
+		r.Events, r.Undecodable, r.Incomplete, r.Missing, r.IndexKeys, r.Invalid, r.Dangling,
+		r.Mismatched, r.Orphans, r.Problems(), r.Repaired)
+}
+
+// Fsck checks the integrity of the database. Every event record must decode, and have all the
+// index keys that EventIndexes generates for it. Every index key must decode, be of a serial
+// that has an event, and its kind, pubkey and created_at, if it has them, must be those of the
+// FullIndex of the event. The FirstSeen, LastAccessed and AccessCounter records must be of a
+// serial that has an event, and the AccessOrder must have the key of their access history.
+//
+// If repair is true, undecodable events and the index keys and records that are wrong are
+// deleted, and missing index keys are written. Repairs are not recorded in the change log.
+// Nothing else can use the database while it runs.
+func (d *D) Fsck(repair bool) (r FsckReport, err error) {
+	if err = d.fsckEvents(&r, repair); chk.E(err) {
+		return
+	}
+	// the index keys are checked against the events as they were repaired.
+	if err = d.fsckIndexes(&r, repair); chk.E(err) {
+		return
+	}
+	if err = d.fsckMetadata(&r, repair); chk.E(err) {
+		return
+	}
+	if repair && r.Repaired > 0 {
+		d.resetStats()
+	}
+	return
+}
+
+// fsckEvents checks that each event record decodes and has all of its index keys.
+func (d *D) fsckEvents(r *FsckReport, repair bool) (err error) {
+	wb := d.DB.NewWriteBatch()
+	defer wb.Cancel()
+	if err = d.View(func(txn *badger.Txn) (err error) {
+		prf := searchPrefix(prefixes.Event)
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: prf})
+		defer it.Close()
+		for it.Seek(prf); it.ValidForPrefix(prf); it.Next() {
+			item := it.Item()
+			if string(item.Key()) == eventSequence {
+				continue
+			}
+			r.Events++
+			k := item.KeyCopy(nil)
+			ser := varint.New()
+			ev := event.New()
+			var val []byte
+			if val, err = item.ValueCopy(nil); chk.E(err) {
+				return
+			}
+			if ser.UnmarshalRead(bytes.NewBuffer(k[len(prf):])) != nil ||
+				ev.UnmarshalRead(bytes.NewBuffer(val)) != nil {
+				log.W.F("event record %x is not a valid event", k)
+				r.Undecodable++
+				if repair {
+					if err = wb.Delete(k); chk.E(err) {
+						return
+					}
+					r.Repaired++
+				}
+				continue
+			}
+			var idxs [][]byte
+			if idxs, err = d.EventIndexes(ev, ser); chk.E(err) {
+				return
+			}
+			var missing int
+			for _, idx := range idxs {
+				if _, err = txn.Get(idx); err == nil {
+					continue
+				} else if !errors.Is(err, badger.ErrKeyNotFound) {
+					return
+				}
+				err = nil
+				missing++
+				if repair {
+					if err = wb.Set(idx, nil); chk.E(err) {
+						return
+					}
+					r.Repaired++
+				}
+			}
+			if missing > 0 {
+				log.W.F("event %s is missing %d index keys", ev.Id, missing)
+				r.Incomplete++
+				r.Missing += missing
+			}
+		}
+		return
+	}); chk.E(err) {
+		return
+	}
+	return wb.Flush()
+}
+
+// fsckIndexes checks that each index key decodes, is of a serial that has an event, and
+// agrees with the FullIndex of the event.
+func (d *D) fsckIndexes(r *FsckReport, repair bool) (err error) {
+	wb := d.DB.NewWriteBatch()
+	defer wb.Cancel()
+	if err = d.View(func(txn *badger.Txn) (err error) {
+		for _, p := range derived {
+			prf := searchPrefix(p)
+			it := txn.NewIterator(badger.IteratorOptions{Prefix: prf, PrefetchValues: false})
+			for it.Seek(prf); it.ValidForPrefix(prf); it.Next() {
+				k := it.Item().KeyCopy(nil)
+				r.IndexKeys++
+				var problem *int
+				f, e := decodeIndex(p, k)
+				switch {
+				case e != nil:
+					problem = &r.Invalid
+				default:
+					var exists bool
+					if exists, err = hasEvent(txn, f.ser); err != nil {
+						it.Close()
+						return
+					}
+					if !exists {
+						problem = &r.Dangling
+						break
+					}
+					var fi *indexes.FullIndex
+					if fi, err = getFullIndex(txn, f.ser.Bytes()); err != nil {
+						// an event without a FullIndex is reported as missing it.
+						err = nil
+						break
+					}
+					if !f.agrees(fi) {
+						problem = &r.Mismatched
+					}
+				}
+				if problem == nil {
+					continue
+				}
+				*problem++
+				if repair {
+					if err = wb.Delete(k); chk.E(err) {
+						it.Close()
+						return
+					}
+					r.Repaired++
+				}
+			}
+			it.Close()
+		}
+		return
+	}); chk.E(err) {
+		return
+	}
+	return wb.Flush()
+}
+
+// fsckMetadata checks that the metadata records of events are of a serial that has an event.
+func (d *D) fsckMetadata(r *FsckReport, repair bool) (err error) {
+	wb := d.DB.NewWriteBatch()
+	defer wb.Cancel()
+	if err = d.View(func(txn *badger.Txn) (err error) {
+		for _, p := range []int{prefixes.FirstSeen, prefixes.LastAccessed, prefixes.AccessCounter} {
+			prf := searchPrefix(p)
+			it := txn.NewIterator(badger.IteratorOptions{Prefix: prf, PrefetchValues: false})
+			for it.Seek(prf); it.ValidForPrefix(prf); it.Next() {
+				k := it.Item().KeyCopy(nil)
+				// the serial follows the prefix in each of these.
+				ser := varint.New()
+				exists := false
+				if ser.UnmarshalRead(bytes.NewBuffer(k[len(prf):])) == nil {
+					if exists, err = hasEvent(txn, ser); err != nil {
+						it.Close()
+						return
+					}
+				}
+				if exists {
+					continue
+				}
+				r.Orphans++
+				if repair {
+					if err = wb.Delete(k); chk.E(err) {
+						it.Close()
+						return
+					}
+					r.Repaired++
+				}
+			}
+			it.Close()
+		}
+		return d.fsckAccessOrder(txn, wb, r, repair)
+	}); chk.E(err) {
+		return
+	}
+	return wb.Flush()
+}
+
+// fsckAccessOrder checks that each AccessOrder key has the time that the LastAccessed and
+// AccessCounter records of its event give it, and that each event with a LastAccessed record
+// has its AccessOrder key.
+func (d *D) fsckAccessOrder(txn *badger.Txn, wb *badger.WriteBatch, r *FsckReport,
+	repair bool) (err error) {
+
+	prf := searchPrefix(prefixes.AccessOrder)
+	it := txn.NewIterator(badger.IteratorOptions{Prefix: prf, PrefetchValues: false})
+	for it.Seek(prf); it.ValidForPrefix(prf); it.Next() {
+		k := it.Item().KeyCopy(nil)
+		at, ser := indexes.AccessOrderVars()
+		var current bool
+		if indexes.AccessOrderDec(at, ser).UnmarshalRead(bytes.NewBuffer(k)) == nil {
+			var ao []byte
+			if ao, err = expectedAccessOrder(txn, ser); err != nil {
+				it.Close()
+				return
+			}
+			if current = bytes.Equal(ao, k); current {
+				// the LastAccessed record may be an orphan itself.
+				if current, err = hasEvent(txn, ser); err != nil {
+					it.Close()
+					return
+				}
+			}
+		}
+		if current {
+			continue
+		}
+		r.Orphans++
+		if repair {
+			if err = wb.Delete(k); chk.E(err) {
+				it.Close()
+				return
+			}
+			r.Repaired++
+		}
+	}
+	it.Close()
+	prf = searchPrefix(prefixes.LastAccessed)
+	it = txn.NewIterator(badger.IteratorOptions{Prefix: prf, PrefetchValues: false})
+	defer it.Close()
+	for it.Seek(prf); it.ValidForPrefix(prf); it.Next() {
+		ser := varint.New()
+		if ser.UnmarshalRead(bytes.NewBuffer(it.Item().Key()[len(prf):])) != nil {
+			continue
+		}
+		var exists bool
+		if exists, err = hasEvent(txn, ser); err != nil {
+			return
+		}
+		if !exists {
+			continue
+		}
+		var ao []byte
+		if ao, err = expectedAccessOrder(txn, ser); err != nil {
+			return
+		}
+		if ao == nil {
+			continue
+		}
+		if _, err = txn.Get(ao); err == nil {
+			continue
+		} else if !errors.Is(err, badger.ErrKeyNotFound) {
+			return
+		}
+		err = nil
+		r.Missing++
+		if repair {
+			if err = wb.Set(ao, nil); chk.E(err) {
+				return
+			}
+			r.Repaired++
+		}
+	}
+	return
+}
+
+// expectedAccessOrder returns the AccessOrder key of an event from its LastAccessed and
+// AccessCounter records, or nil if it has no LastAccessed time.
+func expectedAccessOrder(txn *badger.Txn, ser *varint.V) (ao []byte, err error) {
+	var la []byte
+	if la, err = valueOf(txn, searchPrefix(prefixes.LastAccessed, ser.Bytes())); err != nil {
+		return
+	}
+	var count uint64
+	if count, err = accessCount(txn, searchPrefix(prefixes.AccessCounter,
+		ser.Bytes())); err != nil {
+		return
+	}
+	return accessOrderKey(ser, la, count), nil
+}
+
+// hasEvent returns true if there is an event record with a serial.
+func hasEvent(txn *badger.Txn, ser *varint.V) (exists bool, err error) {
+	if _, err = txn.Get(searchPrefix(prefixes.Event, ser.Bytes())); err == nil {
+		return true, nil
+	} else if errors.Is(err, badger.ErrKeyNotFound) {
+		err = nil
+	}
+	return
+}
+
+// indexFields are the fields of an index key that are checked against the FullIndex of its
+// event, the ones that an index doesn't have are nil.
+type indexFields struct {
+	ser       *varint.V
+	kind      *kindidx.T
+	pubkey    *pubhash.T
+	createdAt *ts.T
+}
+
+// agrees returns true if the fields of an index key are those of the FullIndex of its event.
+func (f *indexFields) agrees(fi *indexes.FullIndex) bool {
+	if f.kind != nil && f.kind.ToKind() != fi.Kind.ToKind() {
+		return false
+	}
+	if f.pubkey != nil && !bytes.Equal(f.pubkey.Bytes(), fi.Pubkey.Bytes()) {
+		return false
+	}
+	if f.createdAt != nil && f.createdAt.ToInt() != fi.CreatedAt.ToInt() {
+		return false
+	}
+	return true
+}
+
+// decodeIndex decodes an index key with one of the derived prefixes. The kind and pubkey of
+// the TagA index, and the pubkey of the TagPubkey index, are of the event that is referred to,
+// so only their serial is returned.
+func decodeIndex(p int, k []byte) (f *indexFields, err error) {
+	f = &indexFields{ser: varint.New()}
+	var dec *indexes.T
+	switch p {
+	case prefixes.Id:
+		dec = indexes.IdDec(idhash.New(), f.ser)
+	case prefixes.FullIndex:
+		f.pubkey, f.kind, f.createdAt = pubhash.New(), kindidx.FromKind(0), &ts.T{}
+		dec = indexes.FullIndexDec(f.ser, fullid.New(), f.pubkey, f.kind, f.createdAt)
+	case prefixes.Pubkey:
+		f.pubkey = pubhash.New()
+		dec = indexes.PubkeyDec(f.pubkey, f.ser)
+	case prefixes.Kind:
+		f.kind = kindidx.FromKind(0)
+		dec = indexes.KindDec(f.kind, f.ser)
+	case prefixes.CreatedAt:
+		f.createdAt = &ts.T{}
+		dec = indexes.CreatedAtDec(f.createdAt, f.ser)
+	case prefixes.PubkeyCreatedAt:
+		f.pubkey, f.createdAt = pubhash.New(), &ts.T{}
+		dec = indexes.PubkeyCreatedAtDec(f.pubkey, f.createdAt, f.ser)
+	case prefixes.KindCreatedAt:
+		f.kind, f.createdAt = kindidx.FromKind(0), &ts.T{}
+		dec = indexes.KindCreatedAtDec(f.kind, f.createdAt, f.ser)
+	case prefixes.KindPubkeyCreatedAt:
+		f.kind, f.pubkey, f.createdAt = kindidx.FromKind(0), pubhash.New(), &ts.T{}
+		dec = indexes.KindPubkeyCreatedAtDec(f.kind, f.pubkey, f.createdAt, f.ser)
+	case prefixes.TagA:
+		dec = indexes.TagADec(kindidx.FromKind(0), pubhash.New(), identhash.New(), f.ser)
+	case prefixes.TagIdentifier:
+		dec = indexes.TagIdentifierDec(identhash.New(), f.ser)
+	case prefixes.TagEvent:
+		dec = indexes.TagEventDec(idhash.New(), f.ser)
+	case prefixes.TagPubkey:
+		dec = indexes.TagPubkeyDec(pubhash.New(), f.ser)
+	case prefixes.TagHashtag:
+		dec = indexes.TagHashtagDec(identhash.New(), f.ser)
+	case prefixes.TagLetter:
+		dec = indexes.TagLetterDec(letter.New(0), identhash.New(), f.ser)
+	case prefixes.TagProtected:
+		f.pubkey = pubhash.New()
+		dec = indexes.TagProtectedDec(f.pubkey, f.ser)
+	case prefixes.TagNonstandard:
+		dec = indexes.TagNonstandardDec(identhash.New(), identhash.New(), f.ser)
+	case prefixes.FulltextWord:
+		dec = indexes.FullTextWordDec(fulltext.New(), varint.New(), f.ser)
+	case prefixes.Expiration:
+		dec = indexes.ExpirationDec(&ts.T{}, f.ser)
+	case prefixes.Usage:
+		f.pubkey = pubhash.New()
+		dec = indexes.UsageDec(f.pubkey, f.ser, varint.New())
+	default:
+		return nil, errorf.E("%s is not a derived index", prefix.New(p))
+	}
+	buf := bytes.NewBuffer(k)
+	if err = dec.UnmarshalRead(buf); err != nil {
+		return
+	}
+	if buf.Len() > 0 {
+		err = errorf.E("%d bytes after the index key", buf.Len())
+	}
+	return
+}
@@ -0,0 +1,79 @@
+package database
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dgraph-io/badger/v4"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/database/indexes"
+	"x.realy.lol/database/indexes/prefixes"
+	"x.realy.lol/database/indexes/types/kindidx"
+	"x.realy.lol/database/indexes/types/timestamp"
+	"x.realy.lol/database/indexes/types/varint"
+)
+
+func TestD_Fsck(t *testing.T) {
+	d, evs := loadExampleEvents(t, "testrealy-fsck", 100)
+	var err error
+	var r FsckReport
+	if r, err = d.Fsck(false); chk.E(err) || r.Problems() != 0 || r.Events != len(evs) {
+		t.Fatalf("a consistent database has problems:\n%s", r)
+	}
+	ser, err := d.FindEventSerialById(evs[0].GetIdBytes())
+	if chk.E(err) {
+		t.Fatal(err)
+	}
+	ca := &timestamp.T{}
+	ca.FromInt64(evs[0].CreatedAt.ToInt64())
+	missing, mismatched := new(bytes.Buffer), new(bytes.Buffer)
+	if err = indexes.CreatedAtEnc(ca, ser).MarshalWrite(missing); chk.E(err) {
+		t.Fatal(err)
+	}
+	if err = indexes.KindCreatedAtEnc(kindidx.FromKind(evs[0].Kind+1), ca,
+		ser).MarshalWrite(mismatched); chk.E(err) {
+		t.Fatal(err)
+	}
+	gone := varint.New()
+	gone.FromUint64(1 << 40)
+	dangling, orphan := new(bytes.Buffer), new(bytes.Buffer)
+	if err = indexes.CreatedAtEnc(ca, gone).MarshalWrite(dangling); chk.E(err) {
+		t.Fatal(err)
+	}
+	if err = indexes.LastAccessedEnc(gone).MarshalWrite(orphan); chk.E(err) {
+		t.Fatal(err)
+	}
+	if err = d.Update(func(txn *badger.Txn) (err error) {
+		if err = txn.Delete(missing.Bytes()); err != nil {
+			return
+		}
+		for _, k := range [][]byte{mismatched.Bytes(), dangling.Bytes(), orphan.Bytes(),
+			searchPrefix(prefixes.Kind, []byte{0})} {
+			if err = txn.Set(k, nil); err != nil {
+				return
+			}
+		}
+		// an event record that is not an event.
+		garbage := varint.New()
+		garbage.FromUint64(1 << 41)
+		return txn.Set(searchPrefix(prefixes.Event, garbage.Bytes()), []byte("garbage"))
+	}); chk.E(err) {
+		t.Fatal(err)
+	}
+	expected := FsckReport{Events: len(evs) + 1, Undecodable: 1, Incomplete: 1, Missing: 1,
+		Invalid: 1, Dangling: 1, Mismatched: 1, Orphans: 1}
+	if r, err = d.Fsck(false); chk.E(err) {
+		t.Fatal(err)
+	}
+	expected.IndexKeys = r.IndexKeys
+	if r != expected {
+		t.Fatalf("found\n%s\nexpected\n%s", r, expected)
+	}
+	if r, err = d.Fsck(true); chk.E(err) || r.Repaired != r.Problems() {
+		t.Fatalf("repaired %d of %d problems", r.Repaired, r.Problems())
+	}
+	if r, err = d.Fsck(false); chk.E(err) || r.Problems() != 0 {
+		t.Fatalf("problems after the repair:\n%s", r)
+	}
+}
@@ -0,0 +1,257 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"math/bits"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/database/indexes"
+	"x.realy.lol/database/indexes/prefixes"
+	"x.realy.lol/database/indexes/types/prefix"
+	"x.realy.lol/database/indexes/types/pubhash"
+	ts "x.realy.lol/database/indexes/types/timestamp"
+	"x.realy.lol/database/indexes/types/varint"
+	"x.realy.lol/log"
+)
+
+// GCInterval is how often the recorded accesses are flushed and the size budget is enforced.
+const GCInterval = 10 * time.Minute
+
+// GCAccessWeight is how much later GC deletes an event for each doubling of the number of times
+// it was accessed, so the AccessOrder combines how recently and how often events are accessed.
+const GCAccessWeight = time.Hour
+
+// accessOrderKey returns the AccessOrder key of an event from the value of its LastAccessed
+// record and its AccessCounter, or nil if the record is not a timestamp. The time of the key is
+// when the event was last accessed, plus GCAccessWeight for each doubling of its accesses.
+func accessOrderKey(ser *varint.V, la []byte, accesses uint64) (key []byte) {
+	t, err := ts.FromBytes(la)
+	if err != nil {
+		return
+	}
+	t.FromInt(t.ToInt() + bits.Len64(accesses)*int(GCAccessWeight/time.Second))
+	var b []byte
+	if b, err = t.Bytes(); chk.E(err) {
+		return
+	}
+	return searchPrefix(prefixes.AccessOrder, b, ser.Bytes())
+}
+
+// storedSize is the running total of the StoredSize. It is computed by a scan when it is first
+// needed, and then kept current as events are stored and deleted, like the cardinality stats.
+type storedSize struct {
+	sync.Mutex
+	known bool
+	size  int64
+}
+
+// StoredSize returns the size of the stored events, the keys and values of their records,
+// index keys and metadata. This is the logical size of the data, the size of the files may be
+// larger until badger compacts them. The configuration and the change log are not counted.
+func (d *D) StoredSize() (size int64, err error) {
+	d.size.Lock()
+	if d.size.known {
+		size = d.size.size
+		d.size.Unlock()
+		return
+	}
+	d.size.Unlock()
+	if size, err = d.scanSize(); chk.E(err) {
+		return
+	}
+	d.size.Lock()
+	if !d.size.known {
+		d.size.size, d.size.known = size, true
+	}
+	size = d.size.size
+	d.size.Unlock()
+	return
+}
+
+// addSize adjusts the StoredSize by the size of events that were stored or deleted.
+func (d *D) addSize(delta int64) {
+	d.size.Lock()
+	defer d.size.Unlock()
+	if d.size.known {
+		d.size.size = max(d.size.size+delta, 0)
+	}
+}
+
+// notEventPrefixes are the prefixes of the keys that are not part of an event, which are not
+// counted in the StoredSize.
+var notEventPrefixes = []int{prefixes.Config, prefixes.MirrorCursor, prefixes.ChangeLog,
+	prefixes.FollowPosition, prefixes.SchemaVersion}
+
+// scanSize computes the StoredSize with a scan of all the keys, which doesn't read the values.
+func (d *D) scanSize() (size int64, err error) {
+	counted := make(map[string]bool)
+	for p := range prefixes.SchemaVersion + 1 {
+		if name := string(prefixes.Prefix(p)); name != "" &&
+			!slices.Contains(notEventPrefixes, p) {
+			counted[name] = true
+		}
+	}
+	err = d.View(func(txn *badger.Txn) (err error) {
+		it := txn.NewIterator(badger.IteratorOptions{PrefetchValues: false})
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			k := item.Key()
+			if len(k) < prefix.Len || !counted[string(k[:prefix.Len])] ||
+				string(k) == eventSequence {
+				continue
+			}
+			size += int64(len(k)) + item.ValueSize()
+		}
+		return
+	})
+	return
+}
+
+// GC deletes events until the StoredSize is within budget, in the AccessOrder, which has the
+// least recently and least frequently accessed first, see accessOrderKey. Events authored by
+// the protected pubkeys are never deleted. The events are read in batches of ReapBatch from the
+// start of the AccessOrder, so only as many are read as are deleted. It returns the number of
+// events that were deleted and the bytes that were freed.
+func (d *D) GC(budget int64, protected ...[]byte) (n int, freed int64, err error) {
+	var size int64
+	if size, err = d.StoredSize(); chk.E(err) {
+		return
+	}
+	if size <= budget {
+		return
+	}
+	d.metrics.gcRuns.Inc()
+	defer func() {
+		d.metrics.gcDeleted.Add(float64(n))
+		d.metrics.gcFreed.Add(float64(freed))
+	}()
+	var hashes [][]byte
+	for _, pk := range protected {
+		ph := pubhash.New()
+		if err = ph.FromPubkey(pk); chk.E(err) {
+			return
+		}
+		hashes = append(hashes, ph.Bytes())
+	}
+	// each batch starts after the last AccessOrder key of the one before it.
+	seek := searchPrefix(prefixes.AccessOrder)
+	for size-freed > budget {
+		var candidates []*varint.V
+		if candidates, seek, err = d.gcCandidates(seek, hashes); chk.E(err) {
+			return
+		}
+		if len(candidates) == 0 {
+			return
+		}
+		var keys [][]byte
+		var deletedSize int64
+		if err = d.logged(func(txn *badger.Txn) (err error) {
+			for _, ser := range candidates {
+				if size-freed-deletedSize <= budget {
+					return
+				}
+				var deleted [][]byte
+				var sz int64
+				if deleted, sz, err = d.deleteEvent(txn, ser); err != nil {
+					if errors.Is(err, badger.ErrKeyNotFound) {
+						err = nil
+						continue
+					}
+					return
+				}
+				keys = append(keys, deleted...)
+				deletedSize += sz
+				n++
+			}
+			return
+		}); chk.E(err) {
+			return
+		}
+		freed += deletedSize
+		d.updateStats(keys, -1)
+		d.addSize(-deletedSize)
+	}
+	return
+}
+
+// gcCandidates reads the serials of the next ReapBatch events in the AccessOrder from a key,
+// skipping those authored by one of the protected pubkey hashes. It returns the key to seek to
+// for the next batch.
+func (d *D) gcCandidates(seek []byte, protected [][]byte) (candidates []*varint.V,
+	next []byte, err error) {
+
+	next = seek
+	err = d.View(func(txn *badger.Txn) (err error) {
+		prf := searchPrefix(prefixes.AccessOrder)
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: prf, PrefetchValues: false})
+		defer it.Close()
+		for it.Seek(seek); it.ValidForPrefix(prf) && len(candidates) < ReapBatch; it.Next() {
+			k := it.Item().KeyCopy(nil)
+			// the next batch starts at the key after this one.
+			next = append(k, 0)
+			at, ser := indexes.AccessOrderVars()
+			if err = indexes.AccessOrderDec(at, ser).UnmarshalRead(
+				bytes.NewBuffer(k)); chk.E(err) {
+				return
+			}
+			var skip bool
+			if skip, err = authoredBy(txn, ser, protected); chk.E(err) {
+				return
+			}
+			if skip {
+				continue
+			}
+			candidates = append(candidates, ser)
+		}
+		return
+	})
+	return
+}
+
+// authoredBy returns true if the event with a serial is authored by one of a list of pubkey
+// hashes, which is read from its FullIndex.
+func authoredBy(txn *badger.Txn, ser *varint.V, hashes [][]byte) (is bool, err error) {
+	if len(hashes) == 0 {
+		return
+	}
+	prf := searchPrefix(prefixes.FullIndex, ser.Bytes())
+	it := txn.NewIterator(badger.IteratorOptions{Prefix: prf, PrefetchValues: false})
+	defer it.Close()
+	it.Seek(prf)
+	if !it.ValidForPrefix(prf) {
+		return
+	}
+	s, t, p, k, c := indexes.FullIndexVars()
+	if err = indexes.FullIndexDec(s, t, p, k, c).UnmarshalRead(
+		bytes.NewBuffer(it.Item().KeyCopy(nil))); chk.E(err) {
+		return
+	}
+	for _, h := range hashes {
+		if bytes.Equal(p.Bytes(), h) {
+			return true, nil
+		}
+	}
+	return
+}
+
+// StartGC flushes the recorded accesses every interval in the background, and if budget is
+// more than zero, deletes the least accessed events that aren't authored by the protected
+// pubkeys until the StoredSize is within it. It is stopped by an interrupt handler in the same
+// way as StartReaper.
+func (d *D) StartGC(interval time.Duration, budget int64, protected ...[]byte) {
+	d.every(interval, func() {
+		if chk.E(d.FlushAccess()) || budget <= 0 {
+			return
+		}
+		if n, freed, err := d.GC(budget, protected...); !chk.E(err) && n > 0 {
+			log.I.F("deleted %d least accessed events, freeing %d bytes", n, freed)
+		}
+	})
+}
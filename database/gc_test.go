@@ -0,0 +1,209 @@
+package database
+
+import (
+	"strconv"
+	"testing"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/event"
+	"x.realy.lol/filter"
+	"x.realy.lol/hex"
+	"x.realy.lol/kind"
+	"x.realy.lol/p256k"
+	"x.realy.lol/timestamp"
+)
+
+func TestD_GC(t *testing.T) {
+	d, _ := loadExampleEvents(t, "testrealy-gc", 1)
+	var err error
+	// the running size is kept as events are stored and deleted.
+	checkSize := func() {
+		var running, scanned int64
+		if running, err = d.StoredSize(); chk.E(err) {
+			t.Fatal(err)
+		}
+		if scanned, err = d.scanSize(); chk.E(err) {
+			t.Fatal(err)
+		}
+		if running != scanned {
+			t.Fatalf("the stored size is %d, scanned %d", running, scanned)
+		}
+	}
+	checkSize()
+	super, user := &p256k.Signer{}, &p256k.Signer{}
+	for _, sign := range []*p256k.Signer{super, user} {
+		if err = sign.Generate(); chk.E(err) {
+			t.Fatal(err)
+		}
+		for i := range 10 {
+			ev := event.New()
+			ev.Kind = kind.TextNote
+			ev.CreatedAt = timestamp.Now() - timestamp.Timestamp(i)
+			ev.Content = strconv.Itoa(i)
+			if err = ev.Sign(sign); chk.E(err) {
+				t.Fatal(err)
+			}
+			if err = d.StoreEvent(ev); chk.E(err) {
+				t.Fatal(err)
+			}
+		}
+	}
+	checkSize()
+	userFilter := filter.F{Authors: []string{hex.Enc(user.Pub())}}
+	accessed := userFilter
+	accessed.Limit = filter.IntToPointer(3)
+	var evs []*event.E
+	if evs, _, err = d.Query(accessed); chk.E(err) {
+		t.Fatal(err)
+	}
+	keep := make(map[string]struct{})
+	for _, ev := range evs {
+		keep[ev.Id] = struct{}{}
+	}
+	if err = d.FlushAccess(); chk.E(err) {
+		t.Fatal(err)
+	}
+	var size int64
+	if size, err = d.StoredSize(); chk.E(err) {
+		t.Fatal(err)
+	}
+	// freeing a single byte deletes one of the events that haven't been accessed.
+	var n int
+	if n, _, err = d.GC(size-1, super.Pub()); chk.E(err) {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 event to be deleted, got %d", n)
+	}
+	checkSize()
+	// with no budget, everything but the superuser's events is deleted.
+	if n, _, err = d.GC(0, super.Pub()); chk.E(err) {
+		t.Fatal(err)
+	}
+	if evs, _, err = d.Query(userFilter); chk.E(err) {
+		t.Fatal(err)
+	}
+	if len(evs) != 0 {
+		t.Fatalf("expected the user's events to be deleted, %d remain", len(evs))
+	}
+	if evs, _, err = d.Query(filter.F{}); chk.E(err) {
+		t.Fatal(err)
+	}
+	if len(evs) != 10 {
+		t.Fatalf("expected the superuser's 10 events to remain, got %d", len(evs))
+	}
+	for _, ev := range evs {
+		if ev.Pubkey != hex.Enc(super.Pub()) {
+			t.Fatalf("event by %s was not deleted", ev.Pubkey)
+		}
+	}
+}
+
+func TestD_GCOrder(t *testing.T) {
+	d, _ := loadExampleEvents(t, "testrealy-gc-order", 1)
+	var err error
+	sign := &p256k.Signer{}
+	if err = sign.Generate(); chk.E(err) {
+		t.Fatal(err)
+	}
+	var stored []*event.E
+	for i := range 5 {
+		ev := event.New()
+		ev.Kind = kind.TextNote
+		ev.CreatedAt = timestamp.Now() - timestamp.Timestamp(i)
+		ev.Content = strconv.Itoa(i)
+		if err = ev.Sign(sign); chk.E(err) {
+			t.Fatal(err)
+		}
+		if err = d.StoreEvent(ev); chk.E(err) {
+			t.Fatal(err)
+		}
+		stored = append(stored, ev)
+	}
+	// all but the last event are accessed.
+	for _, ev := range stored[:4] {
+		if _, _, err = d.Query(filter.F{Ids: []string{ev.Id}}); chk.E(err) {
+			t.Fatal(err)
+		}
+	}
+	if err = d.FlushAccess(); chk.E(err) {
+		t.Fatal(err)
+	}
+	// the example event isn't protected and hasn't been accessed either, so it is deleted
+	// first.
+	for _, protected := range [][][]byte{{sign.Pub()}, nil} {
+		var size int64
+		if size, err = d.StoredSize(); chk.E(err) {
+			t.Fatal(err)
+		}
+		if _, _, err = d.GC(size-1, protected...); chk.E(err) {
+			t.Fatal(err)
+		}
+	}
+	var evs []*event.E
+	if evs, _, err = d.Query(filter.F{}); chk.E(err) {
+		t.Fatal(err)
+	}
+	if len(evs) != 4 {
+		t.Fatalf("expected 4 events to remain, got %d", len(evs))
+	}
+	for _, ev := range evs {
+		if ev.Id == stored[4].Id {
+			t.Fatal("the event that wasn't accessed was kept")
+		}
+	}
+}
+
+func TestD_GCFrequency(t *testing.T) {
+	d, _ := loadExampleEvents(t, "testrealy-gc-frequency", 1)
+	var err error
+	sign := &p256k.Signer{}
+	if err = sign.Generate(); chk.E(err) {
+		t.Fatal(err)
+	}
+	var stored []*event.E
+	for i := range 2 {
+		ev := event.New()
+		ev.Kind = kind.TextNote
+		ev.CreatedAt = timestamp.Now() - timestamp.Timestamp(i)
+		ev.Content = strconv.Itoa(i)
+		if err = ev.Sign(sign); chk.E(err) {
+			t.Fatal(err)
+		}
+		if err = d.StoreEvent(ev); chk.E(err) {
+			t.Fatal(err)
+		}
+		stored = append(stored, ev)
+	}
+	access := func(ev *event.E, times int) {
+		for range times {
+			if _, _, err = d.Query(filter.F{Ids: []string{ev.Id}}); chk.E(err) {
+				t.Fatal(err)
+			}
+		}
+		if err = d.FlushAccess(); chk.E(err) {
+			t.Fatal(err)
+		}
+	}
+	// the first event is accessed often, and then the second once, more recently.
+	access(stored[0], 8)
+	access(stored[1], 1)
+	// the example event, which wasn't accessed, is deleted first, and then the event that was
+	// accessed once, as the accesses of the other keep it for longer.
+	for range 2 {
+		var size int64
+		if size, err = d.StoredSize(); chk.E(err) {
+			t.Fatal(err)
+		}
+		if _, _, err = d.GC(size - 1); chk.E(err) {
+			t.Fatal(err)
+		}
+	}
+	var evs []*event.E
+	if evs, _, err = d.Query(filter.F{}); chk.E(err) {
+		t.Fatal(err)
+	}
+	if len(evs) != 1 || evs[0].Id != stored[0].Id {
+		t.Fatalf("expected only the event that was accessed most to remain, got %d", len(evs))
+	}
+}
@@ -2,7 +2,6 @@ package database
 
 import (
 	"bytes"
-	"time"
 
 	"x.realy.lol/chk"
 	"x.realy.lol/database/indexes"
@@ -30,6 +29,15 @@ func (d *D) GetEventIndexes(ev *event.E) (indices [][]byte, ser *varint.V, err e
 		return
 	}
 	ser.FromUint64(s)
+	indices, err = d.EventIndexes(ev, ser)
+	return
+}
+
+// EventIndexes generates the index keys of an event with a given serial. These are the same
+// keys that were written when the event was stored, which is how they are found to be deleted
+// and how they are rebuilt by Reindex. The metadata keys, such as FirstSeen, are not derived
+// from the event, and are written by StoreEvent.
+func (d *D) EventIndexes(ev *event.E, ser *varint.V) (indices [][]byte, err error) {
 	// create the event id key
 	id := idhash.New()
 	var idb []byte
@@ -83,14 +91,6 @@ func (d *D) GetEventIndexes(ev *event.E) (indices [][]byte, ser *varint.V, err e
 		return
 	}
 	indices = append(indices, evICaB.Bytes())
-	// FirstSeen index
-	evIFsB := new(bytes.Buffer)
-	fs := &timestamp.T{}
-	fs.FromInt64(time.Now().Unix())
-	if err = indexes.FirstSeenEnc(ser, fs).MarshalWrite(evIFsB); chk.E(err) {
-		return
-	}
-	indices = append(indices, evIFsB.Bytes())
 	// Kind index
 	evIKiB := new(bytes.Buffer)
 	if err = indexes.KindEnc(ki, ser).MarshalWrite(evIKiB); chk.E(err) {
@@ -109,6 +109,28 @@ func (d *D) GetEventIndexes(ev *event.E) (indices [][]byte, ser *varint.V, err e
 		return
 	}
 	indices = append(indices, evIKpB.Bytes())
+	// Usage index
+	evB := new(bytes.Buffer)
+	if err = ev.MarshalWrite(evB); chk.E(err) {
+		return
+	}
+	size := varint.New()
+	size.FromUint64(uint64(evB.Len()))
+	evIUsB := new(bytes.Buffer)
+	if err = indexes.UsageEnc(p, ser, size).MarshalWrite(evIUsB); chk.E(err) {
+		return
+	}
+	indices = append(indices, evIUsB.Bytes())
+	// Expiration index
+	if exp, ok := ev.Expiration(); ok {
+		ex := &timestamp.T{}
+		ex.FromInt64(exp.ToInt64())
+		evIExB := new(bytes.Buffer)
+		if err = indexes.ExpirationEnc(ex, ser).MarshalWrite(evIExB); chk.E(err) {
+			return
+		}
+		indices = append(indices, evIExB.Bytes())
+	}
 	// tags
 	// TagA index
 	var atags []tags.Tag_a
@@ -182,6 +182,8 @@ func KindCreatedAtDec(ki *kindidx.T, ca *timestamp.T, ser *varint.V) (enc *T) {
 
 func KindPubkeyCreatedAtVars() (ki *kindidx.T, p *pubhash.T, ca *timestamp.T, ser *varint.V) {
 	ki = kindidx.FromKind(0)
+	p = pubhash.New()
+	ca = &timestamp.T{}
 	ser = varint.New()
 	return
 }
@@ -333,3 +335,40 @@ func AccessCounterEnc(ser *varint.V) (enc *T) {
 func AccessCounterDec(ser *varint.V) (enc *T) {
 	return New(prefix.New(), ser)
 }
+
+func AccessOrderVars() (la *timestamp.T, ser *varint.V) {
+	la = &timestamp.T{}
+	ser = varint.New()
+	return
+}
+func AccessOrderEnc(la *timestamp.T, ser *varint.V) (enc *T) {
+	return New(prefix.New(prefixes.AccessOrder), la, ser)
+}
+func AccessOrderDec(la *timestamp.T, ser *varint.V) (enc *T) {
+	return New(prefix.New(), la, ser)
+}
+
+func ExpirationVars() (exp *timestamp.T, ser *varint.V) {
+	exp = &timestamp.T{}
+	ser = varint.New()
+	return
+}
+func ExpirationEnc(exp *timestamp.T, ser *varint.V) (enc *T) {
+	return New(prefix.New(prefixes.Expiration), exp, ser)
+}
+func ExpirationDec(exp *timestamp.T, ser *varint.V) (enc *T) {
+	return New(prefix.New(), exp, ser)
+}
+
+func UsageVars() (p *pubhash.T, ser *varint.V, size *varint.V) {
+	p = pubhash.New()
+	ser = varint.New()
+	size = varint.New()
+	return
+}
+func UsageEnc(p *pubhash.T, ser *varint.V, size *varint.V) (enc *T) {
+	return New(prefix.New(prefixes.Usage), p, ser, size)
+}
+func UsageDec(p *pubhash.T, ser *varint.V, size *varint.V) (enc *T) {
+	return New(prefix.New(), p, ser, size)
+}
@@ -560,3 +560,81 @@ func TestAccessCounter(t *testing.T) {
 		}
 	}
 }
+
+func TestAccessOrder(t *testing.T) {
+	var err error
+	for range 100 {
+		la, ser := AccessOrderVars()
+		la.FromInt(int(time.Now().Unix()))
+		ser.FromUint64(uint64(frand.Intn(math.MaxInt64)))
+		buf := new(bytes.Buffer)
+		fi := AccessOrderEnc(la, ser)
+		fi.MarshalWrite(buf)
+		bin := buf.Bytes()
+		buf2 := bytes.NewBuffer(bin)
+		la2, ser2 := AccessOrderVars()
+		fi2 := AccessOrderDec(la2, ser2)
+		if err = fi2.UnmarshalRead(buf2); chk.E(err) {
+			t.Fatal(err)
+		}
+		if la.ToTimestamp() != la2.ToTimestamp() {
+			t.Fatal("failed to recover same value as input")
+		}
+		if ser.ToUint64() != ser2.ToUint64() {
+			t.Fatal("failed to recover same value as input")
+		}
+	}
+}
+
+func TestExpiration(t *testing.T) {
+	var err error
+	for range 100 {
+		exp, ser := ExpirationVars()
+		exp.FromInt(int(time.Now().Unix()))
+		ser.FromUint64(uint64(frand.Intn(math.MaxInt64)))
+		buf := new(bytes.Buffer)
+		fi := ExpirationEnc(exp, ser)
+		fi.MarshalWrite(buf)
+		bin := buf.Bytes()
+		buf2 := bytes.NewBuffer(bin)
+		exp2, ser2 := ExpirationVars()
+		fi2 := ExpirationDec(exp2, ser2)
+		if err = fi2.UnmarshalRead(buf2); chk.E(err) {
+			t.Fatal(err)
+		}
+		if exp.ToTimestamp() != exp2.ToTimestamp() {
+			t.Fatal("failed to recover same value as input")
+		}
+		if ser.ToUint64() != ser2.ToUint64() {
+			t.Fatal("failed to recover same value as input")
+		}
+	}
+}
+
+func TestUsage(t *testing.T) {
+	var err error
+	for range 100 {
+		p, ser, size := UsageVars()
+		if err = p.FromPubkey(frand.Bytes(32)); chk.E(err) {
+			t.Fatal(err)
+		}
+		ser.FromUint64(uint64(frand.Intn(math.MaxInt64)))
+		size.FromUint64(uint64(frand.Intn(65536)))
+		buf := new(bytes.Buffer)
+		fi := UsageEnc(p, ser, size)
+		fi.MarshalWrite(buf)
+		bin := buf.Bytes()
+		buf2 := bytes.NewBuffer(bin)
+		p2, ser2, size2 := UsageVars()
+		fi2 := UsageDec(p2, ser2, size2)
+		if err = fi2.UnmarshalRead(buf2); chk.E(err) {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p.Bytes(), p2.Bytes()) {
+			t.Fatal("failed to recover same value as input")
+		}
+		if ser.ToUint64() != ser2.ToUint64() || size.ToUint64() != size2.ToUint64() {
+			t.Fatal("failed to recover same value as input")
+		}
+	}
+}
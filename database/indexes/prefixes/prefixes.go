@@ -14,7 +14,8 @@ const (
 	//   [ prefix ][ 8 byte serial ] [ event in binary format ]
 	Event = iota
 
-	// Config is a singular record containing a free-form configuration in JSON format
+	// Config is a singular record containing a free-form configuration in JSON format. It is
+	// an object, with a member for each section, such as the retention policy.
 	//
 	// [ prefix ] [ configuration in JSON format ]
 	Config
@@ -166,6 +167,49 @@ const (
 	//
 	// [ prefix ][ 8 serial ] [ 8 bytes access counter ]
 	AccessCounter
+
+	// AccessOrder is an index of the events in order of the time in their LastAccessed
+	// record, delayed by how often they were accessed, so the events that garbage collection
+	// deletes first are found by scanning from the start.
+	//
+	// [ prefix ][ 8 bytes last accessed timestamp plus access weight ][ 8 serial ]
+	AccessOrder
+
+	// Expiration is an index of the nip-40 expiration time of events that have one, in time
+	// order so the expired events can be found by scanning from the start.
+	//
+	// [ prefix ][ 8 bytes expiration timestamp ][ 8 serial ]
+	Expiration
+
+	// Usage is the storage used by an event, indexed by its author, so the number of events
+	// and bytes stored by a pubkey can be counted with a keys only scan.
+	//
+	// [ prefix ][ 8 bytes truncated hash of pubkey ][ 8 serial ][ varint size of event ]
+	Usage
+
+	// MirrorCursor is the since cursor of each filter mirrored from an upstream relay, so the
+	// mirror resumes where it stopped.
+	//
+	// [ prefix ][ upstream url ] [ cursors in JSON format ]
+	MirrorCursor
+
+	// ChangeLog is the log of the inserts, replacements and deletions of events, in the order
+	// they were committed, see database.Change.
+	//
+	// [ prefix ][ 8 bytes sequence ] [ op ][ 8 serial ][ 32 bytes id ][ 32 bytes replaced ids... ]
+	ChangeLog
+
+	// FollowPosition is the sequence number of the last change of a primary that a follower
+	// has applied.
+	//
+	// [ prefix ][ primary url ] [ 8 bytes sequence ]
+	FollowPosition
+
+	// SchemaVersion is a singular record of the version of the layout of the keys, which is
+	// upgraded by the migrations that run when the database is opened.
+	//
+	// [ prefix ] [ 4 bytes version ]
+	SchemaVersion
 )
 
 func (i I) Write(w io.Writer) (n int, err error) { return w.Write([]byte(i)) }
@@ -216,6 +260,20 @@ func Prefix(prf int) (i I) {
 		return "la"
 	case AccessCounter:
 		return "ac"
+	case AccessOrder:
+		return "ao"
+	case Expiration:
+		return "ex"
+	case Usage:
+		return "us"
+	case MirrorCursor:
+		return "mc"
+	case ChangeLog:
+		return "cl"
+	case FollowPosition:
+		return "fp"
+	case SchemaVersion:
+		return "sv"
 	}
 	return
 }
@@ -2,13 +2,16 @@ package timestamp
 
 import (
 	"bytes"
+	"encoding/binary"
 	"io"
 
 	"x.realy.lol/chk"
-	"x.realy.lol/database/indexes/types/varint"
+	"x.realy.lol/errorf"
 	timeStamp "x.realy.lol/timestamp"
 )
 
+// Len is the length of an encoded timestamp. It is big-endian, so that keys containing it sort
+// in chronological order and can be range scanned.
 const Len = 8
 
 type T struct{ val int }
@@ -17,21 +20,26 @@ func (ts *T) FromInt(t int)     { ts.val = t }
 func (ts *T) FromInt64(t int64) { ts.val = int(t) }
 
 func FromBytes(timestampBytes []byte) (ts *T, err error) {
-	v := varint.New()
-	if err = v.UnmarshalRead(bytes.NewBuffer(timestampBytes)); chk.E(err) {
+	if len(timestampBytes) != Len {
+		err = errorf.E("timestamp must be %d bytes long, got %d", Len, len(timestampBytes))
+		return
+	}
+	ts = &T{}
+	if err = ts.UnmarshalRead(bytes.NewBuffer(timestampBytes)); chk.E(err) {
 		return
 	}
-	ts = &T{val: v.ToInt()}
 	return
 }
 
 func (ts *T) ToTimestamp() (timestamp timeStamp.Timestamp) {
-	return
+	return timeStamp.Timestamp(ts.val)
 }
+
+func (ts *T) ToInt() int { return ts.val }
+
 func (ts *T) Bytes() (b []byte, err error) {
-	v := varint.New()
 	buf := new(bytes.Buffer)
-	if err = v.MarshalWrite(buf); chk.E(err) {
+	if err = ts.MarshalWrite(buf); chk.E(err) {
 		return
 	}
 	b = buf.Bytes()
@@ -39,18 +47,22 @@ func (ts *T) Bytes() (b []byte, err error) {
 }
 
 func (ts *T) MarshalWrite(w io.Writer) (err error) {
-	v := varint.New()
-	if err = v.MarshalWrite(w); chk.E(err) {
-		return
+	// negative timestamps are clamped so the encoding stays in order.
+	v := ts.val
+	if v < 0 {
+		v = 0
 	}
+	b := make([]byte, Len)
+	binary.BigEndian.PutUint64(b, uint64(v))
+	_, err = w.Write(b)
 	return
 }
 
 func (ts *T) UnmarshalRead(r io.Reader) (err error) {
-	v := varint.New()
-	if err = v.UnmarshalRead(r); chk.E(err) {
+	b := make([]byte, Len)
+	if _, err = io.ReadFull(r, b); chk.E(err) {
 		return
 	}
-	ts.val = v.ToInt()
+	ts.val = int(binary.BigEndian.Uint64(b))
 	return
 }
@@ -36,7 +36,7 @@ func (vi *V) ToUint32() (v uint32) { return uint32(vi.val) }
 func (vi *V) Bytes() (b []byte) {
 	buf := new(bytes.Buffer)
 	varint.Encode(buf, vi.val)
-	return
+	return buf.Bytes()
 }
 
 func (vi *V) MarshalWrite(w io.Writer) (err error) {
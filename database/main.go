@@ -10,6 +10,10 @@ import (
 	"x.realy.lol/units"
 )
 
+// eventSequence is the key of the sequence of event serials, which starts with the Event
+// prefix, so scans of the events skip it.
+const eventSequence = "events"
+
 type D struct {
 	ctx            context.Context
 	cancel         context.CancelCauseFunc
@@ -21,11 +25,29 @@ type D struct {
 	*badger.DB
 	// seq is the monotonic collision free index for raw event storage.
 	seq *badger.Sequence
+	// stats caches the cardinality of index search prefixes for the query planner.
+	stats *stats
+	// access accumulates the accesses of events by queries until they are flushed.
+	access *access
+	// size is the running total of the StoredSize.
+	size storedSize
+	// usage caches the storage used by pubkeys.
+	usage *usage
+	// config is the runtime configuration, from the configuration record.
+	config config
+	// changes numbers the entries of the change log.
+	changes changeLog
+	// storeStats caches the StoreStats.
+	storeStats storeStats
+	// metrics are the measurements of the database, served by RegisterMetrics.
+	metrics *dbMetrics
 }
 
 func New() (d *D) {
 	ctx, cancel := context.WithCancelCause(context.Background())
-	d = &D{BlockCacheSize: units.Gb, ctx: ctx, cancel: cancel}
+	d = &D{BlockCacheSize: units.Gb, ctx: ctx, cancel: cancel, stats: newStats(),
+		access: newAccess(), usage: newUsage(), metrics: newMetrics(),
+		changes: changeLog{wake: make(chan struct{})}}
 	return
 }
 
@@ -47,14 +69,27 @@ func (d *D) Init(path string) (err error) {
 		return err
 	}
 	log.I.Ln("getting event store sequence index", d.dataDir)
-	if d.seq, err = d.DB.GetSequence([]byte("events"), 1000); chk.E(err) {
+	if d.seq, err = d.DB.GetSequence([]byte(eventSequence), 1000); chk.E(err) {
+		return err
+	}
+	if d.changes.seq, err = d.DB.GetSequence([]byte("changes"), 1000); chk.E(err) {
+		return err
+	}
+	if err = d.loadConfig(); chk.E(err) {
+		return err
+	}
+	if err = d.migrate(); chk.E(err) {
 		return err
 	}
 	return nil
 
 }
 
-func (d *D) Close() (err error) { return d.DB.Close() }
+// Close writes the accesses that haven't been flushed and closes the database.
+func (d *D) Close() (err error) {
+	chk.E(d.FlushAccess())
+	return d.DB.Close()
+}
 
 // Serial returns the next monotonic conflict free unique serial on the database.
 func (d *D) Serial() (ser uint64, err error) {
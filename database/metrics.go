@@ -0,0 +1,87 @@
+package database
+
+import (
+	"strings"
+
+	"x.realy.lol/metrics"
+)
+
+// dbMetrics are the measurements of the queries and the garbage collection of the database.
+type dbMetrics struct {
+	queries   *metrics.Histogram
+	gcRuns    *metrics.Counter
+	gcDeleted *metrics.Counter
+	gcFreed   *metrics.Counter
+	reaped    *metrics.Counter
+}
+
+func newMetrics() (m *dbMetrics) {
+	return &dbMetrics{
+		queries: metrics.NewHistogram("realy_query_duration_seconds",
+			"time to scan the index of a query, by the planner path that drove it",
+			metrics.DefaultBuckets, "path"),
+		gcRuns: metrics.NewCounter("realy_gc_runs",
+			"garbage collections that deleted events to get within the size budget"),
+		gcDeleted: metrics.NewCounter("realy_gc_deleted_events",
+			"least accessed events deleted by garbage collection"),
+		gcFreed: metrics.NewCounter("realy_gc_freed_bytes",
+			"bytes freed by garbage collection"),
+		reaped: metrics.NewCounter("realy_expired_deleted_events",
+			"events deleted because their nip-40 expiration passed"),
+	}
+}
+
+// pathLabel is the label of a planner path for the query metrics. Nonstandard tags can have
+// any name, so they share a label.
+func pathLabel(p *Path) string {
+	if strings.HasPrefix(p.Label, "#") && len(p.Label) != 2 {
+		return "#nonstandard"
+	}
+	return p.Label
+}
+
+// RegisterMetrics adds the metrics of the database to a registry, with the cache hit rates
+// and file sizes of badger, which are read when the metrics are served.
+func (d *D) RegisterMetrics(r *metrics.Registry) {
+	m := d.metrics
+	r.Register(m.queries, m.gcRuns, m.gcDeleted, m.gcFreed, m.reaped)
+	for name, cache := range map[string]func() (hits, misses uint64){
+		"block": func() (hits, misses uint64) {
+			if cm := d.DB.BlockCacheMetrics(); cm != nil {
+				hits, misses = cm.Hits(), cm.Misses()
+			}
+			return
+		},
+		"index": func() (hits, misses uint64) {
+			if cm := d.DB.IndexCacheMetrics(); cm != nil {
+				hits, misses = cm.Hits(), cm.Misses()
+			}
+			return
+		},
+	} {
+		r.Register(
+			metrics.NewCounterFunc("realy_badger_"+name+"_cache_hits",
+				"hits of the badger "+name+" cache", func() float64 {
+					hits, _ := cache()
+					return float64(hits)
+				}),
+			metrics.NewCounterFunc("realy_badger_"+name+"_cache_misses",
+				"misses of the badger "+name+" cache", func() float64 {
+					_, misses := cache()
+					return float64(misses)
+				}),
+		)
+	}
+	r.Register(
+		metrics.NewGaugeFunc("realy_badger_lsm_bytes", "size of the badger LSM tree files",
+			func() float64 {
+				lsm, _ := d.DB.Size()
+				return float64(lsm)
+			}),
+		metrics.NewGaugeFunc("realy_badger_vlog_bytes", "size of the badger value log files",
+			func() float64 {
+				_, vlog := d.DB.Size()
+				return float64(vlog)
+			}),
+	)
+}
@@ -0,0 +1,346 @@
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"github.com/dgraph-io/badger/v4"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/database/indexes"
+	"x.realy.lol/database/indexes/prefixes"
+	ts "x.realy.lol/database/indexes/types/timestamp"
+	"x.realy.lol/database/indexes/types/varint"
+	"x.realy.lol/errorf"
+	"x.realy.lol/event"
+	"x.realy.lol/log"
+	"x.realy.lol/timestamp"
+)
+
+// Migration upgrades the layout of the keys of a database from the version before it to its
+// Version.
+type Migration struct {
+	Version     uint32
+	Description string
+	Migrate     func(d *D) (err error)
+}
+
+// migrations are the registered migrations, in order of version.
+var migrations []Migration
+
+// RegisterMigration adds a migration that runs when a database with an older schema version is
+// opened. The versions of the migrations must be consecutive, starting at 1.
+func RegisterMigration(m Migration) {
+	if m.Version != uint32(len(migrations))+1 {
+		panic(errorf.E("migration %d registered after version %d", m.Version, len(migrations)))
+	}
+	migrations = append(migrations, m)
+}
+
+func init() {
+	RegisterMigration(Migration{
+		Version:     1,
+		Description: "reindex the events with 8 byte timestamps, and rewrite their metadata",
+		Migrate:     upgradeTimestamps,
+	})
+}
+
+// SchemaVersion is the schema version that the registered migrations upgrade a database to.
+func SchemaVersion() uint32 { return uint32(len(migrations)) }
+
+// StoredSchemaVersion returns the schema version of the database, which is zero if it was
+// created before schema versions were stored.
+func (d *D) StoredSchemaVersion() (v uint32, err error) {
+	err = d.View(func(txn *badger.Txn) (err error) {
+		var item *badger.Item
+		if item, err = txn.Get(searchPrefix(prefixes.SchemaVersion)); err != nil {
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				err = nil
+			}
+			return
+		}
+		return item.Value(func(b []byte) (err error) {
+			if len(b) != 4 {
+				return errorf.E("invalid schema version %x", b)
+			}
+			v = binary.BigEndian.Uint32(b)
+			return
+		})
+	})
+	return
+}
+
+func (d *D) setSchemaVersion(v uint32) (err error) {
+	return d.Set(searchPrefix(prefixes.SchemaVersion), binary.BigEndian.AppendUint32(nil, v))
+}
+
+// migrate runs the migrations that are newer than the schema version of the database, in
+// order, and stores the version after each of them, so an upgrade that is interrupted resumes
+// from the migration that failed. A new database has the current version. A database with a
+// newer version than the registered migrations was written by a newer version of the relay,
+// and is not opened.
+func (d *D) migrate() (err error) {
+	var v uint32
+	if v, err = d.StoredSchemaVersion(); chk.E(err) {
+		return
+	}
+	if v == 0 {
+		var empty bool
+		if empty, err = d.empty(); chk.E(err) {
+			return
+		}
+		if empty {
+			return d.setSchemaVersion(SchemaVersion())
+		}
+	}
+	if v > SchemaVersion() {
+		return errorf.E("the database has schema version %d, newer than %d, upgrade the relay",
+			v, SchemaVersion())
+	}
+	for _, m := range migrations[v:] {
+		log.I.F("migrating the database to schema version %d: %s", m.Version, m.Description)
+		if err = m.Migrate(d); err != nil {
+			return errorf.E("migration to schema version %d failed: %s", m.Version, err)
+		}
+		if err = d.setSchemaVersion(m.Version); chk.E(err) {
+			return
+		}
+	}
+	return
+}
+
+// empty returns true if the database has no events.
+func (d *D) empty() (empty bool, err error) {
+	err = d.View(func(txn *badger.Txn) (err error) {
+		prf := searchPrefix(prefixes.Event)
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: prf, PrefetchValues: false})
+		defer it.Close()
+		it.Seek(prf)
+		if it.ValidForPrefix(prf) && string(it.Item().Key()) == eventSequence {
+			it.Next()
+		}
+		empty = !it.ValidForPrefix(prf)
+		return
+	})
+	return
+}
+
+// upgradeTimestamps upgrades a database written before timestamps were encoded as 8 bytes
+// big-endian, when every timestamp was written as a zero varint, so the timed scans of the
+// planner skip all of its index keys, and before the expiration and usage indexes and the
+// AccessOrder existed.
+// The indexes are generated again by Reindex, and the metadata of each event is rewritten.
+func upgradeTimestamps(d *D) (err error) {
+	var n int
+	if n, err = d.Reindex(); chk.E(err) {
+		return
+	}
+	log.I.F("reindexed %d events", n)
+	return d.rewriteMetadata()
+}
+
+// rewriteMetadata keeps the oldest FirstSeen key of each event that has a timestamp, and
+// deletes the others, which are either of the old layout or were written twice by StoreEvent
+// and GetEventIndexes. An event without one is first seen at its created_at, as the time it
+// was received was not stored. LastAccessed values that are not timestamps are set to when
+// the event was first seen, and missing AccessCounters are zero. The AccessOrder key of each
+// event is written from these.
+func (d *D) rewriteMetadata() (err error) {
+	wb := d.DB.NewWriteBatch()
+	defer wb.Cancel()
+	now := timestamp.Now()
+	zero := varint.New()
+	if err = d.View(func(txn *badger.Txn) (err error) {
+		evPrf := searchPrefix(prefixes.Event)
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: evPrf})
+		defer it.Close()
+		fsPrf := searchPrefix(prefixes.FirstSeen)
+		fsIt := txn.NewIterator(badger.IteratorOptions{Prefix: fsPrf, PrefetchValues: false})
+		defer fsIt.Close()
+		for it.Seek(evPrf); it.ValidForPrefix(evPrf); it.Next() {
+			item := it.Item()
+			if string(item.Key()) == eventSequence {
+				continue
+			}
+			ser := varint.New()
+			if err = ser.UnmarshalRead(bytes.NewBuffer(item.Key()[len(evPrf):])); chk.E(err) {
+				return
+			}
+			// the serial is a prefix free varint, so this only has the keys of the event.
+			prf := searchPrefix(prefixes.FirstSeen, ser.Bytes())
+			var first *ts.T
+			for fsIt.Seek(prf); fsIt.ValidForPrefix(prf); fsIt.Next() {
+				k := fsIt.Item().KeyCopy(nil)
+				if rest := k[len(prf):]; first == nil && len(rest) == ts.Len {
+					// the timestamps are big-endian, so the oldest is first.
+					first = &ts.T{}
+					if err = first.UnmarshalRead(bytes.NewBuffer(rest)); chk.E(err) {
+						return
+					}
+					continue
+				}
+				if err = wb.Delete(k); chk.E(err) {
+					return
+				}
+			}
+			if first == nil {
+				var val []byte
+				if val, err = item.ValueCopy(nil); chk.E(err) {
+					return
+				}
+				ev := event.New()
+				if ev.UnmarshalRead(bytes.NewBuffer(val)) != nil {
+					// skipped by Reindex, and left for Fsck to repair.
+					continue
+				}
+				first = &ts.T{}
+				first.FromInt64(min(ev.CreatedAt, now).ToInt64())
+				k := new(bytes.Buffer)
+				if err = indexes.FirstSeenEnc(ser, first).MarshalWrite(k); chk.E(err) {
+					return
+				}
+				if err = wb.Set(k.Bytes(), nil); chk.E(err) {
+					return
+				}
+			}
+			laKey := searchPrefix(prefixes.LastAccessed, ser.Bytes())
+			var la []byte
+			if la, err = valueOf(txn, laKey); chk.E(err) {
+				return
+			}
+			if len(la) != ts.Len {
+				if la, err = first.Bytes(); chk.E(err) {
+					return
+				}
+				if err = wb.Set(laKey, la); chk.E(err) {
+					return
+				}
+			}
+			acKey := searchPrefix(prefixes.AccessCounter, ser.Bytes())
+			var ac []byte
+			if ac, err = valueOf(txn, acKey); chk.E(err) {
+				return
+			}
+			if len(ac) == 0 {
+				if err = wb.Set(acKey, zero.Bytes()); chk.E(err) {
+					return
+				}
+			}
+			var count uint64
+			if count, err = accessCount(txn, acKey); chk.E(err) {
+				return
+			}
+			if err = wb.Set(accessOrderKey(ser, la, count), nil); chk.E(err) {
+				return
+			}
+		}
+		return
+	}); chk.E(err) {
+		return
+	}
+	if err = wb.Flush(); chk.E(err) {
+		return
+	}
+	// the running StoredSize doesn't have the keys that were written.
+	d.resetStats()
+	return
+}
+
+// valueOf returns a copy of the value of a key, which is nil if the key is missing.
+func valueOf(txn *badger.Txn, key []byte) (val []byte, err error) {
+	var item *badger.Item
+	if item, err = txn.Get(key); err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			err = nil
+		}
+		return
+	}
+	return item.ValueCopy(nil)
+}
+
+// derived are the prefixes of the index keys that EventIndexes derives from an event.
+var derived = []int{
+	prefixes.Id, prefixes.FullIndex, prefixes.Pubkey, prefixes.Kind, prefixes.CreatedAt,
+	prefixes.PubkeyCreatedAt, prefixes.KindCreatedAt, prefixes.KindPubkeyCreatedAt,
+	prefixes.TagA, prefixes.TagIdentifier, prefixes.TagEvent, prefixes.TagPubkey,
+	prefixes.TagHashtag, prefixes.TagLetter, prefixes.TagProtected, prefixes.TagNonstandard,
+	prefixes.FulltextWord, prefixes.Expiration, prefixes.Usage,
+}
+
+// Reindex deletes the index keys that are derived from the events, and generates them again
+// from the stored events with EventIndexes, so a change to the indexes applies to the events
+// that were stored before it. The metadata of the events, such as when they were first seen
+// and accessed, is kept. Events that can't be decoded are logged and skipped, so they don't
+// leave the database without its indexes, and are left for Fsck to repair. Nothing else can
+// use the database while it runs. It returns the number of events that were indexed.
+func (d *D) Reindex() (n int, err error) {
+	var prfs [][]byte
+	for _, p := range derived {
+		prfs = append(prfs, searchPrefix(p))
+	}
+	if err = d.DB.DropPrefix(prfs...); chk.E(err) {
+		return
+	}
+	wb := d.DB.NewWriteBatch()
+	defer wb.Cancel()
+	if err = d.View(func(txn *badger.Txn) (err error) {
+		prf := searchPrefix(prefixes.Event)
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: prf})
+		defer it.Close()
+		for it.Seek(prf); it.ValidForPrefix(prf); it.Next() {
+			item := it.Item()
+			if string(item.Key()) == eventSequence {
+				continue
+			}
+			ser := varint.New()
+			if e := ser.UnmarshalRead(bytes.NewBuffer(item.Key()[len(prf):])); e != nil {
+				log.W.F("skipping event key %x that can't be decoded: %s", item.Key(), e)
+				continue
+			}
+			var val []byte
+			if val, err = item.ValueCopy(nil); chk.E(err) {
+				return
+			}
+			ev := event.New()
+			if e := ev.UnmarshalRead(bytes.NewBuffer(val)); e != nil {
+				log.W.F("skipping event %d that can't be decoded: %s", ser.ToUint64(), e)
+				continue
+			}
+			var idxs [][]byte
+			if idxs, err = d.EventIndexes(ev, ser); chk.E(err) {
+				return
+			}
+			for _, k := range idxs {
+				if err = wb.Set(k, nil); chk.E(err) {
+					return
+				}
+			}
+			if n++; n%100000 == 0 {
+				log.I.F("reindexed %d events", n)
+			}
+		}
+		return
+	}); chk.E(err) {
+		return
+	}
+	if err = wb.Flush(); chk.E(err) {
+		return
+	}
+	d.resetStats()
+	return
+}
+
+// resetStats clears the cached counts of the index keys, after they are changed by something
+// other than storing and deleting events.
+func (d *D) resetStats() {
+	d.stats.Lock()
+	clear(d.stats.counts)
+	d.stats.Unlock()
+	d.usage.Lock()
+	clear(d.usage.byPubkey)
+	d.usage.Unlock()
+	d.size.Lock()
+	d.size.known = false
+	d.size.Unlock()
+}
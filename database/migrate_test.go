@@ -0,0 +1,194 @@
+package database
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+
+	"github.com/dgraph-io/badger/v4"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/database/indexes"
+	"x.realy.lol/database/indexes/prefixes"
+	"x.realy.lol/database/indexes/types/kindidx"
+	"x.realy.lol/database/indexes/types/timestamp"
+	"x.realy.lol/database/indexes/types/varint"
+	"x.realy.lol/event"
+	"x.realy.lol/filter"
+	timeStamp "x.realy.lol/timestamp"
+)
+
+// keysWithPrefixes returns the keys of a database under any of a set of prefixes.
+func keysWithPrefixes(t *testing.T, d *D, prfs ...int) (keys []string) {
+	if err := d.View(func(txn *badger.Txn) (err error) {
+		for _, p := range prfs {
+			prf := searchPrefix(p)
+			it := txn.NewIterator(badger.IteratorOptions{Prefix: prf, PrefetchValues: false})
+			for it.Seek(prf); it.ValidForPrefix(prf); it.Next() {
+				keys = append(keys, string(it.Item().KeyCopy(nil)))
+			}
+			it.Close()
+		}
+		return
+	}); chk.E(err) {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestD_Migrate(t *testing.T) {
+	d, evs := loadExampleEvents(t, "testrealy-migrate", 50)
+	var err error
+	var v uint32
+	if v, err = d.StoredSchemaVersion(); chk.E(err) || v != SchemaVersion() {
+		t.Fatalf("a new database has schema version %d, expected %d", v, SchemaVersion())
+	}
+	firstSeen := keysWithPrefixes(t, d, prefixes.FirstSeen)
+	if len(firstSeen) != len(evs) {
+		t.Fatalf("%d FirstSeen keys for %d events", len(firstSeen), len(evs))
+	}
+	// a database from before schema versions has a second FirstSeen key for some events.
+	ser, ts := indexes.FirstSeenVars()
+	if err = indexes.FirstSeenDec(ser, ts).UnmarshalRead(
+		bytes.NewBufferString(firstSeen[0])); chk.E(err) {
+		t.Fatal(err)
+	}
+	later := &timestamp.T{}
+	later.FromInt64(ts.ToTimestamp().ToInt64() + 1)
+	dup := new(bytes.Buffer)
+	if err = indexes.FirstSeenEnc(ser, later).MarshalWrite(dup); chk.E(err) {
+		t.Fatal(err)
+	}
+	if err = d.Set(dup.Bytes(), nil); chk.E(err) {
+		t.Fatal(err)
+	}
+	if err = d.Update(func(txn *badger.Txn) error {
+		return txn.Delete(searchPrefix(prefixes.SchemaVersion))
+	}); chk.E(err) {
+		t.Fatal(err)
+	}
+	path := d.Path()
+	d.Close()
+	if err = d.Init(path); chk.E(err) {
+		t.Fatal(err)
+	}
+	if v, err = d.StoredSchemaVersion(); chk.E(err) || v != SchemaVersion() {
+		t.Fatalf("the migrated database has schema version %d, expected %d", v, SchemaVersion())
+	}
+	if keys := keysWithPrefixes(t, d, prefixes.FirstSeen); !slices.Equal(keys, firstSeen) {
+		t.Fatalf("%d FirstSeen keys after the migration, expected %d", len(keys),
+			len(firstSeen))
+	}
+	// a database with a newer schema is not opened.
+	if err = d.setSchemaVersion(SchemaVersion() + 1); chk.E(err) {
+		t.Fatal(err)
+	}
+	d.Close()
+	// the database is left open by the failed Init, for the cleanup to close.
+	if err = d.Init(path); err == nil {
+		t.Fatal("opened a database with a newer schema version")
+	}
+}
+
+func TestD_MigrateBaseline(t *testing.T) {
+	d, evs := loadExampleEvents(t, "testrealy-migrate-baseline", 200)
+	var err error
+	// rewrite the database in the layout written before schema versions, where every
+	// timestamp is a zero varint, and without the expiration and usage indexes.
+	zero := varint.New().Bytes()
+	sers := make([]*varint.V, len(evs))
+	for i, ev := range evs {
+		if sers[i], err = d.FindEventSerialById(ev.GetIdBytes()); chk.E(err) {
+			t.Fatal(err)
+		}
+	}
+	if err = d.DB.DropPrefix(searchPrefix(prefixes.SchemaVersion),
+		searchPrefix(prefixes.FirstSeen), searchPrefix(prefixes.LastAccessed),
+		searchPrefix(prefixes.AccessCounter), searchPrefix(prefixes.AccessOrder)); chk.E(err) {
+		t.Fatal(err)
+	}
+	for _, p := range derived {
+		if err = d.DB.DropPrefix(searchPrefix(p)); chk.E(err) {
+			t.Fatal(err)
+		}
+	}
+	for i, ev := range evs {
+		ser := sers[i]
+		if err = d.Update(func(txn *badger.Txn) (err error) {
+			for k, v := range map[string][]byte{
+				string(searchPrefix(prefixes.KindCreatedAt, kindidx.FromKind(ev.Kind).Bytes(),
+					zero, ser.Bytes())): nil,
+				string(searchPrefix(prefixes.CreatedAt, zero, ser.Bytes())): nil,
+				string(searchPrefix(prefixes.FirstSeen, ser.Bytes(), zero)): nil,
+				string(searchPrefix(prefixes.LastAccessed, ser.Bytes())):    zero,
+				string(searchPrefix(prefixes.AccessCounter, ser.Bytes())):   nil,
+			} {
+				if err = txn.Set([]byte(k), v); err != nil {
+					return
+				}
+			}
+			return
+		}); chk.E(err) {
+			t.Fatal(err)
+		}
+	}
+	path := d.Path()
+	d.Close()
+	if err = d.Init(path); chk.E(err) {
+		t.Fatal(err)
+	}
+	var v uint32
+	if v, err = d.StoredSchemaVersion(); chk.E(err) || v != SchemaVersion() {
+		t.Fatalf("the migrated database has schema version %d, expected %d", v, SchemaVersion())
+	}
+	var r FsckReport
+	if r, err = d.Fsck(false); chk.E(err) || r.Problems() != 0 || r.Events != len(evs) {
+		t.Fatalf("the migrated database has problems:\n%s", r)
+	}
+	// the timed scans find the events again.
+	k, since := evs[0].Kind, evs[0].CreatedAt
+	var expected int
+	for _, ev := range evs {
+		if ev.Kind == k && ev.CreatedAt >= since && !ev.Expired(timeStamp.Now()) {
+			expected++
+		}
+	}
+	var found []*event.E
+	if found, _, err = d.Query(filter.F{Kinds: []int{k}, Since: &since,
+		Limit: filter.IntToPointer(len(evs))}); chk.E(err) || len(found) != expected {
+		t.Fatalf("found %d events of kind %d since %d, expected %d", len(found), k, since,
+			expected)
+	}
+}
+
+func TestD_Reindex(t *testing.T) {
+	d, evs := loadExampleEvents(t, "testrealy-reindex", 200)
+	var err error
+	before := keysWithPrefixes(t, d, derived...)
+	firstSeen := keysWithPrefixes(t, d, prefixes.FirstSeen)
+	// an index key that is lost is restored, and an event that can't be decoded is skipped.
+	corrupt := varint.New()
+	corrupt.FromUint64(1 << 40)
+	if err = d.Update(func(txn *badger.Txn) (err error) {
+		if err = txn.Delete([]byte(before[0])); err != nil {
+			return
+		}
+		return txn.Set(searchPrefix(prefixes.Event, corrupt.Bytes()), []byte("corrupt"))
+	}); chk.E(err) {
+		t.Fatal(err)
+	}
+	var n int
+	if n, err = d.Reindex(); chk.E(err) || n != len(evs) {
+		t.Fatalf("reindexed %d events, expected %d", n, len(evs))
+	}
+	after := keysWithPrefixes(t, d, derived...)
+	if !slices.Equal(after, before) {
+		t.Fatalf("%d index keys after reindexing, expected %d", len(after), len(before))
+	}
+	if keys := keysWithPrefixes(t, d, prefixes.FirstSeen); !slices.Equal(keys, firstSeen) {
+		t.Fatal("reindexing changed the FirstSeen keys")
+	}
+	if c, _, err := d.Count(filter.F{}); chk.E(err) || c != int64(len(evs)) {
+		t.Fatalf("%d events after reindexing, expected %d", c, len(evs))
+	}
+}
@@ -0,0 +1,66 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/dgraph-io/badger/v4"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/database/indexes/prefixes"
+	"x.realy.lol/errorf"
+	"x.realy.lol/filter"
+	"x.realy.lol/timestamp"
+)
+
+// Mirror is an upstream relay, the events it has that match the filters are copied to this
+// relay.
+type Mirror struct {
+	URL     string   `json:"url"`
+	Filters filter.S `json:"filters"`
+}
+
+// Validate checks that the URL is a websocket URL and that there are filters.
+func (m *Mirror) Validate() (err error) {
+	if !strings.HasPrefix(m.URL, "ws://") && !strings.HasPrefix(m.URL, "wss://") {
+		return errorf.E("invalid mirror url: %s", m.URL)
+	}
+	if len(m.Filters) == 0 {
+		return errorf.E("mirror %s has no filters", m.URL)
+	}
+	return
+}
+
+// MirrorCursors returns the since cursors of the filters mirrored from an upstream relay,
+// keyed by the JSON of each filter. Filters that have not been mirrored have no cursor.
+func (d *D) MirrorCursors(url string) (cursors map[string]timestamp.Timestamp, err error) {
+	cursors = make(map[string]timestamp.Timestamp)
+	var b []byte
+	if err = d.View(func(txn *badger.Txn) (err error) {
+		var item *badger.Item
+		if item, err = txn.Get(searchPrefix(prefixes.MirrorCursor, []byte(url))); err != nil {
+			return
+		}
+		b, err = item.ValueCopy(nil)
+		return
+	}); err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			err = nil
+		}
+		return
+	}
+	if err = json.Unmarshal(b, &cursors); chk.E(err) {
+		return
+	}
+	return
+}
+
+// SetMirrorCursors stores the since cursors of the filters mirrored from an upstream relay.
+func (d *D) SetMirrorCursors(url string, cursors map[string]timestamp.Timestamp) (err error) {
+	var b []byte
+	if b, err = json.Marshal(cursors); chk.E(err) {
+		return
+	}
+	return d.Set(searchPrefix(prefixes.MirrorCursor, []byte(url)), b)
+}
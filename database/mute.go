@@ -0,0 +1,213 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/dgraph-io/badger/v4"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/database/indexes"
+	"x.realy.lol/database/indexes/prefixes"
+	"x.realy.lol/database/indexes/types/pubhash"
+	"x.realy.lol/event"
+	"x.realy.lol/filter"
+	"x.realy.lol/hex"
+	"x.realy.lol/kind"
+)
+
+// MaxMuteSets is the most nip-51 mute sets of a user that are read.
+const MaxMuteSets = 100
+
+// Mutes are the pubkeys, hashtags, words and threads a user has muted in the public tags of
+// their nip-51 mute list and mute sets. Private mutes are encrypted to the user, so the relay
+// can't read them. Hashtags are matched exactly, as they are indexed, nip-24 has them in
+// lowercase. Words are matched in lowercase.
+type Mutes struct {
+	Pubkeys  []string
+	Hashtags []string
+	Words    []string
+	Threads  []string
+}
+
+// Empty returns true if nothing is muted.
+func (m *Mutes) Empty() bool {
+	return len(m.Pubkeys)+len(m.Hashtags)+len(m.Words)+len(m.Threads) == 0
+}
+
+// Mutes reads the newest kind 10000 mute list and the kind 30007 mute sets of a hex pubkey.
+func (d *D) Mutes(viewer string) (m *Mutes, err error) {
+	m = &Mutes{}
+	for _, f := range []filter.F{
+		{Kinds: []int{kind.MuteList}, Authors: []string{viewer}, Limit: filter.IntToPointer(1)},
+		{Kinds: []int{kind.MuteSets}, Authors: []string{viewer},
+			Limit: filter.IntToPointer(MaxMuteSets)},
+	} {
+		var evs []*event.E
+		if evs, _, err = d.Query(f); chk.E(err) {
+			return
+		}
+		for _, ev := range evs {
+			for _, t := range ev.Tags {
+				switch t.Key() {
+				case "p":
+					m.Pubkeys = append(m.Pubkeys, t.Value())
+				case "t":
+					m.Hashtags = append(m.Hashtags, t.Value())
+				case "word":
+					m.Words = append(m.Words, strings.ToLower(t.Value()))
+				case "e":
+					m.Threads = append(m.Threads, t.Value())
+				}
+			}
+		}
+	}
+	return
+}
+
+// Muted returns true if an event is by a muted pubkey, has a muted hashtag or word, or is in a
+// muted thread. It is used for events that are not read from the database, such as new events
+// sent to subscriptions.
+func (m *Mutes) Muted(ev *event.E) bool {
+	if slices.Contains(m.Pubkeys, ev.Pubkey) || slices.Contains(m.Threads, ev.Id) {
+		return true
+	}
+	for _, t := range ev.Tags {
+		switch t.Key() {
+		case "t":
+			if slices.Contains(m.Hashtags, t.Value()) {
+				return true
+			}
+		case "e":
+			if slices.Contains(m.Threads, t.Value()) {
+				return true
+			}
+		}
+	}
+	return len(m.Words) > 0 && kind.IsText(ev.Kind) && m.mutedWords(ev.Content)
+}
+
+// mutedWords returns true if the content of an event has a muted word or phrase. As on the
+// fulltext index, a phrase matches if the content has all of its words.
+func (m *Mutes) mutedWords(content string) bool {
+	words := make(map[string]struct{})
+	for _, w := range strings.FieldsFunc(strings.ToLower(content), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}) {
+		words[w] = struct{}{}
+	}
+phrases:
+	for _, phrase := range m.Words {
+		fields := strings.Fields(phrase)
+		for _, w := range fields {
+			if _, ok := words[w]; !ok {
+				continue phrases
+			}
+		}
+		if len(fields) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// MuteRule returns an IndexRule that drops the events a hex pubkey has muted, see Mutes. The
+// pubkeys are compared with the pubkey hash of the FullIndex, and the muted hashtags and
+// threads are looked up on the tag indexes for each event the query finds. Only the events of
+// text kinds are decoded, to check their content for muted words when there are any. It
+// returns nil if nothing is muted.
+func (d *D) MuteRule(viewer string) (rule IndexRule, err error) {
+	var m *Mutes
+	if m, err = d.Mutes(viewer); chk.E(err) {
+		return
+	}
+	return d.MuteRuleOf(m)
+}
+
+// MuteRuleOf returns the IndexRule of mutes that were already read, see MuteRule.
+func (d *D) MuteRuleOf(m *Mutes) (rule IndexRule, err error) {
+	if m.Empty() {
+		return
+	}
+	var authors []*pubhash.T
+	for _, pk := range m.Pubkeys {
+		ph := pubhash.New()
+		if err = ph.FromPubkeyHex(pk); err != nil {
+			err = nil
+			continue
+		}
+		authors = append(authors, ph)
+	}
+	var paths []*Path
+	if len(m.Hashtags) > 0 {
+		paths = append(paths, tagPath("t", m.Hashtags))
+	}
+	if len(m.Threads) > 0 {
+		paths = append(paths, tagPath("e", m.Threads))
+	}
+	threads := make(map[string]struct{}, len(m.Threads))
+	for _, id := range m.Threads {
+		if b, e := hex.Dec(id); e == nil {
+			threads[string(b)] = struct{}{}
+		}
+	}
+	exclude := ExcludeAuthors(authors)
+	rule = func(fi *indexes.FullIndex) (keep bool) {
+		if _, ok := threads[string(fi.Id.Bytes())]; ok {
+			return false
+		}
+		if !exclude(fi) {
+			return false
+		}
+		words := len(m.Words) > 0 && kind.IsText(fi.Kind.ToKind())
+		if len(paths) == 0 && !words {
+			return true
+		}
+		muted, err := d.muted(fi, paths, m, words)
+		if chk.E(err) {
+			return true
+		}
+		return !muted
+	}
+	return
+}
+
+// muted returns true if an event has a key under one of the tag index paths of the muted
+// hashtags and threads, or if words is true, a muted word in its content.
+func (d *D) muted(fi *indexes.FullIndex, paths []*Path, m *Mutes, words bool) (muted bool,
+	err error) {
+
+	err = d.View(func(txn *badger.Txn) (err error) {
+		ser := fi.Ser.Bytes()
+		for _, p := range paths {
+			if muted, err = inPath(txn, p, ser); err != nil || muted {
+				return
+			}
+		}
+		if !words {
+			return
+		}
+		var item *badger.Item
+		if item, err = txn.Get(searchPrefix(prefixes.Event, ser)); err != nil {
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				// the event was deleted after the index was read.
+				err = nil
+			}
+			return
+		}
+		var val []byte
+		if val, err = item.ValueCopy(nil); chk.E(err) {
+			return
+		}
+		ev := event.New()
+		if err = ev.UnmarshalRead(bytes.NewBuffer(val)); chk.E(err) {
+			return
+		}
+		muted = m.mutedWords(ev.Content)
+		return
+	})
+	return
+}
@@ -0,0 +1,96 @@
+package database
+
+import (
+	"testing"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/event"
+	"x.realy.lol/filter"
+	"x.realy.lol/hex"
+	"x.realy.lol/kind"
+	"x.realy.lol/p256k"
+	"x.realy.lol/tags"
+	"x.realy.lol/timestamp"
+)
+
+func TestD_MuteRule(t *testing.T) {
+	d, _ := loadExampleEvents(t, "testrealy-mute", 1)
+	var err error
+	keys := make([]*p256k.Signer, 3)
+	for i := range keys {
+		keys[i] = &p256k.Signer{}
+		if err = keys[i].Generate(); chk.E(err) {
+			t.Fatal(err)
+		}
+	}
+	viewer, author, muted := keys[0], keys[1], keys[2]
+	var i int
+	store := func(sign *p256k.Signer, k int, content string, tt tags.Tags) (ev *event.E) {
+		i++
+		ev = event.New()
+		ev.Kind = k
+		ev.CreatedAt = timestamp.Now() - timestamp.Timestamp(100-i)
+		ev.Content = content
+		ev.Tags = tt
+		if err = ev.Sign(sign); chk.E(err) {
+			t.Fatal(err)
+		}
+		if err = d.StoreEvent(ev); chk.E(err) {
+			t.Fatal(err)
+		}
+		return
+	}
+	root := store(author, kind.TextNote, "a thread", nil)
+	evs := []*event.E{
+		store(author, kind.TextNote, "shown", nil),
+		store(muted, kind.TextNote, "by a muted author", nil),
+		store(author, kind.TextNote, "with a muted hashtag", tags.Tags{{"t", "spam"}}),
+		store(author, kind.TextNote, "with a muted Crypto word", nil),
+		store(author, kind.TextNote, "in a muted thread", tags.Tags{{"e", root.Id}}),
+		store(author, kind.TextNote, "has only muted in it", nil),
+	}
+	store(viewer, kind.MuteList, "", tags.Tags{{"p", hex.Enc(muted.Pub())}, {"t", "spam"},
+		{"word", "crypto"}})
+	store(viewer, kind.MuteSets, "", tags.Tags{{"d", "threads"}, {"e", root.Id},
+		{"word", "muted phrase"}})
+	var rule IndexRule
+	if rule, err = d.MuteRule(hex.Enc(author.Pub())); chk.E(err) || rule != nil {
+		t.Fatal("expected no rule for a user with no mutes")
+	}
+	if rule, err = d.MuteRule(hex.Enc(viewer.Pub())); chk.E(err) {
+		t.Fatal(err)
+	}
+	var got []*event.E
+	if got, _, err = d.Query(filter.F{Kinds: []int{kind.TextNote},
+		Authors: []string{hex.Enc(author.Pub()), hex.Enc(muted.Pub())}}, rule); chk.E(err) {
+		t.Fatal(err)
+	}
+	shown := map[string]bool{evs[0].Id: true, evs[5].Id: true}
+	if len(got) != len(shown) {
+		for _, ev := range got {
+			t.Log(ev.Content)
+		}
+		t.Fatalf("expected %d events, got %d", len(shown), len(got))
+	}
+	for _, ev := range got {
+		if !shown[ev.Id] {
+			t.Errorf("muted event returned: %s", ev.Content)
+		}
+	}
+	// the rule checks the events a query finds, so it applies to those stored after it.
+	store(author, kind.TextNote, "later, with a muted hashtag", tags.Tags{{"t", "spam"}})
+	if got, _, err = d.Query(filter.F{Kinds: []int{kind.TextNote},
+		Authors: []string{hex.Enc(author.Pub())}}, rule); chk.E(err) || len(got) != len(shown) {
+		t.Fatalf("expected %d events after a muted one was stored, got %d", len(shown), len(got))
+	}
+	// the events that aren't read from the database are matched the same way.
+	var m *Mutes
+	if m, err = d.Mutes(hex.Enc(viewer.Pub())); chk.E(err) {
+		t.Fatal(err)
+	}
+	for _, ev := range append(evs, root) {
+		if m.Muted(ev) == shown[ev.Id] {
+			t.Errorf("event %q muted is %v", ev.Content, m.Muted(ev))
+		}
+	}
+}
@@ -0,0 +1,491 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/database/indexes"
+	"x.realy.lol/database/indexes/prefixes"
+	"x.realy.lol/database/indexes/types/identHash"
+	"x.realy.lol/database/indexes/types/idhash"
+	"x.realy.lol/database/indexes/types/kindidx"
+	"x.realy.lol/database/indexes/types/letter"
+	"x.realy.lol/database/indexes/types/prefix"
+	"x.realy.lol/database/indexes/types/pubhash"
+	ts "x.realy.lol/database/indexes/types/timestamp"
+	"x.realy.lol/filter"
+	"x.realy.lol/hex"
+	"x.realy.lol/timestamp"
+)
+
+// DefaultLimit is the most results a query returns, when the filter has no limit or a larger
+// one.
+const DefaultLimit = 10000
+
+// Path is a candidate index that can be scanned to find the events matching a filter.
+type Path struct {
+	// Index is the prefixes constant of the index that is scanned.
+	Index int
+	// Label names the filter fields the path covers.
+	Label string
+	// Prefixes are the search prefixes that are scanned, one for each value of the fields.
+	Prefixes [][]byte
+	// Timed is true when the keys of the index have a created_at after the search prefix, so
+	// the scan can be bounded by since and until, and it returns the newest events first.
+	Timed bool
+	// Cost is the estimated number of keys that will be scanned.
+	Cost int64
+}
+
+// Plan is the query plan for a filter. The cheapest of the Candidates is the Driving path, and
+// every serial it yields is checked against the rest of the filter using the FullIndex and
+// point lookups on the tag indexes, so the events do not need to be decoded.
+type Plan struct {
+	Filter     filter.F
+	Since      timestamp.Timestamp
+	Until      timestamp.Timestamp
+	Limit      int
+	Candidates []*Path
+	Driving    *Path
+	// Residual are the fields of the filter that are checked for each serial found by the
+	// Driving path.
+	Residual []string
+	// Rules are checked for each serial that matches the filter, and only those they all keep
+	// are returned. Nil rules keep everything.
+	Rules []IndexRule
+
+	ids     map[string]struct{}
+	authors map[string]struct{}
+	kinds   map[int]struct{}
+	tags    []*Path
+	cursor  *filter.Cursor
+	// expired are the serials of the events that have expired, but are not yet deleted.
+	expired map[string]struct{}
+}
+
+// Plan estimates the cost of each index that can be used to search for a filter and chooses
+// the cheapest to drive the query.
+func (d *D) Plan(f filter.F) (p *Plan, err error) {
+	p = &Plan{Filter: f, Since: 0, Until: math.MaxInt64, Limit: DefaultLimit}
+	if f.Since != nil {
+		p.Since = *f.Since
+	}
+	if f.Until != nil {
+		p.Until = *f.Until
+	}
+	if f.Limit != nil && *f.Limit < DefaultLimit {
+		p.Limit = *f.Limit
+	}
+	if p.expired, err = d.expiredSerials(timestamp.Now()); chk.E(err) {
+		return
+	}
+	if f.Cursor != nil {
+		// nothing newer than the cursor can be in the page.
+		p.cursor = f.Cursor
+		if p.cursor.CreatedAt < p.Until {
+			p.Until = p.cursor.CreatedAt
+		}
+	}
+	var pubhashes [][]byte
+	if len(f.Authors) > 0 {
+		p.authors = make(map[string]struct{})
+		for _, a := range f.Authors {
+			ph := pubhash.New()
+			if err = ph.FromPubkeyHex(a); err != nil {
+				// invalid authors can't match anything
+				err = nil
+				continue
+			}
+			p.authors[string(ph.Bytes())] = struct{}{}
+			pubhashes = append(pubhashes, ph.Bytes())
+		}
+	}
+	if len(f.Kinds) > 0 {
+		p.kinds = make(map[int]struct{})
+		for _, k := range f.Kinds {
+			p.kinds[k] = struct{}{}
+		}
+	}
+	if len(f.Ids) > 0 {
+		p.ids = make(map[string]struct{})
+		path := &Path{Index: prefixes.Id, Label: "ids"}
+		for _, v := range f.Ids {
+			var id []byte
+			if id, err = hex.Dec(v); err != nil || len(id) != 32 {
+				err = nil
+				continue
+			}
+			p.ids[string(id)] = struct{}{}
+			ih := idhash.New()
+			if err = ih.FromId(id); chk.E(err) {
+				err = nil
+				continue
+			}
+			path.Prefixes = append(path.Prefixes, searchPrefix(prefixes.Id, ih.Bytes()))
+		}
+		p.Candidates = append(p.Candidates, path)
+	}
+	if p.kinds != nil && p.authors != nil {
+		path := &Path{Index: prefixes.KindPubkeyCreatedAt, Label: "kinds authors", Timed: true}
+		for _, k := range f.Kinds {
+			for _, ph := range pubhashes {
+				path.Prefixes = append(path.Prefixes,
+					searchPrefix(prefixes.KindPubkeyCreatedAt, kindidx.FromKind(k).Bytes(), ph))
+			}
+		}
+		p.Candidates = append(p.Candidates, path)
+	}
+	if p.kinds != nil {
+		path := &Path{Index: prefixes.KindCreatedAt, Label: "kinds", Timed: true}
+		for _, k := range f.Kinds {
+			path.Prefixes = append(path.Prefixes,
+				searchPrefix(prefixes.KindCreatedAt, kindidx.FromKind(k).Bytes()))
+		}
+		p.Candidates = append(p.Candidates, path)
+	}
+	if p.authors != nil {
+		path := &Path{Index: prefixes.PubkeyCreatedAt, Label: "authors", Timed: true}
+		for _, ph := range pubhashes {
+			path.Prefixes = append(path.Prefixes, searchPrefix(prefixes.PubkeyCreatedAt, ph))
+		}
+		p.Candidates = append(p.Candidates, path)
+	}
+	// iterate the tags in a stable order so plans are repeatable.
+	var tagKeys []string
+	for k := range f.Tags {
+		tagKeys = append(tagKeys, k)
+	}
+	sort.Strings(tagKeys)
+	for _, k := range tagKeys {
+		path := tagPath(k, f.Tags[k])
+		p.tags = append(p.tags, path)
+		p.Candidates = append(p.Candidates, path)
+	}
+	// created_at is always a candidate, it is the only one when the filter has no fields.
+	p.Candidates = append(p.Candidates, &Path{Index: prefixes.CreatedAt, Label: "created_at",
+		Prefixes: [][]byte{searchPrefix(prefixes.CreatedAt)}, Timed: true})
+	for _, path := range p.Candidates {
+		for _, prf := range path.Prefixes {
+			var n int64
+			if n, err = d.Cardinality(prf); chk.E(err) {
+				return
+			}
+			path.Cost += n
+		}
+	}
+	// candidates are appended in order of preference, which breaks ties.
+	sort.SliceStable(p.Candidates, func(i, j int) bool {
+		return p.Candidates[i].Cost < p.Candidates[j].Cost
+	})
+	p.Driving = p.Candidates[0]
+	if p.ids != nil && p.Driving.Index != prefixes.Id {
+		p.Residual = append(p.Residual, "ids")
+	}
+	if p.kinds != nil && p.Driving.Index != prefixes.KindCreatedAt &&
+		p.Driving.Index != prefixes.KindPubkeyCreatedAt {
+		p.Residual = append(p.Residual, "kinds")
+	}
+	if p.authors != nil && p.Driving.Index != prefixes.PubkeyCreatedAt &&
+		p.Driving.Index != prefixes.KindPubkeyCreatedAt {
+		p.Residual = append(p.Residual, "authors")
+	}
+	if (f.Since != nil || f.Until != nil) && !p.Driving.Timed {
+		p.Residual = append(p.Residual, "created_at")
+	}
+	for _, t := range p.tags {
+		if t != p.Driving {
+			p.Residual = append(p.Residual, t.Label)
+		}
+	}
+	if p.cursor != nil {
+		p.Residual = append(p.Residual, "cursor")
+	}
+	return
+}
+
+// Explain returns a description of the query plan for a filter, for debugging slow queries.
+func (d *D) Explain(f filter.F) (s string, err error) {
+	var p *Plan
+	if p, err = d.Plan(f); chk.E(err) {
+		return
+	}
+	s = p.String()
+	return
+}
+
+func (p *Plan) String() string {
+	b := new(strings.Builder)
+	fmt.Fprintf(b, "filter: %s\n", p.Filter.String())
+	fmt.Fprintf(b, "since: %d until: %d limit: %d\n", p.Since, p.Until, p.Limit)
+	fmt.Fprintf(b, "candidates:\n")
+	for _, c := range p.Candidates {
+		var mark string
+		if c == p.Driving {
+			mark = " <- driving"
+		}
+		fmt.Fprintf(b, "  %s %-16s prefixes: %-4d cost: %d%s\n",
+			prefixes.Prefix(c.Index), c.Label, len(c.Prefixes), c.Cost, mark)
+	}
+	fmt.Fprintf(b, "residual: %s\n", strings.Join(p.Residual, ", "))
+	return b.String()
+}
+
+// Execute scans the driving path of a plan and returns the FullIndex of the matching events,
+// newest first, and then by descending serial for events with the same created_at, up to the
+// limit of the plan.
+func (d *D) Execute(p *Plan) (index []indexes.FullIndex, err error) {
+	start := time.Now()
+	defer func() { d.metrics.queries.Observe(time.Since(start).Seconds(), pathLabel(p.Driving)) }()
+	seen := make(map[string]struct{})
+	if err = d.View(func(txn *badger.Txn) (err error) {
+		for _, prf := range p.Driving.Prefixes {
+			if err = p.scan(txn, prf, seen, p.Limit, nil, func(fi *indexes.FullIndex) {
+				index = append(index, *fi)
+			}); chk.E(err) {
+				return
+			}
+		}
+		return
+	}); chk.E(err) {
+		return
+	}
+	sort.Slice(index, func(i, j int) bool {
+		ci, cj := index[i].CreatedAt.ToTimestamp(), index[j].CreatedAt.ToTimestamp()
+		if ci == cj {
+			return index[i].Ser.ToUint64() > index[j].Ser.ToUint64()
+		}
+		return ci > cj
+	})
+	if len(index) > p.Limit {
+		index = index[:p.Limit]
+	}
+	return
+}
+
+// scan iterates one search prefix of the driving path and calls fn with each match. Serials
+// that are in seen are skipped, unless it is nil. If limit is greater than zero, a timed scan
+// stops when no more matches can be in the newest limit results. If budget is not nil, each
+// key that is read takes one from it, and the scan stops when it goes below zero.
+func (p *Plan) scan(txn *badger.Txn, prf []byte, seen map[string]struct{}, limit int,
+	budget *int, fn func(fi *indexes.FullIndex)) (err error) {
+	opts := badger.IteratorOptions{Prefix: prf, Reverse: p.Driving.Timed}
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	start := prf
+	if p.Driving.Timed {
+		start = timedSeek(prf, p.Until)
+	}
+	var found int
+	var full bool
+	var boundary timestamp.Timestamp
+	for it.Seek(start); it.ValidForPrefix(prf); it.Next() {
+		if budget != nil {
+			if *budget--; *budget < 0 {
+				return
+			}
+		}
+		key := it.Item().Key()
+		rest := key[len(prf):]
+		if p.Driving.Timed {
+			if len(rest) < ts.Len {
+				continue
+			}
+			ca := &ts.T{}
+			if err = ca.UnmarshalRead(bytes.NewBuffer(rest)); chk.E(err) {
+				return
+			}
+			if ca.ToTimestamp() < p.Since || (full && ca.ToTimestamp() != boundary) {
+				break
+			}
+			if ca.ToTimestamp() > p.Until {
+				continue
+			}
+			rest = rest[ts.Len:]
+		}
+		// the remainder of the key is the serial
+		if seen != nil {
+			if _, ok := seen[string(rest)]; ok {
+				continue
+			}
+			seen[string(rest)] = struct{}{}
+		}
+		var fi *indexes.FullIndex
+		if fi, err = getFullIndex(txn, rest); err != nil {
+			// index without an event, skip it
+			err = nil
+			continue
+		}
+		var ok bool
+		if ok, err = p.matches(txn, fi, rest); chk.E(err) {
+			return
+		}
+		if !ok {
+			continue
+		}
+		fn(fi)
+		found++
+		// timed scans return the newest first, so once the limit is reached this prefix can
+		// only contribute events with the same created_at as the last. serials are not in
+		// numerical order in the keys, so these are all collected and the sort in Execute
+		// decides which are in the result.
+		if p.Driving.Timed && limit > 0 && found >= limit && !full {
+			full = true
+			boundary = fi.CreatedAt.ToTimestamp()
+		}
+	}
+	return
+}
+
+// matches checks the fields of the filter that are not covered by the driving path, and that
+// the event has not expired.
+func (p *Plan) matches(txn *badger.Txn, fi *indexes.FullIndex, ser []byte) (ok bool, err error) {
+	if _, expired := p.expired[string(ser)]; expired {
+		return
+	}
+	if p.ids != nil {
+		if _, ok = p.ids[string(fi.Id.Bytes())]; !ok {
+			return
+		}
+	}
+	if p.authors != nil {
+		if _, ok = p.authors[string(fi.Pubkey.Bytes())]; !ok {
+			return
+		}
+	}
+	if p.kinds != nil {
+		if _, ok = p.kinds[fi.Kind.ToKind()]; !ok {
+			return
+		}
+	}
+	ca := fi.CreatedAt.ToTimestamp()
+	if ca < p.Since || ca > p.Until {
+		return false, nil
+	}
+	if p.cursor != nil && !p.cursor.After(ca, fi.Ser.ToUint64()) {
+		return false, nil
+	}
+	for _, t := range p.tags {
+		if t == p.Driving {
+			continue
+		}
+		if ok, err = inPath(txn, t, ser); err != nil || !ok {
+			return
+		}
+	}
+	for _, rule := range p.Rules {
+		if rule != nil && !rule(fi) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// inPath returns true if an encoded serial is under one of the search prefixes of a path.
+func inPath(txn *badger.Txn, path *Path, ser []byte) (ok bool, err error) {
+	for _, prf := range path.Prefixes {
+		if _, err = txn.Get(append(append([]byte{}, prf...), ser...)); err == nil {
+			return true, nil
+		} else if err != badger.ErrKeyNotFound {
+			return
+		}
+		err = nil
+	}
+	return
+}
+
+// getFullIndex fetches the FullIndex of the event with the given encoded serial.
+func getFullIndex(txn *badger.Txn, ser []byte) (fi *indexes.FullIndex, err error) {
+	prf := searchPrefix(prefixes.FullIndex, ser)
+	it := txn.NewIterator(badger.IteratorOptions{Prefix: prf})
+	defer it.Close()
+	for it.Seek(prf); it.ValidForPrefix(prf); {
+		s, t, pk, k, c := indexes.FullIndexVars()
+		if err = indexes.FullIndexDec(s, t, pk, k, c).UnmarshalRead(
+			bytes.NewBuffer(it.Item().KeyCopy(nil))); chk.E(err) {
+			return
+		}
+		fi = &indexes.FullIndex{Ser: s, Id: t, Pubkey: pk, Kind: k, CreatedAt: c}
+		return
+	}
+	err = badger.ErrKeyNotFound
+	return
+}
+
+// tagPath creates the candidate path for the values of a tag in a filter. The key may have
+// the # prefix used in the JSON encoding of filters.
+func tagPath(key string, values []string) (path *Path) {
+	k := strings.TrimPrefix(key, "#")
+	path = &Path{Label: "#" + k}
+	isLetter := len(k) == 1 && ((k[0] >= 'a' && k[0] <= 'z') || (k[0] >= 'A' && k[0] <= 'Z'))
+	for _, v := range values {
+		var prf []byte
+		switch {
+		case k == "e":
+			path.Index = prefixes.TagEvent
+			ih := idhash.New()
+			if err := ih.FromIdHex(v); err != nil {
+				continue
+			}
+			prf = searchPrefix(prefixes.TagEvent, ih.Bytes())
+		case k == "p":
+			path.Index = prefixes.TagPubkey
+			ph := pubhash.New()
+			if err := ph.FromPubkeyHex(v); err != nil {
+				continue
+			}
+			prf = searchPrefix(prefixes.TagPubkey, ph.Bytes())
+		case k == "t":
+			path.Index = prefixes.TagHashtag
+			ht := identhash.New()
+			_ = ht.FromIdent([]byte(v))
+			prf = searchPrefix(prefixes.TagHashtag, ht.Bytes())
+		case k == "d":
+			path.Index = prefixes.TagIdentifier
+			dt := identhash.New()
+			_ = dt.FromIdent([]byte(v))
+			prf = searchPrefix(prefixes.TagIdentifier, dt.Bytes())
+		case isLetter:
+			path.Index = prefixes.TagLetter
+			val := identhash.New()
+			_ = val.FromIdent([]byte(v))
+			prf = searchPrefix(prefixes.TagLetter, []byte{letter.New(k[0]).Letter()}, val.Bytes())
+		default:
+			path.Index = prefixes.TagNonstandard
+			nk, nv := identhash.New(), identhash.New()
+			_ = nk.FromIdent([]byte(k))
+			_ = nv.FromIdent([]byte(v))
+			prf = searchPrefix(prefixes.TagNonstandard, nk.Bytes(), nv.Bytes())
+		}
+		path.Prefixes = append(path.Prefixes, prf)
+	}
+	return
+}
+
+// searchPrefix concatenates an index prefix and the encoded fields that follow it.
+func searchPrefix(prf int, fields ...[]byte) (b []byte) {
+	b = append(b, prefix.New(prf).Bytes()...)
+	for _, f := range fields {
+		b = append(b, f...)
+	}
+	return
+}
+
+// timedSeek returns the key to seek to for a reverse scan of a timed search prefix, which is
+// after every key with a created_at at or before until.
+func timedSeek(prf []byte, until timestamp.Timestamp) (start []byte) {
+	if until >= math.MaxInt64-1 {
+		return append(append([]byte{}, prf...), bytes.Repeat([]byte{0xff}, ts.Len+1)...)
+	}
+	after := &ts.T{}
+	after.FromInt64(until.ToInt64() + 1)
+	buf := bytes.NewBuffer(append([]byte{}, prf...))
+	_ = after.MarshalWrite(buf)
+	return buf.Bytes()
+}
@@ -0,0 +1,178 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/database/indexes"
+	"x.realy.lol/database/indexes/prefixes"
+	"x.realy.lol/event"
+	"x.realy.lol/filter"
+	"x.realy.lol/hex"
+	"x.realy.lol/log"
+	"x.realy.lol/timestamp"
+)
+
+// loadExampleEvents stores up to max of the ExampleEvents in a fresh database, and returns the
+// events that were stored.
+func loadExampleEvents(t *testing.T, name string, max int) (d *D, evs []*event.E) {
+	var err error
+	d = New()
+	tmpDir := filepath.Join(os.TempDir(), name)
+	os.RemoveAll(tmpDir)
+	if err = d.Init(tmpDir); chk.E(err) {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		d.Close()
+		os.RemoveAll(tmpDir)
+	})
+	scan := bufio.NewScanner(bytes.NewBuffer(ExampleEvents))
+	scan.Buffer(make([]byte, 5120000), 5120000)
+	for scan.Scan() {
+		ev := event.New()
+		if err = ev.Unmarshal(scan.Bytes()); chk.E(err) {
+			continue
+		}
+		if err = d.StoreEvent(ev); err != nil {
+			continue
+		}
+		evs = append(evs, ev)
+		if len(evs) >= max {
+			break
+		}
+	}
+	return
+}
+
+func TestD_Plan(t *testing.T) {
+	d, evs := loadExampleEvents(t, "testrealy-planner", 1000)
+	var err error
+	// pick some fields that appear in the stored events to search for.
+	var author, pTag, eTag, tTag string
+	for _, ev := range evs {
+		if author == "" && ev.Kind == 1 {
+			author = ev.Pubkey
+		}
+		for _, tg := range ev.Tags {
+			switch {
+			case pTag == "" && tg.Key() == "p":
+				pTag = tg.Value()
+			case eTag == "" && tg.Key() == "e":
+				eTag = tg.Value()
+			case tTag == "" && tg.Key() == "t":
+				tTag = tg.Value()
+			}
+		}
+	}
+	since, until := timestamp.Timestamp(0), timestamp.Now()
+	for _, ev := range evs[:100] {
+		if ev.CreatedAt > since {
+			since = ev.CreatedAt
+		}
+	}
+	until, since = since, since-100000
+	filters := []filter.F{
+		{Kinds: []int{1}},
+		{Authors: []string{author}},
+		{Kinds: []int{1, 7}, Authors: []string{author}},
+		{Tags: filter.TagMap{"p": {pTag}}},
+		{Tags: filter.TagMap{"#e": {eTag}}},
+		{Tags: filter.TagMap{"t": {tTag}}, Kinds: []int{1}},
+		{Tags: filter.TagMap{"t": {tTag}}, Kinds: []int{1, 7}, Authors: []string{author}},
+		{Tags: filter.TagMap{"t": {tTag}, "p": {pTag}}},
+		{Since: &since, Until: &until},
+		{Kinds: []int{7}, Since: &since},
+		{Ids: []string{evs[3].Id, evs[5].Id}},
+		{Ids: []string{evs[3].Id}, Kinds: []int{evs[3].Kind + 1}},
+		{},
+	}
+	for _, f := range filters {
+		var p *Plan
+		if p, err = d.Plan(f); chk.E(err) {
+			t.Fatal(err)
+		}
+		log.I.F("\n%s", p)
+		var expected []string
+		for _, ev := range evs {
+			mf := f
+			// filter.F matches tags without the # prefix
+			mf.Tags = filter.TagMap{}
+			for k, v := range f.Tags {
+				mf.Tags[k[len(k)-1:]] = v
+			}
+			if mf.Matches(ev) {
+				expected = append(expected, ev.Id)
+			}
+		}
+		sers, err := d.Filter(f)
+		if chk.E(err) {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, ser := range sers {
+			var id []byte
+			if id, err = d.GetEventIdFromSerial(ser); chk.E(err) {
+				t.Fatal(err)
+			}
+			got = append(got, hex.Enc(id))
+		}
+		if len(got) != len(expected) {
+			t.Fatalf("expected %d results, got %d\n%s", len(expected), len(got), p)
+		}
+		sort.Strings(got)
+		sort.Strings(expected)
+		for i := range got {
+			if got[i] != expected[i] {
+				t.Fatalf("result %d: expected %s got %s\n%s", i, expected[i], got[i], p)
+			}
+		}
+	}
+}
+
+func TestD_PlanChoosesCheapestPath(t *testing.T) {
+	d, evs := loadExampleEvents(t, "testrealy-planner-cost", 500)
+	var err error
+	var eTag string
+	for _, ev := range evs {
+		if tg := ev.Tags.GetFirst([]string{"e"}); tg != nil {
+			eTag = tg.Value()
+			break
+		}
+	}
+	var p *Plan
+	// a single event reference is far more selective than a common kind.
+	if p, err = d.Plan(filter.F{Kinds: []int{1}, Tags: filter.TagMap{"e": {eTag}}}); chk.E(err) {
+		t.Fatal(err)
+	}
+	if p.Driving.Index != prefixes.TagEvent {
+		t.Fatalf("expected the e tag index to drive the query\n%s", p)
+	}
+	if len(p.Residual) != 1 || p.Residual[0] != "kinds" {
+		t.Fatalf("expected kinds to be a residual constraint\n%s", p)
+	}
+	// filters with no fields scan created_at
+	if p, err = d.Plan(filter.F{Limit: filter.IntToPointer(10)}); chk.E(err) {
+		t.Fatal(err)
+	}
+	if p.Driving.Index != prefixes.CreatedAt {
+		t.Fatalf("expected created_at to drive the query\n%s", p)
+	}
+	var index []indexes.FullIndex
+	if index, err = d.Execute(p); chk.E(err) {
+		t.Fatal(err)
+	}
+	if len(index) != 10 {
+		t.Fatalf("expected 10 results, got %d", len(index))
+	}
+	for i := 1; i < len(index); i++ {
+		if index[i].CreatedAt.ToTimestamp() > index[i-1].CreatedAt.ToTimestamp() {
+			t.Fatal("results are not in reverse chronological order")
+		}
+	}
+}
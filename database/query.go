@@ -0,0 +1,43 @@
+package database
+
+import (
+	"x.realy.lol/chk"
+	"x.realy.lol/database/indexes"
+	"x.realy.lol/database/indexes/types/varint"
+	"x.realy.lol/event"
+	"x.realy.lol/filter"
+)
+
+// Query runs a filter and returns the matching events in the order of the results of Execute,
+// which skips events that have expired and are yet to be deleted by the reaper. The returned
+// events are recorded as accessed, for garbage collection. Only the events that all the rules
+// keep are returned, see Filter. If the page of results is full, next is the cursor that
+// resumes the query after the last event, otherwise there are no more results and it is nil.
+func (d *D) Query(f filter.F, rules ...IndexRule) (evs []*event.E, next *filter.Cursor, err error) {
+	var p *Plan
+	if p, err = d.Plan(f); chk.E(err) {
+		return
+	}
+	p.Rules = rules
+	var index []indexes.FullIndex
+	if index, err = d.Execute(p); chk.E(err) {
+		return
+	}
+	var accessed []*varint.V
+	for _, fi := range index {
+		var ev *event.E
+		if ev, err = d.GetEventFromSerial(fi.Ser); err != nil {
+			// the event was deleted after the index was read.
+			err = nil
+			continue
+		}
+		evs = append(evs, ev)
+		accessed = append(accessed, fi.Ser)
+	}
+	d.recordAccess(accessed)
+	if len(index) > 0 && len(index) >= p.Limit {
+		last := index[len(index)-1]
+		next = &filter.Cursor{CreatedAt: last.CreatedAt.ToTimestamp(), Serial: last.Ser.ToUint64()}
+	}
+	return
+}
@@ -0,0 +1,107 @@
+package database
+
+import (
+	"testing"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/database/indexes/types/pubhash"
+	"x.realy.lol/event"
+	"x.realy.lol/filter"
+	"x.realy.lol/hex"
+	"x.realy.lol/timestamp"
+)
+
+func TestD_QueryCursor(t *testing.T) {
+	d, evs := loadExampleEvents(t, "testrealy-cursor", 1000)
+	var err error
+	// find the timestamp shared by the most events, so that pages split inside a run of equal
+	// timestamps.
+	counts := make(map[timestamp.Timestamp]int)
+	var tied timestamp.Timestamp
+	for _, ev := range evs {
+		counts[ev.CreatedAt]++
+		if counts[ev.CreatedAt] > counts[tied] {
+			tied = ev.CreatedAt
+		}
+	}
+	if counts[tied] < 3 {
+		t.Skip("example events do not have enough events with the same timestamp")
+	}
+	filters := []filter.F{
+		{Since: &tied, Until: &tied},
+		{Kinds: []int{1}},
+		{Tags: filter.TagMap{"t": {"nostr", "relay"}}},
+	}
+	for _, f := range filters {
+		var expected int
+		for _, ev := range evs {
+			if f.Matches(ev) {
+				expected++
+			}
+		}
+		seen := make(map[string]struct{})
+		f.Limit = filter.IntToPointer(3)
+		var pages int
+		for {
+			var page []*event.E
+			var next *filter.Cursor
+			if page, next, err = d.Query(f); chk.E(err) {
+				t.Fatal(err)
+			}
+			for _, ev := range page {
+				if _, ok := seen[ev.Id]; ok {
+					t.Fatalf("event %s repeated on page %d", ev.Id, pages)
+				}
+				seen[ev.Id] = struct{}{}
+			}
+			pages++
+			if next == nil {
+				break
+			}
+			f.Cursor = next
+		}
+		if len(seen) != expected {
+			t.Fatalf("expected %d events over all pages, got %d in %d pages",
+				expected, len(seen), pages)
+		}
+	}
+}
+
+func TestD_QueryRules(t *testing.T) {
+	d, evs := loadExampleEvents(t, "testrealy-rules", 1000)
+	// exclude the most prolific author of text notes.
+	counts := make(map[string]int)
+	var top string
+	var notes int
+	for _, ev := range evs {
+		if ev.Kind == 1 {
+			notes++
+			counts[ev.Pubkey]++
+			if counts[ev.Pubkey] > counts[top] {
+				top = ev.Pubkey
+			}
+		}
+	}
+	pk, err := hex.Dec(top)
+	if chk.E(err) {
+		t.Fatal(err)
+	}
+	ph := pubhash.New()
+	if err = ph.FromPubkey(pk); chk.E(err) {
+		t.Fatal(err)
+	}
+	f := filter.F{Kinds: []int{1}, Limit: filter.IntToPointer(10)}
+	var got []*event.E
+	if got, _, err = d.Query(f, ExcludeAuthors([]*pubhash.T{ph})); chk.E(err) {
+		t.Fatal(err)
+	}
+	// the excluded events don't count towards the limit.
+	if len(got) != min(10, notes-counts[top]) {
+		t.Fatalf("expected %d events, got %d", min(10, notes-counts[top]), len(got))
+	}
+	for _, ev := range got {
+		if ev.Pubkey == top {
+			t.Fatalf("event %s of an excluded author was returned", ev.Id)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package database
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/dgraph-io/badger/v4"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/database/indexes"
+	"x.realy.lol/database/indexes/prefixes"
+	"x.realy.lol/database/indexes/types/prefix"
+	"x.realy.lol/database/indexes/types/pubhash"
+	"x.realy.lol/errorf"
+	"x.realy.lol/event"
+)
+
+// Usage is the number of events and bytes of binary encoded events stored by a pubkey.
+type Usage struct {
+	Events int64
+	Bytes  int64
+}
+
+// usage is a cache of the Usage of pubkeys. It is computed on first use by scanning the Usage
+// index of the pubkey, and kept current as events are stored and deleted.
+type usage struct {
+	sync.Mutex
+	byPubkey map[string]*Usage
+	// stores serialize the stores of the events of the pubkeys that have a quota, by the
+	// first byte of the pubkey, so each checks the usage after the stores before it.
+	stores [256]sync.Mutex
+}
+
+func newUsage() (u *usage) { return &usage{byPubkey: make(map[string]*Usage)} }
+
+// Quota is the most events and bytes a pubkey can store, a limit of zero is not applied.
+type Quota struct {
+	MaxEvents int64 `json:"max_events,omitempty"`
+	MaxBytes  int64 `json:"max_bytes,omitempty"`
+}
+
+// QuotaPolicy is the Quota that applies to each pubkey, the Allowed quota applies to the
+// pubkeys in the Allowlist, and the Default quota to all others.
+type QuotaPolicy struct {
+	Default   Quota    `json:"default"`
+	Allowed   Quota    `json:"allowed"`
+	Allowlist []string `json:"allowlist,omitempty"`
+}
+
+// Quota returns the quota for a pubkey.
+func (p *QuotaPolicy) Quota(pubkey string) (q Quota) {
+	for _, a := range p.Allowlist {
+		if a == pubkey {
+			return p.Allowed
+		}
+	}
+	return p.Default
+}
+
+// QuotaPolicy returns the quota policy of the configuration in effect.
+func (d *D) QuotaPolicy() (p *QuotaPolicy) {
+	p = &d.Config().clone().Quotas
+	return
+}
+
+// SetQuotaPolicy changes the quota policy of the configuration, which applies to the events
+// that are stored from then on.
+func (d *D) SetQuotaPolicy(p *QuotaPolicy) (err error) {
+	return d.UpdateConfig(func(c *Config) { c.Quotas = *p })
+}
+
+// Usage returns the number of events and bytes stored by a pubkey.
+func (d *D) Usage(pubkey []byte) (u Usage, err error) {
+	ph := pubhash.New()
+	if err = ph.FromPubkey(pubkey); chk.E(err) {
+		return
+	}
+	d.usage.Lock()
+	if c, ok := d.usage.byPubkey[string(ph.Bytes())]; ok {
+		u = *c
+		d.usage.Unlock()
+		return
+	}
+	d.usage.Unlock()
+	prf := searchPrefix(prefixes.Usage, ph.Bytes())
+	if err = d.View(func(txn *badger.Txn) (err error) {
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: prf})
+		defer it.Close()
+		for it.Seek(prf); it.ValidForPrefix(prf); it.Next() {
+			p, ser, size := indexes.UsageVars()
+			if err = indexes.UsageDec(p, ser, size).UnmarshalRead(
+				bytes.NewBuffer(it.Item().KeyCopy(nil))); chk.E(err) {
+				return
+			}
+			u.Events++
+			u.Bytes += int64(size.ToUint64())
+		}
+		return
+	}); chk.E(err) {
+		return
+	}
+	d.usage.Lock()
+	if len(d.usage.byPubkey) >= maxStatsEntries {
+		d.usage.byPubkey = make(map[string]*Usage)
+	}
+	c := u
+	d.usage.byPubkey[string(ph.Bytes())] = &c
+	d.usage.Unlock()
+	return
+}
+
+// updateUsage adjusts the cached usage of the authors of the Usage keys among a set of index
+// keys that have been written (delta 1) or deleted (delta -1).
+func (d *D) updateUsage(keys [][]byte, delta int64) {
+	us := prefix.New(prefixes.Usage).Bytes()
+	d.usage.Lock()
+	defer d.usage.Unlock()
+	for _, k := range keys {
+		if !bytes.HasPrefix(k, us) {
+			continue
+		}
+		p, ser, size := indexes.UsageVars()
+		if err := indexes.UsageDec(p, ser, size).UnmarshalRead(bytes.NewBuffer(k)); chk.E(err) {
+			continue
+		}
+		if c, ok := d.usage.byPubkey[string(p.Bytes())]; ok {
+			c.Events += delta
+			c.Bytes += delta * int64(size.ToUint64())
+		}
+	}
+}
+
+// checkQuota returns an error if storing an event of the given size would exceed the quota
+// of its author. If the author has a quota, the stores of the events of the author are
+// serialized until unlock is called, after the event is stored or refused, so concurrent
+// stores can't exceed the quota together.
+func (d *D) checkQuota(ev *event.E, size int) (unlock func(), err error) {
+	unlock = func() {}
+	q := d.Config().Quotas.Quota(ev.Pubkey)
+	if q.MaxEvents <= 0 && q.MaxBytes <= 0 {
+		return
+	}
+	var pk []byte
+	if pk, err = ev.PubBytes(); chk.E(err) {
+		return
+	}
+	mx := &d.usage.stores[pk[0]]
+	mx.Lock()
+	defer func() {
+		if err != nil {
+			mx.Unlock()
+			return
+		}
+		unlock = mx.Unlock
+	}()
+	var u Usage
+	if u, err = d.Usage(pk); chk.E(err) {
+		return
+	}
+	if q.MaxEvents > 0 && u.Events+1 > q.MaxEvents {
+		err = errorf.E("blocked: storage quota of %d events exceeded", q.MaxEvents)
+		return
+	}
+	if q.MaxBytes > 0 && u.Bytes+int64(size) > q.MaxBytes {
+		err = errorf.E("blocked: storage quota of %d bytes exceeded", q.MaxBytes)
+		return
+	}
+	return
+}
@@ -0,0 +1,136 @@
+package database
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/database/indexes/types/varint"
+	"x.realy.lol/event"
+	"x.realy.lol/filter"
+	"x.realy.lol/hex"
+	"x.realy.lol/kind"
+	"x.realy.lol/p256k"
+	"x.realy.lol/timestamp"
+)
+
+func TestD_Quota(t *testing.T) {
+	d, _ := loadExampleEvents(t, "testrealy-quota", 1)
+	var err error
+	user, allowed := &p256k.Signer{}, &p256k.Signer{}
+	for _, sign := range []*p256k.Signer{user, allowed} {
+		if err = sign.Generate(); chk.E(err) {
+			t.Fatal(err)
+		}
+	}
+	if err = d.SetQuotaPolicy(&QuotaPolicy{
+		Default:   Quota{MaxEvents: 3},
+		Allowed:   Quota{MaxEvents: 5},
+		Allowlist: []string{hex.Enc(allowed.Pub())},
+	}); chk.E(err) {
+		t.Fatal(err)
+	}
+	var i int
+	store := func(sign *p256k.Signer, content string) (ev *event.E, err error) {
+		i++
+		ev = event.New()
+		ev.Kind = kind.TextNote
+		ev.CreatedAt = timestamp.Now() - timestamp.Timestamp(i)
+		ev.Content = content
+		if err = ev.Sign(sign); chk.E(err) {
+			t.Fatal(err)
+		}
+		err = d.StoreEvent(ev)
+		return
+	}
+	for _, c := range []struct {
+		sign   *p256k.Signer
+		stored int
+	}{{user, 3}, {allowed, 5}} {
+		var n int
+		for range 10 {
+			if _, err = store(c.sign, strconv.Itoa(n)); err != nil {
+				if !strings.HasPrefix(err.Error(), "blocked:") {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				continue
+			}
+			n++
+		}
+		if n != c.stored {
+			t.Fatalf("expected %d events to be stored, got %d", c.stored, n)
+		}
+		var u Usage
+		if u, err = d.Usage(c.sign.Pub()); chk.E(err) {
+			t.Fatal(err)
+		}
+		if u.Events != int64(c.stored) || u.Bytes <= 0 {
+			t.Fatalf("unexpected usage %+v", u)
+		}
+	}
+	// deleting an event frees the quota for another.
+	evs, _, err := d.Query(filter.F{Authors: []string{hex.Enc(user.Pub())}})
+	if chk.E(err) {
+		t.Fatal(err)
+	}
+	var ser *varint.V
+	if ser, err = d.FindEventSerialById(evs[0].GetIdBytes()); chk.E(err) {
+		t.Fatal(err)
+	}
+	if err = d.DeleteEvent(ser); chk.E(err) {
+		t.Fatal(err)
+	}
+	if _, err = store(user, "after delete"); chk.E(err) {
+		t.Fatal(err)
+	}
+	// the byte quota counts the binary encoded events.
+	var u Usage
+	if u, err = d.Usage(user.Pub()); chk.E(err) {
+		t.Fatal(err)
+	}
+	if err = d.SetQuotaPolicy(&QuotaPolicy{Default: Quota{MaxBytes: u.Bytes + 250}}); chk.E(err) {
+		t.Fatal(err)
+	}
+	if _, err = store(user, "small"); chk.E(err) {
+		t.Fatal(err)
+	}
+	if _, err = store(user, strings.Repeat("large", 100)); err == nil ||
+		!strings.Contains(err.Error(), "bytes") {
+		t.Fatalf("expected the byte quota to be exceeded, got %v", err)
+	}
+	// concurrent stores don't exceed the quota together.
+	if err = d.SetQuotaPolicy(&QuotaPolicy{Default: Quota{MaxEvents: 3}}); chk.E(err) {
+		t.Fatal(err)
+	}
+	racer := &p256k.Signer{}
+	if err = racer.Generate(); chk.E(err) {
+		t.Fatal(err)
+	}
+	var racing []*event.E
+	for n := range 20 {
+		ev := event.New()
+		ev.Kind, ev.CreatedAt, ev.Content = kind.TextNote, timestamp.Now(), strconv.Itoa(n)
+		if err = ev.Sign(racer); chk.E(err) {
+			t.Fatal(err)
+		}
+		racing = append(racing, ev)
+	}
+	var stored atomic.Int64
+	var wg sync.WaitGroup
+	for _, ev := range racing {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if d.StoreEvent(ev) == nil {
+				stored.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if u, err = d.Usage(racer.Pub()); chk.E(err) || stored.Load() != 3 || u.Events != 3 {
+		t.Fatalf("stored %d events concurrently with usage %+v, expected 3", stored.Load(), u)
+	}
+}
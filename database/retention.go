@@ -0,0 +1,244 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/database/indexes"
+	"x.realy.lol/database/indexes/prefixes"
+	"x.realy.lol/database/indexes/types/kindidx"
+	"x.realy.lol/database/indexes/types/varint"
+	"x.realy.lol/errorf"
+	"x.realy.lol/log"
+	"x.realy.lol/timestamp"
+)
+
+// CompactInterval is how often the compactor applies the retention policy.
+const CompactInterval = time.Hour
+
+// RetentionRule selects events of some kinds to delete, those older than MaxAgeDays, and those
+// beyond the newest MaxPerAuthor events of each author. A limit of zero is not applied.
+type RetentionRule struct {
+	Kinds        []int `json:"kinds"`
+	MaxAgeDays   int   `json:"max_age_days,omitempty"`
+	MaxPerAuthor int   `json:"max_per_author,omitempty"`
+}
+
+func (r RetentionRule) String() (s string) {
+	var limits []string
+	if r.MaxAgeDays > 0 {
+		limits = append(limits, fmt.Sprintf("older than %d days", r.MaxAgeDays))
+	}
+	if r.MaxPerAuthor > 0 {
+		limits = append(limits, fmt.Sprintf("beyond %d per author", r.MaxPerAuthor))
+	}
+	return fmt.Sprintf("kinds %v %s", r.Kinds, strings.Join(limits, " or "))
+}
+
+// RetentionPolicy is the set of rules the compactor deletes events by. If DryRun is set, the
+// compactor only logs what it would delete.
+type RetentionPolicy struct {
+	DryRun bool            `json:"dry_run"`
+	Rules  []RetentionRule `json:"rules"`
+}
+
+// Validate checks that every rule has kinds and a limit.
+func (p *RetentionPolicy) Validate() (err error) {
+	for i, r := range p.Rules {
+		if len(r.Kinds) == 0 {
+			return errorf.E("retention rule %d has no kinds", i)
+		}
+		if r.MaxAgeDays <= 0 && r.MaxPerAuthor <= 0 {
+			return errorf.E("retention rule %d has no limit", i)
+		}
+	}
+	return
+}
+
+// RetentionPolicy returns the retention policy of the configuration in effect.
+func (d *D) RetentionPolicy() (p *RetentionPolicy) {
+	p = &d.Config().clone().Retention
+	return
+}
+
+// SetRetentionPolicy changes the retention policy of the configuration.
+func (d *D) SetRetentionPolicy(p *RetentionPolicy) (err error) {
+	if err = p.Validate(); err != nil {
+		return
+	}
+	return d.UpdateConfig(func(c *Config) { c.Retention = *p })
+}
+
+// CompactReport is the number of events that each rule of a retention policy selected, and
+// how many were deleted, which is none for a dry run.
+type CompactReport struct {
+	DryRun  bool
+	Rules   []RetentionRule
+	Events  []int
+	Deleted int
+}
+
+func (r *CompactReport) String() (s string) {
+	buf := new(strings.Builder)
+	if r.DryRun {
+		buf.WriteString("retention dry run:\n")
+	}
+	for i, rule := range r.Rules {
+		fmt.Fprintf(buf, "%s: %d events\n", rule, r.Events[i])
+	}
+	fmt.Fprintf(buf, "deleted %d events", r.Deleted)
+	return buf.String()
+}
+
+// Compact finds the events that the rules of a retention policy select at the time now, by
+// walking the kind, created_at index for the age limit and the kind, pubkey, created_at index
+// for the per author limit, and deletes them unless dryRun is set.
+func (d *D) Compact(p *RetentionPolicy, now timestamp.Timestamp, dryRun bool) (
+	report *CompactReport, err error) {
+
+	if err = p.Validate(); err != nil {
+		return
+	}
+	report = &CompactReport{DryRun: dryRun, Rules: p.Rules, Events: make([]int, len(p.Rules))}
+	seen := make(map[uint64]struct{})
+	var sers []*varint.V
+	if err = d.View(func(txn *badger.Txn) (err error) {
+		for i, r := range p.Rules {
+			add := func(ser *varint.V) {
+				report.Events[i]++
+				if _, ok := seen[ser.ToUint64()]; !ok {
+					seen[ser.ToUint64()] = struct{}{}
+					sers = append(sers, ser)
+				}
+			}
+			for _, k := range r.Kinds {
+				if r.MaxAgeDays > 0 {
+					cutoff := now - timestamp.Timestamp(r.MaxAgeDays*24*60*60)
+					if err = olderThan(txn, k, cutoff, add); chk.E(err) {
+						return
+					}
+				}
+				if r.MaxPerAuthor > 0 {
+					if err = beyondPerAuthor(txn, k, r.MaxPerAuthor, add); chk.E(err) {
+						return
+					}
+				}
+			}
+		}
+		return
+	}); chk.E(err) {
+		return
+	}
+	if dryRun {
+		return
+	}
+	report.Deleted, err = d.deleteEvents(sers)
+	return
+}
+
+// olderThan calls fn with the serials of the events of a kind created before cutoff.
+func olderThan(txn *badger.Txn, k int, cutoff timestamp.Timestamp, fn func(ser *varint.V)) (err error) {
+	prf := searchPrefix(prefixes.KindCreatedAt, kindidx.FromKind(k).Bytes())
+	it := txn.NewIterator(badger.IteratorOptions{Prefix: prf})
+	defer it.Close()
+	for it.Seek(prf); it.ValidForPrefix(prf); it.Next() {
+		ki, ca, ser := indexes.KindCreatedAtVars()
+		if err = indexes.KindCreatedAtDec(ki, ca, ser).UnmarshalRead(
+			bytes.NewBuffer(it.Item().KeyCopy(nil))); chk.E(err) {
+			return
+		}
+		if ca.ToTimestamp() >= cutoff {
+			return
+		}
+		fn(ser)
+	}
+	return
+}
+
+// beyondPerAuthor calls fn with the serials of the events of a kind that are older than the
+// newest max events of their author. The keys of each author are in time order, so all but the
+// last max of them are selected.
+func beyondPerAuthor(txn *badger.Txn, k int, max int, fn func(ser *varint.V)) (err error) {
+	prf := searchPrefix(prefixes.KindPubkeyCreatedAt, kindidx.FromKind(k).Bytes())
+	it := txn.NewIterator(badger.IteratorOptions{Prefix: prf})
+	defer it.Close()
+	var author []byte
+	var sers []*varint.V
+	flush := func() {
+		for i := 0; i < len(sers)-max; i++ {
+			fn(sers[i])
+		}
+		sers = sers[:0]
+	}
+	for it.Seek(prf); it.ValidForPrefix(prf); it.Next() {
+		ki, p, ca, ser := indexes.KindPubkeyCreatedAtVars()
+		if err = indexes.KindPubkeyCreatedAtDec(ki, p, ca, ser).UnmarshalRead(
+			bytes.NewBuffer(it.Item().KeyCopy(nil))); chk.E(err) {
+			return
+		}
+		if !bytes.Equal(author, p.Bytes()) {
+			flush()
+			author = p.Bytes()
+		}
+		sers = append(sers, ser)
+	}
+	flush()
+	return
+}
+
+// deleteEvents deletes events in batches of ReapBatch in each transaction. Events that were
+// already deleted are skipped. It is the delete path of both the compactor and nip-09
+// deletion requests.
+func (d *D) deleteEvents(sers []*varint.V) (n int, err error) {
+	for len(sers) > 0 {
+		batch := sers[:min(ReapBatch, len(sers))]
+		sers = sers[len(batch):]
+		var keys [][]byte
+		var size int64
+		if err = d.logged(func(txn *badger.Txn) (err error) {
+			for _, ser := range batch {
+				var deleted [][]byte
+				var sz int64
+				if deleted, sz, err = d.deleteEvent(txn, ser); err != nil {
+					if errors.Is(err, badger.ErrKeyNotFound) {
+						err = nil
+						continue
+					}
+					return
+				}
+				keys = append(keys, deleted...)
+				size += sz
+				n++
+			}
+			return
+		}); chk.E(err) {
+			return
+		}
+		d.updateStats(keys, -1)
+		d.addSize(-size)
+	}
+	return
+}
+
+// StartCompactor applies the stored retention policy every interval in the background, so
+// changes to the policy take effect on the next run. It is stopped by an interrupt handler in
+// the same way as StartReaper.
+func (d *D) StartCompactor(interval time.Duration) {
+	d.every(interval, func() {
+		p := d.RetentionPolicy()
+		if len(p.Rules) == 0 {
+			return
+		}
+		report, err := d.Compact(p, timestamp.Now(), p.DryRun)
+		if chk.E(err) {
+			return
+		}
+		log.I.Ln(report)
+	})
+}
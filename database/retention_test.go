@@ -0,0 +1,98 @@
+package database
+
+import (
+	"strconv"
+	"testing"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/event"
+	"x.realy.lol/filter"
+	"x.realy.lol/kind"
+	"x.realy.lol/p256k"
+	"x.realy.lol/timestamp"
+)
+
+func TestD_Compact(t *testing.T) {
+	d, _ := loadExampleEvents(t, "testrealy-retention", 1)
+	var err error
+	now := timestamp.Now()
+	const day = 24 * 60 * 60
+	for range 3 {
+		sign := &p256k.Signer{}
+		if err = sign.Generate(); chk.E(err) {
+			t.Fatal(err)
+		}
+		// a note a day for 10 days, and a reaction every 30 days for 150 days.
+		for i := range 10 {
+			ev := event.New()
+			ev.Kind = kind.TextNote
+			ev.CreatedAt = now - timestamp.Timestamp(i*day)
+			ev.Content = strconv.Itoa(i)
+			if err = ev.Sign(sign); chk.E(err) {
+				t.Fatal(err)
+			}
+			if err = d.StoreEvent(ev); chk.E(err) {
+				t.Fatal(err)
+			}
+		}
+		for i := range 5 {
+			ev := event.New()
+			ev.Kind = kind.Reaction
+			ev.CreatedAt = now - timestamp.Timestamp(i*30*day+1)
+			ev.Content = "+"
+			if err = ev.Sign(sign); chk.E(err) {
+				t.Fatal(err)
+			}
+			if err = d.StoreEvent(ev); chk.E(err) {
+				t.Fatal(err)
+			}
+		}
+	}
+	p := &RetentionPolicy{Rules: []RetentionRule{
+		{Kinds: []int{kind.Reaction}, MaxAgeDays: 90},
+		{Kinds: []int{kind.TextNote}, MaxPerAuthor: 3},
+	}}
+	if err = d.SetRetentionPolicy(p); chk.E(err) {
+		t.Fatal(err)
+	}
+	if p = d.RetentionPolicy(); len(p.Rules) != 2 {
+		t.Fatalf("retention policy was not stored: %v", p)
+	}
+	count := func(k int) (n int) {
+		evs, _, err := d.Query(filter.F{Kinds: []int{k}})
+		if chk.E(err) {
+			t.Fatal(err)
+		}
+		return len(evs)
+	}
+	var report *CompactReport
+	if report, err = d.Compact(p, now, true); chk.E(err) {
+		t.Fatal(err)
+	}
+	// reactions at 90 and 120 days, and 7 of the 10 notes, for each of 3 authors.
+	if report.Events[0] != 6 || report.Events[1] != 21 || report.Deleted != 0 {
+		t.Fatalf("unexpected dry run report:\n%s", report)
+	}
+	if count(kind.Reaction) != 15 || count(kind.TextNote) < 30 {
+		t.Fatalf("a dry run deleted events")
+	}
+	if report, err = d.Compact(p, now, false); chk.E(err) {
+		t.Fatal(err)
+	}
+	if report.Deleted != 27 {
+		t.Fatalf("unexpected report:\n%s", report)
+	}
+	if n := count(kind.Reaction); n != 9 {
+		t.Fatalf("expected 9 reactions to be kept, got %d", n)
+	}
+	evs, _, err := d.Query(filter.F{Kinds: []int{kind.TextNote}, Since: &now})
+	if chk.E(err) {
+		t.Fatal(err)
+	}
+	if len(evs) != 3 {
+		t.Fatalf("expected the newest notes to be kept, got %d", len(evs))
+	}
+	if err = d.SetRetentionPolicy(&RetentionPolicy{Rules: []RetentionRule{{Kinds: []int{1}}}}); err == nil {
+		t.Fatal("a rule without a limit was accepted")
+	}
+}
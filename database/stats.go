@@ -0,0 +1,118 @@
+package database
+
+import (
+	"sync"
+
+	"github.com/dgraph-io/badger/v4"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/database/indexes/prefixes"
+	"x.realy.lol/database/indexes/types/identHash"
+	"x.realy.lol/database/indexes/types/kindidx"
+	"x.realy.lol/database/indexes/types/letter"
+	"x.realy.lol/database/indexes/types/prefix"
+	"x.realy.lol/database/indexes/types/pubhash"
+)
+
+// StatsScanCap is the most keys that will be counted when computing the cardinality of a
+// search prefix. Anything larger is costed as StatsScanCap, which is large enough that the
+// planner will prefer any other path that is more selective.
+const StatsScanCap = 100000
+
+// maxStatsEntries bounds the size of the cardinality cache, it is cleared when this is
+// exceeded and repopulated on demand.
+const maxStatsEntries = 1 << 16
+
+// stats is a cache of the number of keys under the search prefixes the query planner uses to
+// estimate the cost of an index path. Counts are computed on first use by a keys only prefix
+// scan, and kept current as events are stored.
+type stats struct {
+	sync.Mutex
+	counts map[string]int64
+}
+
+func newStats() (s *stats) { return &stats{counts: make(map[string]int64)} }
+
+// Cardinality returns the number of keys that are found under a search prefix, up to
+// StatsScanCap.
+func (d *D) Cardinality(prf []byte) (n int64, err error) {
+	d.stats.Lock()
+	var ok bool
+	if n, ok = d.stats.counts[string(prf)]; ok {
+		d.stats.Unlock()
+		return
+	}
+	d.stats.Unlock()
+	if err = d.View(func(txn *badger.Txn) (err error) {
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: prf})
+		defer it.Close()
+		for it.Seek(prf); it.ValidForPrefix(prf); it.Next() {
+			n++
+			if n >= StatsScanCap {
+				break
+			}
+		}
+		return
+	}); chk.E(err) {
+		return
+	}
+	d.stats.Lock()
+	if len(d.stats.counts) >= maxStatsEntries {
+		d.stats.counts = make(map[string]int64)
+	}
+	d.stats.counts[string(prf)] = n
+	d.stats.Unlock()
+	return
+}
+
+// updateStats adjusts the cached cardinality of the search prefixes of a set of index keys
+// that have been written (delta 1) or deleted (delta -1), and the cached usage of their authors.
+func (d *D) updateStats(keys [][]byte, delta int64) {
+	d.updateUsage(keys, delta)
+	d.stats.Lock()
+	defer d.stats.Unlock()
+	for _, k := range keys {
+		for _, sp := range statPrefixes(k) {
+			if n, ok := d.stats.counts[string(sp)]; ok {
+				if n += delta; n < 0 {
+					n = 0
+				}
+				d.stats.counts[string(sp)] = n
+			}
+		}
+	}
+}
+
+// statPrefixes returns the search prefixes the planner may estimate that an index key is
+// counted under, the whole index prefix and the prefix without the created_at and serial.
+func statPrefixes(key []byte) (sps [][]byte) {
+	if len(key) < prefix.Len {
+		return
+	}
+	sps = append(sps, key[:prefix.Len])
+	var l int
+	switch prefixes.I(key[:prefix.Len]) {
+	case prefixes.Prefix(prefixes.Kind), prefixes.Prefix(prefixes.KindCreatedAt):
+		l = kindidx.Len
+	case prefixes.Prefix(prefixes.Pubkey), prefixes.Prefix(prefixes.PubkeyCreatedAt),
+		prefixes.Prefix(prefixes.TagPubkey):
+		l = pubhash.Len
+	case prefixes.Prefix(prefixes.KindPubkeyCreatedAt):
+		l = kindidx.Len + pubhash.Len
+	case prefixes.Prefix(prefixes.TagEvent), prefixes.Prefix(prefixes.TagHashtag),
+		prefixes.Prefix(prefixes.TagIdentifier):
+		l = identhash.Len
+	case prefixes.Prefix(prefixes.TagLetter):
+		l = letter.Len + identhash.Len
+	case prefixes.Prefix(prefixes.TagNonstandard):
+		l = identhash.Len * 2
+	case prefixes.Prefix(prefixes.TagA):
+		l = kindidx.Len + pubhash.Len + identhash.Len
+	default:
+		return
+	}
+	if len(key) >= prefix.Len+l {
+		sps = append(sps, key[:prefix.Len+l])
+	}
+	return
+}
@@ -4,15 +4,33 @@ import (
 	"bytes"
 	"time"
 
+	"github.com/dgraph-io/badger/v4"
+
 	"x.realy.lol/chk"
 	"x.realy.lol/database/indexes"
 	"x.realy.lol/database/indexes/types/timestamp"
 	"x.realy.lol/database/indexes/types/varint"
 	"x.realy.lol/errorf"
 	"x.realy.lol/event"
+	"x.realy.lol/kind"
+	"x.realy.lol/log"
+	timeStamp "x.realy.lol/timestamp"
 )
 
+// StoreEvent writes an event and its indexes. Ephemeral events are refused, as they are only
+// relayed to the subscribers that are connected when they arrive, as are events that have
+// already expired, events that would exceed the storage quota of their author, and events that
+// their author deleted with a nip-09 deletion request. A deletion request that is stored
+// deletes the events it refers to.
 func (d *D) StoreEvent(ev *event.E) (err error) {
+	if kind.IsEphemeralKind(ev.Kind) {
+		err = errorf.E("blocked: ephemeral events are not stored")
+		return
+	}
+	if ev.Expired(timeStamp.Now()) {
+		err = errorf.E("invalid: event has expired")
+		return
+	}
 	var ev2 *event.E
 	if ev2, err = d.GetEventById(ev.GetIdBytes()); err != nil {
 		// so we didn't find it?
@@ -24,6 +42,18 @@ func (d *D) StoreEvent(ev *event.E) (err error) {
 			return
 		}
 	}
+	if err = d.deletedBy(ev); err != nil {
+		return
+	}
+	evV := new(bytes.Buffer)
+	if err = ev.MarshalWrite(evV); chk.E(err) {
+		return
+	}
+	var unlock func()
+	if unlock, err = d.checkQuota(ev, evV.Len()); err != nil {
+		return
+	}
+	defer unlock()
 	var ser *varint.V
 	var idxs [][]byte
 	if idxs, ser, err = d.GetEventIndexes(ev); chk.E(err) {
@@ -48,6 +78,7 @@ func (d *D) StoreEvent(ev *event.E) (err error) {
 			return
 		}
 	}
+	d.updateStats(idxs, 1)
 	// LastAccessed
 	laI := new(bytes.Buffer)
 	if err = indexes.LastAccessedEnc(ser).MarshalWrite(laI); chk.E(err) {
@@ -60,6 +91,10 @@ func (d *D) StoreEvent(ev *event.E) (err error) {
 	if err = d.Set(laI.Bytes(), tsb); chk.E(err) {
 		return
 	}
+	aoI := accessOrderKey(ser, tsb, 0)
+	if err = d.Set(aoI, nil); chk.E(err) {
+		return
+	}
 	// AccessCounter
 	acI := new(bytes.Buffer)
 	if err = indexes.AccessCounterEnc(ser).MarshalWrite(acI); chk.E(err) {
@@ -69,17 +104,41 @@ func (d *D) StoreEvent(ev *event.E) (err error) {
 	if err = d.Set(acI.Bytes(), ac.Bytes()); chk.E(err) {
 		return
 	}
-	// lastly, the event
+	op := Insert
+	var replaces [][]byte
+	if kind.IsReplaceableKind(ev.Kind) || kind.IsAddressableKind(ev.Kind) {
+		if replaces, err = d.replaced(ev); chk.E(err) {
+			return
+		}
+		if len(replaces) > 0 {
+			op = Replace
+		}
+	}
+	// lastly, the event, with its entry in the change log.
 	evk := new(bytes.Buffer)
 	if err = indexes.EventEnc(ser).MarshalWrite(evk); chk.E(err) {
 		return
 	}
-	evV := new(bytes.Buffer)
-	if err = ev.MarshalWrite(evV); chk.E(err) {
+	if err = d.logged(func(txn *badger.Txn) (err error) {
+		if err = txn.Set(evk.Bytes(), evV.Bytes()); chk.E(err) {
+			return
+		}
+		return d.logChange(txn, op, ser, ev.GetIdBytes(), replaces)
+	}); chk.E(err) {
 		return
 	}
-	if err = d.Set(evk.Bytes(), evV.Bytes()); chk.E(err) {
-		return
+	size := int64(len(laI.Bytes())+len(tsb)+len(aoI)+len(acI.Bytes())+
+		len(ac.Bytes())+len(evk.Bytes())) + int64(evV.Len())
+	for _, k := range idxs {
+		size += int64(len(k))
+	}
+	d.addSize(size)
+	if ev.Kind == kind.Deletion {
+		var n int
+		if n, err = d.applyDeletion(ev); chk.E(err) {
+			return
+		}
+		log.D.F("deletion request %s deleted %d events", ev.Id, n)
 	}
 	return
 }
@@ -0,0 +1,229 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/database/indexes"
+	"x.realy.lol/database/indexes/prefixes"
+	"x.realy.lol/database/indexes/types/fulltext"
+	"x.realy.lol/database/indexes/types/prefix"
+	"x.realy.lol/database/indexes/types/varint"
+	"x.realy.lol/event"
+	"x.realy.lol/timestamp"
+)
+
+// StoreStatsTTL is how long the StoreStats are cached before they are computed again.
+const StoreStatsTTL = 10 * time.Minute
+
+// TopAuthors is the number of authors with the most events that the StoreStats list.
+const TopAuthors = 20
+
+// OtherPrefix is the name of the keys that don't have one of the prefixes of the database,
+// such as the keys of the sequences and of badger.
+const OtherPrefix = "other"
+
+// PrefixStats is the number of keys with a prefix, and their size with their values.
+type PrefixStats struct {
+	Prefix string `json:"prefix"`
+	Keys   int64  `json:"keys"`
+	Bytes  int64  `json:"bytes"`
+}
+
+// KindStats is the number of events of a kind.
+type KindStats struct {
+	Kind   int   `json:"kind"`
+	Events int64 `json:"events"`
+}
+
+// AuthorStats is the number of events of an author.
+type AuthorStats struct {
+	Pubkey string `json:"pubkey"`
+	Events int64  `json:"events"`
+}
+
+// StoreStats describe what is in the database.
+type StoreStats struct {
+	// ComputedAt is when the stats were computed, they are cached for StoreStatsTTL.
+	ComputedAt timestamp.Timestamp `json:"computed_at"`
+	Events     int64               `json:"events"`
+	// Kinds are the number of events of each kind, in order of kind.
+	Kinds []KindStats `json:"kinds"`
+	// Authors is the number of authors, and TopAuthors those with the most events.
+	Authors    int64         `json:"authors"`
+	TopAuthors []AuthorStats `json:"top_authors"`
+	// Prefixes are the keys of each prefix, largest first.
+	Prefixes []PrefixStats `json:"prefixes"`
+	// HighWater is the largest serial of a stored event.
+	HighWater uint64 `json:"serial_high_water"`
+	// LSMSize and VlogSize are the sizes of the badger files.
+	LSMSize  int64 `json:"lsm_size"`
+	VlogSize int64 `json:"vlog_size"`
+	// Vocabulary is the number of distinct words in the fulltext index.
+	Vocabulary int64 `json:"fulltext_vocabulary"`
+}
+
+// storeStats caches the StoreStats, the mutex is held while they are computed so they are
+// only computed once at a time.
+type storeStats struct {
+	mx    sync.Mutex
+	stats *StoreStats
+	at    time.Time
+}
+
+// StoreStats returns the stats of the database, which are computed by a scan of all the keys
+// and cached for StoreStatsTTL, unless refresh is true.
+func (d *D) StoreStats(refresh bool) (s *StoreStats, err error) {
+	d.storeStats.mx.Lock()
+	defer d.storeStats.mx.Unlock()
+	if !refresh && d.storeStats.stats != nil && time.Since(d.storeStats.at) < StoreStatsTTL {
+		return d.storeStats.stats, nil
+	}
+	if s, err = d.computeStoreStats(); chk.E(err) {
+		return
+	}
+	d.storeStats.stats, d.storeStats.at = s, time.Now()
+	return
+}
+
+// computeStoreStats scans all the keys of the database.
+func (d *D) computeStoreStats() (s *StoreStats, err error) {
+	s = &StoreStats{ComputedAt: timestamp.Now()}
+	// the prefixes are numbered consecutively, and the gaps between the groups have no name.
+	known := make(map[string]bool)
+	for p := range prefixes.SchemaVersion + 1 {
+		if name := string(prefixes.Prefix(p)); name != "" {
+			known[name] = true
+		}
+	}
+	byPrefix := make(map[string]*PrefixStats)
+	kinds := make(map[int]int64)
+	authors := make(map[string]int64)
+	var lastWord []byte
+	if err = d.View(func(txn *badger.Txn) (err error) {
+		it := txn.NewIterator(badger.IteratorOptions{PrefetchValues: false})
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			k := item.Key()
+			name := OtherPrefix
+			if len(k) >= prefix.Len && known[string(k[:prefix.Len])] &&
+				string(k) != eventSequence {
+				name = string(k[:prefix.Len])
+			}
+			ps, ok := byPrefix[name]
+			if !ok {
+				ps = &PrefixStats{Prefix: name}
+				byPrefix[name] = ps
+			}
+			ps.Keys++
+			ps.Bytes += item.EstimatedSize()
+			rest := bytes.NewBuffer(k[min(len(k), prefix.Len):])
+			switch name {
+			case string(prefixes.Prefix(prefixes.Event)):
+				s.Events++
+				ser := varint.New()
+				if ser.UnmarshalRead(rest) == nil && ser.ToUint64() > s.HighWater {
+					s.HighWater = ser.ToUint64()
+				}
+			case string(prefixes.Prefix(prefixes.Kind)):
+				ki, _ := indexes.KindVars()
+				if ki.UnmarshalRead(rest) == nil {
+					kinds[ki.ToKind()]++
+				}
+			case string(prefixes.Prefix(prefixes.Pubkey)):
+				ph, _ := indexes.PubkeyVars()
+				if ph.UnmarshalRead(rest) == nil {
+					authors[string(ph.Bytes())]++
+				}
+			case string(prefixes.Prefix(prefixes.FulltextWord)):
+				// the keys of a word are together.
+				w := fulltext.New()
+				if w.UnmarshalRead(rest) == nil && !bytes.Equal(w.Bytes(), lastWord) {
+					s.Vocabulary++
+					lastWord = append(lastWord[:0], w.Bytes()...)
+				}
+			}
+		}
+		return
+	}); chk.E(err) {
+		return
+	}
+	for _, ps := range byPrefix {
+		s.Prefixes = append(s.Prefixes, *ps)
+	}
+	sort.Slice(s.Prefixes, func(i, j int) bool {
+		if s.Prefixes[i].Bytes == s.Prefixes[j].Bytes {
+			return s.Prefixes[i].Prefix < s.Prefixes[j].Prefix
+		}
+		return s.Prefixes[i].Bytes > s.Prefixes[j].Bytes
+	})
+	for k, n := range kinds {
+		s.Kinds = append(s.Kinds, KindStats{Kind: k, Events: n})
+	}
+	sort.Slice(s.Kinds, func(i, j int) bool { return s.Kinds[i].Kind < s.Kinds[j].Kind })
+	s.Authors = int64(len(authors))
+	type author struct {
+		hash   string
+		events int64
+	}
+	var top []author
+	for h, n := range authors {
+		top = append(top, author{h, n})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].events == top[j].events {
+			return top[i].hash < top[j].hash
+		}
+		return top[i].events > top[j].events
+	})
+	for _, a := range top[:min(len(top), TopAuthors)] {
+		var pubkey string
+		if pubkey, err = d.authorOf([]byte(a.hash)); chk.E(err) {
+			return
+		}
+		s.TopAuthors = append(s.TopAuthors, AuthorStats{Pubkey: pubkey, Events: a.events})
+	}
+	s.LSMSize, s.VlogSize = d.DB.Size()
+	return
+}
+
+// authorOf returns the hex pubkey of an author from the hash of the pubkey in the indexes, by
+// reading one of their events. It is empty if the events of the author were deleted after
+// they were counted.
+func (d *D) authorOf(hash []byte) (pubkey string, err error) {
+	var ser *varint.V
+	if err = d.View(func(txn *badger.Txn) (err error) {
+		prf := searchPrefix(prefixes.Pubkey, hash)
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: prf, PrefetchValues: false})
+		defer it.Close()
+		it.Seek(prf)
+		if !it.ValidForPrefix(prf) {
+			return
+		}
+		p, s := indexes.PubkeyVars()
+		if err = indexes.PubkeyDec(p, s).UnmarshalRead(
+			bytes.NewBuffer(it.Item().KeyCopy(nil))); chk.E(err) {
+			return
+		}
+		ser = s
+		return
+	}); chk.E(err) || ser == nil {
+		return
+	}
+	var ev *event.E
+	if ev, err = d.GetEventFromSerial(ser); err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			err = nil
+		}
+		return
+	}
+	pubkey = ev.Pubkey
+	return
+}
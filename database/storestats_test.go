@@ -0,0 +1,70 @@
+package database
+
+import (
+	"testing"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/database/indexes/prefixes"
+)
+
+func TestD_StoreStats(t *testing.T) {
+	d, evs := loadExampleEvents(t, "testrealy-storestats", 500)
+	kinds := make(map[int]int64)
+	authors := make(map[string]int64)
+	for _, ev := range evs {
+		kinds[ev.Kind]++
+		authors[ev.Pubkey]++
+	}
+	s, err := d.StoreStats(false)
+	if chk.E(err) {
+		t.Fatal(err)
+	}
+	if s.Events != int64(len(evs)) {
+		t.Fatalf("counted %d events, stored %d", s.Events, len(evs))
+	}
+	if len(s.Kinds) != len(kinds) {
+		t.Fatalf("counted %d kinds, stored %d", len(s.Kinds), len(kinds))
+	}
+	for _, k := range s.Kinds {
+		if k.Events != kinds[k.Kind] {
+			t.Fatalf("counted %d events of kind %d, stored %d", k.Events, k.Kind, kinds[k.Kind])
+		}
+	}
+	if s.Authors != int64(len(authors)) {
+		t.Fatalf("counted %d authors, stored %d", s.Authors, len(authors))
+	}
+	if len(s.TopAuthors) != min(len(authors), TopAuthors) {
+		t.Fatalf("listed %d top authors", len(s.TopAuthors))
+	}
+	for i, a := range s.TopAuthors {
+		if a.Events != authors[a.Pubkey] {
+			t.Fatalf("counted %d events of %s, stored %d", a.Events, a.Pubkey,
+				authors[a.Pubkey])
+		}
+		if i > 0 && a.Events > s.TopAuthors[i-1].Events {
+			t.Fatalf("top authors are not in order of events")
+		}
+	}
+	if s.HighWater+1 < uint64(len(evs)) {
+		t.Fatalf("serial high water %d is less than the number of events", s.HighWater)
+	}
+	if s.Vocabulary == 0 {
+		t.Fatalf("the fulltext index has no words")
+	}
+	var events bool
+	for _, p := range s.Prefixes {
+		if p.Prefix == string(prefixes.Prefix(prefixes.Event)) {
+			events = p.Keys == s.Events && p.Bytes > 0
+		}
+	}
+	if !events {
+		t.Fatalf("the event records are not counted in the prefixes: %v", s.Prefixes)
+	}
+	var cached *StoreStats
+	if cached, err = d.StoreStats(false); chk.E(err) || cached != s {
+		t.Fatalf("the stats were not cached")
+	}
+	if cached, err = d.StoreStats(true); chk.E(err) || cached == s {
+		t.Fatalf("the stats were not computed again")
+	}
+}
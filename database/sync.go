@@ -0,0 +1,47 @@
+package database
+
+import (
+	"x.realy.lol/chk"
+	"x.realy.lol/database/indexes"
+	"x.realy.lol/errorf"
+	"x.realy.lol/filter"
+	"x.realy.lol/negentropy"
+)
+
+// MaxSyncEvents is the most events a filter can match to be reconciled with negentropy.
+const MaxSyncEvents = 500000
+
+// SyncVector returns the created_at and id of the events that match a filter, and that all the
+// rules keep, for a negentropy reconciliation. They are read from the FullIndex of each event
+// found by the query plan, so no event is decoded. If the filter has no limit, or one greater
+// than MaxSyncEvents, and it matches more, an error is returned.
+func (d *D) SyncVector(f filter.F, rules ...IndexRule) (v *negentropy.Vector, err error) {
+	var p *Plan
+	if p, err = d.Plan(f); chk.E(err) {
+		return
+	}
+	p.Rules = rules
+	p.Limit = MaxSyncEvents + 1
+	if f.Limit != nil && *f.Limit <= MaxSyncEvents {
+		p.Limit = *f.Limit
+	}
+	var index []indexes.FullIndex
+	if index, err = d.Execute(p); chk.E(err) {
+		return
+	}
+	if len(index) > MaxSyncEvents {
+		err = errorf.E("blocked: filter matches more than %d events, narrow it to sync",
+			MaxSyncEvents)
+		return
+	}
+	v = negentropy.NewVector()
+	for _, fi := range index {
+		if err = v.Insert(uint64(fi.CreatedAt.ToTimestamp()), fi.Id.Bytes()); chk.E(err) {
+			return
+		}
+	}
+	if err = v.Seal(); chk.E(err) {
+		return
+	}
+	return
+}
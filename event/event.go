@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"strconv"
 
 	"x.realy.lol/chk"
 	"x.realy.lol/errorf"
@@ -189,6 +190,27 @@ func (ev *E) CheckId() (ok bool) {
 	return idHex == ev.Id
 }
 
+// Expiration returns the time of the nip-40 expiration tag of the event, ok is false if it
+// doesn't have a valid one.
+func (ev *E) Expiration() (exp timestamp.Timestamp, ok bool) {
+	t := ev.Tags.GetFirst([]string{"expiration", ""})
+	if t == nil {
+		return
+	}
+	var n int64
+	var err error
+	if n, err = strconv.ParseInt(t.Value(), 10, 64); err != nil || n < 0 {
+		return
+	}
+	return timestamp.Timestamp(n), true
+}
+
+// Expired returns true if the event has an expiration time that is before now.
+func (ev *E) Expired(now timestamp.Timestamp) (expired bool) {
+	exp, ok := ev.Expiration()
+	return ok && exp < now
+}
+
 // this is an absolute minimum length canonical encoded event
 var minimal = len(`[0,"0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",1733739427,0,[],""]`)
 
@@ -0,0 +1,58 @@
+package filter
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/errorf"
+	"x.realy.lol/timestamp"
+)
+
+// Cursor is a position in the results of a filter, the created_at and database serial of the
+// last event of a page of results. Results are ordered by created_at and then serial, both
+// descending, so a filter with a Cursor resumes exactly after that event, even when many events
+// share the same timestamp.
+//
+// Clients treat it as an opaque string, in the "cursor" field of a filter.
+type Cursor struct {
+	CreatedAt timestamp.Timestamp
+	Serial    uint64
+}
+
+const cursorLen = 16
+
+// After reports whether a result with the given created_at and serial comes after the cursor
+// position, and so belongs in the next page.
+func (c *Cursor) After(createdAt timestamp.Timestamp, serial uint64) bool {
+	if createdAt != c.CreatedAt {
+		return createdAt < c.CreatedAt
+	}
+	return serial < c.Serial
+}
+
+// String encodes the cursor in its opaque form.
+func (c *Cursor) String() string {
+	b := make([]byte, cursorLen)
+	binary.BigEndian.PutUint64(b, uint64(c.CreatedAt))
+	binary.BigEndian.PutUint64(b[8:], c.Serial)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// DecodeCursor decodes the opaque form of a Cursor.
+func DecodeCursor(s string) (c *Cursor, err error) {
+	var b []byte
+	if b, err = base64.RawURLEncoding.DecodeString(s); chk.D(err) {
+		err = errorf.E("invalid cursor '%s': %s", s, err)
+		return
+	}
+	if len(b) != cursorLen {
+		err = errorf.E("invalid cursor '%s': length %d, require %d", s, len(b), cursorLen)
+		return
+	}
+	c = &Cursor{
+		CreatedAt: timestamp.Timestamp(binary.BigEndian.Uint64(b)),
+		Serial:    binary.BigEndian.Uint64(b[8:]),
+	}
+	return
+}
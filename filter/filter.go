@@ -21,6 +21,8 @@ type F struct {
 	Until   *timestamp.Timestamp
 	Limit   *int
 	Search  string
+	// Cursor resumes a query after the last event of a previous page of results.
+	Cursor *Cursor
 }
 
 type TagMap map[string][]string
@@ -134,6 +136,10 @@ func FilterEqual(a F, b F) bool {
 		return false
 	}
 
+	if !helpers.ArePointerValuesEqual(a.Cursor, b.Cursor) {
+		return false
+	}
+
 	return true
 }
 
@@ -163,6 +169,11 @@ func (ef F) Clone() F {
 		clone.Until = &until
 	}
 
+	if ef.Cursor != nil {
+		cursor := *ef.Cursor
+		clone.Cursor = &cursor
+	}
+
 	return clone
 }
 
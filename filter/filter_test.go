@@ -185,3 +185,20 @@ func TestFilter(t *testing.T) {
 	}
 	log.I.S(f2)
 }
+
+func TestFilterCursorRoundTrip(t *testing.T) {
+	c := &Cursor{CreatedAt: 1700000000, Serial: 12345}
+	f := F{Kinds: []int{kind.TextNote}, Limit: IntToPointer(20), Cursor: c}
+	b, err := json.Marshal(f)
+	require.NoError(t, err)
+	var f2 F
+	require.NoError(t, json.Unmarshal(b, &f2))
+	require.NotNil(t, f2.Cursor)
+	assert.Equal(t, *c, *f2.Cursor)
+	assert.True(t, FilterEqual(f, f2), "filter with cursor should survive a round trip")
+	assert.True(t, c.After(1700000000, 12344), "lower serial with equal timestamp is after")
+	assert.False(t, c.After(1700000000, 12345), "the cursor position itself is not after")
+	assert.True(t, c.After(1699999999, 99999), "older timestamp is after")
+	var f3 F
+	assert.Error(t, json.Unmarshal([]byte(`{"cursor":"!!"}`), &f3))
+}
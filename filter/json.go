@@ -0,0 +1,129 @@
+package filter
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/errorf"
+	"x.realy.lol/timestamp"
+)
+
+// MarshalJSON encodes a filter in the nip-01 format, where tags are fields with the key
+// prefixed with #.
+func (ef F) MarshalJSON() (b []byte, err error) {
+	buf := new(bytes.Buffer)
+	buf.WriteByte('{')
+	first := true
+	field := func(k string, v any) {
+		if err != nil {
+			return
+		}
+		var vb []byte
+		if vb, err = json.Marshal(v); chk.E(err) {
+			return
+		}
+		if !first {
+			buf.WriteByte(',')
+		}
+		first = false
+		kb, _ := json.Marshal(k)
+		buf.Write(kb)
+		buf.WriteByte(':')
+		buf.Write(vb)
+	}
+	if ef.Ids != nil {
+		field("ids", ef.Ids)
+	}
+	if ef.Kinds != nil {
+		field("kinds", ef.Kinds)
+	}
+	if ef.Authors != nil {
+		field("authors", ef.Authors)
+	}
+	if ef.Since != nil {
+		field("since", *ef.Since)
+	}
+	if ef.Until != nil {
+		field("until", *ef.Until)
+	}
+	if ef.Limit != nil {
+		field("limit", *ef.Limit)
+	}
+	if ef.Search != "" {
+		field("search", ef.Search)
+	}
+	if ef.Cursor != nil {
+		field("cursor", ef.Cursor.String())
+	}
+	var keys []string
+	for k := range ef.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		field("#"+strings.TrimPrefix(k, "#"), ef.Tags[k])
+	}
+	if err != nil {
+		return
+	}
+	buf.WriteByte('}')
+	b = buf.Bytes()
+	return
+}
+
+// UnmarshalJSON decodes a filter in the nip-01 format. Tag fields are stored in Tags without
+// the # prefix.
+func (ef *F) UnmarshalJSON(b []byte) (err error) {
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(b, &fields); chk.D(err) {
+		return
+	}
+	*ef = F{}
+	for k, v := range fields {
+		switch k {
+		case "ids":
+			err = json.Unmarshal(v, &ef.Ids)
+		case "kinds":
+			err = json.Unmarshal(v, &ef.Kinds)
+		case "authors":
+			err = json.Unmarshal(v, &ef.Authors)
+		case "since":
+			ef.Since = new(timestamp.Timestamp)
+			err = json.Unmarshal(v, ef.Since)
+		case "until":
+			ef.Until = new(timestamp.Timestamp)
+			err = json.Unmarshal(v, ef.Until)
+		case "limit":
+			ef.Limit = new(int)
+			err = json.Unmarshal(v, ef.Limit)
+		case "search":
+			err = json.Unmarshal(v, &ef.Search)
+		case "cursor":
+			var c string
+			if err = json.Unmarshal(v, &c); err != nil {
+				break
+			}
+			ef.Cursor, err = DecodeCursor(c)
+		default:
+			if len(k) > 1 && k[0] == '#' {
+				if ef.Tags == nil {
+					ef.Tags = make(TagMap)
+				}
+				var vals []string
+				if err = json.Unmarshal(v, &vals); err != nil {
+					break
+				}
+				ef.Tags[k[1:]] = vals
+			}
+			// other unknown fields are ignored
+		}
+		if err != nil {
+			err = errorf.E("invalid filter field '%s': %s", k, err)
+			return
+		}
+	}
+	return
+}
@@ -17,6 +17,7 @@ require (
 	go-simpler.org/env v0.12.0
 	golang.org/x/exp v0.0.0-20250530174510-65e920069ea6
 	golang.org/x/lint v0.0.0-20241112194109-818c5a804067
+	golang.org/x/net v0.40.0
 	honnef.co/go/tools v0.6.1
 	lukechampine.com/frand v1.5.1
 )
@@ -45,7 +46,6 @@ require (
 	go.opentelemetry.io/otel/trace v1.35.0 // indirect
 	golang.org/x/exp/typeparams v0.0.0-20250530174510-65e920069ea6 // indirect
 	golang.org/x/mod v0.24.0 // indirect
-	golang.org/x/net v0.40.0 // indirect
 	golang.org/x/sync v0.14.0 // indirect
 	golang.org/x/sys v0.33.0 // indirect
 	golang.org/x/text v0.25.0 // indirect
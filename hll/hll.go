@@ -0,0 +1,87 @@
+// Package hll is a HyperLogLog cardinality estimator with 256 registers, the size used by
+// nip-45 for approximate counts. It estimates the number of distinct values added to it using a
+// fixed 256 bytes of memory, regardless of how many are added.
+package hll
+
+import (
+	"math"
+	"math/bits"
+
+	"x.realy.lol/errorf"
+	"x.realy.lol/hex"
+)
+
+// M is the number of registers.
+const M = 256
+
+// alpha is the bias correction constant for M registers.
+var alpha = 0.7213 / (1 + 1.079/float64(M))
+
+// T is a HyperLogLog sketch.
+type T struct{ registers [M]uint8 }
+
+func New() (h *T) { return &T{} }
+
+// Add adds a value to the sketch. The value must be a uniformly distributed hash at least 8
+// bytes long, such as a truncated sha256: the first byte selects the register and the following
+// 7 bytes are the bits whose leading zeros are counted.
+func (h *T) Add(hash []byte) {
+	if len(hash) < 8 {
+		return
+	}
+	var w uint64
+	for _, b := range hash[1:8] {
+		w = w<<8 | uint64(b)
+	}
+	// the 56 bits are in the low bits of w.
+	rho := uint8(bits.LeadingZeros64(w) - 8 + 1)
+	if rho > h.registers[hash[0]] {
+		h.registers[hash[0]] = rho
+	}
+}
+
+// Merge combines another sketch into this one, the result estimates the number of distinct
+// values added to either of them.
+func (h *T) Merge(o *T) {
+	for i, r := range o.registers {
+		if r > h.registers[i] {
+			h.registers[i] = r
+		}
+	}
+}
+
+// Estimate returns the estimated number of distinct values that have been added.
+func (h *T) Estimate() (n uint64) {
+	var sum float64
+	var zeros int
+	for _, r := range h.registers {
+		sum += math.Pow(2, -float64(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	e := alpha * M * M / sum
+	// small cardinalities are estimated more accurately by counting empty registers.
+	if e <= 2.5*M && zeros > 0 {
+		e = M * math.Log(float64(M)/float64(zeros))
+	}
+	return uint64(math.Round(e))
+}
+
+// String returns the registers encoded as hex.
+func (h *T) String() string { return hex.Enc(h.registers[:]) }
+
+// FromString decodes a sketch from the hex encoding of its registers.
+func FromString(s string) (h *T, err error) {
+	var b []byte
+	if b, err = hex.Dec(s); err != nil {
+		return
+	}
+	if len(b) != M {
+		err = errorf.E("hll registers must be %d bytes, got %d", M, len(b))
+		return
+	}
+	h = New()
+	copy(h.registers[:], b)
+	return
+}
@@ -0,0 +1,48 @@
+package hll
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/helpers"
+)
+
+func TestT_Estimate(t *testing.T) {
+	for _, n := range []int{10, 100, 1000, 100000} {
+		h := New()
+		for i := range n {
+			v := helpers.Hash(binary.BigEndian.AppendUint64(nil, uint64(i)))
+			// duplicates don't change the estimate
+			h.Add(v)
+			h.Add(v)
+		}
+		e := h.Estimate()
+		// the standard error with 256 registers is about 6.5%
+		if math.Abs(float64(e)-float64(n))/float64(n) > 0.2 {
+			t.Fatalf("estimate %d is too far from %d", e, n)
+		}
+	}
+}
+
+func TestT_Merge(t *testing.T) {
+	var err error
+	a, b := New(), New()
+	for i := range 20000 {
+		v := helpers.Hash(binary.BigEndian.AppendUint64(nil, uint64(i)))
+		if i%2 == 0 {
+			a.Add(v)
+		} else {
+			b.Add(v)
+		}
+	}
+	var c *T
+	if c, err = FromString(a.String()); chk.E(err) {
+		t.Fatal(err)
+	}
+	c.Merge(b)
+	if e := c.Estimate(); math.Abs(float64(e)-20000)/20000 > 0.2 {
+		t.Fatalf("merged estimate %d is too far from 20000", e)
+	}
+}
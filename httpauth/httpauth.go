@@ -0,0 +1,162 @@
+// Package httpauth implements nip-98 HTTP auth, with net/http middleware that verifies the
+// Authorization header of requests and puts the pubkey that signed it in the request context.
+package httpauth
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/errorf"
+	"x.realy.lol/event"
+	"x.realy.lol/hex"
+	"x.realy.lol/kind"
+	"x.realy.lol/signer"
+	"x.realy.lol/tags"
+	"x.realy.lol/timestamp"
+)
+
+// Window is the most seconds the created_at of an auth event can be from the time the request
+// is received.
+const Window = 60
+
+// MaxBody is the largest request body that is read to check the payload hash.
+const MaxBody = 1 << 20
+
+// Scheme is the scheme of the Authorization header.
+const Scheme = "Nostr "
+
+type contextKey struct{}
+
+// Pubkey returns the hex pubkey that signed the Authorization header of a request, which is
+// set by Middleware. ok is false if the request was not authenticated.
+func Pubkey(ctx context.Context) (pubkey string, ok bool) {
+	pubkey, ok = ctx.Value(contextKey{}).(string)
+	return
+}
+
+// Middleware verifies the Authorization header of requests, and serves them with the pubkey
+// that signed it in the request context. Requests without the header are served without a
+// pubkey, so handlers that require auth check Pubkey, and requests with an invalid one are
+// rejected with 401 Unauthorized.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), Scheme) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxBody))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		var pubkey string
+		if pubkey, err = Verify(r, body); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		// the body was read to check the payload, so it is replaced for the handler.
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, pubkey)))
+	})
+}
+
+// Verify checks the Authorization header of a request with the given body, and returns the
+// hex pubkey that signed it.
+//
+//	Authorization: Nostr <base64 encoded kind 27235 event>
+//
+// The event must be signed, created within Window of now, and have a u tag with the URL and a
+// method tag with the method of the request. If the body isn't empty, it must also have a
+// payload tag with the hex SHA-256 hash of the body.
+func Verify(r *http.Request, body []byte) (pubkey string, err error) {
+	enc, ok := strings.CutPrefix(r.Header.Get("Authorization"), Scheme)
+	if !ok {
+		err = errorf.E("missing Nostr authorization")
+		return
+	}
+	var b []byte
+	if b, err = base64.StdEncoding.DecodeString(strings.TrimSpace(enc)); err != nil {
+		err = errorf.E("invalid authorization encoding: %s", err)
+		return
+	}
+	ev := event.New()
+	if err = ev.Unmarshal(b); err != nil {
+		err = errorf.E("invalid authorization event: %s", err)
+		return
+	}
+	if ev.Kind != kind.HTTPAuth {
+		err = errorf.E("authorization event is kind %d, not %d", ev.Kind, kind.HTTPAuth)
+		return
+	}
+	if ok, err = ev.Verify(); err != nil || !ok {
+		err = errorf.E("authorization event signature is invalid")
+		return
+	}
+	if d := timestamp.Now() - ev.CreatedAt; d > Window || d < -Window {
+		err = errorf.E("authorization event is more than %d seconds from now", Window)
+		return
+	}
+	u := ev.Tags.GetFirst([]string{"u", ""})
+	if u == nil || !sameURL(u.Value(), r) {
+		err = errorf.E("authorization event is not for this URL")
+		return
+	}
+	m := ev.Tags.GetFirst([]string{"method", ""})
+	if m == nil || !strings.EqualFold(m.Value(), r.Method) {
+		err = errorf.E("authorization event is not for this method")
+		return
+	}
+	if len(body) > 0 {
+		p := ev.Tags.GetFirst([]string{"payload", ""})
+		if p == nil || !strings.EqualFold(p.Value(), payloadHash(body)) {
+			err = errorf.E("authorization event is not for this payload")
+			return
+		}
+	}
+	return ev.Pubkey, nil
+}
+
+// Header returns the value of an Authorization header for a request to a URL with the given
+// method and body, signed by sign.
+func Header(sign signer.I, method, u string, body []byte) (header string, err error) {
+	ev := event.New()
+	ev.Kind = kind.HTTPAuth
+	ev.CreatedAt = timestamp.Now()
+	ev.Tags = tags.Tags{{"u", u}, {"method", strings.ToUpper(method)}}
+	if len(body) > 0 {
+		ev.Tags = append(ev.Tags, tags.Tag{"payload", payloadHash(body)})
+	}
+	if err = ev.Sign(sign); chk.E(err) {
+		return
+	}
+	var b []byte
+	if b, err = ev.Marshal(); chk.E(err) {
+		return
+	}
+	return Scheme + base64.StdEncoding.EncodeToString(b), nil
+}
+
+func payloadHash(body []byte) string {
+	hash := sha256.Sum256(body)
+	return hex.Enc(hash[:])
+}
+
+// sameURL returns true if the u tag of an auth event is the URL of a request. The scheme isn't
+// compared, as a server can't tell it behind a reverse proxy, and clients of a relay may use
+// its websocket URL.
+func sameURL(tag string, r *http.Request) (same bool) {
+	u, err := url.Parse(tag)
+	if err != nil {
+		return
+	}
+	return strings.EqualFold(u.Host, r.Host) &&
+		strings.TrimSuffix(u.Path, "/") == strings.TrimSuffix(r.URL.Path, "/") &&
+		u.RawQuery == r.URL.RawQuery
+}
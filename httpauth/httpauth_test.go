@@ -0,0 +1,86 @@
+package httpauth
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/event"
+	"x.realy.lol/hex"
+	"x.realy.lol/kind"
+	"x.realy.lol/p256k"
+	"x.realy.lol/tags"
+	"x.realy.lol/timestamp"
+)
+
+func TestMiddleware(t *testing.T) {
+	sign := &p256k.Signer{}
+	if err := sign.Generate(); chk.E(err) {
+		t.Fatal(err)
+	}
+	var pubkey, body string
+	h := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pubkey, _ = Pubkey(r.Context())
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+	}))
+	const u = "https://relay.example.com/admin"
+	// serve sends a request with an Authorization header, and returns the status.
+	serve := func(method, target, payload, header string) (status int) {
+		pubkey, body = "", ""
+		r := httptest.NewRequest(method, target, strings.NewReader(payload))
+		if header != "" {
+			r.Header.Set("Authorization", header)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	header := func(method, target, payload string) string {
+		hdr, err := Header(sign, method, target, []byte(payload))
+		if chk.E(err) {
+			t.Fatal(err)
+		}
+		return hdr
+	}
+	if status := serve("POST", u, "{}", header("POST", u, "{}")); status != http.StatusOK ||
+		pubkey != hex.Enc(sign.Pub()) || body != "{}" {
+		t.Fatalf("valid auth was not accepted: %d %q %q", status, pubkey, body)
+	}
+	if status := serve("GET", u, "", ""); status != http.StatusOK || pubkey != "" {
+		t.Fatalf("a request without auth was not passed through: %d %q", status, pubkey)
+	}
+	// the scheme of the u tag isn't compared, the websocket URL of a relay is accepted.
+	ws := header("GET", "wss://relay.example.com/admin/", "")
+	if status := serve("GET", u, "", ws); status != http.StatusOK {
+		t.Fatalf("the websocket URL was not accepted: %d", status)
+	}
+	// an old auth event.
+	stale := event.New()
+	stale.Kind = kind.HTTPAuth
+	stale.CreatedAt = timestamp.Now() - 2*Window
+	stale.Tags = tags.Tags{{"u", u}, {"method", "GET"}}
+	if err := stale.Sign(sign); chk.E(err) {
+		t.Fatal(err)
+	}
+	for name, hdr := range map[string]string{
+		"wrong method":  header("POST", u, ""),
+		"wrong url":     header("GET", "https://relay.example.com/other", ""),
+		"wrong host":    header("GET", "https://other.example.com/admin", ""),
+		"stale":         Scheme + base64.StdEncoding.EncodeToString(stale.Serialize()),
+		"not base64":    Scheme + "not base64",
+		"wrong payload": header("GET", u, "other"),
+	} {
+		payload := ""
+		if name == "wrong payload" {
+			payload = "payload"
+		}
+		if status := serve("GET", u, payload, hdr); status != http.StatusUnauthorized || pubkey != "" {
+			t.Errorf("%s: expected the request to be unauthorized, got %d", name, status)
+		}
+	}
+}
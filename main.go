@@ -1,19 +1,32 @@
 package main
 
 import (
+	"context"
+	"net"
+	"net/http"
 	"os"
+	"strconv"
 
 	"x.realy.lol/bech32encoding"
 	"x.realy.lol/chk"
 	"x.realy.lol/config"
+	"x.realy.lol/database"
 	"x.realy.lol/hex"
+	"x.realy.lol/interrupt"
 	"x.realy.lol/log"
+	"x.realy.lol/metrics"
 	"x.realy.lol/p256k"
+	"x.realy.lol/policy"
+	"x.realy.lol/relay"
+	"x.realy.lol/units"
 	"x.realy.lol/version"
 )
 
 func main() {
 	cfg := config.New()
+	if cfg.Command != "" {
+		os.Exit(command(cfg))
+	}
 	if cfg.Superuser == "" {
 		log.F.F("SUPERUSER is not set")
 		os.Exit(1)
@@ -32,5 +45,76 @@ func main() {
 	if err = super.InitPub(dst); chk.E(err) {
 		return
 	}
+	ctx, cancel := context.WithCancel(context.Background())
+	d := database.New()
+	if err = d.Init(cfg.DataDir); chk.E(err) {
+		os.Exit(1)
+	}
+	rl := relay.New(ctx, d)
+	rl.Superuser = hex.Enc(super.Pub())
+	if rl.TrustedProxies, err = relay.ParseProxies(cfg.TrustedProxies); chk.E(err) {
+		os.Exit(1)
+	}
+	// authenticated clients are not sent the events they have muted.
+	rl.ReadPolicy = policy.ReadChain{&policy.Mutes{D: d}}
+	if cfg.WritePolicy != "" {
+		plugin := policy.NewPlugin(cfg.WritePolicy)
+		rl.WritePolicy = append(rl.WritePolicy, plugin)
+		interrupt.AddHandler(plugin.Close)
+	}
+	// the upstream relays of the configuration are mirrored until the context is canceled.
+	rl.StartMirror()
+	if cfg.Primary != "" {
+		var follower *p256k.Signer
+		if follower, err = secretKey(cfg.PrimaryKey); chk.E(err) {
+			log.F.F("PRIMARY_KEY is invalid")
+			os.Exit(1)
+		}
+		rl.ReadOnly = true
+		go rl.Follow(ctx, cfg.Primary, follower)
+	}
+	srv := &http.Server{
+		Addr:    net.JoinHostPort(cfg.Listen, strconv.Itoa(cfg.Port)),
+		Handler: rl,
+	}
+	interrupt.AddHandler(func() {
+		cancel()
+		chk.E(srv.Close())
+		chk.E(d.Close())
+	})
+	// interrupt handlers run in reverse order, so these stop before the database closes.
+	d.StartReaper(database.ReapInterval)
+	d.StartCompactor(database.CompactInterval)
+	// the superuser's own events are never garbage collected.
+	d.StartGC(database.GCInterval, int64(cfg.GCSize)*units.Mb, super.Pub())
+	if cfg.SnapshotDir != "" {
+		d.StartSnapshots(cfg.SnapshotDir, cfg.SnapshotInterval, cfg.SnapshotKeep)
+	}
+	if cfg.MetricsListen != "" {
+		serveMetrics(cfg.MetricsListen, rl, d)
+	}
+	log.I.F("listening on %s", srv.Addr)
+	if err = srv.ListenAndServe(); err != http.ErrServerClosed {
+		chk.E(err)
+		interrupt.Request()
+	}
+	<-interrupt.HandlersDone
+}
 
+// serveMetrics serves the metrics of the relay and the database at /metrics on a separate
+// listener, so they aren't exposed on the public address of the relay.
+func serveMetrics(addr string, rl *relay.Server, d *database.D) {
+	reg := metrics.New()
+	rl.RegisterMetrics(reg)
+	d.RegisterMetrics(reg)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", reg)
+	srv := &http.Server{Addr: addr, Handler: mux}
+	interrupt.AddHandler(func() { chk.E(srv.Close()) })
+	go func() {
+		log.I.F("serving metrics on http://%s/metrics", addr)
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			chk.E(err)
+		}
+	}()
 }
@@ -0,0 +1,321 @@
+// Package metrics is a minimal implementation of counters, gauges and histograms, served in
+// the OpenMetrics text format that prometheus scrapes. Metrics are created by the packages
+// they measure, and added to a Registry that serves them.
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/errorf"
+)
+
+// ContentType is the content type of the OpenMetrics text format.
+const ContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// DefaultBuckets are the upper bounds of the buckets of a histogram of latencies in seconds,
+// from 1ms to 10s.
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metric is a metric family that can be added to a Registry.
+type Metric interface {
+	// Name is the name of the metric family, without the _total suffix of counters.
+	Name() string
+	write(w *bufio.Writer)
+}
+
+// family is the name, help and series of a metric, one series for each set of label values.
+type family struct {
+	name, help, typ string
+	labels          []string
+	mx              sync.Mutex
+	series          map[string]*series
+}
+
+// series are the values of a metric for a set of label values. A histogram has a count for
+// each bucket, sum and count are the sum and number of the observations, and value is the
+// value of a counter or gauge.
+type series struct {
+	values  []string
+	value   float64
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+func newFamily(name, help, typ string, labels []string) (f *family) {
+	return &family{name: name, help: help, typ: typ, labels: labels,
+		series: make(map[string]*series)}
+}
+
+func (f *family) Name() string { return f.name }
+
+// with calls fn with the series of the label values, which are the values of the labels of
+// the metric in order.
+func (f *family) with(values []string, fn func(s *series)) {
+	if len(values) != len(f.labels) {
+		panic(errorf.E("metric %s has %d labels, got %d values", f.name, len(f.labels),
+			len(values)))
+	}
+	key := strings.Join(values, "\x00")
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{values: append([]string(nil), values...)}
+		f.series[key] = s
+	}
+	fn(s)
+}
+
+// sorted returns the series in order of label values, so the output is stable.
+func (f *family) sorted() (keys []string) {
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return
+}
+
+func (f *family) header(w *bufio.Writer) {
+	w.WriteString("# TYPE " + f.name + " " + f.typ + "\n")
+	if f.help != "" {
+		w.WriteString("# HELP " + f.name + " " + escape(f.help, false) + "\n")
+	}
+}
+
+func (f *family) write(w *bufio.Writer) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	f.header(w)
+	suffix := ""
+	if f.typ == "counter" {
+		suffix = "_total"
+	}
+	for _, k := range f.sorted() {
+		s := f.series[k]
+		sample(w, f.name+suffix, f.labels, s.values, s.value)
+	}
+}
+
+// Counter is a value that only increases, such as the number of events stored.
+type Counter struct{ *family }
+
+// NewCounter creates a counter, with a series for each set of values of the labels. The name
+// should not end with _total, which is added to the samples.
+func NewCounter(name, help string, labels ...string) (c *Counter) {
+	return &Counter{newFamily(name, help, "counter", labels)}
+}
+
+// Inc adds one to the series of the label values.
+func (c *Counter) Inc(values ...string) { c.Add(1, values...) }
+
+// Add adds v, which must not be negative, to the series of the label values.
+func (c *Counter) Add(v float64, values ...string) {
+	if v < 0 {
+		return
+	}
+	c.with(values, func(s *series) { s.value += v })
+}
+
+// Gauge is a value that goes up and down, such as the number of open connections.
+type Gauge struct{ *family }
+
+// NewGauge creates a gauge, with a series for each set of values of the labels.
+func NewGauge(name, help string, labels ...string) (g *Gauge) {
+	return &Gauge{newFamily(name, help, "gauge", labels)}
+}
+
+// Set sets the series of the label values to v.
+func (g *Gauge) Set(v float64, values ...string) {
+	g.with(values, func(s *series) { s.value = v })
+}
+
+// Add adds v to the series of the label values.
+func (g *Gauge) Add(v float64, values ...string) {
+	g.with(values, func(s *series) { s.value += v })
+}
+
+// Histogram counts observations, such as the latencies of queries, in buckets.
+type Histogram struct {
+	*family
+	bounds []float64
+}
+
+// NewHistogram creates a histogram with buckets up to each of the bounds, which must be in
+// increasing order, and a series for each set of values of the labels.
+func NewHistogram(name, help string, bounds []float64, labels ...string) (h *Histogram) {
+	return &Histogram{newFamily(name, help, "histogram", labels), bounds}
+}
+
+// Observe adds an observation to the series of the label values.
+func (h *Histogram) Observe(v float64, values ...string) {
+	h.with(values, func(s *series) {
+		if s.buckets == nil {
+			s.buckets = make([]uint64, len(h.bounds))
+		}
+		// the buckets are cumulative, so they are counted when they are written.
+		if i := sort.SearchFloat64s(h.bounds, v); i < len(h.bounds) {
+			s.buckets[i]++
+		}
+		s.sum += v
+		s.count++
+	})
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	h.header(w)
+	labels := append(append([]string(nil), h.labels...), "le")
+	for _, k := range h.sorted() {
+		s := h.series[k]
+		var cumulative uint64
+		for i, b := range h.bounds {
+			cumulative += s.buckets[i]
+			sample(w, h.name+"_bucket", labels, append(s.values, number(b)),
+				float64(cumulative))
+		}
+		sample(w, h.name+"_bucket", labels, append(s.values, "+Inf"), float64(s.count))
+		sample(w, h.name+"_sum", h.labels, s.values, s.sum)
+		sample(w, h.name+"_count", h.labels, s.values, float64(s.count))
+	}
+}
+
+// Func is a counter or gauge without labels whose value is read when it is served, for values
+// that are kept elsewhere, such as the cache statistics of the database.
+type Func struct {
+	*family
+	fn func() float64
+}
+
+// NewCounterFunc creates a counter whose value is returned by fn, which must only increase.
+func NewCounterFunc(name, help string, fn func() float64) (f *Func) {
+	return &Func{newFamily(name, help, "counter", nil), fn}
+}
+
+// NewGaugeFunc creates a gauge whose value is returned by fn.
+func NewGaugeFunc(name, help string, fn func() float64) (f *Func) {
+	return &Func{newFamily(name, help, "gauge", nil), fn}
+}
+
+func (f *Func) write(w *bufio.Writer) {
+	f.header(w)
+	name := f.name
+	if f.typ == "counter" {
+		name += "_total"
+	}
+	sample(w, name, nil, nil, f.fn())
+}
+
+// sample writes a line with the value of a series.
+func sample(w *bufio.Writer, name string, labels, values []string, v float64) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(l + `="` + escape(values[i], true) + `"`)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteString(" " + number(v) + "\n")
+}
+
+// number formats a value in the shortest form that keeps its precision.
+func number(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// escape escapes the backslashes and newlines of help text, and also the quotes of label
+// values.
+func escape(s string, quotes bool) string {
+	r := []string{`\`, `\\`, "\n", `\n`}
+	if quotes {
+		r = append(r, `"`, `\"`)
+	}
+	return strings.NewReplacer(r...).Replace(s)
+}
+
+// Registry is a set of metrics that are served together.
+type Registry struct {
+	mx      sync.Mutex
+	metrics map[string]Metric
+}
+
+func New() (r *Registry) { return &Registry{metrics: make(map[string]Metric)} }
+
+// Register adds metrics to the registry. The names of the metrics of a registry must be
+// unique.
+func (r *Registry) Register(metrics ...Metric) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	for _, m := range metrics {
+		if _, ok := r.metrics[m.Name()]; ok {
+			panic(errorf.E("metric %s is already registered", m.Name()))
+		}
+		r.metrics[m.Name()] = m
+	}
+}
+
+// WriteTo writes the metrics of the registry in the OpenMetrics text format, in order of name.
+func (r *Registry) WriteTo(w io.Writer) (n int64, err error) {
+	r.mx.Lock()
+	var names []string
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	metrics := make([]Metric, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		metrics = append(metrics, r.metrics[name])
+	}
+	r.mx.Unlock()
+	cw := &countWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	bw.WriteString("# EOF\n")
+	err = bw.Flush()
+	return cw.n, err
+}
+
+// ServeHTTP serves the metrics of the registry to a prometheus scrape.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", ContentType)
+	_, err := r.WriteTo(w)
+	chk.T(err)
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(b []byte) (n int, err error) {
+	n, err = c.w.Write(b)
+	c.n += int64(n)
+	return
+}
@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"x.realy.lol/chk"
+)
+
+func TestRegistry_WriteTo(t *testing.T) {
+	r := New()
+	events := NewCounter("events_rejected", "events that were rejected", "reason")
+	conns := NewGauge("connections", "open connections")
+	latency := NewHistogram("query_duration_seconds", "query latency", []float64{.1, 1}, "path")
+	r.Register(events, conns, latency,
+		NewGaugeFunc("cache_ratio", "hit ratio\nof the cache", func() float64 { return .5 }))
+	events.Inc("blocked")
+	events.Add(2, `say "no"`)
+	conns.Add(3)
+	conns.Add(-1)
+	latency.Observe(.05, "kinds")
+	latency.Observe(.5, "kinds")
+	latency.Observe(5, "kinds")
+	b := new(strings.Builder)
+	if _, err := r.WriteTo(b); chk.E(err) {
+		t.Fatal(err)
+	}
+	expected := `# TYPE cache_ratio gauge
+# HELP cache_ratio hit ratio\nof the cache
+cache_ratio 0.5
+# TYPE connections gauge
+# HELP connections open connections
+connections 2
+# TYPE events_rejected counter
+# HELP events_rejected events that were rejected
+events_rejected_total{reason="blocked"} 1
+events_rejected_total{reason="say \"no\""} 2
+# TYPE query_duration_seconds histogram
+# HELP query_duration_seconds query latency
+query_duration_seconds_bucket{path="kinds",le="0.1"} 1
+query_duration_seconds_bucket{path="kinds",le="1"} 2
+query_duration_seconds_bucket{path="kinds",le="+Inf"} 3
+query_duration_seconds_sum{path="kinds"} 5.55
+query_duration_seconds_count{path="kinds"} 3
+# EOF
+`
+	if b.String() != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, b.String())
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Header().Get("Content-Type") != ContentType || w.Body.String() != expected {
+		t.Fatalf("served %s:\n%s", w.Header().Get("Content-Type"), w.Body.String())
+	}
+}
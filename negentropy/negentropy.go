@@ -0,0 +1,353 @@
+// Package negentropy implements version 1 of the negentropy range based set reconciliation
+// protocol, which is used by nip-77 to find the events two relays don't have in common by
+// exchanging fingerprints of ranges of the (created_at, id) ordering of their events.
+package negentropy
+
+import (
+	"bytes"
+	"io"
+	"math"
+
+	"x.realy.lol/errorf"
+)
+
+// ProtocolVersion is the version byte at the start of every message.
+const ProtocolVersion = 0x61
+
+// The modes of the ranges of a message.
+const (
+	ModeSkip        = 0
+	ModeFingerprint = 1
+	ModeIdList      = 2
+)
+
+// MaxTimestamp is the timestamp of the upper bound of the last range, which is infinity.
+const MaxTimestamp = math.MaxUint64
+
+// MinFrameSizeLimit is the smallest limit on the size of messages.
+const MinFrameSizeLimit = 4096
+
+// buckets is the number of ranges a range is split into when its fingerprints differ.
+const buckets = 16
+
+// Bound is the upper bound of a range, the items before it have a smaller timestamp, or the
+// same timestamp and an id that sorts before the id prefix.
+type Bound struct {
+	Timestamp uint64
+	Id        []byte
+}
+
+// Negentropy is one side of a reconciliation of the items of a Vector.
+type Negentropy struct {
+	storage          *Vector
+	frameSizeLimit   int
+	initiator        bool
+	lastTimestampIn  uint64
+	lastTimestampOut uint64
+}
+
+// New creates a reconciliation of a sealed Vector. Messages are kept within frameSizeLimit
+// bytes, unless it is zero.
+func New(storage *Vector, frameSizeLimit int) (n *Negentropy, err error) {
+	if !storage.sealed {
+		err = errorf.E("negentropy storage is not sealed")
+		return
+	}
+	if frameSizeLimit != 0 && frameSizeLimit < MinFrameSizeLimit {
+		err = errorf.E("negentropy frame size limit must be at least %d", MinFrameSizeLimit)
+		return
+	}
+	return &Negentropy{storage: storage, frameSizeLimit: frameSizeLimit}, nil
+}
+
+// Initiate returns the first message of a reconciliation, which makes this side the client.
+func (n *Negentropy) Initiate() (msg []byte, err error) {
+	if n.initiator {
+		err = errorf.E("negentropy reconciliation already initiated")
+		return
+	}
+	n.initiator = true
+	n.lastTimestampOut = 0
+	msg = []byte{ProtocolVersion}
+	msg = n.splitRange(msg, 0, n.storage.Size(), Bound{Timestamp: MaxTimestamp})
+	return
+}
+
+// Reconcile processes a message from the client and returns the response.
+func (n *Negentropy) Reconcile(query []byte) (out []byte, err error) {
+	if n.initiator {
+		err = errorf.E("the initiator must use ReconcileClient")
+		return
+	}
+	out, _, _, err = n.reconcile(query)
+	return
+}
+
+// ReconcileClient processes a response from the server, and returns the next message, and
+// the ids that this side has and the other doesn't, and those it needs. The next message is
+// nil when the reconciliation is complete.
+func (n *Negentropy) ReconcileClient(query []byte) (out []byte, have, need [][]byte,
+	err error) {
+
+	if !n.initiator {
+		err = errorf.E("only the initiator can use ReconcileClient")
+		return
+	}
+	if out, have, need, err = n.reconcile(query); err != nil {
+		return
+	}
+	if len(out) == 1 {
+		out = nil
+	}
+	return
+}
+
+func (n *Negentropy) reconcile(query []byte) (out []byte, have, need [][]byte, err error) {
+	n.lastTimestampIn, n.lastTimestampOut = 0, 0
+	r := bytes.NewReader(query)
+	out = []byte{ProtocolVersion}
+	var version byte
+	if version, err = r.ReadByte(); err != nil {
+		err = errorf.E("empty negentropy message")
+		return
+	}
+	if version < 0x60 || version > 0x6f {
+		err = errorf.E("invalid negentropy protocol version byte %x", version)
+		return
+	}
+	if version != ProtocolVersion {
+		if n.initiator {
+			err = errorf.E("unsupported negentropy protocol version requested %x", version)
+			return
+		}
+		// the response tells the client which version this side supports.
+		return
+	}
+	size := n.storage.Size()
+	var prevBound Bound
+	var prevIndex int
+	var skip bool
+	for r.Len() > 0 {
+		var o []byte
+		doSkip := func() {
+			if skip {
+				skip = false
+				o = n.appendBound(o, prevBound)
+				o = appendVarint(o, ModeSkip)
+			}
+		}
+		var curr Bound
+		if curr, err = n.readBound(r); err != nil {
+			return
+		}
+		var mode uint64
+		if mode, err = readVarint(r); err != nil {
+			return
+		}
+		lower := prevIndex
+		upper := n.storage.lowerBound(prevIndex, size, curr)
+		switch mode {
+		case ModeSkip:
+			skip = true
+		case ModeFingerprint:
+			theirs := make([]byte, FingerprintSize)
+			if _, err = io.ReadFull(r, theirs); err != nil {
+				err = errorf.E("truncated negentropy fingerprint")
+				return
+			}
+			ours := n.storage.Fingerprint(lower, upper)
+			if !bytes.Equal(theirs, ours[:]) {
+				doSkip()
+				o = n.splitRange(o, lower, upper, curr)
+			} else {
+				skip = true
+			}
+		case ModeIdList:
+			var count uint64
+			if count, err = readVarint(r); err != nil {
+				return
+			}
+			if count > uint64(r.Len()/IdSize) {
+				err = errorf.E("truncated negentropy id list")
+				return
+			}
+			theirs := make(map[[IdSize]byte]struct{}, count)
+			for range count {
+				var id [IdSize]byte
+				_, _ = io.ReadFull(r, id[:])
+				theirs[id] = struct{}{}
+			}
+			for i := lower; i < upper; i++ {
+				id := n.storage.items[i].Id
+				if _, ok := theirs[id]; ok {
+					delete(theirs, id)
+				} else if n.initiator {
+					have = append(have, id[:])
+				}
+			}
+			if n.initiator {
+				skip = true
+				for id := range theirs {
+					need = append(need, id[:])
+				}
+				break
+			}
+			doSkip()
+			var ids []byte
+			var num int
+			end := curr
+			for i := lower; i < upper; i++ {
+				if n.exceeded(len(out) + len(o) + len(ids)) {
+					item := n.storage.items[i]
+					end = Bound{Timestamp: item.Timestamp, Id: item.Id[:]}
+					upper = i
+					break
+				}
+				ids = append(ids, n.storage.items[i].Id[:]...)
+				num++
+			}
+			o = n.appendBound(o, end)
+			o = appendVarint(o, ModeIdList)
+			o = appendVarint(o, uint64(num))
+			o = append(o, ids...)
+			out = append(out, o...)
+			o = nil
+		default:
+			err = errorf.E("unexpected negentropy mode %d", mode)
+			return
+		}
+		if n.exceeded(len(out) + len(o)) {
+			// the rest of the ranges are left for the next round, with a fingerprint of the
+			// remaining items.
+			fp := n.storage.Fingerprint(upper, size)
+			out = n.appendBound(out, Bound{Timestamp: MaxTimestamp})
+			out = appendVarint(out, ModeFingerprint)
+			out = append(out, fp[:]...)
+			break
+		}
+		out = append(out, o...)
+		prevIndex, prevBound = upper, curr
+	}
+	return
+}
+
+// splitRange appends the ranges for the items from lower to upper, the ids themselves if there
+// are few, otherwise the fingerprints of buckets of them.
+func (n *Negentropy) splitRange(o []byte, lower, upper int, upperBound Bound) []byte {
+	count := upper - lower
+	if count < buckets*2 {
+		o = n.appendBound(o, upperBound)
+		o = appendVarint(o, ModeIdList)
+		o = appendVarint(o, uint64(count))
+		for i := lower; i < upper; i++ {
+			o = append(o, n.storage.items[i].Id[:]...)
+		}
+		return o
+	}
+	perBucket, extra := count/buckets, count%buckets
+	curr := lower
+	for i := range buckets {
+		size := perBucket
+		if i < extra {
+			size++
+		}
+		fp := n.storage.Fingerprint(curr, curr+size)
+		curr += size
+		next := upperBound
+		if curr != upper {
+			next = minimalBound(n.storage.items[curr-1], n.storage.items[curr])
+		}
+		o = n.appendBound(o, next)
+		o = appendVarint(o, ModeFingerprint)
+		o = append(o, fp[:]...)
+	}
+	return o
+}
+
+func (n *Negentropy) exceeded(size int) bool {
+	return n.frameSizeLimit > 0 && size > n.frameSizeLimit-200
+}
+
+// minimalBound returns the shortest bound that is after prev and not after curr.
+func minimalBound(prev, curr Item) (b Bound) {
+	if curr.Timestamp != prev.Timestamp {
+		return Bound{Timestamp: curr.Timestamp}
+	}
+	var shared int
+	for shared < IdSize && prev.Id[shared] == curr.Id[shared] {
+		shared++
+	}
+	return Bound{Timestamp: curr.Timestamp, Id: curr.Id[:min(shared+1, IdSize)]}
+}
+
+// appendBound encodes a bound, its timestamp is the difference from the previous one in the
+// message, plus one, and zero is infinity.
+func (n *Negentropy) appendBound(o []byte, b Bound) []byte {
+	if b.Timestamp == MaxTimestamp {
+		n.lastTimestampOut = MaxTimestamp
+		o = appendVarint(o, 0)
+	} else {
+		delta := b.Timestamp - n.lastTimestampOut
+		n.lastTimestampOut = b.Timestamp
+		o = appendVarint(o, delta+1)
+	}
+	o = appendVarint(o, uint64(len(b.Id)))
+	return append(o, b.Id...)
+}
+
+func (n *Negentropy) readBound(r *bytes.Reader) (b Bound, err error) {
+	var ts uint64
+	if ts, err = readVarint(r); err != nil {
+		return
+	}
+	if ts == 0 || n.lastTimestampIn == MaxTimestamp {
+		b.Timestamp = MaxTimestamp
+	} else {
+		b.Timestamp = n.lastTimestampIn + ts - 1
+	}
+	n.lastTimestampIn = b.Timestamp
+	var l uint64
+	if l, err = readVarint(r); err != nil {
+		return
+	}
+	if l > IdSize {
+		err = errorf.E("negentropy bound id is longer than %d bytes", IdSize)
+		return
+	}
+	b.Id = make([]byte, l)
+	if _, err = io.ReadFull(r, b.Id); err != nil {
+		err = errorf.E("truncated negentropy bound")
+	}
+	return
+}
+
+// appendVarint encodes an unsigned integer in base 128 with the most significant digit first,
+// and the high bit set on all but the last byte.
+func appendVarint(o []byte, v uint64) []byte {
+	var b [10]byte
+	i := len(b) - 1
+	b[i] = byte(v & 0x7f)
+	for v >>= 7; v > 0; v >>= 7 {
+		i--
+		b[i] = byte(v&0x7f) | 0x80
+	}
+	return append(o, b[i:]...)
+}
+
+func readVarint(r *bytes.Reader) (v uint64, err error) {
+	for i := 0; ; i++ {
+		if i == 10 {
+			err = errorf.E("negentropy varint is too long")
+			return
+		}
+		var b byte
+		if b, err = r.ReadByte(); err != nil {
+			err = errorf.E("truncated negentropy varint")
+			return
+		}
+		v = v<<7 | uint64(b&0x7f)
+		if b&0x80 == 0 {
+			return
+		}
+	}
+}
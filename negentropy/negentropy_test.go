@@ -0,0 +1,176 @@
+package negentropy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestVarint(t *testing.T) {
+	for _, v := range []uint64{0, 1, 127, 128, 16383, 16384, 1 << 40, MaxTimestamp} {
+		b := appendVarint(nil, v)
+		got, err := readVarint(bytes.NewReader(b))
+		if err != nil || got != v {
+			t.Fatalf("varint %d decoded as %d: %v", v, got, err)
+		}
+	}
+	if b := appendVarint(nil, 300); !bytes.Equal(b, []byte{0x82, 0x2c}) {
+		t.Fatalf("300 encoded as %x", b)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	v := NewVector()
+	// the sum of the ids carries across the 64 bit words.
+	a, b := make([]byte, IdSize), make([]byte, IdSize)
+	for i := range 8 {
+		a[i], b[i] = 0xff, 0xff
+	}
+	b[0] = 0x01
+	if err := v.Insert(1, a); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Insert(2, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Seal(); err != nil {
+		t.Fatal(err)
+	}
+	sum := make([]byte, IdSize)
+	binary.LittleEndian.PutUint64(sum, 0xffffffffffffff00)
+	sum[8] = 1
+	hash := sha256.Sum256(append(sum, 2))
+	if fp := v.Fingerprint(0, 2); !bytes.Equal(fp[:], hash[:FingerprintSize]) {
+		t.Fatalf("fingerprint %x, expected %x", fp, hash[:FingerprintSize])
+	}
+}
+
+// sync reconciles two vectors and returns the ids the client has and needs.
+func sync(t *testing.T, client, server *Vector, frameSizeLimit int) (have, need [][]byte) {
+	c, err := New(client, frameSizeLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s *Negentropy
+	if s, err = New(server, frameSizeLimit); err != nil {
+		t.Fatal(err)
+	}
+	var msg []byte
+	if msg, err = c.Initiate(); err != nil {
+		t.Fatal(err)
+	}
+	for rounds := 0; msg != nil; rounds++ {
+		if rounds > 1000 {
+			t.Fatal("reconciliation did not finish")
+		}
+		if frameSizeLimit > 0 && len(msg) > frameSizeLimit {
+			t.Fatalf("message of %d bytes exceeds the limit", len(msg))
+		}
+		if msg, err = s.Reconcile(msg); err != nil {
+			t.Fatal(err)
+		}
+		if frameSizeLimit > 0 && len(msg) > frameSizeLimit {
+			t.Fatalf("response of %d bytes exceeds the limit", len(msg))
+		}
+		var h, n [][]byte
+		if msg, h, n, err = c.ReconcileClient(msg); err != nil {
+			t.Fatal(err)
+		}
+		have, need = append(have, h...), append(need, n...)
+	}
+	return
+}
+
+func sorted(ids [][]byte) [][]byte {
+	sort.Slice(ids, func(i, j int) bool { return bytes.Compare(ids[i], ids[j]) < 0 })
+	return ids
+}
+
+func TestReconcile(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, tc := range []struct {
+		name                           string
+		shared, clientOnly, serverOnly int
+		frameSizeLimit                 int
+	}{
+		{"empty", 0, 0, 0, 0},
+		{"same", 1000, 0, 0, 0},
+		{"client only", 0, 50, 0, 0},
+		{"server only", 0, 0, 50, 0},
+		{"few", 10, 3, 4, 0},
+		{"many", 20000, 500, 700, 0},
+		{"frame limit", 5000, 300, 400, MinFrameSizeLimit},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := NewVector(), NewVector()
+			var clientOnly, serverOnly [][]byte
+			add := func(n int, vs ...*Vector) (ids [][]byte) {
+				for range n {
+					id := make([]byte, IdSize)
+					rng.Read(id)
+					// few timestamps, so bounds need id prefixes.
+					ts := uint64(1700000000 + rng.Intn(100))
+					for _, v := range vs {
+						if err := v.Insert(ts, id); err != nil {
+							t.Fatal(err)
+						}
+					}
+					ids = append(ids, id)
+				}
+				return
+			}
+			add(tc.shared, client, server)
+			clientOnly = add(tc.clientOnly, client)
+			serverOnly = add(tc.serverOnly, server)
+			if err := client.Seal(); err != nil {
+				t.Fatal(err)
+			}
+			if err := server.Seal(); err != nil {
+				t.Fatal(err)
+			}
+			have, need := sync(t, client, server, tc.frameSizeLimit)
+			if len(have) != len(clientOnly) || len(need) != len(serverOnly) {
+				t.Fatalf("have %d need %d, expected %d and %d", len(have), len(need),
+					len(clientOnly), len(serverOnly))
+			}
+			for i, id := range sorted(clientOnly) {
+				if !bytes.Equal(sorted(have)[i], id) {
+					t.Fatalf("have %x, expected %x", have[i], id)
+				}
+			}
+			for i, id := range sorted(serverOnly) {
+				if !bytes.Equal(sorted(need)[i], id) {
+					t.Fatalf("need %x, expected %x", need[i], id)
+				}
+			}
+		})
+	}
+}
+
+func TestReconcile_Version(t *testing.T) {
+	v := NewVector()
+	if err := v.Seal(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(v, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the server responds to an unsupported version with the one it supports.
+	var out []byte
+	if out, err = s.Reconcile([]byte{0x62}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, []byte{ProtocolVersion}) {
+		t.Fatalf("unexpected response %x", out)
+	}
+	if _, err = s.Reconcile([]byte{0x01}); err == nil {
+		t.Fatal("invalid version byte was accepted")
+	}
+	if _, err = s.Reconcile([]byte{ProtocolVersion, 0x01}); err == nil {
+		t.Fatal("truncated message was accepted")
+	}
+}
@@ -0,0 +1,112 @@
+package negentropy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/bits"
+	"sort"
+
+	"x.realy.lol/errorf"
+)
+
+// IdSize is the size of the ids of items.
+const IdSize = 32
+
+// FingerprintSize is the size of the fingerprint of a range.
+const FingerprintSize = 16
+
+// Item is an element of the set that is reconciled, an event id and its created_at.
+type Item struct {
+	Timestamp uint64
+	Id        [IdSize]byte
+}
+
+// less is the order of items, by timestamp and then by id.
+func (a Item) less(b Item) bool {
+	if a.Timestamp != b.Timestamp {
+		return a.Timestamp < b.Timestamp
+	}
+	return bytes.Compare(a.Id[:], b.Id[:]) < 0
+}
+
+// before returns true if an item is before a bound. The id of the bound is a prefix that is
+// compared as if it was padded with zeros.
+func (a Item) before(b Bound) bool {
+	if a.Timestamp != b.Timestamp {
+		return a.Timestamp < b.Timestamp
+	}
+	var id [IdSize]byte
+	copy(id[:], b.Id)
+	return bytes.Compare(a.Id[:], id[:]) < 0
+}
+
+// Vector is the items of one side of a reconciliation, which are inserted and then sorted by
+// Seal.
+type Vector struct {
+	items  []Item
+	sealed bool
+}
+
+// NewVector creates an empty Vector.
+func NewVector() (v *Vector) { return &Vector{} }
+
+// Insert adds an item, which must be before the Vector is sealed.
+func (v *Vector) Insert(timestamp uint64, id []byte) (err error) {
+	if v.sealed {
+		return errorf.E("negentropy vector is sealed")
+	}
+	if len(id) != IdSize {
+		return errorf.E("negentropy item id must be %d bytes, got %d", IdSize, len(id))
+	}
+	item := Item{Timestamp: timestamp}
+	copy(item.Id[:], id)
+	v.items = append(v.items, item)
+	return
+}
+
+// Seal sorts the items, after which the Vector can be reconciled.
+func (v *Vector) Seal() (err error) {
+	if v.sealed {
+		return errorf.E("negentropy vector is already sealed")
+	}
+	sort.Slice(v.items, func(i, j int) bool { return v.items[i].less(v.items[j]) })
+	for i := 1; i < len(v.items); i++ {
+		if v.items[i] == v.items[i-1] {
+			return errorf.E("duplicate negentropy item %x", v.items[i].Id)
+		}
+	}
+	v.sealed = true
+	return
+}
+
+// Size returns the number of items.
+func (v *Vector) Size() int { return len(v.items) }
+
+// lowerBound returns the index of the first item from lower to upper that is not before a
+// bound, or upper if there is none.
+func (v *Vector) lowerBound(lower, upper int, b Bound) int {
+	return lower + sort.Search(upper-lower, func(i int) bool {
+		return !v.items[lower+i].before(b)
+	})
+}
+
+// Fingerprint returns the fingerprint of the items from lower to upper, the first bytes of the
+// SHA-256 hash of the sum of their ids as little endian 256 bit integers, and their count.
+func (v *Vector) Fingerprint(lower, upper int) (fp [FingerprintSize]byte) {
+	var sum [4]uint64
+	for _, item := range v.items[lower:upper] {
+		var carry uint64
+		for i := range sum {
+			sum[i], carry = bits.Add64(sum[i], binary.LittleEndian.Uint64(item.Id[i*8:]), carry)
+		}
+	}
+	b := make([]byte, IdSize, IdSize+10)
+	for i := range sum {
+		binary.LittleEndian.PutUint64(b[i*8:], sum[i])
+	}
+	b = appendVarint(b, uint64(upper-lower))
+	hash := sha256.Sum256(b)
+	copy(fp[:], hash[:])
+	return
+}
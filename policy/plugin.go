@@ -0,0 +1,188 @@
+package policy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/errorf"
+	"x.realy.lol/event"
+	"x.realy.lol/log"
+)
+
+// PluginTimeout is how long a plugin has to decide on an event before it is restarted.
+const PluginTimeout = 5 * time.Second
+
+// pluginRequest is the line written to a plugin for each event, in the format of the strfry
+// write policy plugins.
+type pluginRequest struct {
+	Type       string   `json:"type"`
+	Event      *event.E `json:"event"`
+	ReceivedAt int64    `json:"receivedAt"`
+	SourceType string   `json:"sourceType"`
+	SourceInfo string   `json:"sourceInfo"`
+}
+
+// pluginResponse is the line a plugin writes with its decision on an event.
+type pluginResponse struct {
+	Id     string `json:"id"`
+	Action string `json:"action"`
+	Msg    string `json:"msg"`
+}
+
+// Plugin is a write policy run by an external program, which reads a JSON object for each
+// event from its stdin and writes a JSON object with its decision to its stdout, one per line:
+//
+//	{"type": "new", "event": {...}, "receivedAt": <unix seconds>, "sourceType": "IP4",
+//		"sourceInfo": "<address>"}
+//	{"id": "<event id>", "action": "accept|reject|shadowReject", "msg": "<reason>"}
+//
+// The program is started when the first event is checked, and restarted if it exits or
+// doesn't answer within the Timeout. Events are rejected while it isn't working.
+type Plugin struct {
+	Path    string
+	Args    []string
+	Timeout time.Duration
+	mx      sync.Mutex
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	stdout  *bufio.Reader
+}
+
+// NewPlugin creates a Plugin that runs the program at path with the given arguments.
+func NewPlugin(path string, args ...string) (p *Plugin) {
+	return &Plugin{Path: path, Args: args, Timeout: PluginTimeout}
+}
+
+func (p *Plugin) Check(ctx context.Context, src *Source, ev *event.E) (res Result) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	var err error
+	if p.cmd == nil {
+		if err = p.start(); chk.E(err) {
+			return Result{Reject, "error: write policy is unavailable"}
+		}
+	}
+	var resp *pluginResponse
+	if resp, err = p.call(ctx, src, ev); err != nil {
+		log.E.F("write policy %s: %s", p.Path, err)
+		p.stop()
+		return Result{Reject, "error: write policy failed"}
+	}
+	switch resp.Action {
+	case "accept":
+		return Result{Accept, resp.Msg}
+	case "shadowReject":
+		return Result{ShadowReject, resp.Msg}
+	case "reject":
+		if resp.Msg == "" {
+			resp.Msg = "blocked: rejected by write policy"
+		}
+		return Result{Reject, resp.Msg}
+	}
+	log.E.F("write policy %s: unknown action %s", p.Path, resp.Action)
+	return Result{Reject, "error: write policy failed"}
+}
+
+// call writes the request for an event and reads the response, which must be for the same
+// event.
+func (p *Plugin) call(ctx context.Context, src *Source, ev *event.E) (resp *pluginResponse,
+	err error) {
+
+	req := pluginRequest{Type: "new", Event: ev, ReceivedAt: src.ReceivedAt.Unix(),
+		SourceType: sourceType(src.Remote), SourceInfo: src.Remote}
+	var b []byte
+	if b, err = json.Marshal(req); chk.E(err) {
+		return
+	}
+	if _, err = p.stdin.Write(append(b, '\n')); err != nil {
+		return
+	}
+	type line struct {
+		b   []byte
+		err error
+	}
+	// the read can't be interrupted, so it is done in another goroutine, which returns when
+	// the program is stopped if it times out.
+	read := make(chan line, 1)
+	go func() {
+		b, err := p.stdout.ReadBytes('\n')
+		read <- line{b, err}
+	}()
+	var l line
+	select {
+	case l = <-read:
+	case <-time.After(p.Timeout):
+		err = errorf.E("no response after %v", p.Timeout)
+		return
+	case <-ctx.Done():
+		err = ctx.Err()
+		return
+	}
+	if err = l.err; err != nil {
+		return
+	}
+	resp = &pluginResponse{}
+	if err = json.Unmarshal(l.b, resp); err != nil {
+		err = errorf.E("invalid response %s: %s", l.b, err)
+		return
+	}
+	if resp.Id != ev.Id {
+		err = errorf.E("response is for event %s, not %s", resp.Id, ev.Id)
+	}
+	return
+}
+
+func (p *Plugin) start() (err error) {
+	cmd := exec.Command(p.Path, p.Args...)
+	cmd.Stderr = os.Stderr
+	if p.stdin, err = cmd.StdinPipe(); err != nil {
+		return
+	}
+	var stdout io.ReadCloser
+	if stdout, err = cmd.StdoutPipe(); err != nil {
+		return
+	}
+	if err = cmd.Start(); err != nil {
+		return
+	}
+	p.cmd, p.stdout = cmd, bufio.NewReader(stdout)
+	log.I.F("started write policy %s", p.Path)
+	return
+}
+
+func (p *Plugin) stop() {
+	if p.cmd == nil {
+		return
+	}
+	_ = p.stdin.Close()
+	_ = p.cmd.Process.Kill()
+	_ = p.cmd.Wait()
+	p.cmd = nil
+}
+
+// Close stops the program.
+func (p *Plugin) Close() {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	p.stop()
+}
+
+// sourceType is the strfry source type of a remote address.
+func sourceType(remote string) string {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		host = remote
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		return "IP6"
+	}
+	return "IP4"
+}
@@ -0,0 +1,150 @@
+// Package policy is the write policies that decide whether the relay accepts an event, which
+// are evaluated in order before it is stored.
+package policy
+
+import (
+	"context"
+	"fmt"
+	"math/bits"
+	"slices"
+	"time"
+
+	"x.realy.lol/event"
+	"x.realy.lol/timestamp"
+)
+
+// Action is what a policy decides to do with an event.
+type Action int
+
+const (
+	// Accept lets the event be stored, unless a later policy rejects it.
+	Accept Action = iota
+	// Reject refuses the event, the client is told the reason.
+	Reject
+	// ShadowReject tells the client the event was accepted, but it isn't stored or sent to
+	// subscriptions.
+	ShadowReject
+)
+
+func (a Action) String() string {
+	switch a {
+	case Accept:
+		return "accept"
+	case Reject:
+		return "reject"
+	case ShadowReject:
+		return "shadowReject"
+	}
+	return fmt.Sprintf("action(%d)", int(a))
+}
+
+// Result is the decision of a policy, the Reason is sent to the client when the event is
+// rejected, and should start with one of the nip-01 machine readable prefixes.
+type Result struct {
+	Action Action
+	Reason string
+}
+
+// Source is the client an event was received from, or that a query is made by.
+type Source struct {
+	// Remote is the address of the client.
+	Remote string
+	// Pubkey is the hex pubkey the client authenticated as, it is empty if it hasn't.
+	Pubkey string
+	// ReceivedAt is when the event was received.
+	ReceivedAt time.Time
+}
+
+// I is a write policy. Check is called with the context of the connection the event was
+// received on, and must be safe to call concurrently.
+type I interface {
+	Check(ctx context.Context, src *Source, ev *event.E) (res Result)
+}
+
+// Func is a function that is a write policy.
+type Func func(ctx context.Context, src *Source, ev *event.E) (res Result)
+
+func (f Func) Check(ctx context.Context, src *Source, ev *event.E) (res Result) {
+	return f(ctx, src, ev)
+}
+
+// Chain is a list of policies that are evaluated in order, the first one that doesn't accept
+// the event decides.
+type Chain []I
+
+func (c Chain) Check(ctx context.Context, src *Source, ev *event.E) (res Result) {
+	for _, p := range c {
+		if res = p.Check(ctx, src, ev); res.Action != Accept {
+			return
+		}
+	}
+	return
+}
+
+// Kinds accepts only events of the Allow kinds, if there are any, and rejects events of the
+// Deny kinds.
+type Kinds struct {
+	Allow []int
+	Deny  []int
+}
+
+func (k *Kinds) Check(_ context.Context, _ *Source, ev *event.E) (res Result) {
+	if slices.Contains(k.Deny, ev.Kind) ||
+		(len(k.Allow) > 0 && !slices.Contains(k.Allow, ev.Kind)) {
+		return Result{Reject, fmt.Sprintf("blocked: kind %d is not accepted", ev.Kind)}
+	}
+	return
+}
+
+// Pubkeys accepts only events authored by the hex pubkeys of the allowlist.
+type Pubkeys []string
+
+func (p Pubkeys) Check(_ context.Context, _ *Source, ev *event.E) (res Result) {
+	if !slices.Contains(p, ev.Pubkey) {
+		return Result{Reject, "restricted: pubkey is not allowed to publish"}
+	}
+	return
+}
+
+// PoW rejects events whose id has fewer leading zero bits than MinDifficulty, the nip-13 proof
+// of work.
+type PoW struct {
+	MinDifficulty int
+}
+
+func (p *PoW) Check(_ context.Context, _ *Source, ev *event.E) (res Result) {
+	if d := Difficulty(ev.GetIdBytes()); d < p.MinDifficulty {
+		return Result{Reject, fmt.Sprintf("pow: difficulty %d is less than %d", d,
+			p.MinDifficulty)}
+	}
+	return
+}
+
+// Difficulty returns the number of leading zero bits of an event id.
+func Difficulty(id []byte) (d int) {
+	for _, b := range id {
+		if b != 0 {
+			return d + bits.LeadingZeros8(b)
+		}
+		d += 8
+	}
+	return
+}
+
+// CreatedAt rejects events created more than MaxAge before or MaxFuture after the time they
+// are received. A limit of zero is not applied.
+type CreatedAt struct {
+	MaxAge    time.Duration
+	MaxFuture time.Duration
+}
+
+func (c *CreatedAt) Check(_ context.Context, src *Source, ev *event.E) (res Result) {
+	now := timestamp.New(src.ReceivedAt.Unix())
+	if c.MaxAge > 0 && ev.CreatedAt < now-timestamp.New(c.MaxAge.Seconds()) {
+		return Result{Reject, "invalid: created_at is too far in the past"}
+	}
+	if c.MaxFuture > 0 && ev.CreatedAt > now+timestamp.New(c.MaxFuture.Seconds()) {
+		return Result{Reject, "invalid: created_at is too far in the future"}
+	}
+	return
+}
@@ -0,0 +1,217 @@
+package policy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/database"
+	"x.realy.lol/event"
+	"x.realy.lol/filter"
+	"x.realy.lol/hex"
+	"x.realy.lol/kind"
+	"x.realy.lol/p256k"
+	"x.realy.lol/tags"
+	"x.realy.lol/timestamp"
+)
+
+// TestMain runs the test binary as a write policy plugin when it is started by
+// TestPlugin. It rejects events containing "spam", shadow rejects events containing
+// "shadow", stops answering for "hang" and accepts everything else.
+func TestMain(m *testing.M) {
+	if os.Getenv("REALY_TEST_PLUGIN") == "" {
+		os.Exit(m.Run())
+	}
+	sc := bufio.NewScanner(os.Stdin)
+	for sc.Scan() {
+		var req pluginRequest
+		if err := json.Unmarshal(sc.Bytes(), &req); err != nil {
+			os.Exit(1)
+		}
+		resp := pluginResponse{Id: req.Event.Id, Action: "accept"}
+		switch {
+		case strings.Contains(req.Event.Content, "hang"):
+			time.Sleep(time.Hour)
+		case strings.Contains(req.Event.Content, "spam"):
+			resp.Action, resp.Msg = "reject", "blocked: spam from "+req.SourceType
+		case strings.Contains(req.Event.Content, "shadow"):
+			resp.Action = "shadowReject"
+		}
+		b, _ := json.Marshal(resp)
+		fmt.Println(string(b))
+	}
+}
+
+func testEvent(t *testing.T, k int, content string) (ev *event.E) {
+	sign := &p256k.Signer{}
+	if err := sign.Generate(); chk.E(err) {
+		t.Fatal(err)
+	}
+	ev = event.New()
+	ev.Kind = k
+	ev.CreatedAt = timestamp.Now()
+	ev.Content = content
+	if err := ev.Sign(sign); chk.E(err) {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestChain(t *testing.T) {
+	ctx := context.Background()
+	src := &Source{Remote: "127.0.0.1:1234", ReceivedAt: time.Now()}
+	note := testEvent(t, kind.TextNote, "note")
+	c := Chain{
+		&Kinds{Deny: []int{kind.Reaction}},
+		&CreatedAt{MaxAge: time.Hour, MaxFuture: time.Minute},
+	}
+	if res := c.Check(ctx, src, note); res.Action != Accept {
+		t.Fatalf("note was not accepted: %s", res.Reason)
+	}
+	if res := c.Check(ctx, src, testEvent(t, kind.Reaction, "+")); res.Action != Reject ||
+		!strings.HasPrefix(res.Reason, "blocked:") {
+		t.Fatalf("reaction was not rejected: %v %s", res.Action, res.Reason)
+	}
+	old := &Source{Remote: src.Remote, ReceivedAt: time.Now().Add(2 * time.Hour)}
+	if res := c.Check(ctx, old, note); res.Action != Reject {
+		t.Fatal("an old event was not rejected")
+	}
+	if res := (Pubkeys{note.Pubkey}).Check(ctx, src, testEvent(t, kind.TextNote, "")); res.Action != Reject {
+		t.Fatal("an event from another pubkey was not rejected")
+	}
+}
+
+func TestPoW(t *testing.T) {
+	for _, tc := range []struct {
+		id []byte
+		d  int
+	}{
+		{[]byte{0xff}, 0},
+		{[]byte{0x00, 0x0f}, 12},
+		{[]byte{0x00, 0x00, 0x01}, 23},
+	} {
+		if d := Difficulty(tc.id); d != tc.d {
+			t.Errorf("difficulty of %x is %d, expected %d", tc.id, d, tc.d)
+		}
+	}
+	ev := testEvent(t, kind.TextNote, "")
+	if res := (&PoW{MinDifficulty: 40}).Check(context.Background(), &Source{}, ev); res.Action != Reject ||
+		!strings.HasPrefix(res.Reason, "pow:") {
+		t.Fatalf("an event without proof of work was not rejected")
+	}
+}
+
+func TestPlugin(t *testing.T) {
+	t.Setenv("REALY_TEST_PLUGIN", "1")
+	p := NewPlugin(os.Args[0])
+	p.Timeout = time.Second
+	defer p.Close()
+	ctx := context.Background()
+	src := &Source{Remote: "[::1]:1234", ReceivedAt: time.Now()}
+	for _, tc := range []struct {
+		content string
+		action  Action
+		reason  string
+	}{
+		{"note", Accept, ""},
+		{"spam", Reject, "blocked: spam from IP6"},
+		{"shadow", ShadowReject, ""},
+		// the plugin is restarted after it times out.
+		{"hang", Reject, "error: write policy failed"},
+		{"note", Accept, ""},
+	} {
+		res := p.Check(ctx, src, testEvent(t, kind.TextNote, tc.content))
+		if res.Action != tc.action || res.Reason != tc.reason {
+			t.Errorf("%s: expected %v %q, got %v %q", tc.content, tc.action, tc.reason,
+				res.Action, res.Reason)
+		}
+	}
+}
+
+func TestReadChain(t *testing.T) {
+	ctx := context.Background()
+	c := ReadChain{AnonymousKinds{kind.ProfileMetadata, kind.TextNote},
+		&Limit{Anonymous: 10, Authenticated: 100}}
+	anon, authed := &Source{}, &Source{Pubkey: "ab"}
+	f := filter.F{Kinds: []int{kind.TextNote, kind.Reaction}}
+	if _, reason := c.Query(ctx, anon, &f); reason != "" || len(f.Kinds) != 1 ||
+		f.Kinds[0] != kind.TextNote || *f.Limit != 10 {
+		t.Fatalf("the anonymous filter was not restricted: %s %v", reason, f)
+	}
+	f = filter.F{Kinds: []int{kind.Reaction}, Limit: filter.IntToPointer(500)}
+	if _, reason := c.Query(ctx, anon, &f); reason == "" {
+		t.Fatal("an anonymous filter for other kinds was not refused")
+	}
+	if _, reason := c.Query(ctx, authed, &f); reason != "" || *f.Limit != 100 {
+		t.Fatalf("the authenticated filter was not capped: %s %v", reason, f)
+	}
+	reaction := testEvent(t, kind.Reaction, "+")
+	if c.Result(ctx, anon, reaction) != nil || c.Result(ctx, authed, reaction) != reaction {
+		t.Fatal("the reaction was not only sent to the authenticated client")
+	}
+}
+
+func TestMutes(t *testing.T) {
+	d := database.New()
+	if err := d.Init(t.TempDir()); chk.E(err) {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	viewer, muted := &p256k.Signer{}, &p256k.Signer{}
+	for _, sign := range []*p256k.Signer{viewer, muted} {
+		if err := sign.Generate(); chk.E(err) {
+			t.Fatal(err)
+		}
+	}
+	store := func(sign *p256k.Signer, k int, created timestamp.Timestamp, tt tags.Tags) (
+		ev *event.E) {
+
+		ev = event.New()
+		ev.Kind, ev.CreatedAt, ev.Tags = k, created, tt
+		if err := ev.Sign(sign); chk.E(err) {
+			t.Fatal(err)
+		}
+		if err := d.StoreEvent(ev); chk.E(err) {
+			t.Fatal(err)
+		}
+		return
+	}
+	now := timestamp.Now()
+	note := store(muted, kind.TextNote, now-10, nil)
+	store(viewer, kind.MuteList, now-10, tags.Tags{{"p", hex.Enc(muted.Pub())}})
+	ctx, src := context.Background(), &Source{Pubkey: hex.Enc(viewer.Pub())}
+	m := &Mutes{D: d}
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if m.Result(ctx, src, note) != nil {
+				t.Error("a muted event was sent")
+			}
+		}()
+	}
+	wg.Wait()
+	cached := m.cache[src.Pubkey]
+	rules, _ := m.Query(ctx, src, &filter.F{})
+	if len(rules) != 1 || m.cache[src.Pubkey] != cached {
+		t.Fatal("the mutes were not cached")
+	}
+	// the mutes are read again once they expire.
+	store(viewer, kind.MuteList, now, nil)
+	if m.Result(ctx, src, note) != nil {
+		t.Fatal("the cached mutes were not used")
+	}
+	cached.loaded = time.Now().Add(-2 * MuteCacheTTL)
+	if rules, _ = m.Query(ctx, src, &filter.F{}); len(rules) != 0 ||
+		m.Result(ctx, src, note) != note {
+		t.Fatal("the expired mutes were not read again")
+	}
+}
@@ -0,0 +1,255 @@
+package policy
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/database"
+	"x.realy.lol/database/indexes/types/pubhash"
+	"x.realy.lol/event"
+	"x.realy.lol/filter"
+	"x.realy.lol/hex"
+)
+
+// Reader is a read policy, which decides what clients can query and what they are sent.
+// Its methods must be safe to call concurrently.
+type Reader interface {
+	// Query is called with each filter of a REQ or COUNT before it runs. It can change the
+	// filter, and return rules that are checked against the index of each event the filter
+	// matches. If the reason isn't empty the query is refused with it, and it should start with
+	// one of the nip-01 machine readable prefixes. The rules are only applied to stored
+	// events, so events that they drop should also be dropped by Result.
+	Query(ctx context.Context, src *Source, f *filter.F) (rules []database.IndexRule,
+		reason string)
+	// Result is called with each event before it is sent to the client, both the stored events
+	// a REQ finds and new ones that match its subscription. It returns the event to send,
+	// which may be a changed copy, or nil if it isn't sent. The event must not be modified.
+	Result(ctx context.Context, src *Source, ev *event.E) (out *event.E)
+}
+
+// ReadChain is a list of read policies that are applied in order. The first to refuse a query
+// decides, and the rules of all of them are combined. Each gets the event the one before it
+// returned.
+type ReadChain []Reader
+
+func (c ReadChain) Query(ctx context.Context, src *Source, f *filter.F) (
+	rules []database.IndexRule, reason string) {
+
+	for _, r := range c {
+		var rr []database.IndexRule
+		if rr, reason = r.Query(ctx, src, f); reason != "" {
+			return nil, reason
+		}
+		rules = append(rules, rr...)
+	}
+	return
+}
+
+func (c ReadChain) Result(ctx context.Context, src *Source, ev *event.E) (out *event.E) {
+	out = ev
+	for _, r := range c {
+		if out = r.Result(ctx, src, out); out == nil {
+			return
+		}
+	}
+	return
+}
+
+// ReadFuncs is a read policy made of functions, either of which may be nil.
+type ReadFuncs struct {
+	QueryFunc func(ctx context.Context, src *Source, f *filter.F) (
+		rules []database.IndexRule, reason string)
+	ResultFunc func(ctx context.Context, src *Source, ev *event.E) (out *event.E)
+}
+
+func (r *ReadFuncs) Query(ctx context.Context, src *Source, f *filter.F) (
+	rules []database.IndexRule, reason string) {
+
+	if r.QueryFunc == nil {
+		return
+	}
+	return r.QueryFunc(ctx, src, f)
+}
+
+func (r *ReadFuncs) Result(ctx context.Context, src *Source, ev *event.E) (out *event.E) {
+	if r.ResultFunc == nil {
+		return ev
+	}
+	return r.ResultFunc(ctx, src, ev)
+}
+
+// AnonymousKinds are the only kinds that clients that haven't authenticated can read. The
+// kinds of their filters are narrowed to these, and a filter for none of them is refused.
+type AnonymousKinds []int
+
+func (a AnonymousKinds) Query(_ context.Context, src *Source, f *filter.F) (
+	rules []database.IndexRule, reason string) {
+
+	if src.Pubkey != "" {
+		return
+	}
+	if len(f.Kinds) == 0 {
+		f.Kinds = slices.Clone(a)
+		return
+	}
+	f.Kinds = slices.DeleteFunc(slices.Clone(f.Kinds), func(k int) bool {
+		return !slices.Contains(a, k)
+	})
+	if len(f.Kinds) == 0 {
+		reason = "auth-required: these kinds can only be read by authenticated clients"
+	}
+	return
+}
+
+func (a AnonymousKinds) Result(_ context.Context, src *Source, ev *event.E) (out *event.E) {
+	if src.Pubkey == "" && !slices.Contains(a, ev.Kind) {
+		return
+	}
+	return ev
+}
+
+// Limit caps the limit of the filters of clients that haven't authenticated to Anonymous, and
+// of those that have to Authenticated. A limit of zero is not applied.
+type Limit struct {
+	Anonymous     int
+	Authenticated int
+}
+
+func (l *Limit) Query(_ context.Context, src *Source, f *filter.F) (
+	rules []database.IndexRule, reason string) {
+
+	max := l.Anonymous
+	if src.Pubkey != "" {
+		max = l.Authenticated
+	}
+	if max > 0 && (f.Limit == nil || *f.Limit > max) {
+		f.Limit = filter.IntToPointer(max)
+	}
+	return
+}
+
+func (l *Limit) Result(_ context.Context, _ *Source, ev *event.E) (out *event.E) { return ev }
+
+// HideAuthors are hex pubkeys whose events are not sent to clients, though they are stored.
+type HideAuthors []string
+
+func (h HideAuthors) Query(_ context.Context, _ *Source, _ *filter.F) (
+	rules []database.IndexRule, reason string) {
+
+	var authors []*pubhash.T
+	for _, pk := range h {
+		b, err := hex.Dec(pk)
+		if chk.E(err) {
+			continue
+		}
+		ph := pubhash.New()
+		if err = ph.FromPubkey(b); chk.E(err) {
+			continue
+		}
+		authors = append(authors, ph)
+	}
+	return []database.IndexRule{database.ExcludeAuthors(authors)}, ""
+}
+
+func (h HideAuthors) Result(_ context.Context, _ *Source, ev *event.E) (out *event.E) {
+	if slices.Contains(h, ev.Pubkey) {
+		return
+	}
+	return ev
+}
+
+// MuteCacheTTL is how long the mutes of a client, and the rule for its queries, are used
+// before they are read again.
+const MuteCacheTTL = time.Minute
+
+// Mutes is a read policy that doesn't send authenticated clients the events they have muted
+// with their nip-51 mute list and mute sets, see database.D.Mutes.
+type Mutes struct {
+	D     *database.D
+	mx    sync.Mutex
+	cache map[string]*cachedMutes
+}
+
+// cachedMutes are the mutes of a client. The rule is only made for queries, as new events are
+// checked with the mutes.
+type cachedMutes struct {
+	// ready is closed once the mutes are read.
+	ready    chan struct{}
+	mutes    *database.Mutes
+	loaded   time.Time
+	ruleOnce sync.Once
+	rule     database.IndexRule
+}
+
+func (m *Mutes) Query(_ context.Context, src *Source, _ *filter.F) (
+	rules []database.IndexRule, reason string) {
+
+	if src.Pubkey == "" {
+		return
+	}
+	c := m.load(src.Pubkey)
+	c.ruleOnce.Do(func() {
+		var err error
+		if c.rule, err = m.D.MuteRuleOf(c.mutes); chk.E(err) {
+			c.rule = nil
+		}
+	})
+	if c.rule == nil {
+		return
+	}
+	return []database.IndexRule{c.rule}, ""
+}
+
+func (m *Mutes) Result(_ context.Context, src *Source, ev *event.E) (out *event.E) {
+	if src.Pubkey == "" {
+		return ev
+	}
+	if m.load(src.Pubkey).mutes.Muted(ev) {
+		return
+	}
+	return ev
+}
+
+// load returns the cached mutes of a client, reading them if they aren't cached or are older
+// than MuteCacheTTL. They are read without holding the lock of the cache, and only once, the
+// others that need them at the same time wait for them.
+func (m *Mutes) load(pubkey string) (c *cachedMutes) {
+	m.mx.Lock()
+	c, ok := m.cache[pubkey]
+	if ok {
+		select {
+		case <-c.ready:
+			ok = time.Since(c.loaded) <= MuteCacheTTL
+		default:
+			// they are being read.
+		}
+	}
+	if ok {
+		m.mx.Unlock()
+		<-c.ready
+		return
+	}
+	if m.cache == nil || len(m.cache) >= maxCachedMutes {
+		m.cache = make(map[string]*cachedMutes)
+	}
+	c = &cachedMutes{ready: make(chan struct{})}
+	m.cache[pubkey] = c
+	m.mx.Unlock()
+	defer close(c.ready)
+	var err error
+	if c.mutes, err = m.D.Mutes(pubkey); chk.E(err) {
+		// nothing is muted until they are read again, which the zero time makes the next
+		// time they are needed.
+		c.mutes = &database.Mutes{}
+		return
+	}
+	c.loaded = time.Now()
+	return
+}
+
+// maxCachedMutes is the most clients whose mutes are cached, when it is reached the cache is
+// cleared.
+const maxCachedMutes = 10000
@@ -0,0 +1,51 @@
+package relay
+
+import (
+	"x.realy.lol/database"
+	"x.realy.lol/event"
+)
+
+// accessLists are the allow and deny lists of the configuration, as sets.
+type accessLists struct {
+	allowPubkeys map[string]struct{}
+	denyPubkeys  map[string]struct{}
+	denyEvents   map[string]struct{}
+	denyKinds    map[int]struct{}
+}
+
+func newAccessLists(a database.Access) (l *accessLists) {
+	l = &accessLists{
+		allowPubkeys: set(a.AllowPubkeys),
+		denyPubkeys:  set(a.DenyPubkeys),
+		denyEvents:   set(a.DenyEvents),
+		denyKinds:    set(a.DenyKinds),
+	}
+	return
+}
+
+func set[K comparable](list []K) (s map[K]struct{}) {
+	s = make(map[K]struct{}, len(list))
+	for _, v := range list {
+		s[v] = struct{}{}
+	}
+	return
+}
+
+// check returns the reason an event can't be published, or an empty string if it can.
+func (l *accessLists) check(ev *event.E) (reason string) {
+	if _, ok := l.denyEvents[ev.Id]; ok {
+		return "blocked: event is banned"
+	}
+	if _, ok := l.denyPubkeys[ev.Pubkey]; ok {
+		return "blocked: pubkey is banned"
+	}
+	if _, ok := l.denyKinds[ev.Kind]; ok {
+		return "blocked: kind is not accepted"
+	}
+	if len(l.allowPubkeys) > 0 {
+		if _, ok := l.allowPubkeys[ev.Pubkey]; !ok {
+			return "restricted: pubkey is not allowed to publish"
+		}
+	}
+	return
+}
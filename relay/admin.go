@@ -0,0 +1,316 @@
+package relay
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/database"
+	"x.realy.lol/errorf"
+	"x.realy.lol/filter"
+	"x.realy.lol/hex"
+	"x.realy.lol/httpauth"
+	"x.realy.lol/kind"
+	"x.realy.lol/log"
+)
+
+// ManagementContentType is the content type of nip-86 relay management requests and
+// responses.
+const ManagementContentType = "application/nostr+json+rpc"
+
+// ReportLimit is the most reports that are read to list the events needing moderation.
+const ReportLimit = 500
+
+// managementRequest is a nip-86 request.
+//
+//	{"method": "<method>", "params": [...]}
+type managementRequest struct {
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+// managementResponse is a nip-86 response, with either a result or an error.
+type managementResponse struct {
+	Result any    `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// listed is an entry of the lists returned by the management methods.
+type listed struct {
+	Pubkey string `json:"pubkey,omitempty"`
+	Id     string `json:"id,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// managementMethod is a management method, which only the superuser can call if superuser is
+// set.
+type managementMethod struct {
+	superuser bool
+	call      func(s *Server, params []json.RawMessage) (result any, err error)
+}
+
+// managementMethods are the supported nip-86 methods, and grantadmin, revokeadmin and
+// listadmins, which the superuser uses to delegate the others. Allowing a pubkey adds it to
+// the allow list, so once any are allowed, only allowed pubkeys can publish.
+var managementMethods = map[string]managementMethod{
+	"banpubkey": {call: func(s *Server, params []json.RawMessage) (result any, err error) {
+		return s.updateAccess(params, func(a *database.Access, pk string) {
+			a.DenyPubkeys = with(a.DenyPubkeys, pk)
+			a.AllowPubkeys = without(a.AllowPubkeys, pk)
+		})
+	}},
+	"allowpubkey": {call: func(s *Server, params []json.RawMessage) (result any, err error) {
+		return s.updateAccess(params, func(a *database.Access, pk string) {
+			a.AllowPubkeys = with(a.AllowPubkeys, pk)
+			a.DenyPubkeys = without(a.DenyPubkeys, pk)
+		})
+	}},
+	"listbannedpubkeys": {call: func(s *Server, _ []json.RawMessage) (result any, err error) {
+		a := s.D.Config().Access
+		return listEntries(a.DenyPubkeys, a.Reasons, false), nil
+	}},
+	"listallowedpubkeys": {call: func(s *Server, _ []json.RawMessage) (result any, err error) {
+		a := s.D.Config().Access
+		return listEntries(a.AllowPubkeys, a.Reasons, false), nil
+	}},
+	"banevent": {call: func(s *Server, params []json.RawMessage) (result any, err error) {
+		if result, err = s.updateAccess(params, func(a *database.Access, id string) {
+			a.DenyEvents = with(a.DenyEvents, id)
+		}); err != nil {
+			return
+		}
+		var id string
+		_ = json.Unmarshal(params[0], &id)
+		err = s.deleteEvent(id)
+		return
+	}},
+	"allowevent": {call: func(s *Server, params []json.RawMessage) (result any, err error) {
+		// the event is no longer listed, so there is no reason to keep.
+		return s.updateAccess(params[:min(1, len(params))], func(a *database.Access, id string) {
+			a.DenyEvents = without(a.DenyEvents, id)
+		})
+	}},
+	"listbannedevents": {call: func(s *Server, _ []json.RawMessage) (result any, err error) {
+		a := s.D.Config().Access
+		return listEntries(a.DenyEvents, a.Reasons, true), nil
+	}},
+	"listeventsneedingmoderation": {call: func(s *Server, _ []json.RawMessage) (result any, err error) {
+		return s.reportedEvents()
+	}},
+	"changerelayname": {call: func(s *Server, params []json.RawMessage) (result any, err error) {
+		return s.updateInfo(params, func(i *database.Info, v string) { i.Name = v })
+	}},
+	"changerelaydescription": {call: func(s *Server, params []json.RawMessage) (result any, err error) {
+		return s.updateInfo(params, func(i *database.Info, v string) { i.Description = v })
+	}},
+	"changerelayicon": {call: func(s *Server, params []json.RawMessage) (result any, err error) {
+		return s.updateInfo(params, func(i *database.Info, v string) { i.Icon = v })
+	}},
+	"stats": {call: func(s *Server, params []json.RawMessage) (result any, err error) {
+		// the optional parameter computes them again instead of returning the cached stats.
+		var refresh bool
+		if len(params) > 0 {
+			_ = json.Unmarshal(params[0], &refresh)
+		}
+		return s.D.StoreStats(refresh)
+	}},
+	"grantadmin": {superuser: true, call: func(s *Server, params []json.RawMessage) (result any, err error) {
+		return s.updateAdmins(params, with)
+	}},
+	"revokeadmin": {superuser: true, call: func(s *Server, params []json.RawMessage) (result any, err error) {
+		return s.updateAdmins(params, without)
+	}},
+	"listadmins": {superuser: true, call: func(s *Server, _ []json.RawMessage) (result any, err error) {
+		return listEntries(s.D.Config().Admins, nil, false), nil
+	}},
+}
+
+// handleManagement serves a nip-86 relay management request, which must have a nip-98
+// Authorization header signed by the superuser or one of the admins. It is served through
+// httpauth.Middleware, which verifies the header.
+func (s *Server) handleManagement(w http.ResponseWriter, r *http.Request) {
+	pubkey, ok := httpauth.Pubkey(r.Context())
+	if !ok {
+		writeManagement(w, http.StatusUnauthorized, nil,
+			errorf.E("management requests require nip-98 authorization"))
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, httpauth.MaxBody))
+	if err != nil {
+		writeManagement(w, http.StatusRequestEntityTooLarge, nil, err)
+		return
+	}
+	superuser := pubkey == s.Superuser
+	if !superuser && !slices.Contains(s.D.Config().Admins, pubkey) {
+		writeManagement(w, http.StatusForbidden, nil, errorf.E("%s is not an admin", pubkey))
+		return
+	}
+	var req managementRequest
+	if err = json.Unmarshal(body, &req); err != nil {
+		writeManagement(w, http.StatusBadRequest, nil, errorf.E("invalid request: %s", err))
+		return
+	}
+	if req.Method == "supportedmethods" {
+		var methods []string
+		for name, m := range managementMethods {
+			if superuser || !m.superuser {
+				methods = append(methods, name)
+			}
+		}
+		sort.Strings(methods)
+		writeManagement(w, http.StatusOK, append([]string{req.Method}, methods...), nil)
+		return
+	}
+	m, ok := managementMethods[req.Method]
+	if !ok || (m.superuser && !superuser) {
+		writeManagement(w, http.StatusOK, nil, errorf.E("unsupported method %s", req.Method))
+		return
+	}
+	var result any
+	if result, err = m.call(s, req.Params); err != nil {
+		writeManagement(w, http.StatusOK, nil, err)
+		return
+	}
+	log.I.F("%s called %s %s", pubkey, req.Method, req.Params)
+	writeManagement(w, http.StatusOK, result, nil)
+}
+
+func writeManagement(w http.ResponseWriter, status int, result any, err error) {
+	resp := managementResponse{Result: result}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	w.Header().Set("Content-Type", ManagementContentType)
+	w.WriteHeader(status)
+	chk.T(json.NewEncoder(w).Encode(resp))
+}
+
+// updateAccess changes the access lists of the configuration for the pubkey or event id in the
+// first parameter, and records the reason in the optional second parameter.
+func (s *Server) updateAccess(params []json.RawMessage,
+	fn func(a *database.Access, v string)) (result any, err error) {
+
+	var v, reason string
+	if len(params) < 1 || json.Unmarshal(params[0], &v) != nil {
+		err = errorf.E("missing pubkey or event id parameter")
+		return
+	}
+	if len(params) > 1 {
+		_ = json.Unmarshal(params[1], &reason)
+	}
+	if err = s.D.UpdateConfig(func(c *database.Config) {
+		fn(&c.Access, v)
+		delete(c.Access.Reasons, v)
+		if reason != "" {
+			if c.Access.Reasons == nil {
+				c.Access.Reasons = make(map[string]string)
+			}
+			c.Access.Reasons[v] = reason
+		}
+	}); err != nil {
+		return
+	}
+	return true, nil
+}
+
+// updateInfo changes a field of the relay information to the first parameter.
+func (s *Server) updateInfo(params []json.RawMessage,
+	fn func(i *database.Info, v string)) (result any, err error) {
+
+	var v string
+	if len(params) < 1 || json.Unmarshal(params[0], &v) != nil {
+		err = errorf.E("missing string parameter")
+		return
+	}
+	if err = s.D.UpdateConfig(func(c *database.Config) { fn(&c.Info, v) }); err != nil {
+		return
+	}
+	return true, nil
+}
+
+// updateAdmins adds or removes the pubkey in the first parameter from the admins.
+func (s *Server) updateAdmins(params []json.RawMessage,
+	fn func(list []string, v string) []string) (result any, err error) {
+
+	var pk string
+	if len(params) < 1 || json.Unmarshal(params[0], &pk) != nil {
+		err = errorf.E("missing pubkey parameter")
+		return
+	}
+	if err = s.D.UpdateConfig(func(c *database.Config) { c.Admins = fn(c.Admins, pk) }); err != nil {
+		return
+	}
+	return true, nil
+}
+
+// deleteEvent deletes a banned event if it is stored.
+func (s *Server) deleteEvent(id string) (err error) {
+	var b []byte
+	if b, err = hex.Dec(id); chk.E(err) {
+		return
+	}
+	ser, err := s.D.FindEventSerialById(b)
+	if err != nil {
+		// it isn't stored.
+		return nil
+	}
+	return s.D.DeleteEvent(ser)
+}
+
+// reportedEvents lists the events referred to by the newest nip-56 reports, that are not
+// already banned. The reason is the report type and the content of the report.
+func (s *Server) reportedEvents() (reported []listed, err error) {
+	evs, _, err := s.D.Query(filter.F{Kinds: []int{kind.Reporting},
+		Limit: filter.IntToPointer(ReportLimit)})
+	if chk.E(err) {
+		return
+	}
+	skip := set(s.D.Config().Access.DenyEvents)
+	reported = []listed{}
+	for _, ev := range evs {
+		for _, t := range ev.Tags.GetAll([]string{"e", ""}) {
+			if _, ok := skip[t.Value()]; ok {
+				continue
+			}
+			skip[t.Value()] = struct{}{}
+			reason := "reported"
+			if len(t) > 2 && t[2] != "" {
+				reason = t[2]
+			}
+			if ev.Content != "" {
+				reason += ": " + ev.Content
+			}
+			reported = append(reported, listed{Id: t.Value(), Reason: reason})
+		}
+	}
+	return
+}
+
+// listEntries returns the entries of a pubkey or event id list with their reasons.
+func listEntries(l []string, reasons map[string]string, ids bool) (entries []listed) {
+	entries = []listed{}
+	for _, v := range l {
+		e := listed{Pubkey: v, Reason: reasons[v]}
+		if ids {
+			e = listed{Id: v, Reason: reasons[v]}
+		}
+		entries = append(entries, e)
+	}
+	return
+}
+
+// with returns a list with v added if it is not already in it.
+func with(list []string, v string) []string {
+	if slices.Contains(list, v) {
+		return list
+	}
+	return append(list, v)
+}
+
+// without returns a list with v removed.
+func without(list []string, v string) []string {
+	return slices.DeleteFunc(list, func(x string) bool { return x == v })
+}
@@ -0,0 +1,114 @@
+package relay
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/errorf"
+	"x.realy.lol/httpauth"
+	"x.realy.lol/log"
+	"x.realy.lol/signer"
+)
+
+// BackupPath is the path of the online backup of the relay.
+const BackupPath = "/backup"
+
+// BackupNextTrailer is the trailer of a backup with the since of the next incremental backup,
+// which is only known when the backup is complete.
+const BackupNextTrailer = "Backup-Next"
+
+// authorizeAdmin returns the pubkey of the nip-98 authorization of a request if it is the
+// superuser or an admin, otherwise it responds with an error and ok is false.
+func (s *Server) authorizeAdmin(w http.ResponseWriter, r *http.Request) (pubkey string,
+	ok bool) {
+
+	if pubkey, ok = httpauth.Pubkey(r.Context()); !ok {
+		http.Error(w, r.URL.Path+" requires nip-98 authorization", http.StatusUnauthorized)
+		return
+	}
+	if pubkey != s.Superuser && !slices.Contains(s.D.Config().Admins, pubkey) {
+		http.Error(w, pubkey+" is not an admin", http.StatusForbidden)
+		return "", false
+	}
+	return
+}
+
+// handleBackup writes a consistent backup of the database while the relay is running, see
+// database.D.Backup. It is incremental if the "since" query parameter is set, and the since of
+// the next incremental backup is in the BackupNextTrailer. It requires a nip-98 Authorization
+// header signed by the superuser or one of the admins.
+//
+//	GET /backup?since=<version>
+func (s *Server) handleBackup(w http.ResponseWriter, r *http.Request) {
+	pubkey, ok := s.authorizeAdmin(w, r)
+	if !ok {
+		return
+	}
+	var since uint64
+	if v := r.URL.Query().Get("since"); v != "" {
+		var err error
+		if since, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, "invalid since: "+v, http.StatusBadRequest)
+			return
+		}
+	}
+	log.I.F("%s is taking a backup since %d", pubkey, since)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Trailer", BackupNextTrailer)
+	w.WriteHeader(http.StatusOK)
+	next, err := s.D.Backup(w, since)
+	if err != nil {
+		// the status has been sent, so the missing trailer tells the client it failed.
+		log.E.F("backup for %s failed: %s", pubkey, err)
+		return
+	}
+	w.Header().Set(BackupNextTrailer, strconv.FormatUint(next, 10))
+}
+
+// Backup downloads a backup of the relay at a URL to w, authorized with nip-98 by sign, which
+// must be the superuser or an admin of the relay. It is incremental if since is greater than
+// zero, and next is the since of the next incremental backup.
+func Backup(ctx context.Context, url string, sign signer.I, since uint64,
+	w io.Writer) (next uint64, err error) {
+
+	// a websocket URL of the relay is also its http URL.
+	base := strings.TrimSuffix(url, "/")
+	if strings.HasPrefix(base, "ws") {
+		base = "http" + strings.TrimPrefix(base, "ws")
+	}
+	u := fmt.Sprintf("%s%s?since=%d", base, BackupPath, since)
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, http.MethodGet, u, nil); chk.E(err) {
+		return
+	}
+	var header string
+	if header, err = httpauth.Header(sign, http.MethodGet, u, nil); chk.E(err) {
+		return
+	}
+	req.Header.Set("Authorization", header)
+	var resp *http.Response
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return 0, errorf.E("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if _, err = io.Copy(w, bufio.NewReader(resp.Body)); err != nil {
+		return
+	}
+	// the trailer is only set when the body has been read.
+	v := resp.Trailer.Get(BackupNextTrailer)
+	if next, err = strconv.ParseUint(v, 10, 64); err != nil {
+		return 0, errorf.E("the backup is incomplete, the relay failed to write it")
+	}
+	return
+}
@@ -0,0 +1,172 @@
+package relay
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/database"
+	"x.realy.lol/errorf"
+	"x.realy.lol/httpauth"
+	"x.realy.lol/log"
+	"x.realy.lol/signer"
+)
+
+// ChangesPath is the path of the change feed of the relay.
+const ChangesPath = "/changes"
+
+// ChangesContentType is the content type of the change feed, which is a JSON database.Change
+// on each line.
+const ChangesContentType = "application/x-ndjson"
+
+// ChangesHeartbeat is how often an empty line is sent on the change feed while there are no
+// changes, so followers can tell the connection is alive.
+const ChangesHeartbeat = 30 * time.Second
+
+// MaxChangeLine is the longest line of the change feed that a follower reads.
+const MaxChangeLine = 1 << 24
+
+// handleChanges streams the change log of the database after the sequence number of the
+// "after" query parameter, and then the new changes as they are made, until the client
+// disconnects. It requires a nip-98 Authorization header signed by the superuser or one of the
+// admins, as the log has every stored event.
+//
+//	GET /changes?after=<sequence number>
+func (s *Server) handleChanges(w http.ResponseWriter, r *http.Request) {
+	pubkey, ok := s.authorizeAdmin(w, r)
+	if !ok {
+		return
+	}
+	var after uint64
+	if v := r.URL.Query().Get("after"); v != "" {
+		var err error
+		if after, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, "invalid after: "+v, http.StatusBadRequest)
+			return
+		}
+	}
+	log.I.F("%s is following the change feed after %d", pubkey, after)
+	w.Header().Set("Content-Type", ChangesContentType)
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	it := s.D.TailChanges(after)
+	for {
+		ctx, cancel := context.WithTimeout(r.Context(), ChangesHeartbeat)
+		next := it.Next(ctx)
+		cancel()
+		var err error
+		switch {
+		case next:
+			err = enc.Encode(it.Change())
+		case it.Err() != nil:
+			chk.E(it.Err())
+			return
+		case r.Context().Err() != nil:
+			return
+		default:
+			_, err = io.WriteString(w, "\n")
+		}
+		if err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// Follow makes the database a replica of the relay at a primary URL, by applying the changes
+// of its change feed, from the last one that was applied, until the context is canceled. It
+// reconnects when the connection fails, or when nothing is received for two heartbeats. The
+// requests are authorized with nip-98 by sign, which must be the superuser or an admin of the
+// primary. Events that are stored are sent to the subscriptions that match them.
+func (s *Server) Follow(ctx context.Context, primary string, sign signer.I) {
+	log.I.F("following %s", primary)
+	for {
+		err := s.follow(ctx, primary, sign)
+		if ctx.Err() != nil {
+			log.I.F("stopped following %s", primary)
+			return
+		}
+		log.W.F("follow %s: %s, reconnecting in %v", primary, err, MirrorRetry)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(MirrorRetry):
+		}
+	}
+}
+
+// follow applies the changes of the change feed of a primary until the connection ends, and
+// returns the reason it ended.
+func (s *Server) follow(ctx context.Context, primary string, sign signer.I) (err error) {
+	var after uint64
+	if after, err = s.D.FollowPosition(primary); chk.E(err) {
+		return
+	}
+	// a websocket URL of the primary is also its http URL.
+	base := strings.TrimSuffix(primary, "/")
+	if strings.HasPrefix(base, "ws") {
+		base = "http" + strings.TrimPrefix(base, "ws")
+	}
+	u := fmt.Sprintf("%s%s?after=%d", base, ChangesPath, after)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, http.MethodGet, u, nil); chk.E(err) {
+		return
+	}
+	var header string
+	if header, err = httpauth.Header(sign, http.MethodGet, u, nil); chk.E(err) {
+		return
+	}
+	req.Header.Set("Authorization", header)
+	var resp *http.Response
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errorf.E("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	// the request is canceled if the primary stops sending heartbeats.
+	idle := time.AfterFunc(2*ChangesHeartbeat, cancel)
+	defer idle.Stop()
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 0, 1<<16), MaxChangeLine)
+	for sc.Scan() {
+		idle.Reset(2 * ChangesHeartbeat)
+		line := sc.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		c := &database.Change{}
+		if err = json.Unmarshal(line, c); err != nil {
+			return errorf.E("invalid change: %s", err)
+		}
+		var applied bool
+		if applied, err = s.D.Apply(c); err != nil {
+			return errorf.E("failed to apply change %d: %s", c.Seq, err)
+		}
+		if applied && c.Event != nil {
+			s.broadcast(c.Event)
+		}
+		if err = s.D.SetFollowPosition(primary, c.Seq); chk.E(err) {
+			return
+		}
+	}
+	if err = sc.Err(); err == nil {
+		err = errorf.E("the primary closed the change feed")
+	}
+	return
+}
@@ -0,0 +1,76 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/errorf"
+)
+
+// ClientTimeout is the longest a client waits for a message from another relay.
+const ClientTimeout = 30 * time.Second
+
+// client is a connection to another relay, for syncing events with it.
+type client struct {
+	url string
+	ws  *websocket.Conn
+	// cancel ends the connection.
+	cancel context.CancelFunc
+	// timeout is the longest receive waits for a message.
+	timeout time.Duration
+}
+
+// connect opens a connection to the relay at a websocket url, which is closed by close, or
+// when the context is canceled.
+func connect(ctx context.Context, url string) (c *client, err error) {
+	c = &client{url: url, timeout: ClientTimeout}
+	if c.ws, err = websocket.Dial(url, "", "http://localhost/"); err != nil {
+		err = errorf.E("failed to connect to %s: %s", url, err)
+		return
+	}
+	ctx, c.cancel = context.WithCancel(ctx)
+	go func() {
+		<-ctx.Done()
+		chk.T(c.ws.Close())
+	}()
+	return
+}
+
+func (c *client) close() { c.cancel() }
+
+// send writes a message with the given label and fields, encoded as a JSON array.
+func (c *client) send(label string, fields ...any) (err error) {
+	var b []byte
+	if b, err = json.Marshal(append([]any{label}, fields...)); chk.E(err) {
+		return
+	}
+	if err = websocket.Message.Send(c.ws, string(b)); err != nil {
+		err = errorf.E("failed to send to %s: %s", c.url, err)
+	}
+	return
+}
+
+// receive reads the next message, and returns its label and the rest of its fields.
+func (c *client) receive() (label string, env []json.RawMessage, err error) {
+	if err = c.ws.SetReadDeadline(time.Now().Add(c.timeout)); chk.E(err) {
+		return
+	}
+	var msg []byte
+	if err = websocket.Message.Receive(c.ws, &msg); err != nil {
+		err = errorf.E("failed to receive from %s: %s", c.url, err)
+		return
+	}
+	if err = json.Unmarshal(msg, &env); err != nil || len(env) < 1 {
+		err = errorf.E("invalid message from %s: %s", c.url, msg)
+		return
+	}
+	if err = json.Unmarshal(env[0], &label); err != nil {
+		err = errorf.E("invalid message label from %s: %s", c.url, env[0])
+		return
+	}
+	return label, env[1:], nil
+}
@@ -0,0 +1,198 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/errorf"
+	"x.realy.lol/httpauth"
+	"x.realy.lol/log"
+	"x.realy.lol/negentropy"
+	"x.realy.lol/policy"
+)
+
+// SendQueue is the number of messages that are queued for a connection. Replies to the
+// messages of the client wait for room in the queue, but the new events for its subscriptions
+// don't, as they are sent by the connection that published them, so a client that doesn't
+// read them fast enough is disconnected as a slow consumer.
+const SendQueue = 256
+
+// conn is a client connection to the relay.
+type conn struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	ws     *websocket.Conn
+	// remote is the address of the client, from the X-Forwarded-For header if the relay is
+	// behind a trusted reverse proxy.
+	remote string
+	// pubkey is the hex pubkey the client authenticated as with nip-98 auth on the websocket
+	// upgrade request, it is empty if it didn't.
+	pubkey string
+	// queue are the encoded messages that are waiting to be sent by writeLoop, which is the
+	// only writer to the websocket.
+	queue chan []byte
+	// ephemeral limits the rate of ephemeral events, which are relayed without being stored
+	// and so are otherwise only limited by the bandwidth of the connection.
+	ephemeral limiter
+	// negs are the open nip-77 reconciliations, they are only used by the read loop.
+	negs map[string]*negentropy.Negentropy
+}
+
+func newConn(ctx context.Context, ws *websocket.Conn, r *http.Request,
+	trusted []netip.Prefix) (c *conn) {
+	c = &conn{ws: ws, remote: remoteAddr(r, trusted), queue: make(chan []byte, SendQueue)}
+	c.pubkey, _ = httpauth.Pubkey(r.Context())
+	c.ctx, c.cancel = context.WithCancel(ctx)
+	return
+}
+
+// remoteAddr returns the address of the client of a request. Clients can set the
+// X-Forwarded-For header to anything, so it is only used if the request is from a trusted
+// proxy, and the address is the last one in it that is not a trusted proxy.
+func remoteAddr(r *http.Request, trusted []netip.Prefix) (remote string) {
+	remote = r.RemoteAddr
+	if !isTrusted(remote, trusted) {
+		return
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		remote = hop
+		if !isTrusted(hop, trusted) {
+			return
+		}
+	}
+	return
+}
+
+// isTrusted returns true if an address, with or without a port, is in one of the trusted
+// ranges.
+func isTrusted(addr string, trusted []netip.Prefix) bool {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return false
+	}
+	for _, p := range trusted {
+		if p.Contains(ip.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseProxies parses the addresses and CIDR ranges of trusted proxies.
+func ParseProxies(proxies []string) (trusted []netip.Prefix, err error) {
+	for _, p := range proxies {
+		var prefix netip.Prefix
+		if strings.Contains(p, "/") {
+			if prefix, err = netip.ParsePrefix(p); err != nil {
+				err = errorf.E("invalid trusted proxy range %s: %s", p, err)
+				return
+			}
+		} else {
+			var addr netip.Addr
+			if addr, err = netip.ParseAddr(p); err != nil {
+				err = errorf.E("invalid trusted proxy address %s: %s", p, err)
+				return
+			}
+			prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		trusted = append(trusted, prefix.Masked())
+	}
+	return
+}
+
+// source returns the client for the write and read policies.
+func (c *conn) source() (src *policy.Source) {
+	return &policy.Source{Remote: c.remote, Pubkey: c.pubkey, ReceivedAt: time.Now()}
+}
+
+func (c *conn) close() { c.cancel() }
+
+// writeLoop sends the queued messages to the websocket until the connection is closed.
+func (c *conn) writeLoop() {
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case msg := <-c.queue:
+			if err := websocket.Message.Send(c.ws, string(msg)); chk.T(err) {
+				c.cancel()
+				return
+			}
+		}
+	}
+}
+
+// write queues a message with the given label and fields, encoded as a JSON array, waiting
+// for room in the queue. It is used for the replies to the messages of the client.
+func (c *conn) write(label string, fields ...any) (err error) {
+	var msg []byte
+	if msg, err = encode(label, fields...); chk.E(err) {
+		return
+	}
+	select {
+	case c.queue <- msg:
+	case <-c.ctx.Done():
+		err = c.ctx.Err()
+	}
+	return
+}
+
+// push queues a message like write, but without waiting, for the events that are sent to the
+// subscriptions of the client by other connections. If the queue is full the client is not
+// reading the messages it is sent, and the connection is closed, and slow is true.
+func (c *conn) push(label string, fields ...any) (slow bool) {
+	msg, err := encode(label, fields...)
+	if chk.E(err) {
+		return
+	}
+	select {
+	case c.queue <- msg:
+	case <-c.ctx.Done():
+	default:
+		log.D.F("%s is not reading its messages, closing the connection", c.remote)
+		c.cancel()
+		slow = true
+	}
+	return
+}
+
+// encode encodes a message as a JSON array of its label and fields.
+func encode(label string, fields ...any) (msg []byte, err error) {
+	buf := new(bytes.Buffer)
+	enc := json.NewEncoder(buf)
+	// event content is sent as it was signed.
+	enc.SetEscapeHTML(false)
+	if err = enc.Encode(append([]any{label}, fields...)); err != nil {
+		return
+	}
+	msg = bytes.TrimSpace(buf.Bytes())
+	return
+}
+
+func (c *conn) notice(format string, a ...any) {
+	_ = c.write(NOTICE, fmt.Sprintf(format, a...))
+}
+
+// ok sends the result of an EVENT message. The reason should start with one of the nip-01
+// machine readable prefixes if the event is rejected.
+func (c *conn) ok(id string, accepted bool, reason string) {
+	_ = c.write(OK, id, accepted, reason)
+}
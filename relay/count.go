@@ -0,0 +1,63 @@
+package relay
+
+import (
+	"encoding/json"
+
+	"x.realy.lol/database"
+	"x.realy.lol/filter"
+)
+
+// countResult is the payload of a nip-45 COUNT response.
+type countResult struct {
+	Count       int64 `json:"count"`
+	Approximate bool  `json:"approximate,omitempty"`
+	// HLL are the hex encoded registers of the authors of the events, for the filters that
+	// nip-45 defines them for, so clients can merge the counts of several relays.
+	HLL string `json:"hll,omitempty"`
+}
+
+// handleCount responds with the number of events that match any of the filters of a nip-45
+// COUNT message, an event that matches more than one is counted once. The filters are changed
+// or refused by the read policy, and only the events its index rules keep are counted, but its
+// result hooks are not applied, as events are counted without reading them.
+//
+//	["COUNT", <subscription id>, <filter JSON>...]
+//	["COUNT", <subscription id>, {"count": <integer>, "approximate": <bool>, "hll": <hex>}]
+func (s *Server) handleCount(c *conn, env []json.RawMessage) {
+	if len(env) < 2 {
+		c.notice("COUNT message requires a subscription id and at least one filter")
+		return
+	}
+	var subId string
+	if err := json.Unmarshal(env[0], &subId); err != nil || subId == "" {
+		c.notice("invalid subscription id: %s", env[0])
+		return
+	}
+	src := c.source()
+	var ff []filter.F
+	var rules [][]database.IndexRule
+	for _, raw := range env[1:] {
+		var f filter.F
+		if err := json.Unmarshal(raw, &f); err != nil {
+			_ = c.write(CLOSED, subId, "error: "+err.Error())
+			return
+		}
+		rr, reason := s.ReadPolicy.Query(c.ctx, src, &f)
+		if reason != "" {
+			_ = c.write(CLOSED, subId, reason)
+			return
+		}
+		ff = append(ff, f)
+		rules = append(rules, rr)
+	}
+	r, err := s.D.CountEvents(ff, rules)
+	if err != nil {
+		_ = c.write(CLOSED, subId, "error: "+err.Error())
+		return
+	}
+	res := countResult{Count: r.Count, Approximate: r.Approximate}
+	if r.HLL != nil {
+		res.HLL = r.HLL.String()
+	}
+	_ = c.write(COUNT, subId, res)
+}
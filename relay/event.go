@@ -0,0 +1,117 @@
+package relay
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"x.realy.lol/event"
+	"x.realy.lol/kind"
+	"x.realy.lol/log"
+	"x.realy.lol/policy"
+)
+
+// handleEvent verifies and stores an event sent by a client, and sends it to the subscriptions
+// that match it.
+//
+//	["EVENT", <event JSON>]
+func (s *Server) handleEvent(c *conn, env []json.RawMessage) {
+	if len(env) < 1 {
+		c.notice("EVENT message has no event")
+		return
+	}
+	ev := event.New()
+	if err := ev.Unmarshal(env[0]); err != nil {
+		c.notice("invalid event: %s", err)
+		return
+	}
+	s.metrics.received.Inc()
+	if s.ReadOnly {
+		s.reject(c, ev.Id, "blocked: this relay is a read-only replica")
+		return
+	}
+	if ok, err := ev.Verify(); err != nil || !ok {
+		s.reject(c, ev.Id, "invalid: signature verification failed")
+		return
+	}
+	if reason := s.access.Load().check(ev); reason != "" {
+		s.reject(c, ev.Id, reason)
+		return
+	}
+	switch res := s.WritePolicy.Check(c.ctx, c.source(), ev); res.Action {
+	case policy.Reject:
+		s.reject(c, ev.Id, res.Reason)
+		return
+	case policy.ShadowReject:
+		// the client is not told, so spam looks like it is accepted.
+		log.T.F("%s event %s shadow rejected: %s", c.remote, ev.Id, res.Reason)
+		s.metrics.rejected.Inc("shadow")
+		c.ok(ev.Id, true, "")
+		return
+	}
+	if kind.IsEphemeralKind(ev.Kind) {
+		s.handleEphemeral(c, ev)
+		return
+	}
+	if err := s.D.StoreEvent(ev); err != nil {
+		if strings.HasPrefix(err.Error(), "duplicate") {
+			s.metrics.rejected.Inc("duplicate")
+			c.ok(ev.Id, true, "duplicate: already have this event")
+			return
+		}
+		s.reject(c, ev.Id, reason(err))
+		return
+	}
+	log.T.F("%s stored event %s", c.remote, ev.Id)
+	s.metrics.stored.Inc()
+	c.ok(ev.Id, true, "")
+	s.broadcast(ev)
+}
+
+// handleEphemeral sends a verified ephemeral event to the subscriptions that match it, without
+// storing it. Ephemeral events are used for request and response traffic such as nip-46 remote
+// signing and wallet connect, so their rate is limited on each connection.
+func (s *Server) handleEphemeral(c *conn, ev *event.E) {
+	l := s.D.Config().Limits
+	if !c.ephemeral.allow(time.Now(), l.EphemeralRate, l.EphemeralBurst) {
+		s.reject(c, ev.Id, "rate-limited: slow down, too many ephemeral events")
+		return
+	}
+	log.T.F("%s relayed ephemeral event %s", c.remote, ev.Id)
+	s.metrics.relayed.Inc()
+	c.ok(ev.Id, true, "")
+	s.broadcast(ev)
+}
+
+// reject refuses an event, and counts the reason by its machine readable prefix.
+func (s *Server) reject(c *conn, id, reason string) {
+	s.metrics.rejected.Inc(reasonLabel(reason))
+	c.ok(id, false, reason)
+}
+
+// reasonPrefixes are the nip-01 machine readable prefixes of the reasons events are rejected.
+var reasonPrefixes = []string{"blocked", "invalid", "rate-limited", "restricted", "pow", "mute",
+	"error"}
+
+// reasonLabel is the machine readable prefix of a reason an event was rejected, or error if
+// it has none, so the rejection metric has a small set of labels.
+func reasonLabel(reason string) string {
+	for _, prf := range reasonPrefixes {
+		if strings.HasPrefix(reason, prf+":") {
+			return prf
+		}
+	}
+	return "error"
+}
+
+// reason returns the message of an error for a rejected event, with the error prefix unless it
+// already starts with one of the nip-01 machine readable prefixes.
+func reason(err error) string {
+	msg := err.Error()
+	for _, prf := range reasonPrefixes {
+		if strings.HasPrefix(msg, prf+":") {
+			return msg
+		}
+	}
+	return "error: " + msg
+}
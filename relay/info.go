@@ -0,0 +1,141 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/websocket"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/database"
+	"x.realy.lol/policy"
+	"x.realy.lol/version"
+)
+
+// InfoContentType is the content type of the nip-11 relay information document.
+const InfoContentType = "application/nostr+json"
+
+// Software is the URL of the relay software in the information document.
+const Software = "https://x.realy.lol"
+
+// SupportedNIPs are the nips the relay implements.
+var SupportedNIPs = []int{1, 9, 11, 40, 45, 77, 86}
+
+// info is the nip-11 relay information document.
+type info struct {
+	Name          string     `json:"name,omitempty"`
+	Description   string     `json:"description,omitempty"`
+	Pubkey        string     `json:"pubkey,omitempty"`
+	Contact       string     `json:"contact,omitempty"`
+	Icon          string     `json:"icon,omitempty"`
+	Banner        string     `json:"banner,omitempty"`
+	SupportedNIPs []int      `json:"supported_nips"`
+	Software      string     `json:"software"`
+	Version       string     `json:"version"`
+	Limitation    limitation `json:"limitation"`
+}
+
+// limitation is the limits the relay applies to clients, in the information document. The
+// read limits are those of clients that haven't authenticated.
+type limitation struct {
+	MaxMessageLength    int   `json:"max_message_length"`
+	MaxLimit            int   `json:"max_limit"`
+	DefaultLimit        int   `json:"default_limit"`
+	MinPowDifficulty    int   `json:"min_pow_difficulty,omitempty"`
+	AuthRequired        bool  `json:"auth_required"`
+	PaymentRequired     bool  `json:"payment_required"`
+	RestrictedWrites    bool  `json:"restricted_writes"`
+	CreatedAtLowerLimit int64 `json:"created_at_lower_limit,omitempty"`
+	CreatedAtUpperLimit int64 `json:"created_at_upper_limit,omitempty"`
+}
+
+// newInfo returns the information document for a configuration and the read and write
+// policies. The pubkey is the superuser, unless the configuration has another contact pubkey.
+func (s *Server) newInfo(c *database.Config) (inf *info) {
+	inf = &info{
+		Name:          c.Info.Name,
+		Description:   c.Info.Description,
+		Pubkey:        c.Info.Pubkey,
+		Contact:       c.Info.Contact,
+		Icon:          c.Info.Icon,
+		Banner:        c.Info.Banner,
+		SupportedNIPs: SupportedNIPs,
+		Software:      Software,
+		Version:       strings.TrimSpace(version.Version),
+		Limitation: limitation{
+			MaxMessageLength: websocket.DefaultMaxPayloadBytes,
+			MaxLimit:         database.DefaultLimit,
+			DefaultLimit:     database.DefaultLimit,
+			RestrictedWrites: len(c.Access.AllowPubkeys) > 0,
+		},
+	}
+	readLimitation(s.ReadPolicy, &inf.Limitation)
+	writeLimitation(s.WritePolicy, &inf.Limitation)
+	if inf.Pubkey == "" {
+		inf.Pubkey = s.Superuser
+	}
+	if inf.Name == "" {
+		inf.Name = version.Name
+	}
+	return
+}
+
+// readLimitation adds the limits of a read policy to a limitation. The filters of clients
+// that haven't authenticated are capped by Limit, which is also their limit if they have none,
+// and with no AnonymousKinds they can't read anything.
+func readLimitation(r policy.Reader, l *limitation) {
+	switch p := r.(type) {
+	case policy.ReadChain:
+		for _, r := range p {
+			readLimitation(r, l)
+		}
+	case *policy.Limit:
+		if p.Anonymous > 0 && p.Anonymous < l.MaxLimit {
+			l.MaxLimit, l.DefaultLimit = p.Anonymous, p.Anonymous
+		}
+	case policy.AnonymousKinds:
+		if len(p) == 0 {
+			l.AuthRequired = true
+		}
+	}
+}
+
+// writeLimitation adds the limits of a write policy to a limitation. Policies other than the
+// proof of work and created_at limits, such as plugins, decide which events are accepted in
+// ways the document can't describe, so writes are restricted.
+func writeLimitation(w policy.I, l *limitation) {
+	switch p := w.(type) {
+	case policy.Chain:
+		for _, w := range p {
+			writeLimitation(w, l)
+		}
+	case *policy.PoW:
+		l.MinPowDifficulty = max(l.MinPowDifficulty, p.MinDifficulty)
+	case *policy.CreatedAt:
+		if age := int64(p.MaxAge.Seconds()); age > 0 &&
+			(l.CreatedAtLowerLimit == 0 || age < l.CreatedAtLowerLimit) {
+			l.CreatedAtLowerLimit = age
+		}
+		if future := int64(p.MaxFuture.Seconds()); future > 0 &&
+			(l.CreatedAtUpperLimit == 0 || future < l.CreatedAtUpperLimit) {
+			l.CreatedAtUpperLimit = future
+		}
+	default:
+		l.RestrictedWrites = true
+	}
+}
+
+// handleInfo serves the information document, from the configuration in effect so it is
+// current when settings change.
+func (s *Server) handleInfo(w http.ResponseWriter, r *http.Request) {
+	// web clients fetch the document from other origins.
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	if r.Method == http.MethodOptions {
+		return
+	}
+	w.Header().Set("Content-Type", InfoContentType)
+	chk.T(json.NewEncoder(w).Encode(s.newInfo(s.D.Config())))
+}
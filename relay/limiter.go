@@ -0,0 +1,32 @@
+package relay
+
+import (
+	"time"
+)
+
+// limiter is a token bucket that allows a sustained rate of actions per second, with bursts of
+// up to its size. The rate and size are given on each use, so changes to the configuration
+// apply to existing connections.
+type limiter struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token from the bucket, it returns false if it is empty. The bucket starts
+// full. A rate of zero or less is unlimited.
+func (l *limiter) allow(now time.Time, rate float64, burst int) (ok bool) {
+	if rate <= 0 {
+		return true
+	}
+	if l.last.IsZero() {
+		l.tokens = float64(burst)
+	} else {
+		l.tokens = min(float64(burst), l.tokens+now.Sub(l.last).Seconds()*rate)
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
@@ -0,0 +1,41 @@
+package relay
+
+import (
+	"x.realy.lol/metrics"
+)
+
+// relayMetrics are the measurements of the events and connections of the relay.
+type relayMetrics struct {
+	received    *metrics.Counter
+	stored      *metrics.Counter
+	relayed     *metrics.Counter
+	rejected    *metrics.Counter
+	connections *metrics.Gauge
+	slow        *metrics.Counter
+}
+
+func newMetrics() (m *relayMetrics) {
+	return &relayMetrics{
+		received: metrics.NewCounter("realy_events_received",
+			"events sent by clients"),
+		stored: metrics.NewCounter("realy_events_stored",
+			"events sent by clients that were stored"),
+		relayed: metrics.NewCounter("realy_ephemeral_events_relayed",
+			"ephemeral events sent by clients that were relayed to the subscriptions"),
+		rejected: metrics.NewCounter("realy_events_rejected",
+			"events sent by clients that were not stored, by the prefix of the reason",
+			"reason"),
+		connections: metrics.NewGauge("realy_connections", "open websocket connections"),
+		slow: metrics.NewCounter("realy_slow_consumers",
+			"connections that were closed because they didn't read their events"),
+	}
+}
+
+// RegisterMetrics adds the metrics of the relay to a registry, with the number of open
+// subscriptions, which is read when the metrics are served.
+func (s *Server) RegisterMetrics(r *metrics.Registry) {
+	m := s.metrics
+	r.Register(m.received, m.stored, m.relayed, m.rejected, m.connections, m.slow,
+		metrics.NewGaugeFunc("realy_subscriptions", "open subscriptions of all connections",
+			func() float64 { return float64(s.subs.Len()) }))
+}
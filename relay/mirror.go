@@ -0,0 +1,260 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/database"
+	"x.realy.lol/errorf"
+	"x.realy.lol/event"
+	"x.realy.lol/filter"
+	"x.realy.lol/log"
+	"x.realy.lol/policy"
+	"x.realy.lol/timestamp"
+)
+
+// MirrorRetry is how long the mirror waits to reconnect to an upstream relay after the
+// connection fails.
+const MirrorRetry = time.Minute
+
+// MirrorIdle is how long the mirror waits for a message from an upstream relay before it
+// reconnects, as a connection can fail without being closed.
+const MirrorIdle = 10 * time.Minute
+
+// MirrorSaveInterval is the most often the cursors of an upstream relay are stored while new
+// events are received, they are also stored when its stored events have all been received,
+// and when the connection ends after that.
+const MirrorSaveInterval = 10 * time.Second
+
+// mirroring is an upstream relay that is being mirrored.
+type mirroring struct {
+	mirror database.Mirror
+	cancel context.CancelFunc
+}
+
+// StartMirror mirrors the upstream relays of the configuration until the server's context is
+// canceled. Each upstream is sent a REQ with its filters, and the events it sends are
+// verified and stored as if a client sent them, see Sync. The since of each filter is set to
+// the created_at of the newest event received for it, so the mirror resumes where it stopped.
+// Upstreams send their stored events newest first, and may send only some of them, so the
+// older ones are paged backwards with until, and the cursor only moves once they have all
+// been received. Upstreams are started and stopped as the configuration changes.
+func (s *Server) StartMirror() {
+	running := make(map[string]*mirroring)
+	s.D.OnConfig(func(c *database.Config) {
+		wanted := make(map[string]database.Mirror)
+		for _, m := range c.Mirrors {
+			wanted[m.URL] = m
+		}
+		for url, r := range running {
+			if m, ok := wanted[url]; !ok ||
+				m.Filters.String() != r.mirror.Filters.String() {
+				r.cancel()
+				delete(running, url)
+			}
+		}
+		for url, m := range wanted {
+			if _, ok := running[url]; ok {
+				continue
+			}
+			ctx, cancel := context.WithCancel(s.Ctx)
+			running[url] = &mirroring{mirror: m, cancel: cancel}
+			go s.mirror(ctx, m)
+		}
+	})
+}
+
+// mirror copies the events of an upstream relay, reconnecting when the connection ends, until
+// the context is canceled.
+func (s *Server) mirror(ctx context.Context, m database.Mirror) {
+	log.I.F("mirroring %s %s", m.URL, m.Filters)
+	for {
+		start := time.Now()
+		err := s.mirrorOnce(ctx, m)
+		if ctx.Err() != nil {
+			log.I.F("stopped mirroring %s", m.URL)
+			return
+		}
+		wait := MirrorRetry
+		if time.Since(start) > MirrorRetry {
+			// the connection was working, so it is resumed straight away.
+			wait = 0
+		}
+		log.W.F("mirror %s: %s, reconnecting in %v", m.URL, err, wait)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// mirrorSub is the state of the subscription of a filter of a mirror.
+type mirrorSub struct {
+	// key is the filter encoded as JSON, which its cursor is stored under.
+	key string
+	// f is the filter, with the since of its cursor.
+	f filter.F
+	// backfilled is true once the stored events since the cursor have all been received,
+	// until then the cursor is not moved.
+	backfilled bool
+	// newest is the created_at of the newest event received.
+	newest timestamp.Timestamp
+	// until is the until of the page of stored events being received, and older is true if
+	// the page has an event before it.
+	until timestamp.Timestamp
+	older bool
+	// paging is true while a page of stored events is requested, and exclusive if the page is
+	// before until, after a page with until had no older events.
+	paging, exclusive bool
+}
+
+// mirrorOnce connects to an upstream relay and stores the events it sends until the connection
+// ends. It returns the reason the connection ended.
+//
+// Each filter has a subscription that stays open for new events, and the stored events that
+// it doesn't send, as the upstream has a limit, are requested in pages with until set to the
+// oldest event of the last page, and then before it, until a page has no older events.
+func (s *Server) mirrorOnce(ctx context.Context, m database.Mirror) (err error) {
+	var cursors map[string]timestamp.Timestamp
+	if cursors, err = s.D.MirrorCursors(m.URL); chk.E(err) {
+		return
+	}
+	var c *client
+	if c, err = connect(ctx, m.URL); err != nil {
+		return
+	}
+	defer c.close()
+	c.timeout = MirrorIdle
+	subs := make([]*mirrorSub, len(m.Filters))
+	for i, f := range m.Filters {
+		sub := &mirrorSub{key: f.String(), f: f.Clone(), until: timestamp.Timestamp(math.MaxInt64)}
+		if since, ok := cursors[sub.key]; ok && (f.Since == nil || *f.Since < since) {
+			sub.f.Since = &since
+		}
+		subs[i] = sub
+		if err = c.send(REQ, subIdOf(i), sub.f); err != nil {
+			return
+		}
+	}
+	var changed bool
+	var saved time.Time
+	save := func() {
+		if changed {
+			chk.E(s.D.SetMirrorCursors(m.URL, cursors))
+			changed, saved = false, time.Now()
+		}
+	}
+	defer save()
+	src := &policy.Source{Remote: m.URL}
+	for {
+		var label string
+		var env []json.RawMessage
+		if label, env, err = c.receive(); err != nil {
+			return
+		}
+		var subId string
+		if len(env) > 0 {
+			_ = json.Unmarshal(env[0], &subId)
+		}
+		i, page := -1, false
+		for j := range subs {
+			if subId == subIdOf(j) || subId == pageIdOf(j) {
+				i, page = j, subId == pageIdOf(j)
+			}
+		}
+		if i < 0 {
+			continue
+		}
+		sub := subs[i]
+		switch label {
+		case EVENT:
+			if len(env) < 2 {
+				continue
+			}
+			ev := event.New()
+			if err = ev.Unmarshal(env[1]); err != nil {
+				log.D.F("%s: invalid event: %s", m.URL, err)
+				err = nil
+				continue
+			}
+			// only events the filter asked for are stored, and can move its cursor.
+			if !sub.f.Matches(ev) {
+				continue
+			}
+			// the page has older events even if they are refused.
+			if !sub.backfilled && ev.CreatedAt < sub.until {
+				sub.until, sub.older = ev.CreatedAt, true
+			}
+			src.ReceivedAt = time.Now()
+			if refused := s.ingest(ctx, src, ev); refused != "" {
+				log.D.F("%s: event %s not stored: %s", m.URL, ev.Id, refused)
+				continue
+			}
+			sub.newest = max(sub.newest, ev.CreatedAt)
+			if !sub.backfilled {
+				continue
+			}
+			if sub.newest > cursors[sub.key] {
+				cursors[sub.key] = sub.newest
+				changed = true
+			}
+			if time.Since(saved) > MirrorSaveInterval {
+				save()
+			}
+		case EOSE:
+			if sub.backfilled || page != sub.paging {
+				continue
+			}
+			if page {
+				if err = c.send(CLOSE, pageIdOf(i)); err != nil {
+					return
+				}
+				sub.paging = false
+			}
+			f := sub.f.Clone()
+			switch {
+			case sub.older:
+				// the page had events, there may be older ones that the upstream didn't send.
+				until := sub.until
+				f.Until = &until
+				sub.older, sub.exclusive = false, false
+			case page && !sub.exclusive:
+				// the events at until were all sent, or as many as the limit of the upstream,
+				// so the next page is before them.
+				until := sub.until - 1
+				f.Until = &until
+				sub.exclusive = true
+			default:
+				f.Until = nil
+			}
+			if f.Until != nil {
+				if err = c.send(REQ, pageIdOf(i), f); err != nil {
+					return
+				}
+				sub.paging = true
+				continue
+			}
+			log.D.F("%s: received the stored events of %s", m.URL, sub.key)
+			sub.backfilled = true
+			if sub.newest > cursors[sub.key] {
+				cursors[sub.key] = sub.newest
+				changed = true
+			}
+			save()
+		case CLOSED:
+			return errorf.E("closed the subscription for %s: %s", sub.key, env)
+		}
+	}
+}
+
+// subIdOf is the subscription id of the filter of a mirror with an index.
+func subIdOf(i int) string { return fmt.Sprintf("mirror-%d", i) }
+
+// pageIdOf is the subscription id of the pages of stored events of the filter of a mirror
+// with an index.
+func pageIdOf(i int) string { return fmt.Sprintf("mirror-%d-page", i) }
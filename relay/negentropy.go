@@ -0,0 +1,120 @@
+package relay
+
+import (
+	"encoding/json"
+
+	"x.realy.lol/filter"
+	"x.realy.lol/hex"
+	"x.realy.lol/negentropy"
+)
+
+// FrameSizeLimit is the most bytes of a negentropy message, before it is hex encoded.
+const FrameSizeLimit = 500000
+
+// MaxReconciliations is the most negentropy reconciliations a connection can have open, as
+// each holds the ids and timestamps of up to database.MaxSyncEvents events.
+const MaxReconciliations = 4
+
+// handleNegOpen starts a nip-77 negentropy reconciliation of the events that match a filter,
+// as the read policy allows, and responds to the initial message of the client. A
+// reconciliation with the same subscription id replaces the one that is open, and a
+// connection can have at most MaxReconciliations open.
+//
+//	["NEG-OPEN", <subscription id>, <filter JSON>, <initial message hex>]
+//	["NEG-MSG", <subscription id>, <message hex>]
+//	["NEG-ERR", <subscription id>, <reason>]
+func (s *Server) handleNegOpen(c *conn, env []json.RawMessage) {
+	if len(env) < 3 {
+		c.notice("NEG-OPEN message requires a subscription id, a filter and a message")
+		return
+	}
+	var subId string
+	if err := json.Unmarshal(env[0], &subId); err != nil || subId == "" {
+		c.notice("invalid subscription id: %s", env[0])
+		return
+	}
+	delete(c.negs, subId)
+	if len(c.negs) >= MaxReconciliations {
+		_ = c.write(NEGERR, subId, "blocked: too many open reconciliations")
+		return
+	}
+	var f filter.F
+	if err := json.Unmarshal(env[1], &f); err != nil {
+		_ = c.write(NEGERR, subId, "error: "+err.Error())
+		return
+	}
+	rules, refused := s.ReadPolicy.Query(c.ctx, c.source(), &f)
+	if refused != "" {
+		_ = c.write(NEGERR, subId, refused)
+		return
+	}
+	v, err := s.D.SyncVector(f, rules...)
+	if err != nil {
+		_ = c.write(NEGERR, subId, reason(err))
+		return
+	}
+	var n *negentropy.Negentropy
+	if n, err = negentropy.New(v, FrameSizeLimit); err != nil {
+		_ = c.write(NEGERR, subId, "error: "+err.Error())
+		return
+	}
+	if c.negs == nil {
+		c.negs = make(map[string]*negentropy.Negentropy)
+	}
+	c.negs[subId] = n
+	s.reconcile(c, subId, n, env[2])
+}
+
+// handleNegMsg responds to a message of an open negentropy reconciliation.
+//
+//	["NEG-MSG", <subscription id>, <message hex>]
+func (s *Server) handleNegMsg(c *conn, env []json.RawMessage) {
+	if len(env) < 2 {
+		c.notice("NEG-MSG message requires a subscription id and a message")
+		return
+	}
+	var subId string
+	if err := json.Unmarshal(env[0], &subId); err != nil || subId == "" {
+		c.notice("invalid subscription id: %s", env[0])
+		return
+	}
+	n, ok := c.negs[subId]
+	if !ok {
+		_ = c.write(NEGERR, subId, "closed: no open reconciliation with this id")
+		return
+	}
+	s.reconcile(c, subId, n, env[1])
+}
+
+// handleNegClose ends a negentropy reconciliation.
+//
+//	["NEG-CLOSE", <subscription id>]
+func (s *Server) handleNegClose(c *conn, env []json.RawMessage) {
+	var subId string
+	if len(env) < 1 || json.Unmarshal(env[0], &subId) != nil {
+		c.notice("NEG-CLOSE message requires a subscription id")
+		return
+	}
+	delete(c.negs, subId)
+}
+
+// reconcile sends the response to a hex encoded negentropy message, or closes the
+// reconciliation with an error if it is invalid.
+func (s *Server) reconcile(c *conn, subId string, n *negentropy.Negentropy,
+	raw json.RawMessage) {
+
+	var msg string
+	var query, out []byte
+	err := json.Unmarshal(raw, &msg)
+	if err == nil {
+		if query, err = hex.Dec(msg); err == nil {
+			out, err = n.Reconcile(query)
+		}
+	}
+	if err != nil {
+		delete(c.negs, subId)
+		_ = c.write(NEGERR, subId, "error: "+err.Error())
+		return
+	}
+	_ = c.write(NEGMSG, subId, hex.Enc(out))
+}
@@ -0,0 +1,204 @@
+// Package relay is a nostr relay, it accepts websocket connections and serves the nip-01
+// protocol from a database.D.
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/net/websocket"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/database"
+	"x.realy.lol/event"
+	"x.realy.lol/httpauth"
+	"x.realy.lol/log"
+	"x.realy.lol/policy"
+	"x.realy.lol/subscription"
+)
+
+// The labels of the messages of the relay protocol.
+const (
+	EVENT  = "EVENT"
+	REQ    = "REQ"
+	CLOSE  = "CLOSE"
+	EOSE   = "EOSE"
+	OK     = "OK"
+	NOTICE = "NOTICE"
+	CLOSED = "CLOSED"
+	COUNT  = "COUNT"
+
+	NEGOPEN  = "NEG-OPEN"
+	NEGMSG   = "NEG-MSG"
+	NEGCLOSE = "NEG-CLOSE"
+	NEGERR   = "NEG-ERR"
+)
+
+// Server is a relay serving the events in a database.D.
+type Server struct {
+	Ctx context.Context
+	D   *database.D
+	// Superuser is the hex pubkey that can call every management method, including granting
+	// the others to admins.
+	Superuser string
+	// WritePolicy are the policies that decide whether events are accepted, after their
+	// signature and the access lists are checked.
+	WritePolicy policy.Chain
+	// ReadPolicy are the policies that decide what clients can query and what they are sent.
+	ReadPolicy policy.ReadChain
+	// ReadOnly refuses the events clients send, for a replica that follows a primary.
+	ReadOnly bool
+	// TrustedProxies are the reverse proxies whose X-Forwarded-For header is the address of
+	// the client, see ParseProxies.
+	TrustedProxies []netip.Prefix
+	ws             websocket.Server
+	// upgrade serves websocket requests, after verifying their nip-98 auth if they have it.
+	upgrade http.Handler
+	// management serves nip-86 requests, after verifying their nip-98 auth.
+	management http.Handler
+	// changes serves the change feed, after verifying its nip-98 auth.
+	changes http.Handler
+	// backup serves online backups, after verifying their nip-98 auth.
+	backup http.Handler
+	// subs are the open subscriptions, which new events are sent to.
+	subs *subscription.Registry
+	// access is the allow and deny lists of the configuration, which is replaced when the
+	// configuration changes.
+	access atomic.Pointer[accessLists]
+	// metrics are the measurements of the relay, served by RegisterMetrics.
+	metrics *relayMetrics
+}
+
+// New creates a relay Server for a database. The context is the lifetime of the server, all
+// connections are closed when it is canceled.
+func New(ctx context.Context, d *database.D) (s *Server) {
+	s = &Server{Ctx: ctx, D: d, subs: subscription.New(), metrics: newMetrics()}
+	d.OnConfig(func(c *database.Config) { s.access.Store(newAccessLists(c.Access)) })
+	s.ws = websocket.Server{
+		// nostr clients connect from anywhere, so the origin is not checked.
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler:   s.serve,
+	}
+	s.upgrade = httpauth.Middleware(s.ws)
+	s.management = httpauth.Middleware(http.HandlerFunc(s.handleManagement))
+	s.changes = httpauth.Middleware(http.HandlerFunc(s.handleChanges))
+	s.backup = httpauth.Middleware(http.HandlerFunc(s.handleBackup))
+	return
+}
+
+// ServeHTTP upgrades websocket requests to a connection to the relay, and serves the nip-11
+// information document, nip-86 management requests, the change feed and backups.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet && r.URL.Path == ChangesPath {
+		s.changes.ServeHTTP(w, r)
+		return
+	}
+	if r.Method == http.MethodGet && r.URL.Path == BackupPath {
+		s.backup.ServeHTTP(w, r)
+		return
+	}
+	if (r.Method == http.MethodGet || r.Method == http.MethodOptions) &&
+		strings.Contains(r.Header.Get("Accept"), InfoContentType) {
+		s.handleInfo(w, r)
+		return
+	}
+	if r.Method == http.MethodPost &&
+		strings.HasPrefix(r.Header.Get("Content-Type"), ManagementContentType) {
+		s.management.ServeHTTP(w, r)
+		return
+	}
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		http.Error(w, "this is a nostr relay, connect to it with a websocket",
+			http.StatusUpgradeRequired)
+		return
+	}
+	s.upgrade.ServeHTTP(w, r)
+}
+
+// serve reads and handles the messages from a websocket connection until it is closed.
+func (s *Server) serve(ws *websocket.Conn) {
+	c := newConn(s.Ctx, ws, ws.Request(), s.TrustedProxies)
+	defer c.close()
+	defer s.subs.RemoveOwner(c)
+	s.metrics.connections.Add(1)
+	defer s.metrics.connections.Add(-1)
+	log.D.F("%s connected", c.remote)
+	go func() {
+		// websocket reads don't take a context, so the socket is closed to end the read loop
+		// when the server shuts down.
+		<-c.ctx.Done()
+		chk.T(ws.Close())
+	}()
+	go c.writeLoop()
+	for {
+		var msg []byte
+		if err := websocket.Message.Receive(ws, &msg); err != nil {
+			log.D.F("%s disconnected: %s", c.remote, err)
+			return
+		}
+		s.handleMessage(c, msg)
+	}
+}
+
+// handleMessage decodes the envelope of a message and dispatches it to the handler for its
+// label.
+func (s *Server) handleMessage(c *conn, msg []byte) {
+	var env []json.RawMessage
+	if err := json.Unmarshal(msg, &env); err != nil || len(env) < 1 {
+		c.notice("invalid message: %s", msg)
+		return
+	}
+	var label string
+	if err := json.Unmarshal(env[0], &label); err != nil {
+		c.notice("invalid message label: %s", env[0])
+		return
+	}
+	switch label {
+	case EVENT:
+		s.handleEvent(c, env[1:])
+	case REQ:
+		s.handleReq(c, env[1:])
+	case COUNT:
+		s.handleCount(c, env[1:])
+	case CLOSE:
+		s.handleClose(c, env[1:])
+	case NEGOPEN:
+		s.handleNegOpen(c, env[1:])
+	case NEGMSG:
+		s.handleNegMsg(c, env[1:])
+	case NEGCLOSE:
+		s.handleNegClose(c, env[1:])
+	default:
+		c.notice("unknown message type %s", label)
+	}
+}
+
+// handleClose ends a subscription.
+//
+//	["CLOSE", <subscription id>]
+func (s *Server) handleClose(c *conn, env []json.RawMessage) {
+	var subId string
+	if len(env) < 1 || json.Unmarshal(env[0], &subId) != nil {
+		c.notice("CLOSE message requires a subscription id")
+		return
+	}
+	s.subs.Remove(c, subId)
+}
+
+// broadcast sends a new event to the open subscriptions that match it, as the read policy
+// allows. It doesn't wait for the connections to send it, those that are too slow to keep up
+// are closed.
+func (s *Server) broadcast(ev *event.E) {
+	for _, sub := range s.subs.Match(ev) {
+		c := sub.Owner.(*conn)
+		if out := s.ReadPolicy.Result(c.ctx, c.source(), ev); out != nil {
+			if c.push(EVENT, sub.Id, out) {
+				s.metrics.slow.Inc()
+			}
+		}
+	}
+}
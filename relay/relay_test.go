@@ -0,0 +1,1004 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/database"
+	"x.realy.lol/database/indexes/types/pubhash"
+	"x.realy.lol/event"
+	"x.realy.lol/filter"
+	"x.realy.lol/hex"
+	"x.realy.lol/httpauth"
+	"x.realy.lol/kind"
+	"x.realy.lol/metrics"
+	"x.realy.lol/negentropy"
+	"x.realy.lol/p256k"
+	"x.realy.lol/policy"
+	"x.realy.lol/tags"
+	"x.realy.lol/timestamp"
+)
+
+// testRelay starts a relay on a fresh database and returns its websocket URL.
+func testRelay(t *testing.T) (s *Server, url string) {
+	d := database.New()
+	tmpDir, err := os.MkdirTemp("", "testrealy-")
+	if chk.E(err) {
+		t.Fatal(err)
+	}
+	if err = d.Init(tmpDir); chk.E(err) {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s = New(ctx, d)
+	hs := httptest.NewServer(s)
+	t.Cleanup(func() {
+		cancel()
+		hs.Close()
+		d.Close()
+		os.RemoveAll(tmpDir)
+	})
+	url = "ws" + strings.TrimPrefix(hs.URL, "http")
+	return
+}
+
+func dial(t *testing.T, url string) (ws *websocket.Conn) {
+	var err error
+	if ws, err = websocket.Dial(url, "", "http://localhost/"); chk.E(err) {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return
+}
+
+func send(t *testing.T, ws *websocket.Conn, msg ...any) {
+	b, err := json.Marshal(msg)
+	if chk.E(err) {
+		t.Fatal(err)
+	}
+	if err = websocket.Message.Send(ws, string(b)); chk.E(err) {
+		t.Fatal(err)
+	}
+}
+
+func receive(t *testing.T, ws *websocket.Conn) (label string, env []json.RawMessage) {
+	var msg []byte
+	if err := websocket.Message.Receive(ws, &msg); chk.E(err) {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(msg, &env); chk.E(err) {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(env[0], &label); chk.E(err) {
+		t.Fatal(err)
+	}
+	return label, env[1:]
+}
+
+// signedEvent creates a text note signed by a new key.
+func signedEvent(t *testing.T, sign *p256k.Signer, createdAt timestamp.Timestamp,
+	content string) (ev *event.E) {
+	ev = event.New()
+	ev.Kind = kind.TextNote
+	ev.CreatedAt = createdAt
+	ev.Content = content
+	if err := ev.Sign(sign); chk.E(err) {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestServer_ReqCursor(t *testing.T) {
+	_, url := testRelay(t)
+	ws := dial(t, url)
+	sign := &p256k.Signer{}
+	if err := sign.Generate(); chk.E(err) {
+		t.Fatal(err)
+	}
+	// half of the events share a timestamp, which until based paging can't split.
+	now := timestamp.Now()
+	var stored int
+	for i := range 10 {
+		ts := now
+		if i%2 == 0 {
+			ts = now - timestamp.Timestamp(i)
+		}
+		ev := signedEvent(t, sign, ts, strings.Repeat("x", i))
+		send(t, ws, EVENT, ev)
+		label, env := receive(t, ws)
+		var accepted bool
+		if label != OK || json.Unmarshal(env[1], &accepted) != nil || !accepted {
+			t.Fatalf("event was not accepted: %s %s", label, env)
+		}
+		stored++
+	}
+	f := filter.F{Kinds: []int{kind.TextNote}, Limit: filter.IntToPointer(3)}
+	seen := make(map[string]struct{})
+	for page := 0; ; page++ {
+		send(t, ws, REQ, "sub", f)
+		var cursor string
+		for {
+			label, env := receive(t, ws)
+			if label == EVENT {
+				ev := event.New()
+				if err := ev.Unmarshal(env[1]); chk.E(err) {
+					t.Fatal(err)
+				}
+				if _, ok := seen[ev.Id]; ok {
+					t.Fatalf("event %s repeated on page %d", ev.Id, page)
+				}
+				seen[ev.Id] = struct{}{}
+				continue
+			}
+			if label != EOSE {
+				t.Fatalf("unexpected %s message %s", label, env)
+			}
+			if len(env) > 1 {
+				_ = json.Unmarshal(env[1], &cursor)
+			}
+			break
+		}
+		if cursor == "" {
+			break
+		}
+		var err error
+		if f.Cursor, err = filter.DecodeCursor(cursor); chk.E(err) {
+			t.Fatal(err)
+		}
+	}
+	if len(seen) != stored {
+		t.Fatalf("expected %d events over all pages, got %d", stored, len(seen))
+	}
+}
+
+func TestServer_Count(t *testing.T) {
+	s, url := testRelay(t)
+	sign := &p256k.Signer{}
+	if err := sign.Generate(); chk.E(err) {
+		t.Fatal(err)
+	}
+	hidden := pubhash.New()
+	if err := hidden.FromPubkey(sign.Pub()); chk.E(err) {
+		t.Fatal(err)
+	}
+	var hide atomic.Bool
+	s.ReadPolicy = policy.ReadChain{&policy.ReadFuncs{QueryFunc: func(context.Context,
+		*policy.Source, *filter.F) (rules []database.IndexRule, reason string) {
+		if hide.Load() {
+			rules = []database.IndexRule{database.ExcludeAuthors([]*pubhash.T{hidden})}
+		}
+		return
+	}}}
+	ws := dial(t, url)
+	now := timestamp.Now()
+	for i := range 5 {
+		send(t, ws, EVENT, signedEvent(t, sign, now-timestamp.Timestamp(i), "count me"))
+		if label, _ := receive(t, ws); label != OK {
+			t.Fatalf("expected OK, got %s", label)
+		}
+	}
+	send(t, ws, COUNT, "c", filter.F{Kinds: []int{kind.TextNote}, Limit: filter.IntToPointer(1)})
+	label, env := receive(t, ws)
+	if label != COUNT {
+		t.Fatalf("expected COUNT, got %s", label)
+	}
+	var res countResult
+	if err := json.Unmarshal(env[1], &res); chk.E(err) {
+		t.Fatal(err)
+	}
+	if res.Count != 5 || res.Approximate {
+		t.Fatalf("expected an exact count of 5, got %d", res.Count)
+	}
+	count := func(ff ...filter.F) (n int64) {
+		msg := []any{COUNT, "c"}
+		for _, f := range ff {
+			msg = append(msg, f)
+		}
+		send(t, ws, msg...)
+		label, env := receive(t, ws)
+		var res countResult
+		if label != COUNT || json.Unmarshal(env[1], &res) != nil {
+			t.Fatalf("expected COUNT, got %s %s", label, env)
+		}
+		return res.Count
+	}
+	// the filters overlap, so the events are counted once.
+	author := filter.F{Authors: []string{hex.Enc(sign.Pub())}}
+	if n := count(filter.F{Kinds: []int{kind.TextNote}}, author); n != 5 {
+		t.Fatalf("expected the union of the filters to count 5, got %d", n)
+	}
+	// the events the read policy hides are not counted.
+	hide.Store(true)
+	if n := count(author); n != 0 {
+		t.Fatalf("expected the hidden events not to be counted, got %d", n)
+	}
+}
+
+func TestServer_Subscription(t *testing.T) {
+	_, url := testRelay(t)
+	sub, pub := dial(t, url), dial(t, url)
+	sign := &p256k.Signer{}
+	if err := sign.Generate(); chk.E(err) {
+		t.Fatal(err)
+	}
+	send(t, sub, REQ, "live", filter.F{Authors: []string{hex.Enc(sign.Pub())}})
+	if label, _ := receive(t, sub); label != EOSE {
+		t.Fatalf("expected EOSE, got %s", label)
+	}
+	publish := func(content string) (ev *event.E) {
+		ev = signedEvent(t, sign, timestamp.Now(), content)
+		send(t, pub, EVENT, ev)
+		// the event is sent to the subscriptions before the OK.
+		if label, _ := receive(t, pub); label != OK {
+			t.Fatalf("expected OK, got %s", label)
+		}
+		return
+	}
+	ev := publish("live")
+	label, env := receive(t, sub)
+	var subId string
+	if label != EVENT || json.Unmarshal(env[0], &subId) != nil || subId != "live" {
+		t.Fatalf("expected the event on the subscription, got %s %s", label, env)
+	}
+	got := event.New()
+	if err := got.Unmarshal(env[1]); chk.E(err) || got.Id != ev.Id {
+		t.Fatalf("expected event %s, got %s", ev.Id, env[1])
+	}
+	send(t, sub, CLOSE, "live")
+	publish("closed")
+	send(t, sub, COUNT, "c", filter.F{Authors: []string{hex.Enc(sign.Pub())}})
+	if label, env = receive(t, sub); label != COUNT {
+		t.Fatalf("expected no events after CLOSE, got %s %s", label, env)
+	}
+}
+
+func TestConn_SlowConsumer(t *testing.T) {
+	c := &conn{remote: "slow", queue: make(chan []byte, 1)}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	if c.push(EVENT, "sub", "first") {
+		t.Fatal("a connection with room in its queue was closed")
+	}
+	// the queue is full as the connection is not sending its messages.
+	if !c.push(EVENT, "sub", "second") || c.ctx.Err() == nil {
+		t.Fatal("a connection that doesn't read its events was not closed")
+	}
+	if err := c.write(NOTICE, "closed"); err == nil {
+		t.Fatal("a reply was queued on a closed connection")
+	}
+}
+
+func TestRemoteAddr(t *testing.T) {
+	trusted, err := ParseProxies([]string{"10.0.0.0/8", "::1"})
+	if chk.E(err) {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ remote, fwd, expected string }{
+		// clients can't set their address.
+		{"192.0.2.1:1234", "198.51.100.1", "192.0.2.1:1234"},
+		{"10.0.0.1:1234", "", "10.0.0.1:1234"},
+		{"10.0.0.1:1234", "198.51.100.1", "198.51.100.1"},
+		{"[::1]:1234", "198.51.100.1", "198.51.100.1"},
+		// the address is the last one that isn't a trusted proxy.
+		{"10.0.0.1:1234", "203.0.113.1, 198.51.100.1, 10.0.0.2", "198.51.100.1"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tc.remote
+		if tc.fwd != "" {
+			r.Header.Set("X-Forwarded-For", tc.fwd)
+		}
+		if got := remoteAddr(r, trusted); got != tc.expected {
+			t.Fatalf("%s forwarding %q is %s, expected %s", tc.remote, tc.fwd, got,
+				tc.expected)
+		}
+	}
+	if _, err = ParseProxies([]string{"proxy"}); err == nil {
+		t.Fatal("an invalid proxy address was accepted")
+	}
+}
+
+func TestServer_Ephemeral(t *testing.T) {
+	s, url := testRelay(t)
+	if err := s.D.UpdateConfig(func(c *database.Config) {
+		c.Limits.EphemeralRate, c.Limits.EphemeralBurst = 1, 3
+	}); chk.E(err) {
+		t.Fatal(err)
+	}
+	sub, pub := dial(t, url), dial(t, url)
+	sign := &p256k.Signer{}
+	if err := sign.Generate(); chk.E(err) {
+		t.Fatal(err)
+	}
+	send(t, sub, REQ, "eph", filter.F{Kinds: []int{kind.NostrConnect}})
+	if label, _ := receive(t, sub); label != EOSE {
+		t.Fatalf("expected EOSE, got %s", label)
+	}
+	var relayed int
+	for i := range 5 {
+		ev := event.New()
+		ev.Kind = kind.NostrConnect
+		ev.CreatedAt = timestamp.Now()
+		ev.Content = strings.Repeat("x", i)
+		if err := ev.Sign(sign); chk.E(err) {
+			t.Fatal(err)
+		}
+		send(t, pub, EVENT, ev)
+		label, env := receive(t, pub)
+		var accepted bool
+		var reason string
+		if label != OK || json.Unmarshal(env[1], &accepted) != nil ||
+			json.Unmarshal(env[2], &reason) != nil {
+			t.Fatalf("expected OK, got %s %s", label, env)
+		}
+		if !accepted {
+			if !strings.HasPrefix(reason, "rate-limited:") {
+				t.Fatalf("unexpected rejection %s", reason)
+			}
+			continue
+		}
+		relayed++
+		if label, env = receive(t, sub); label != EVENT {
+			t.Fatalf("expected the event on the subscription, got %s %s", label, env)
+		}
+	}
+	// the burst is let through, and the rest are sent faster than the rate.
+	if relayed != 3 {
+		t.Fatalf("expected 3 events to be relayed, got %d", relayed)
+	}
+	send(t, sub, COUNT, "c", filter.F{Kinds: []int{kind.NostrConnect}})
+	label, env := receive(t, sub)
+	var res countResult
+	if label != COUNT || json.Unmarshal(env[1], &res) != nil || res.Count != 0 {
+		t.Fatalf("ephemeral events were stored: %s %s", label, env)
+	}
+}
+
+func TestServer_AccessLists(t *testing.T) {
+	s, url := testRelay(t)
+	ws := dial(t, url)
+	sign := &p256k.Signer{}
+	if err := sign.Generate(); chk.E(err) {
+		t.Fatal(err)
+	}
+	publish := func(content string) (accepted bool, reason string) {
+		send(t, ws, EVENT, signedEvent(t, sign, timestamp.Now(), content))
+		label, env := receive(t, ws)
+		if label != OK || json.Unmarshal(env[1], &accepted) != nil ||
+			json.Unmarshal(env[2], &reason) != nil {
+			t.Fatalf("expected OK, got %s %s", label, env)
+		}
+		return
+	}
+	if accepted, reason := publish("before"); !accepted {
+		t.Fatalf("event was rejected: %s", reason)
+	}
+	// the configuration applies to the open connection without a restart.
+	if err := s.D.UpdateConfig(func(c *database.Config) {
+		c.Access.DenyPubkeys = []string{hex.Enc(sign.Pub())}
+	}); chk.E(err) {
+		t.Fatal(err)
+	}
+	if accepted, reason := publish("banned"); accepted || !strings.HasPrefix(reason, "blocked:") {
+		t.Fatalf("expected the event to be blocked, got %v %s", accepted, reason)
+	}
+}
+
+// manage sends a nip-86 management request to the relay with a nip-98 auth event signed by
+// sign, and returns the HTTP status and the decoded response.
+func manage(t *testing.T, url string, sign *p256k.Signer, method string, params ...any) (
+	status int, resp managementResponse) {
+
+	url = "http" + strings.TrimPrefix(url, "ws")
+	body, err := json.Marshal(managementRequest{Method: method, Params: rawParams(t, params)})
+	if chk.E(err) {
+		t.Fatal(err)
+	}
+	header, err := httpauth.Header(sign, http.MethodPost, url, body)
+	if chk.E(err) {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	req.Header.Set("Content-Type", ManagementContentType)
+	req.Header.Set("Authorization", header)
+	var r *http.Response
+	if r, err = http.DefaultClient.Do(req); chk.E(err) {
+		t.Fatal(err)
+	}
+	defer r.Body.Close()
+	if err = json.NewDecoder(r.Body).Decode(&resp); chk.E(err) {
+		t.Fatal(err)
+	}
+	return r.StatusCode, resp
+}
+
+func rawParams(t *testing.T, params []any) (raw []json.RawMessage) {
+	for _, p := range params {
+		b, err := json.Marshal(p)
+		if chk.E(err) {
+			t.Fatal(err)
+		}
+		raw = append(raw, b)
+	}
+	return
+}
+
+func TestServer_Management(t *testing.T) {
+	s, url := testRelay(t)
+	keys := make([]*p256k.Signer, 4)
+	for i := range keys {
+		keys[i] = &p256k.Signer{}
+		if err := keys[i].Generate(); chk.E(err) {
+			t.Fatal(err)
+		}
+	}
+	super, admin, user, reporter := keys[0], keys[1], keys[2], keys[3]
+	s.Superuser = hex.Enc(super.Pub())
+	if status, _ := manage(t, url, admin, "banpubkey", hex.Enc(user.Pub())); status != http.StatusForbidden {
+		t.Fatalf("expected a non admin to be forbidden, got %d", status)
+	}
+	if status, resp := manage(t, url, super, "grantadmin", hex.Enc(admin.Pub())); status != http.StatusOK ||
+		resp.Error != "" {
+		t.Fatalf("grantadmin failed: %d %s", status, resp.Error)
+	}
+	if _, resp := manage(t, url, admin, "grantadmin", hex.Enc(user.Pub())); resp.Error == "" {
+		t.Fatal("an admin granted admin")
+	}
+	if _, resp := manage(t, url, admin, "banpubkey", hex.Enc(user.Pub()), "spam"); resp.Error != "" {
+		t.Fatal(resp.Error)
+	}
+	_, resp := manage(t, url, admin, "listbannedpubkeys")
+	if b, _ := json.Marshal(resp.Result); !strings.Contains(string(b), `"reason":"spam"`) {
+		t.Fatalf("the banned pubkey is not listed: %s", b)
+	}
+	if s.D.Config().Access.DenyPubkeys[0] != hex.Enc(user.Pub()) {
+		t.Fatalf("the pubkey was not banned")
+	}
+	// a reported event is listed until it is banned, which also deletes it.
+	ws := dial(t, url)
+	note := signedEvent(t, reporter, timestamp.Now(), "note")
+	report := event.New()
+	report.Kind = kind.Reporting
+	report.CreatedAt = timestamp.Now()
+	report.Tags = tags.Tags{{"e", note.Id, "spam"}}
+	if err := report.Sign(reporter); chk.E(err) {
+		t.Fatal(err)
+	}
+	for _, ev := range []*event.E{note, report} {
+		send(t, ws, EVENT, ev)
+		if label, env := receive(t, ws); label != OK || string(env[1]) != "true" {
+			t.Fatalf("event was not accepted: %s %s", label, env)
+		}
+	}
+	_, resp = manage(t, url, admin, "listeventsneedingmoderation")
+	if b, _ := json.Marshal(resp.Result); !strings.Contains(string(b), note.Id) {
+		t.Fatalf("the reported event is not listed: %s", b)
+	}
+	if _, resp = manage(t, url, admin, "banevent", note.Id, "spam"); resp.Error != "" {
+		t.Fatal(resp.Error)
+	}
+	if _, err := s.D.GetEventById(note.GetIdBytes()); err == nil {
+		t.Fatal("the banned event was not deleted")
+	}
+	_, resp = manage(t, url, admin, "listeventsneedingmoderation")
+	if b, _ := json.Marshal(resp.Result); strings.Contains(string(b), note.Id) {
+		t.Fatalf("the banned event is still listed: %s", b)
+	}
+	if _, resp = manage(t, url, admin, "changerelayname", "test relay"); resp.Error != "" ||
+		s.D.Config().Info.Name != "test relay" {
+		t.Fatalf("the relay name was not changed: %s", resp.Error)
+	}
+}
+
+func TestServer_Info(t *testing.T) {
+	s, url := testRelay(t)
+	s.Superuser = strings.Repeat("ab", 32)
+	get := func() (inf info) {
+		req, _ := http.NewRequest(http.MethodGet, "http"+strings.TrimPrefix(url, "ws"), nil)
+		req.Header.Set("Accept", InfoContentType)
+		r, err := http.DefaultClient.Do(req)
+		if chk.E(err) {
+			t.Fatal(err)
+		}
+		defer r.Body.Close()
+		if r.Header.Get("Content-Type") != InfoContentType {
+			t.Fatalf("unexpected content type %s", r.Header.Get("Content-Type"))
+		}
+		if err = json.NewDecoder(r.Body).Decode(&inf); chk.E(err) {
+			t.Fatal(err)
+		}
+		return
+	}
+	inf := get()
+	if inf.Pubkey != s.Superuser || inf.Version == "" || len(inf.SupportedNIPs) == 0 ||
+		inf.Limitation.RestrictedWrites {
+		t.Fatalf("unexpected information document %+v", inf)
+	}
+	// the document follows changes to the configuration.
+	if err := s.D.UpdateConfig(func(c *database.Config) {
+		c.Info.Name = "test relay"
+		c.Access.AllowPubkeys = []string{s.Superuser}
+	}); chk.E(err) {
+		t.Fatal(err)
+	}
+	if inf = get(); inf.Name != "test relay" || !inf.Limitation.RestrictedWrites {
+		t.Fatalf("the information document was not updated %+v", inf)
+	}
+	l := inf.Limitation
+	if l.MaxLimit != database.DefaultLimit || l.DefaultLimit != database.DefaultLimit ||
+		l.AuthRequired || l.MinPowDifficulty != 0 {
+		t.Fatalf("unexpected limitation without policies %+v", l)
+	}
+	// the limitation describes the policies.
+	s.ReadPolicy = policy.ReadChain{policy.AnonymousKinds{},
+		&policy.Limit{Anonymous: 50, Authenticated: 500}}
+	s.WritePolicy = policy.Chain{&policy.PoW{MinDifficulty: 8},
+		&policy.CreatedAt{MaxAge: time.Hour, MaxFuture: time.Minute}}
+	if l = get().Limitation; l.MaxLimit != 50 || l.DefaultLimit != 50 || !l.AuthRequired ||
+		l.MinPowDifficulty != 8 || l.CreatedAtLowerLimit != 3600 ||
+		l.CreatedAtUpperLimit != 60 {
+		t.Fatalf("the limitation doesn't describe the policies %+v", l)
+	}
+}
+
+func TestServer_WritePolicy(t *testing.T) {
+	s, url := testRelay(t)
+	s.WritePolicy = policy.Chain{policy.Func(func(_ context.Context, _ *policy.Source,
+		ev *event.E) (res policy.Result) {
+		switch ev.Content {
+		case "spam":
+			return policy.Result{Action: policy.Reject, Reason: "blocked: spam"}
+		case "shadow":
+			return policy.Result{Action: policy.ShadowReject}
+		}
+		return
+	})}
+	ws := dial(t, url)
+	sign := &p256k.Signer{}
+	if err := sign.Generate(); chk.E(err) {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		content  string
+		accepted bool
+		stored   bool
+	}{
+		{"note", true, true},
+		{"spam", false, false},
+		{"shadow", true, false},
+	} {
+		ev := signedEvent(t, sign, timestamp.Now(), tc.content)
+		send(t, ws, EVENT, ev)
+		var accepted bool
+		if label, env := receive(t, ws); label != OK || json.Unmarshal(env[1], &accepted) != nil ||
+			accepted != tc.accepted {
+			t.Fatalf("%s: unexpected response %s %s", tc.content, label, env)
+		}
+		if _, err := s.D.GetEventById(ev.GetIdBytes()); (err == nil) != tc.stored {
+			t.Fatalf("%s: expected stored to be %v", tc.content, tc.stored)
+		}
+	}
+}
+
+func TestServer_ReadPolicy(t *testing.T) {
+	s, url := testRelay(t)
+	keys := make([]*p256k.Signer, 2)
+	for i := range keys {
+		keys[i] = &p256k.Signer{}
+		if err := keys[i].Generate(); chk.E(err) {
+			t.Fatal(err)
+		}
+	}
+	author, hidden := keys[0], keys[1]
+	s.ReadPolicy = policy.ReadChain{
+		policy.AnonymousKinds{kind.ProfileMetadata},
+		policy.HideAuthors{hex.Enc(hidden.Pub())},
+	}
+	ws := dial(t, url)
+	for _, ev := range []*event.E{signedEvent(t, author, timestamp.Now(), "shown"),
+		signedEvent(t, hidden, timestamp.Now(), "hidden")} {
+		send(t, ws, EVENT, ev)
+		if label, env := receive(t, ws); label != OK || string(env[1]) != "true" {
+			t.Fatalf("event was not accepted: %s %s", label, env)
+		}
+	}
+	send(t, ws, REQ, "anon", filter.F{Kinds: []int{kind.TextNote}})
+	if label, env := receive(t, ws); label != CLOSED ||
+		!strings.Contains(string(env[1]), "auth-required:") {
+		t.Fatalf("expected the anonymous query to be refused, got %s %s", label, env)
+	}
+	// a client that authenticates the websocket upgrade with nip-98 can read every kind, but
+	// not the hidden author.
+	cfg, err := websocket.NewConfig(url, "http://localhost/")
+	if chk.E(err) {
+		t.Fatal(err)
+	}
+	var header string
+	if header, err = httpauth.Header(author, http.MethodGet, url, nil); chk.E(err) {
+		t.Fatal(err)
+	}
+	cfg.Header.Set("Authorization", header)
+	var authed *websocket.Conn
+	if authed, err = websocket.DialConfig(cfg); chk.E(err) {
+		t.Fatal(err)
+	}
+	defer authed.Close()
+	send(t, authed, REQ, "authed", filter.F{Kinds: []int{kind.TextNote}})
+	var contents []string
+	for {
+		label, env := receive(t, authed)
+		if label == EOSE {
+			break
+		}
+		ev := event.New()
+		if label != EVENT || ev.Unmarshal(env[1]) != nil {
+			t.Fatalf("unexpected %s %s", label, env)
+		}
+		contents = append(contents, ev.Content)
+	}
+	if len(contents) != 1 || contents[0] != "shown" {
+		t.Fatalf("expected only the shown event, got %v", contents)
+	}
+	// new events of the hidden author are not sent to the subscription either.
+	send(t, ws, EVENT, signedEvent(t, hidden, timestamp.Now(), "hidden"))
+	receive(t, ws)
+	send(t, ws, EVENT, signedEvent(t, author, timestamp.Now(), "new"))
+	receive(t, ws)
+	if label, env := receive(t, authed); label != EVENT || !strings.Contains(string(env[1]), `"new"`) {
+		t.Fatalf("expected the new shown event, got %s %s", label, env)
+	}
+}
+
+func TestServer_Sync(t *testing.T) {
+	a, _ := testRelay(t)
+	b, url := testRelay(t)
+	sign := &p256k.Signer{}
+	if err := sign.Generate(); chk.E(err) {
+		t.Fatal(err)
+	}
+	now := timestamp.Now()
+	store := func(content string, kinds int, ss ...*Server) {
+		ev := signedEvent(t, sign, now, content)
+		ev.Kind = kinds
+		if err := ev.Sign(sign); chk.E(err) {
+			t.Fatal(err)
+		}
+		for _, s := range ss {
+			if err := s.D.StoreEvent(ev); chk.E(err) {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := range 20 {
+		switch {
+		case i < 8:
+			store(fmt.Sprint("shared ", i), kind.TextNote, a, b)
+		case i < 13:
+			store(fmt.Sprint("a ", i), kind.TextNote, a)
+		case i < 17:
+			store(fmt.Sprint("b ", i), kind.TextNote, b)
+		default:
+			// events the filter doesn't match are not synced.
+			store(fmt.Sprint("b ", i), kind.Repost, b)
+		}
+	}
+	f := filter.F{Kinds: []int{kind.TextNote}}
+	res, err := a.Sync(context.Background(), url, f, true)
+	if chk.E(err) {
+		t.Fatal(err)
+	}
+	if len(res.Have) != 5 || len(res.Need) != 4 || res.Fetched != 4 || res.Sent != 5 {
+		t.Fatalf("unexpected result: have %d need %d fetched %d sent %d", len(res.Have),
+			len(res.Need), res.Fetched, res.Sent)
+	}
+	for _, s := range []*Server{a, b} {
+		if n, _, err := s.D.Count(f); chk.E(err) || n != 17 {
+			t.Fatalf("%d events after the sync, expected 17", n)
+		}
+	}
+	if res, err = a.Sync(context.Background(), url, f, true); chk.E(err) {
+		t.Fatal(err)
+	}
+	if len(res.Have)+len(res.Need) != 0 {
+		t.Fatalf("the relays differ after syncing: have %d need %d", len(res.Have),
+			len(res.Need))
+	}
+	// a connection can only have a few reconciliations open at once.
+	v := negentropy.NewVector()
+	if err = v.Seal(); chk.E(err) {
+		t.Fatal(err)
+	}
+	n, err := negentropy.New(v, FrameSizeLimit)
+	if chk.E(err) {
+		t.Fatal(err)
+	}
+	msg, err := n.Initiate()
+	if chk.E(err) {
+		t.Fatal(err)
+	}
+	ws := dial(t, url)
+	for i := range MaxReconciliations + 1 {
+		send(t, ws, NEGOPEN, fmt.Sprint("neg-", i), f, hex.Enc(msg))
+		label, env := receive(t, ws)
+		if i < MaxReconciliations && label != NEGMSG {
+			t.Fatalf("reconciliation %d was not opened: %s %s", i, label, env)
+		}
+		if i == MaxReconciliations && (label != NEGERR ||
+			!strings.Contains(string(env[1]), "blocked")) {
+			t.Fatalf("too many reconciliations were opened: %s %s", label, env)
+		}
+	}
+	send(t, ws, NEGCLOSE, "neg-0")
+	send(t, ws, NEGOPEN, "neg-0", f, hex.Enc(msg))
+	if label, env := receive(t, ws); label != NEGMSG {
+		t.Fatalf("a closed reconciliation was not replaced: %s %s", label, env)
+	}
+	// the filters are subject to the read policy of the other relay.
+	b.ReadPolicy = policy.ReadChain{policy.AnonymousKinds{kind.Repost}}
+	if _, err = a.Sync(context.Background(), url, f, false); err == nil ||
+		!strings.Contains(err.Error(), "auth-required") {
+		t.Fatalf("the sync was not refused: %v", err)
+	}
+}
+
+func TestServer_Mirror(t *testing.T) {
+	a, _ := testRelay(t)
+	b, url := testRelay(t)
+	team, other := &p256k.Signer{}, &p256k.Signer{}
+	for _, sign := range []*p256k.Signer{team, other} {
+		if err := sign.Generate(); chk.E(err) {
+			t.Fatal(err)
+		}
+	}
+	now := timestamp.Now()
+	for i := range 6 {
+		sign := team
+		if i%2 == 1 {
+			sign = other
+		}
+		ev := signedEvent(t, sign, now-timestamp.Timestamp(10-i), fmt.Sprint("note ", i))
+		if err := b.D.StoreEvent(ev); chk.E(err) {
+			t.Fatal(err)
+		}
+	}
+	// the upstream only sends the newest event of each page, so the older ones are paged.
+	limit := 1
+	f := filter.F{Authors: []string{hex.Enc(team.Pub())}, Limit: &limit}
+	if err := a.D.UpdateConfig(func(c *database.Config) {
+		c.Mirrors = []database.Mirror{{URL: url, Filters: filter.S{f}}}
+	}); chk.E(err) {
+		t.Fatal(err)
+	}
+	a.StartMirror()
+	wait := func(n int64) {
+		for range 100 {
+			if got, _, err := a.D.Count(filter.F{}); chk.E(err) || got == n {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		got, _, _ := a.D.Count(filter.F{})
+		t.Fatalf("%d events were mirrored, expected %d", got, n)
+	}
+	wait(3)
+	// new events are mirrored as they are published upstream.
+	ws := dial(t, url)
+	ev := signedEvent(t, team, now, "new")
+	send(t, ws, EVENT, ev)
+	if label, env := receive(t, ws); label != OK || string(env[1]) != "true" {
+		t.Fatalf("event was not accepted: %s %s", label, env)
+	}
+	wait(4)
+	// removing the mirror stops it, which stores its cursor.
+	if err := a.D.UpdateConfig(func(c *database.Config) { c.Mirrors = nil }); chk.E(err) {
+		t.Fatal(err)
+	}
+	for range 100 {
+		cursors, err := a.D.MirrorCursors(url)
+		if chk.E(err) {
+			t.Fatal(err)
+		}
+		if cursors[f.String()] == now {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if cursors, _ := a.D.MirrorCursors(url); cursors[f.String()] != now {
+		t.Fatalf("the cursor was not advanced: %v", cursors)
+	}
+	if err := a.D.UpdateConfig(func(c *database.Config) {
+		c.Mirrors = []database.Mirror{{URL: "http://example.com", Filters: filter.S{f}}}
+	}); err == nil {
+		t.Fatal("a mirror that isn't a websocket url was accepted")
+	}
+}
+
+func TestServer_Follow(t *testing.T) {
+	primary, url := testRelay(t)
+	replica, replicaURL := testRelay(t)
+	super, other := &p256k.Signer{}, &p256k.Signer{}
+	for _, sign := range []*p256k.Signer{super, other} {
+		if err := sign.Generate(); chk.E(err) {
+			t.Fatal(err)
+		}
+	}
+	primary.Superuser = hex.Enc(super.Pub())
+	httpURL := "http" + strings.TrimPrefix(url, "ws")
+	// the change feed is only for admins.
+	u := httpURL + ChangesPath
+	req, _ := http.NewRequest(http.MethodGet, u, nil)
+	header, err := httpauth.Header(other, http.MethodGet, u, nil)
+	if chk.E(err) {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", header)
+	resp, err := http.DefaultClient.Do(req)
+	if chk.E(err) {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("status %d, expected %d", resp.StatusCode, http.StatusForbidden)
+	}
+	now := timestamp.Now()
+	// an event in the change log that has expired since is skipped by the replica.
+	expiring := event.New()
+	expiring.Kind, expiring.CreatedAt, expiring.Content = kind.TextNote, now, "expiring"
+	expiring.Tags = tags.Tags{{"expiration", fmt.Sprint(now.ToInt64())}}
+	if err = expiring.Sign(other); chk.E(err) {
+		t.Fatal(err)
+	}
+	if err = primary.D.StoreEvent(expiring); chk.E(err) {
+		t.Fatal(err)
+	}
+	var evs []*event.E
+	for i := range 3 {
+		ev := signedEvent(t, other, now, fmt.Sprint("note ", i))
+		if err := primary.D.StoreEvent(ev); chk.E(err) {
+			t.Fatal(err)
+		}
+		evs = append(evs, ev)
+	}
+	for !expiring.Expired(timestamp.Now()) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	replica.ReadOnly = true
+	go replica.Follow(ctx, url, super)
+	wait := func(n int64) {
+		for range 100 {
+			if got, _, err := replica.D.Count(filter.F{}); chk.E(err) || got == n {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		got, _, _ := replica.D.Count(filter.F{})
+		t.Fatalf("the replica has %d events, expected %d", got, n)
+	}
+	wait(3)
+	// new events and deletions are applied as they are made.
+	ws := dial(t, replicaURL)
+	send(t, ws, REQ, "sub", filter.F{})
+	for label, _ := receive(t, ws); label != EOSE; label, _ = receive(t, ws) {
+	}
+	ev := signedEvent(t, other, now, "new")
+	if err := primary.D.StoreEvent(ev); chk.E(err) {
+		t.Fatal(err)
+	}
+	if label, env := receive(t, ws); label != EVENT || !strings.Contains(string(env[1]), ev.Id) {
+		t.Fatalf("the replica did not send the new event: %s %s", label, env)
+	}
+	ser, err := primary.D.FindEventSerialById(evs[0].GetIdBytes())
+	if chk.E(err) {
+		t.Fatal(err)
+	}
+	if err = primary.D.DeleteEvent(ser); chk.E(err) {
+		t.Fatal(err)
+	}
+	wait(3)
+	// the replica doesn't accept events from clients.
+	send(t, ws, EVENT, signedEvent(t, other, now, "refused"))
+	if label, env := receive(t, ws); label != OK || string(env[1]) != "false" {
+		t.Fatalf("the replica accepted an event: %s %s", label, env)
+	}
+}
+
+func TestServer_Backup(t *testing.T) {
+	s, url := testRelay(t)
+	super, other := &p256k.Signer{}, &p256k.Signer{}
+	for _, sign := range []*p256k.Signer{super, other} {
+		if err := sign.Generate(); chk.E(err) {
+			t.Fatal(err)
+		}
+	}
+	s.Superuser = hex.Enc(super.Pub())
+	ctx := context.Background()
+	// backups are only for admins.
+	if _, err := Backup(ctx, url, other, 0, new(bytes.Buffer)); err == nil ||
+		!strings.Contains(err.Error(), "403") {
+		t.Fatalf("a backup by a user that isn't an admin: %v", err)
+	}
+	now := timestamp.Now()
+	if err := s.D.StoreEvent(signedEvent(t, other, now, "first")); chk.E(err) {
+		t.Fatal(err)
+	}
+	full := new(bytes.Buffer)
+	next, err := Backup(ctx, url, super, 0, full)
+	if chk.E(err) || next == 0 {
+		t.Fatalf("backup to version %d: %v", next, err)
+	}
+	if err = s.D.StoreEvent(signedEvent(t, other, now, "second")); chk.E(err) {
+		t.Fatal(err)
+	}
+	incremental := new(bytes.Buffer)
+	if _, err = Backup(ctx, url, super, next, incremental); chk.E(err) {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err = database.Restore(dir, full, incremental); chk.E(err) {
+		t.Fatal(err)
+	}
+	d := database.New()
+	if err = d.Init(dir); chk.E(err) {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if n, _, err := d.Count(filter.F{}); chk.E(err) || n != 2 {
+		t.Fatalf("restored %d events, expected 2", n)
+	}
+}
+
+func TestServer_Metrics(t *testing.T) {
+	s, url := testRelay(t)
+	r := metrics.New()
+	s.RegisterMetrics(r)
+	s.D.RegisterMetrics(r)
+	ws := dial(t, url)
+	sign := &p256k.Signer{}
+	if err := sign.Generate(); chk.E(err) {
+		t.Fatal(err)
+	}
+	ev := signedEvent(t, sign, timestamp.Now(), "measured")
+	forged := signedEvent(t, sign, timestamp.Now(), "forged")
+	forged.Sig = strings.Repeat("0", 128)
+	for _, e := range []*event.E{ev, ev, forged} {
+		send(t, ws, EVENT, e)
+		if label, env := receive(t, ws); label != OK {
+			t.Fatalf("expected OK, got %s %s", label, env)
+		}
+	}
+	send(t, ws, REQ, "sub", filter.F{Authors: []string{hex.Enc(sign.Pub())}})
+	for label := ""; label != EOSE; {
+		label, _ = receive(t, ws)
+	}
+	b := new(strings.Builder)
+	if _, err := r.WriteTo(b); chk.E(err) {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"realy_events_received_total 3\n",
+		"realy_events_stored_total 1\n",
+		`realy_events_rejected_total{reason="duplicate"} 1` + "\n",
+		`realy_events_rejected_total{reason="invalid"} 1` + "\n",
+		"realy_connections 1\n",
+		"realy_subscriptions 1\n",
+		`realy_query_duration_seconds_count{path="authors"} 1` + "\n",
+		"# TYPE realy_badger_block_cache_hits counter\n",
+		"# TYPE realy_gc_runs counter\n",
+	} {
+		if !strings.Contains(b.String(), line) {
+			t.Fatalf("the metrics have no %q:\n%s", line, b.String())
+		}
+	}
+}
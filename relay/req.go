@@ -0,0 +1,83 @@
+package relay
+
+import (
+	"encoding/json"
+
+	"x.realy.lol/database"
+	"x.realy.lol/event"
+	"x.realy.lol/filter"
+)
+
+// handleReq opens a subscription and sends the stored events that match its filters, followed
+// by an EOSE. New events that match the filters are sent until the subscription is closed.
+// The read policy can change the filters or refuse them, and change or drop the events.
+//
+//	["REQ", <subscription id>, <filter JSON>...]
+//
+// Each filter returns at most its limit of events. If any of them has more results, the EOSE
+// has a cursor for each filter, in the same order, which is set in the "cursor" field of the
+// filter to get the next page. The cursor is empty for filters that have no more results.
+//
+//	["EOSE", <subscription id>, <cursor>...]
+func (s *Server) handleReq(c *conn, env []json.RawMessage) {
+	if len(env) < 2 {
+		c.notice("REQ message requires a subscription id and at least one filter")
+		return
+	}
+	var subId string
+	if err := json.Unmarshal(env[0], &subId); err != nil || subId == "" {
+		c.notice("invalid subscription id: %s", env[0])
+		return
+	}
+	src := c.source()
+	var ff filter.S
+	var rules [][]database.IndexRule
+	for _, raw := range env[1:] {
+		var f filter.F
+		if err := json.Unmarshal(raw, &f); err != nil {
+			_ = c.write(CLOSED, subId, "error: "+err.Error())
+			return
+		}
+		rr, reason := s.ReadPolicy.Query(c.ctx, src, &f)
+		if reason != "" {
+			_ = c.write(CLOSED, subId, reason)
+			return
+		}
+		ff = append(ff, f)
+		rules = append(rules, rr)
+	}
+	// the subscription is opened before the query so no event stored while it runs is missed,
+	// which may send such an event twice.
+	s.subs.Add(c, subId, ff)
+	var cursors []any
+	var more bool
+	for i, f := range ff {
+		var evs []*event.E
+		var next *filter.Cursor
+		var err error
+		if evs, next, err = s.D.Query(f, rules[i]...); err != nil {
+			s.subs.Remove(c, subId)
+			_ = c.write(CLOSED, subId, "error: "+err.Error())
+			return
+		}
+		for _, ev := range evs {
+			if ev = s.ReadPolicy.Result(c.ctx, src, ev); ev == nil {
+				continue
+			}
+			if err = c.write(EVENT, subId, ev); err != nil {
+				return
+			}
+		}
+		if next != nil {
+			more = true
+			cursors = append(cursors, next.String())
+		} else {
+			cursors = append(cursors, "")
+		}
+	}
+	if more {
+		_ = c.write(EOSE, append([]any{subId}, cursors...)...)
+		return
+	}
+	_ = c.write(EOSE, subId)
+}
@@ -0,0 +1,238 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"strings"
+	"time"
+
+	"x.realy.lol/chk"
+	"x.realy.lol/errorf"
+	"x.realy.lol/event"
+	"x.realy.lol/filter"
+	"x.realy.lol/hex"
+	"x.realy.lol/log"
+	"x.realy.lol/negentropy"
+	"x.realy.lol/policy"
+)
+
+// SyncBatch is the most events that are requested with one REQ, or sent before waiting for
+// their OK, by Sync.
+const SyncBatch = 100
+
+// SyncResult is the outcome of a Sync.
+type SyncResult struct {
+	// Have are the ids of the events this relay has and the other doesn't.
+	Have [][]byte
+	// Need are the ids of the events the other relay has and this one doesn't.
+	Need [][]byte
+	// Fetched is the number of needed events that were received and accepted.
+	Fetched int
+	// Sent is the number of events the other relay accepted.
+	Sent int
+}
+
+// Sync reconciles the stored events that match a filter with those of the relay at a
+// websocket url with nip-77 negentropy, and then downloads the events it needs. If push is
+// true, it also uploads the events the other relay doesn't have. Downloaded events are
+// verified and checked against the access lists and write policy as if a client sent them.
+func (s *Server) Sync(ctx context.Context, url string, f filter.F, push bool) (
+	res *SyncResult, err error) {
+
+	var v *negentropy.Vector
+	if v, err = s.D.SyncVector(f); chk.E(err) {
+		return
+	}
+	var n *negentropy.Negentropy
+	if n, err = negentropy.New(v, FrameSizeLimit); chk.E(err) {
+		return
+	}
+	var c *client
+	if c, err = connect(ctx, url); err != nil {
+		return
+	}
+	defer c.close()
+	res = &SyncResult{}
+	if err = c.reconcile(n, f, res); err != nil {
+		return
+	}
+	log.I.F("%s: have %d events it doesn't, need %d", url, len(res.Have), len(res.Need))
+	src := &policy.Source{Remote: url}
+	for batch := range slices.Chunk(res.Need, SyncBatch) {
+		if err = s.fetch(ctx, c, src, batch, res); err != nil {
+			return
+		}
+	}
+	if push {
+		for batch := range slices.Chunk(res.Have, SyncBatch) {
+			if err = s.push(c, batch, res); err != nil {
+				return
+			}
+		}
+	}
+	log.I.F("%s: fetched %d events, sent %d", url, res.Fetched, res.Sent)
+	return
+}
+
+// reconcile exchanges negentropy messages with the other relay until the ids each side has
+// that the other doesn't are known.
+func (c *client) reconcile(n *negentropy.Negentropy, f filter.F, res *SyncResult) (
+	err error) {
+
+	subId := "sync"
+	var msg []byte
+	if msg, err = n.Initiate(); chk.E(err) {
+		return
+	}
+	if err = c.send(NEGOPEN, subId, f, hex.Enc(msg)); err != nil {
+		return
+	}
+	for {
+		var label string
+		var env []json.RawMessage
+		if label, env, err = c.receive(); err != nil {
+			return
+		}
+		var id, payload string
+		if len(env) >= 2 {
+			_ = json.Unmarshal(env[0], &id)
+			_ = json.Unmarshal(env[1], &payload)
+		}
+		switch {
+		case label == NEGERR && id == subId:
+			return errorf.E("%s refused to sync: %s", c.url, payload)
+		case label == NEGMSG && id == subId:
+			var query []byte
+			if query, err = hex.Dec(payload); err != nil {
+				return errorf.E("invalid negentropy message from %s: %s", c.url, err)
+			}
+			var have, need [][]byte
+			if msg, have, need, err = n.ReconcileClient(query); err != nil {
+				return
+			}
+			res.Have = append(res.Have, have...)
+			res.Need = append(res.Need, need...)
+			if msg == nil {
+				return c.send(NEGCLOSE, subId)
+			}
+			if err = c.send(NEGMSG, subId, hex.Enc(msg)); err != nil {
+				return
+			}
+		case label == NOTICE:
+			log.D.F("%s: %s", c.url, env)
+		}
+	}
+}
+
+// fetch requests a batch of events by id from the other relay and stores them.
+func (s *Server) fetch(ctx context.Context, c *client, src *policy.Source, ids [][]byte,
+	res *SyncResult) (err error) {
+
+	subId := "sync-fetch"
+	f := filter.F{Limit: filter.IntToPointer(len(ids))}
+	for _, id := range ids {
+		f.Ids = append(f.Ids, hex.Enc(id))
+	}
+	if err = c.send(REQ, subId, f); err != nil {
+		return
+	}
+	for {
+		var label string
+		var env []json.RawMessage
+		if label, env, err = c.receive(); err != nil {
+			return
+		}
+		switch label {
+		case EVENT:
+			if len(env) < 2 {
+				continue
+			}
+			ev := event.New()
+			if err = ev.Unmarshal(env[1]); err != nil {
+				log.D.F("%s: invalid event: %s", c.url, err)
+				err = nil
+				continue
+			}
+			src.ReceivedAt = time.Now()
+			if refused := s.ingest(ctx, src, ev); refused != "" {
+				log.D.F("%s: event %s not stored: %s", c.url, ev.Id, refused)
+				continue
+			}
+			res.Fetched++
+		case EOSE:
+			return c.send(CLOSE, subId)
+		case CLOSED:
+			return errorf.E("%s closed the request for events: %s", c.url, env)
+		}
+	}
+}
+
+// push sends a batch of stored events by id to the other relay, and waits for their OKs.
+func (s *Server) push(c *client, ids [][]byte, res *SyncResult) (err error) {
+	pending := make(map[string]struct{})
+	for _, id := range ids {
+		var ev *event.E
+		if ev, err = s.D.GetEventById(id); err != nil {
+			// the event was deleted after it was reconciled.
+			err = nil
+			continue
+		}
+		if err = c.send(EVENT, ev); err != nil {
+			return
+		}
+		pending[ev.Id] = struct{}{}
+	}
+	for len(pending) > 0 {
+		var label string
+		var env []json.RawMessage
+		if label, env, err = c.receive(); err != nil {
+			return
+		}
+		if label != OK || len(env) < 3 {
+			continue
+		}
+		var id, msg string
+		var accepted bool
+		_ = json.Unmarshal(env[0], &id)
+		_ = json.Unmarshal(env[1], &accepted)
+		_ = json.Unmarshal(env[2], &msg)
+		if _, ok := pending[id]; !ok {
+			continue
+		}
+		delete(pending, id)
+		if accepted {
+			res.Sent++
+		} else {
+			log.D.F("%s: event %s rejected: %s", c.url, id, msg)
+		}
+	}
+	return
+}
+
+// ingest verifies and stores an event that wasn't sent by a client of the relay, and sends it
+// to the subscriptions that match it. It returns the reason if the event is refused,
+// duplicates and events shadow rejected by the write policy are not stored but are not
+// refused.
+func (s *Server) ingest(ctx context.Context, src *policy.Source, ev *event.E) (refused string) {
+	if ok, err := ev.Verify(); err != nil || !ok {
+		return "invalid: signature verification failed"
+	}
+	if refused = s.access.Load().check(ev); refused != "" {
+		return
+	}
+	switch res := s.WritePolicy.Check(ctx, src, ev); res.Action {
+	case policy.Reject:
+		return res.Reason
+	case policy.ShadowReject:
+		return
+	}
+	if err := s.D.StoreEvent(ev); err != nil {
+		if strings.HasPrefix(err.Error(), "duplicate") {
+			return ""
+		}
+		return reason(err)
+	}
+	s.broadcast(ev)
+	return
+}
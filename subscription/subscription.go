@@ -0,0 +1,215 @@
+// Package subscription is a registry of the open subscriptions of a relay, which finds the
+// subscriptions that a new event must be sent to.
+//
+// Each filter of a subscription is indexed by the values of one of its fields, in order of
+// preference the ids, authors, tag values or kinds. An event can only match a filter if it has
+// one of the values of the indexed field, so the candidates for an event are found by looking up
+// its id, pubkey, tags and kind, and only those are fully matched against the event. Filters
+// that have none of these fields are candidates for every event.
+package subscription
+
+import (
+	"sort"
+	"sync"
+
+	"x.realy.lol/event"
+	"x.realy.lol/filter"
+)
+
+// T is a subscription, the filters of a REQ that is open on a connection.
+type T struct {
+	// Owner is the connection the subscription was opened on. It must be comparable.
+	Owner   any
+	Id      string
+	Filters filter.S
+}
+
+// ref is a filter of a subscription, by its position in the filters.
+type ref struct {
+	sub *T
+	i   int
+}
+
+type postings map[ref]struct{}
+
+type key struct {
+	owner any
+	id    string
+}
+
+// Registry is an index of the filters of the open subscriptions.
+type Registry struct {
+	mx      sync.RWMutex
+	subs    map[key]*T
+	owners  map[any]map[string]*T
+	ids     map[string]postings
+	authors map[string]postings
+	kinds   map[int]postings
+	// tags are indexed by the tag key and value, separated by a zero byte.
+	tags map[string]postings
+	// all is the filters that don't have any of the indexed fields.
+	all postings
+}
+
+func New() (r *Registry) {
+	return &Registry{
+		subs:    make(map[key]*T),
+		owners:  make(map[any]map[string]*T),
+		ids:     make(map[string]postings),
+		authors: make(map[string]postings),
+		kinds:   make(map[int]postings),
+		tags:    make(map[string]postings),
+		all:     make(postings),
+	}
+}
+
+// Add opens a subscription, replacing any subscription with the same owner and id.
+func (r *Registry) Add(owner any, id string, ff filter.S) (sub *T) {
+	sub = &T{Owner: owner, Id: id, Filters: ff}
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.remove(owner, id)
+	r.subs[key{owner, id}] = sub
+	if r.owners[owner] == nil {
+		r.owners[owner] = make(map[string]*T)
+	}
+	r.owners[owner][id] = sub
+	for i := range ff {
+		r.index(ref{sub, i}, true)
+	}
+	return
+}
+
+// Remove closes a subscription, it returns false if it was not open.
+func (r *Registry) Remove(owner any, id string) (ok bool) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.remove(owner, id)
+}
+
+// RemoveOwner closes all of the subscriptions of an owner, when its connection is closed.
+func (r *Registry) RemoveOwner(owner any) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	for id := range r.owners[owner] {
+		r.remove(owner, id)
+	}
+}
+
+// Len returns the number of open subscriptions.
+func (r *Registry) Len() (n int) {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+	return len(r.subs)
+}
+
+// Match returns the subscriptions that have a filter that matches an event.
+func (r *Registry) Match(ev *event.E) (subs []*T) {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+	matched := make(map[*T]struct{})
+	check := func(p postings) {
+		for rf := range p {
+			if _, ok := matched[rf.sub]; ok {
+				continue
+			}
+			if rf.sub.Filters[rf.i].Matches(ev) {
+				matched[rf.sub] = struct{}{}
+				subs = append(subs, rf.sub)
+			}
+		}
+	}
+	check(r.ids[ev.Id])
+	check(r.authors[ev.Pubkey])
+	check(r.kinds[ev.Kind])
+	for _, t := range ev.Tags {
+		if len(t) < 2 {
+			continue
+		}
+		check(r.tags[tagKey(t[0], t[1])])
+	}
+	check(r.all)
+	return
+}
+
+func (r *Registry) remove(owner any, id string) (ok bool) {
+	var sub *T
+	if sub, ok = r.subs[key{owner, id}]; !ok {
+		return
+	}
+	for i := range sub.Filters {
+		r.index(ref{sub, i}, false)
+	}
+	delete(r.subs, key{owner, id})
+	delete(r.owners[owner], id)
+	if len(r.owners[owner]) == 0 {
+		delete(r.owners, owner)
+	}
+	return
+}
+
+// index adds or removes a filter in the postings of the values of its indexed field.
+func (r *Registry) index(rf ref, add bool) {
+	f := &rf.sub.Filters[rf.i]
+	switch {
+	case f.Ids != nil:
+		for _, id := range f.Ids {
+			update(r.ids, id, rf, add)
+		}
+	case f.Authors != nil:
+		for _, a := range f.Authors {
+			update(r.authors, a, rf, add)
+		}
+	case tagField(f) != "":
+		k := tagField(f)
+		for _, v := range f.Tags[k] {
+			update(r.tags, tagKey(k, v), rf, add)
+		}
+	case f.Kinds != nil:
+		for _, k := range f.Kinds {
+			update(r.kinds, k, rf, add)
+		}
+	default:
+		if add {
+			r.all[rf] = struct{}{}
+		} else {
+			delete(r.all, rf)
+		}
+	}
+}
+
+func update[K comparable](m map[K]postings, k K, rf ref, add bool) {
+	if add {
+		if m[k] == nil {
+			m[k] = make(postings)
+		}
+		m[k][rf] = struct{}{}
+		return
+	}
+	delete(m[k], rf)
+	if len(m[k]) == 0 {
+		delete(m, k)
+	}
+}
+
+// tagField returns the tag key of a filter with the fewest values, or an empty string if it has
+// no tag conditions.
+func tagField(f *filter.F) (k string) {
+	var keys []string
+	for tk, v := range f.Tags {
+		// nil values are not a condition on the tag.
+		if v != nil {
+			keys = append(keys, tk)
+		}
+	}
+	// the order is stable so the filter is removed from the same postings it was added to.
+	sort.Strings(keys)
+	for _, tk := range keys {
+		if k == "" || len(f.Tags[tk]) < len(f.Tags[k]) {
+			k = tk
+		}
+	}
+	return
+}
+
+func tagKey(k, v string) string { return k + "\x00" + v }
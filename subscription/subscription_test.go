@@ -0,0 +1,177 @@
+package subscription
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"testing"
+
+	"x.realy.lol/event"
+	"x.realy.lol/filter"
+	"x.realy.lol/kind"
+	"x.realy.lol/tags"
+)
+
+// workload generates subscriptions and events drawn from the same pools of authors, kinds and
+// tag values, so that a fraction of the subscriptions match each event.
+type workload struct {
+	rnd     *rand.Rand
+	authors []string
+	kinds   []int
+	topics  []string
+}
+
+func newWorkload() (w *workload) {
+	w = &workload{
+		rnd:   rand.New(rand.NewPCG(1, 2)),
+		kinds: []int{kind.TextNote, kind.Reaction, kind.Repost, kind.Article, kind.FollowList},
+	}
+	for i := range 10000 {
+		w.authors = append(w.authors, fmt.Sprintf("%064x", i))
+	}
+	for i := range 1000 {
+		w.topics = append(w.topics, fmt.Sprintf("topic%d", i))
+	}
+	return
+}
+
+func (w *workload) filter() (f filter.F) {
+	switch w.rnd.IntN(5) {
+	case 0:
+		f.Authors = []string{w.authors[w.rnd.IntN(len(w.authors))],
+			w.authors[w.rnd.IntN(len(w.authors))]}
+	case 1:
+		f.Kinds = []int{w.kinds[w.rnd.IntN(len(w.kinds))]}
+		f.Tags = filter.TagMap{"t": {w.topics[w.rnd.IntN(len(w.topics))]}}
+	case 2:
+		f.Kinds = []int{w.kinds[w.rnd.IntN(len(w.kinds))]}
+		f.Authors = []string{w.authors[w.rnd.IntN(len(w.authors))]}
+	case 3:
+		f.Tags = filter.TagMap{"p": {w.authors[w.rnd.IntN(len(w.authors))]}}
+	default:
+		f.Ids = []string{fmt.Sprintf("%064x", w.rnd.IntN(100000))}
+	}
+	return
+}
+
+func (w *workload) event(i int) (ev *event.E) {
+	return &event.E{
+		Id:     fmt.Sprintf("%064x", i),
+		Pubkey: w.authors[w.rnd.IntN(len(w.authors))],
+		Kind:   w.kinds[w.rnd.IntN(len(w.kinds))],
+		Tags: tags.Tags{
+			{"t", w.topics[w.rnd.IntN(len(w.topics))]},
+			{"p", w.authors[w.rnd.IntN(len(w.authors))]},
+		},
+	}
+}
+
+func (w *workload) registry(n int) (r *Registry, subs []*T) {
+	r = New()
+	for i := range n {
+		subs = append(subs, r.Add(i%1000, fmt.Sprint(i), filter.S{w.filter()}))
+	}
+	return
+}
+
+func linear(subs []*T, ev *event.E) (matched []*T) {
+	for _, sub := range subs {
+		if sub.Filters.Match(ev) {
+			matched = append(matched, sub)
+		}
+	}
+	return
+}
+
+func ids(subs []*T) (s []string) {
+	for _, sub := range subs {
+		s = append(s, sub.Id)
+	}
+	slices.Sort(s)
+	return
+}
+
+func TestRegistry_Match(t *testing.T) {
+	w := newWorkload()
+	r, subs := w.registry(10000)
+	// subscriptions with more than one filter, and without any indexed fields.
+	subs = append(subs, r.Add("multi", "multi", filter.S{w.filter(), w.filter()}))
+	subs = append(subs, r.Add("any", "any", filter.S{{}}))
+	var total int
+	for i := range 1000 {
+		ev := w.event(i)
+		got, want := ids(r.Match(ev)), ids(linear(subs, ev))
+		if !slices.Equal(got, want) {
+			t.Fatalf("event %d matched %v, expected %v", i, got, want)
+		}
+		total += len(got)
+	}
+	if total <= 1000 {
+		t.Fatalf("only the unindexed subscription matched")
+	}
+}
+
+func TestRegistry_Remove(t *testing.T) {
+	r := New()
+	ev := &event.E{Id: "a", Pubkey: "b", Kind: kind.TextNote}
+	r.Add(1, "x", filter.S{{Kinds: []int{kind.TextNote}}})
+	r.Add(1, "y", filter.S{{Authors: []string{"b"}}})
+	r.Add(2, "x", filter.S{{Ids: []string{"a"}}})
+	if n := len(r.Match(ev)); n != 3 {
+		t.Fatalf("expected 3 matches, got %d", n)
+	}
+	// a subscription with the same id replaces the previous one.
+	r.Add(1, "x", filter.S{{Kinds: []int{kind.Reaction}}})
+	if n := len(r.Match(ev)); n != 2 {
+		t.Fatalf("expected 2 matches, got %d", n)
+	}
+	if !r.Remove(2, "x") || r.Remove(2, "x") {
+		t.Fatalf("expected the subscription to be removed once")
+	}
+	r.RemoveOwner(1)
+	if r.Len() != 0 || len(r.Match(ev)) != 0 {
+		t.Fatalf("expected no subscriptions, got %d", r.Len())
+	}
+	if len(r.kinds) != 0 || len(r.authors) != 0 || len(r.ids) != 0 || len(r.owners) != 0 {
+		t.Fatalf("postings were not removed")
+	}
+}
+
+func BenchmarkRegistry_Match(b *testing.B) {
+	w := newWorkload()
+	r, _ := w.registry(100000)
+	evs := make([]*event.E, 1000)
+	for i := range evs {
+		evs[i] = w.event(i)
+	}
+	b.ResetTimer()
+	for i := range b.N {
+		r.Match(evs[i%len(evs)])
+	}
+}
+
+func BenchmarkLinear_Match(b *testing.B) {
+	w := newWorkload()
+	_, subs := w.registry(100000)
+	evs := make([]*event.E, 1000)
+	for i := range evs {
+		evs[i] = w.event(i)
+	}
+	b.ResetTimer()
+	for i := range b.N {
+		linear(subs, evs[i%len(evs)])
+	}
+}
+
+func BenchmarkRegistry_Add(b *testing.B) {
+	w := newWorkload()
+	r := New()
+	ff := make([]filter.S, 100000)
+	for i := range ff {
+		ff[i] = filter.S{w.filter()}
+	}
+	b.ResetTimer()
+	for i := range b.N {
+		r.Add(i%1000, fmt.Sprint(i%len(ff)), ff[i%len(ff)])
+	}
+}